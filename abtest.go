@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// abPrompt is a prompt to replay. feedback is what the user thought of
+// the answer they got at the time, up or down, if known
+type abPrompt struct {
+	Prompt   string `json:"prompt"`
+	Feedback string `json:"feedback,omitempty"`
+}
+
+// abAnswer is how one path answered
+type abAnswer struct {
+	Length    int     `json:"length"`
+	Tokens    int     `json:"tokens"`
+	LatencyMS float64 `json:"latency_ms"`
+	Answer    string  `json:"answer"`
+}
+
+// abResult compares the with-tools and without-tools answers to a prompt
+// with what the server would have done
+type abResult struct {
+	Prompt     string  `json:"prompt"`
+	Feedback   string  `json:"feedback,omitempty"`
+	Intent     string  `json:"intent"`
+	Confidence float64 `json:"confidence"`
+	// the server would have attached tools to the turn
+	Routed bool `json:"routed"`
+	// tools the model called when offered all of them
+	ToolsUsed []string `json:"tools_used"`
+	// the model said it can't know without tools
+	AdmitsIgnorance bool     `json:"admits_ignorance"`
+	WithTools       abAnswer `json:"with_tools"`
+	WithoutTools    abAnswer `json:"without_tools"`
+	// tools_ok, no_tools_ok, missed or needless
+	Verdict string `json:"verdict"`
+	Error   string `json:"error,omitempty"`
+}
+
+// a turn needed tools if the model called one when offered, or said it
+// couldn't answer without
+func (r abResult) needed() bool {
+	return len(r.ToolsUsed) > 0 || r.AdmitsIgnorance
+}
+
+const (
+	abToolsOK   = "tools_ok"
+	abNoToolsOK = "no_tools_ok"
+	abMissed    = "missed"
+	abNeedless  = "needless"
+)
+
+// runABTestCommand implements the "abtest" subcommand. it replays
+// prompts with and without tools and reports how often the heuristics
+// and intent classifier routed them right, for tuning the keywords and
+// -clarify-below. the other flags are the server's, so the replay uses
+// the same rules, classifier and model
+func runABTestCommand(args []string) error {
+	var cfg config
+	fs := flag.NewFlagSet("abtest", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	promptsPath := fs.String("prompts", "", "File of prompts to replay, one per line or JSON lines like {\"prompt\": ..., \"feedback\": \"up\"}")
+	jsonPath := fs.String("json", "", "Also write the result of every prompt as JSON lines to this file")
+	fs.Parse(args)
+
+	if err := cfg.loadSystemPrompt(); err != nil {
+		return err
+	}
+	if *promptsPath == "" {
+		return fmt.Errorf("-prompts is required")
+	}
+	prompts, err := readABPrompts(*promptsPath)
+	if err != nil {
+		return err
+	}
+	if len(prompts) == 0 {
+		return fmt.Errorf("no prompts in %s", *promptsPath)
+	}
+
+	app, err := newABTestApp(cfg)
+	if err != nil {
+		return err
+	}
+
+	var results []abResult
+	for i, p := range prompts {
+		fmt.Fprintf(os.Stderr, "[%d/%d] %s\n", i+1, len(prompts), truncate(p.Prompt, 60))
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		results = append(results, app.abTest(ctx, p))
+		cancel()
+	}
+
+	if *jsonPath != "" {
+		f, err := os.Create(*jsonPath)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		for _, r := range results {
+			enc.Encode(r)
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	writeABReport(os.Stdout, results, cfg)
+	return nil
+}
+
+// readABPrompts reads one prompt per line. lines starting with { are
+// JSON, blank lines and lines starting with # are skipped
+func readABPrompts(path string) ([]abPrompt, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var prompts []abPrompt
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "{"):
+			var p abPrompt
+			if err := json.Unmarshal([]byte(line), &p); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+			if p.Feedback != "" && p.Feedback != "up" && p.Feedback != "down" {
+				return nil, fmt.Errorf("%s:%d: feedback must be up or down", path, n)
+			}
+			if p.Prompt != "" {
+				prompts = append(prompts, p)
+			}
+		default:
+			prompts = append(prompts, abPrompt{Prompt: line})
+		}
+	}
+	return prompts, scanner.Err()
+}
+
+// newABTestApp sets up the parts of the server a replay needs: the
+// tools, the heuristics and the intent classifier
+func newABTestApp(cfg config) (*application, error) {
+	backend, ollama, err := newBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	app := &application{
+		// the replay reports, the server's logging would drown it
+		logger:      slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})),
+		config:      cfg,
+		backend:     backend,
+		ollama:      ollama,
+		toolCache:   newToolCache(nil),
+		toolBudgets: newToolBudgets(nil),
+		reminders:   newReminderScheduler(),
+	}
+	if app.weather, err = newWeatherProvider(cfg.weatherProvider, cfg.weatherAPIKey); err != nil {
+		return nil, err
+	}
+	if app.search, err = newSearchProvider(cfg.searchProvider, cfg.searxngURL); err != nil {
+		return nil, err
+	}
+	if cfg.knowledgeGraph {
+		app.graph = newKnowledgeGraph()
+	}
+	app.tools = newToolRegistry()
+	if err := app.registerTools(); err != nil {
+		return nil, err
+	}
+	if app.heuristics, err = newHeuristics(cfg.heuristics, app.tools); err != nil {
+		return nil, err
+	}
+	if app.models, err = loadModelSettings(cfg.modelConfig); err != nil {
+		return nil, err
+	}
+	if app.intentRoutes, err = loadIntentRoutes(cfg.intentRoutes, app.tools); err != nil {
+		return nil, err
+	}
+	if app.classifier, err = app.newIntentClassifier(cfg.intentClassifier); err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+// abTest answers p once without tools and once with every tool offered
+func (app *application) abTest(ctx context.Context, p abPrompt) abResult {
+	result := abResult{Prompt: p.Prompt, Feedback: p.Feedback, ToolsUsed: []string{}}
+
+	conv := newConversation()
+	decision, route := app.classifyIntent(ctx, conv, p.Prompt, detectLanguage(p.Prompt))
+	result.Intent, result.Confidence = decision.Name, decision.Confidence
+	result.Routed = len(decision.Tools) > 0
+
+	model := app.config.ollamaModel
+	if route.Model != "" {
+		model = route.Model
+	}
+	msgs := []api.Message{
+		{Role: "system", Content: app.config.systemPrompt},
+		{Role: "user", Content: p.Prompt},
+	}
+
+	var err error
+	result.WithoutTools, _, err = app.abAnswer(ctx, model, msgs, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.AdmitsIgnorance = admitsIgnorance(result.WithoutTools.Answer)
+
+	var calls []api.ToolCall
+	tools := app.tools.all()
+	if !app.modelSettings(model).tools() {
+		tools = nil
+	}
+	result.WithTools, calls, err = app.abAnswer(ctx, model, msgs, tools)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if len(calls) > 0 {
+		// run the calls and let the model answer from their results
+		turn := &turnInfo{model: model}
+		msgs = append(msgs, api.Message{Role: "assistant", ToolCalls: calls})
+		for _, call := range calls {
+			if !slices.Contains(result.ToolsUsed, call.Function.Name) {
+				result.ToolsUsed = append(result.ToolsUsed, call.Function.Name)
+			}
+			msgs = append(msgs, api.Message{
+				Role:     "tool",
+				Content:  app.handleToolCall(ctx, conv, call, turn),
+				ToolName: call.Function.Name,
+			})
+		}
+		final, _, err := app.abAnswer(ctx, model, msgs, nil)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		final.Tokens += result.WithTools.Tokens
+		final.LatencyMS += result.WithTools.LatencyMS
+		result.WithTools = final
+	}
+
+	switch {
+	case result.Routed && result.needed():
+		result.Verdict = abToolsOK
+	case !result.Routed && !result.needed():
+		result.Verdict = abNoToolsOK
+	case result.needed():
+		result.Verdict = abMissed
+	default:
+		result.Verdict = abNeedless
+	}
+	return result
+}
+
+// abAnswer sends msgs with tools and returns the answer and the tool
+// calls the model made instead of answering
+func (app *application) abAnswer(ctx context.Context, model string, msgs []api.Message, tools api.Tools) (abAnswer, []api.ToolCall, error) {
+	var answer strings.Builder
+	var calls []api.ToolCall
+	var tokens int
+	started := time.Now()
+	err := app.chat(ctx, &api.ChatRequest{
+		Model:    model,
+		Messages: msgs,
+		Tools:    tools,
+		Options:  app.config.options.request(),
+		Stream:   new(bool),
+	}, func(resp api.ChatResponse) error {
+		answer.WriteString(resp.Message.Content)
+		calls = append(calls, resp.Message.ToolCalls...)
+		tokens += resp.EvalCount
+		return nil
+	})
+	content := strings.TrimSpace(answer.String())
+	return abAnswer{
+		Length:    len([]rune(content)),
+		Tokens:    tokens,
+		LatencyMS: millisSince(started),
+		Answer:    content,
+	}, calls, err
+}
+
+// writeABReport summarizes the results: how the routing compares with
+// what the model needed, and what raising -clarify-below would catch
+func writeABReport(w io.Writer, results []abResult, cfg config) {
+	counts := map[string]int{}
+	var failed int
+	var withLen, withoutLen, withN int
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+			continue
+		}
+		counts[r.Verdict]++
+		withoutLen += r.WithoutTools.Length
+		if len(r.ToolsUsed) > 0 {
+			withLen += r.WithTools.Length
+			withN++
+		}
+	}
+	done := len(results) - failed
+
+	fmt.Fprintf(w, "\nReplayed %d prompts with %s, %s classifier", len(results), cfg.ollamaModel, cfg.intentClassifier)
+	if failed > 0 {
+		fmt.Fprintf(w, ", %d failed", failed)
+	}
+	fmt.Fprintln(w)
+	if done == 0 {
+		return
+	}
+
+	fmt.Fprintln(w, "\n                 needed tools  didn't need them")
+	fmt.Fprintf(w, "routed tools     %5d right   %5d needless\n", counts[abToolsOK], counts[abNeedless])
+	fmt.Fprintf(w, "routed no tools  %5d missed  %5d right\n", counts[abMissed], counts[abNoToolsOK])
+	fmt.Fprintf(w, "routed right     %d of %d (%.0f%%)\n", counts[abToolsOK]+counts[abNoToolsOK], done,
+		100*float64(counts[abToolsOK]+counts[abNoToolsOK])/float64(done))
+
+	fmt.Fprintf(w, "\nAverage answer length without tools %d characters", withoutLen/done)
+	if withN > 0 {
+		fmt.Fprintf(w, ", with the tools it called %d", withLen/withN)
+	}
+	fmt.Fprintln(w)
+
+	// feedback only says something about the routing if bad answers
+	// were misrouted more often than good ones
+	feedback := map[string][2]int{}
+	for _, r := range results {
+		if r.Feedback == "" || r.Error != "" {
+			continue
+		}
+		f := feedback[r.Feedback]
+		f[0]++
+		if r.Verdict == abMissed || r.Verdict == abNeedless {
+			f[1]++
+		}
+		feedback[r.Feedback] = f
+	}
+	if len(feedback) > 0 {
+		fmt.Fprintln(w, "\nFeedback       prompts  misrouted")
+		for _, kind := range []string{"up", "down"} {
+			if f, ok := feedback[kind]; ok {
+				fmt.Fprintf(w, "  %-12s %7d  %9d\n", kind, f[0], f[1])
+			}
+		}
+	}
+
+	// every misrouted turn below the threshold would have been asked a
+	// clarification question instead, so would every right one
+	fmt.Fprintf(w, "\n-clarify-below  misrouted asked  routed right asked  (now %.2f)\n", cfg.clarifyBelow)
+	for _, threshold := range []float64{0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9} {
+		var wrong, right int
+		for _, r := range results {
+			if r.Error != "" || r.Confidence >= threshold {
+				continue
+			}
+			if r.Verdict == abMissed || r.Verdict == abNeedless {
+				wrong++
+			} else {
+				right++
+			}
+		}
+		fmt.Fprintf(w, "  %.1f          %15d  %18d\n", threshold, wrong, right)
+	}
+
+	var misrouted []abResult
+	for _, r := range results {
+		if r.Verdict == abMissed || r.Verdict == abNeedless {
+			misrouted = append(misrouted, r)
+		}
+	}
+	if len(misrouted) > 0 {
+		fmt.Fprintln(w, "\nMisrouted prompts")
+		for _, r := range misrouted {
+			why := "no tool called"
+			switch {
+			case len(r.ToolsUsed) > 0:
+				why = "called " + strings.Join(r.ToolsUsed, ", ")
+			case r.AdmitsIgnorance:
+				why = "can't know without tools"
+			}
+			fmt.Fprintf(w, "  %-8s %.2f  %-16s %q (%s)\n", r.Verdict, r.Confidence, r.Intent, truncate(r.Prompt, 60), why)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// access log formats
+const (
+	accessLogCLF  = "clf"
+	accessLogJSON = "json"
+)
+
+// rotatingFile is an append-only file that's moved aside and started
+// again once it's too big or too old. only the newest keep old files
+// are kept
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, keep int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, keep: keep}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size, rf.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	tooBig := rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize
+	tooOld := rf.maxAge > 0 && time.Since(rf.opened) > rf.maxAge
+	if tooBig || tooOld {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file with a timestamp suffix and opens a
+// new one. rf.mu must be held
+func (rf *rotatingFile) rotate() error {
+	rf.f.Close()
+	rotated := rf.path + "." + time.Now().Format("20060102-150405.000000")
+	if err := os.Rename(rf.path, rotated); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+
+	// the suffix sorts by time, oldest first
+	old, _ := filepath.Glob(rf.path + ".*")
+	sort.Strings(old)
+	for len(old) > rf.keep {
+		os.Remove(old[0])
+		old = old[1:]
+	}
+	return nil
+}
+
+// accessRecorder captures the status and size of a response. it passes
+// flushing through for SSE and hijacking for websocket upgrades
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *accessRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *accessRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *accessRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *accessRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer can't be hijacked")
+	}
+	// an upgraded websocket has answered 101
+	rec.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (rec *accessRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	Remote     string    `json:"remote"`
+	User       string    `json:"user,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMS float64   `json:"duration_ms"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+}
+
+// secret query parameters, anyone who reads the access log could use
+// them to watch or resume a conversation
+var redactedParams = []string{"token", "conversation", "stream"}
+
+// redactURL returns u with the secret parameters redacted. the
+// conversation ids in /api/conversations/{conversation}/... and
+// /admin/conversations/{conversation}/... are as secret as the parameter.
+// requests turned away before the mux never got a pattern, so it goes by
+// the path
+func redactURL(u *url.URL) *url.URL {
+	query := u.Query()
+	redacted := false
+	for _, name := range redactedParams {
+		if query.Has(name) {
+			query.Set(name, "REDACTED")
+			redacted = true
+		}
+	}
+	segments := strings.Split(u.Path, "/")
+	for i := 1; i+1 < len(segments); i++ {
+		if segments[i] == "conversations" && (segments[i-1] == "api" || segments[i-1] == "admin") && segments[i+1] != "" {
+			segments[i+1] = "REDACTED"
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u
+	}
+	c := *u
+	c.RawQuery = query.Encode()
+	c.Path, c.RawPath = strings.Join(segments, "/"), ""
+	return &c
+}
+
+// loggedReferer is the Referer header with the secret parameters
+// redacted, the page may have been opened with them
+func loggedReferer(r *http.Request) string {
+	u, err := url.Parse(r.Referer())
+	if err != nil {
+		return ""
+	}
+	return redactURL(u).String()
+}
+
+// clf renders the entry in Common Log Format
+func (e accessEntry) clf() string {
+	user := e.User
+	if user == "" {
+		user = "-"
+	}
+	size := "-"
+	if e.Bytes > 0 {
+		size = fmt.Sprint(e.Bytes)
+	}
+	return fmt.Sprintf("%s - %s [%s] %q %d %s\n", e.Remote, user,
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method+" "+e.Path+" "+e.Proto, e.Status, size)
+}
+
+// accessLog writes a line per request to -access-log, apart from the
+// application log. websocket connections are logged when they close
+func (app *application) accessLog(next http.Handler) http.Handler {
+	if app.accessLogFile == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		rec := &accessRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		user, _ := app.authenticate(r)
+		if !app.authEnabled() {
+			user = ""
+		}
+		entry := accessEntry{
+			Time:       started,
+			Remote:     clientIP(r),
+			User:       user,
+			Method:     r.Method,
+			Path:       redactURL(r.URL).RequestURI(),
+			Proto:      r.Proto,
+			Status:     rec.status,
+			Bytes:      rec.bytes,
+			DurationMS: millisSince(started),
+			Referer:    loggedReferer(r),
+			UserAgent:  r.UserAgent(),
+		}
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+
+		line := entry.clf()
+		if app.config.accessLogFormat == accessLogJSON {
+			js, _ := json.Marshal(entry)
+			line = string(js) + "\n"
+		}
+		if _, err := app.accessLogFile.Write([]byte(line)); err != nil {
+			app.logger.Error(fmt.Sprintf("Error writing access log: %v", err))
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRedactURL(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{
+			name: "nothing secret",
+			url:  "/api/models?sort=name",
+			want: "/api/models?sort=name",
+		},
+		{
+			name: "token",
+			url:  "/ws/watch?token=abc",
+			want: "/ws/watch?token=REDACTED",
+		},
+		{
+			name: "conversation and stream parameters",
+			url:  "/ws?conversation=abc&stream=def",
+			want: "/ws?conversation=REDACTED&stream=REDACTED",
+		},
+		{
+			name: "conversation id in an API path",
+			url:  "/api/conversations/abc123/messages/4",
+			want: "/api/conversations/REDACTED/messages/4",
+		},
+		{
+			name: "conversation id in an admin path",
+			url:  "/admin/conversations/abc123/takeover",
+			want: "/admin/conversations/REDACTED/takeover",
+		},
+		{
+			name: "conversation id at the end of the path",
+			url:  "/api/conversations/abc123",
+			want: "/api/conversations/REDACTED",
+		},
+		{
+			name: "conversation list",
+			url:  "/api/conversations",
+			want: "/api/conversations",
+		},
+		{
+			name: "path and parameter",
+			url:  "/api/conversations/abc123/replay?token=x",
+			want: "/api/conversations/REDACTED/replay?token=REDACTED",
+		},
+		{
+			name: "conversations elsewhere in a path",
+			url:  "/static/conversations/abc.png",
+			want: "/static/conversations/abc.png",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := redactURL(u).RequestURI(); got != tt.want {
+				t.Errorf("redactURL(%s) = %s, want %s", tt.url, got, tt.want)
+			}
+			if u.String() != tt.url {
+				t.Errorf("redactURL changed its argument to %s", u)
+			}
+		})
+	}
+}
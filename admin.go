@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// audit records an administrative action. These go through the normal
+// logger but are tagged so they can be filtered out of the rest of the noise
+func (app *application) audit(r *http.Request, action string, args ...any) {
+	attrs := append([]any{"audit", true, "action", action, "remote", r.RemoteAddr}, args...)
+	app.logger.Info("Admin action", attrs...)
+}
+
+// copies an existing model to a new name, e.g. to keep a known good
+// version around before pulling an update. with several Ollama servers
+// it's copied on every one that has it
+func (app *application) handleAdminCopyModel(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Source      string `json:"source"`
+		Destination string `json:"destination"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if input.Source == "" || input.Destination == "" {
+		app.clientError(w, http.StatusBadRequest, "source and destination are required")
+		return
+	}
+
+	ollama, ok := app.ollamaOnly(w)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	err := ollama.onAll(func(s *ollamaServer) error {
+		return s.client.Copy(ctx, &api.CopyRequest{Source: input.Source, Destination: input.Destination})
+	})
+	if err != nil {
+		app.audit(r, "model.copy", "source", input.Source, "destination", input.Destination, "error", err)
+		app.ollamaError(w, err)
+		return
+	}
+
+	app.audit(r, "model.copy", "source", input.Source, "destination", input.Destination)
+	app.writeJSON(w, http.StatusOK, map[string]string{"status": "copied"})
+}
+
+// deletes a model from the Ollama servers. Deleting is not reversible so
+// the caller has to repeat the model name in the confirm field
+func (app *application) handleAdminDeleteModel(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Model   string `json:"model"`
+		Confirm string `json:"confirm"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if input.Model == "" {
+		app.clientError(w, http.StatusBadRequest, "model is required")
+		return
+	}
+	if input.Confirm != input.Model {
+		app.clientError(w, http.StatusBadRequest, "confirm must repeat the model name to delete it")
+		return
+	}
+
+	ollama, ok := app.ollamaOnly(w)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	err := ollama.onAll(func(s *ollamaServer) error {
+		return s.client.Delete(ctx, &api.DeleteRequest{Model: input.Model})
+	})
+	if err != nil {
+		app.audit(r, "model.delete", "model", input.Model, "error", err)
+		app.ollamaError(w, err)
+		return
+	}
+
+	app.audit(r, "model.delete", "model", input.Model)
+	app.writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+// ollamaError passes Ollama's own status codes (e.g. 404 for an unknown
+// model) through to the client, anything else is treated as a bad gateway
+func (app *application) ollamaError(w http.ResponseWriter, err error) {
+	var statusErr api.StatusError
+	if errors.As(err, &statusErr) {
+		app.clientError(w, statusErr.StatusCode, statusErr.ErrorMessage)
+		return
+	}
+	app.logger.Error(err.Error())
+	app.clientError(w, http.StatusBadGateway, "failed to reach the Ollama server")
+}
+
+// pullProgress is sent to the admin client for every progress update
+// Ollama reports while downloading a model
+type pullProgress struct {
+	Status    string  `json:"status"`
+	Digest    string  `json:"digest,omitempty"`
+	Total     int64   `json:"total,omitempty"`
+	Completed int64   `json:"completed,omitempty"`
+	Percent   float64 `json:"percent"`
+	Speed     float64 `json:"bytes_per_second"`
+	// the server the update is from when there are several
+	Server string `json:"server,omitempty"`
+}
+
+// pullTracker keeps the cancel funcs of the pulls currently running so a
+// pull can be stopped from a different request than the one streaming it
+type pullTracker struct {
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
+}
+
+// start registers a pull, it fails if the model is already being pulled
+func (p *pullTracker) start(model string, cancel context.CancelFunc) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.running == nil {
+		p.running = make(map[string]context.CancelFunc)
+	}
+	if _, ok := p.running[model]; ok {
+		return false
+	}
+	p.running[model] = cancel
+	return true
+}
+
+func (p *pullTracker) finish(model string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.running, model)
+}
+
+// cancel stops a running pull, it reports whether there was one
+func (p *pullTracker) cancel(model string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cancel, ok := p.running[model]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// pulls a model and streams Ollama's progress back as server-sent events.
+// closing the connection or calling the cancel endpoint aborts the download.
+// with several Ollama servers the model is pulled onto each in turn
+func (app *application) handleAdminPullModel(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Model string `json:"model"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if input.Model == "" {
+		app.clientError(w, http.StatusBadRequest, "model is required")
+		return
+	}
+
+	ollama, ok := app.ollamaOnly(w)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	if !app.pulls.start(input.Model, cancel) {
+		app.clientError(w, http.StatusConflict, "model is already being pulled")
+		return
+	}
+	defer app.pulls.finish(input.Model)
+
+	sse, err := app.newSSEWriter(w, r)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	defer sse.close()
+
+	app.audit(r, "model.pull", "model", input.Model)
+
+	err = ollama.onAll(func(s *ollamaServer) error {
+		return app.pullOnto(ctx, sse, s, input.Model, len(ollama.servers) > 1)
+	})
+
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		app.audit(r, "model.pull", "model", input.Model, "result", "cancelled")
+		sse.send("cancelled", map[string]string{"model": input.Model})
+	case err != nil:
+		app.audit(r, "model.pull", "model", input.Model, "error", err)
+		sse.send("error", map[string]string{"error": err.Error()})
+	default:
+		app.audit(r, "model.pull", "model", input.Model, "result", "success")
+		sse.send("done", map[string]string{"model": input.Model})
+	}
+}
+
+// pullOnto pulls model onto one server, passing on its progress. named
+// says to tell which server an update is from
+func (app *application) pullOnto(ctx context.Context, sse *sseWriter, s *ollamaServer, model string, named bool) error {
+	// speed is calculated per layer from the previous update
+	var lastDigest string
+	var lastCompleted int64
+	lastUpdate := time.Now()
+
+	return s.client.Pull(ctx, &api.PullRequest{Model: model}, func(resp api.ProgressResponse) error {
+		progress := pullProgress{
+			Status:    resp.Status,
+			Digest:    resp.Digest,
+			Total:     resp.Total,
+			Completed: resp.Completed,
+		}
+		if named {
+			progress.Server = s.url
+		}
+		if resp.Total > 0 {
+			progress.Percent = float64(resp.Completed) / float64(resp.Total) * 100
+		}
+
+		now := time.Now()
+		if resp.Digest != "" && resp.Digest == lastDigest {
+			if elapsed := now.Sub(lastUpdate).Seconds(); elapsed > 0 {
+				progress.Speed = float64(resp.Completed-lastCompleted) / elapsed
+			}
+		}
+		lastDigest, lastCompleted, lastUpdate = resp.Digest, resp.Completed, now
+
+		return sse.send("progress", progress)
+	})
+}
+
+// cancels an in-progress pull started by handleAdminPullModel
+func (app *application) handleAdminCancelPull(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Model string `json:"model"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !app.pulls.cancel(input.Model) {
+		app.clientError(w, http.StatusNotFound, "no pull in progress for that model")
+		return
+	}
+
+	app.audit(r, "model.pull.cancel", "model", input.Model)
+	app.writeJSON(w, http.StatusOK, map[string]string{"status": "cancelling"})
+}
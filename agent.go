@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// iterationLimit is added to the last request of a turn that used up its
+// -max-tool-iterations rounds of tool calls
+const iterationLimit = "You have used all the tool calls available for this question. " +
+	"Do not call any tools, answer the user's question with the information you have."
+
+// agentStep is sent to the client before each round of tool calls so it
+// can show what the model is doing on long chains
+type agentStep struct {
+	Iteration int      `json:"iteration"`
+	Max       int      `json:"max"`
+	Tools     []string `json:"tools"`
+}
+
+// emitStep tells the client which tools the model called in round
+// iteration of max
+func (t *turnInfo) emitStep(iteration, max int, calls []api.ToolCall) {
+	if t.emit == nil {
+		return
+	}
+	step := agentStep{Iteration: iteration, Max: max}
+	for _, call := range calls {
+		step.Tools = append(step.Tools, call.Function.Name)
+	}
+	t.emit(Message{
+		Type:    "agent_step",
+		Content: fmt.Sprintf("Step %d of %d: %s", iteration, max, strings.Join(step.Tools, ", ")),
+		Time:    time.Now().Format("15:04:05"),
+		Step:    &step,
+	})
+}
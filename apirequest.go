@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+)
+
+// requestBefore returns the history that was sent to the model to produce
+// the assistant message with the given id
+func (c *conversation) requestBefore(id int) ([]api.Message, chatMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := c.find(id)
+	if i < 0 || c.messages[i].Role != "assistant" {
+		return nil, chatMessage{}, errMessageNotFound
+	}
+
+	msgs := make([]api.Message, 0, i)
+	for _, m := range c.messages[:i] {
+		msgs = append(msgs, m.Message)
+	}
+	return msgs, *c.messages[i], nil
+}
+
+// returns a curl command or go program that sends the same request to
+// ollama as the one that produced an answer, ?format=curl|go
+func (app *application) handleMessageRequest(w http.ResponseWriter, r *http.Request) {
+	conv, ok := app.ownConversation(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		app.clientError(w, http.StatusNotFound, "message not found")
+		return
+	}
+
+	history, msg, err := conv.requestBefore(id)
+	if err != nil {
+		app.messageError(w, err)
+		return
+	}
+	if msg.Language != "" {
+		history = append(history, languageInstruction(msg.Language))
+	}
+
+	req := api.ChatRequest{
+		Model:    app.conversationModel(conv),
+		Messages: history,
+		Options:  app.conversationOptions(conv).request(),
+		Stream:   new(bool),
+	}
+	body, err := json.MarshalIndent(req, "", "  ")
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	var snippet string
+	switch r.URL.Query().Get("format") {
+	case "", "curl":
+		snippet = curlSnippet(app.config.ollamaURL, body)
+	case "go":
+		snippet = goSnippet(app.config.ollamaURL, body)
+	default:
+		app.clientError(w, http.StatusBadRequest, "format must be curl or go")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, snippet)
+}
+
+func curlSnippet(server string, body []byte) string {
+	// close the quote, add an escaped quote and open it again
+	quoted := strings.ReplaceAll(string(body), "'", `'\''`)
+	return fmt.Sprintf("curl %s/api/chat \\\n  -H 'Content-Type: application/json' \\\n  -d '%s'\n", server, quoted)
+}
+
+func goSnippet(server string, body []byte) string {
+	literal := "`" + string(body) + "`"
+	if strings.Contains(string(body), "`") {
+		literal = strconv.Quote(string(body))
+	}
+
+	return fmt.Sprintf(`package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/ollama/ollama/api"
+)
+
+const request = %s
+
+func main() {
+	var req api.ChatRequest
+	if err := json.Unmarshal([]byte(request), &req); err != nil {
+		log.Fatal(err)
+	}
+
+	server, err := url.Parse(%q)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := api.NewClient(server, http.DefaultClient)
+
+	err = client.Chat(context.Background(), &req, func(resp api.ChatResponse) error {
+		fmt.Print(resp.Message.Content)
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println()
+}
+`, literal, server)
+}
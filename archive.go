@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// an archived conversation is out of the way without being deleted: the
+// conversation list leaves it out unless ?archived=true, and what the
+// knowledge graph learned only from archived conversations isn't
+// offered to the model. a search with ?q= still finds it, and it can be
+// switched to and continued like any other
+//
+//	POST   /api/conversations/{conversation}/archive
+//	DELETE /api/conversations/{conversation}/archive  unarchives
+
+func (c *conversation) setArchived(on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.archived = on
+}
+
+func (c *conversation) isArchived() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.archived
+}
+
+// matches reports whether the conversation's title or any message
+// contains query, ignoring case
+func (c *conversation) matches(query string) bool {
+	query = strings.ToLower(query)
+	if strings.Contains(strings.ToLower(c.info().Title), query) {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range c.messages {
+		if (m.Role == "user" || m.Role == "assistant") && strings.Contains(strings.ToLower(m.Content), query) {
+			return true
+		}
+	}
+	return false
+}
+
+// remembered reports whether the knowledge graph may use what it
+// learned from the conversations in ids: at least one of them must not
+// be archived. ids of conversations that are gone count, the graph
+// outlives them on purpose
+func (app *application) remembered(ids []string) bool {
+	for _, id := range ids {
+		conv, ok := app.conversations.get(id)
+		if !ok || !conv.isArchived() {
+			return true
+		}
+	}
+	return false
+}
+
+func (app *application) handleArchiveConversation(w http.ResponseWriter, r *http.Request) {
+	app.setConversationArchived(w, r, true)
+}
+
+func (app *application) handleUnarchiveConversation(w http.ResponseWriter, r *http.Request) {
+	app.setConversationArchived(w, r, false)
+}
+
+func (app *application) setConversationArchived(w http.ResponseWriter, r *http.Request, on bool) {
+	conv, ok := app.ownedConversation(r.PathValue("conversation"), app.owner(r))
+	if !ok {
+		app.clientError(w, http.StatusNotFound, "conversation not found")
+		return
+	}
+	conv.setArchived(on)
+	app.logger.Info("Conversation archived", "conversation", conv.id, "archived", on)
+	app.writeJSON(w, http.StatusOK, conv.info())
+}
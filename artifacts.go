@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// artifacts are standalone documents the assistant produces, like a
+// source file or a markdown doc. they're kept out of the chat text and
+// every change is stored as a new version
+var createArtifactTool = functionTool("create_artifact",
+	"Create a standalone document such as a code file or a markdown document. "+
+		"Use this instead of writing long documents into the chat. "+
+		"Creating an artifact with an existing name stores a new version of it",
+	[]string{"name", "content"},
+	map[string]toolProperty{
+		"name":     {Type: api.PropertyType{"string"}, Description: "File name including extension, e.g. main.go or notes.md"},
+		"content":  {Type: api.PropertyType{"string"}, Description: "The full content of the document"},
+		"language": {Type: api.PropertyType{"string"}, Description: "Programming or markup language of the content"},
+	})
+
+type artifactVersion struct {
+	Version   int       `json:"version"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type artifact struct {
+	Name     string            `json:"name"`
+	Language string            `json:"language,omitempty"`
+	Versions []artifactVersion `json:"versions"`
+}
+
+// artifactInfo describes one version of an artifact, it's what clients
+// get in the live preview message and in listings
+type artifactInfo struct {
+	Name      string    `json:"name"`
+	Language  string    `json:"language,omitempty"`
+	Version   int       `json:"version"`
+	Content   string    `json:"content,omitempty"`
+	URL       string    `json:"url"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type artifactStore struct {
+	mu     sync.Mutex
+	byName map[string]*artifact
+	// id of the conversation, for download URLs
+	conversation string
+}
+
+// save stores content as the next version of the named artifact
+func (s *artifactStore) save(name, language, content string) artifactInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.byName == nil {
+		s.byName = make(map[string]*artifact)
+	}
+	a, ok := s.byName[name]
+	if !ok {
+		a = &artifact{Name: name}
+		s.byName[name] = a
+	}
+	if language != "" {
+		a.Language = language
+	}
+
+	v := artifactVersion{Version: len(a.Versions) + 1, Content: content, CreatedAt: time.Now().UTC()}
+	a.Versions = append(a.Versions, v)
+	return a.info(v, s.conversation)
+}
+
+// get returns a version of an artifact, version 0 is the latest
+func (s *artifactStore) get(name string, version int) (artifactInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.byName[name]
+	if !ok {
+		return artifactInfo{}, false
+	}
+	if version == 0 {
+		version = len(a.Versions)
+	}
+	if version < 1 || version > len(a.Versions) {
+		return artifactInfo{}, false
+	}
+	return a.info(a.Versions[version-1], s.conversation), true
+}
+
+// list returns the latest version of every artifact without content
+func (s *artifactStore) list() []artifactInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := []artifactInfo{}
+	for _, a := range s.byName {
+		info := a.info(a.Versions[len(a.Versions)-1], s.conversation)
+		info.Content = ""
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (a *artifact) info(v artifactVersion, conversation string) artifactInfo {
+	return artifactInfo{
+		Name:      a.Name,
+		Language:  a.Language,
+		Version:   v.Version,
+		Content:   v.Content,
+		URL:       fmt.Sprintf("/api/conversations/%s/artifacts/%s?version=%d", conversation, url.PathEscape(a.Name), v.Version),
+		CreatedAt: v.CreatedAt,
+	}
+}
+
+// runArtifactTool executes create_artifact and pushes the new version to
+// the client for preview
+func runArtifactTool(ctx context.Context, args api.ToolCallFunctionArguments) string {
+	env := toolEnvFrom(ctx)
+	language, _ := args["language"].(string)
+
+	// names end up in download urls and file names, keep them flat
+	name := path.Base(args["name"].(string))
+
+	info := env.conv.artifacts.save(name, language, args["content"].(string))
+	env.turn.emitArtifact(info)
+
+	js, _ := json.Marshal(map[string]any{
+		"status":  "saved",
+		"name":    info.Name,
+		"version": info.Version,
+		"url":     info.URL,
+	})
+	return string(js)
+}
+
+// emitArtifact sends an artifact to the client for live preview
+func (t *turnInfo) emitArtifact(info artifactInfo) {
+	if t.emit == nil {
+		return
+	}
+	t.emit(Message{
+		Type:     "artifact",
+		Content:  info.Name,
+		Time:     time.Now().Format("15:04:05"),
+		Artifact: &info,
+	})
+}
+
+// lists the artifacts of the conversation
+func (app *application) handleListArtifacts(w http.ResponseWriter, r *http.Request) {
+	conv, ok := app.ownConversation(w, r)
+	if !ok {
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, conv.artifacts.list())
+}
+
+// downloads an artifact, the latest version unless ?version= is given
+func (app *application) handleDownloadArtifact(w http.ResponseWriter, r *http.Request) {
+	conv, ok := app.ownConversation(w, r)
+	if !ok {
+		return
+	}
+
+	version := 0
+	if v := r.URL.Query().Get("version"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, "invalid version")
+			return
+		}
+		version = n
+	}
+
+	info, ok := conv.artifacts.get(r.PathValue("name"), version)
+	if !ok {
+		app.clientError(w, http.StatusNotFound, "artifact not found")
+		return
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(info.Name))
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name}))
+	w.Write([]byte(info.Content))
+}
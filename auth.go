@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const sessionCookie = "session"
+
+// sessionSigner issues and checks session cookies. a cookie is the user
+// and expiry signed with HMAC-SHA256, so no session state is kept
+type sessionSigner struct {
+	key []byte
+	ttl time.Duration
+}
+
+// newSessionSigner uses secret as the signing key. without one a random
+// key is made, and sessions end when the server restarts
+func newSessionSigner(secret string, ttl time.Duration) *sessionSigner {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &sessionSigner{key: key, ttl: ttl}
+}
+
+func (s *sessionSigner) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issue returns the cookie value for user
+func (s *sessionSigner) issue(user string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(user)) + "." +
+		strconv.FormatInt(time.Now().Add(s.ttl).Unix(), 10)
+	return payload + "." + s.sign(payload)
+}
+
+// verify returns the user of a valid, unexpired cookie value
+func (s *sessionSigner) verify(value string) (string, bool) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return "", false
+	}
+	payload, sig := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(s.sign(payload))) {
+		return "", false
+	}
+
+	encodedUser, expiry, ok := strings.Cut(payload, ".")
+	if !ok {
+		return "", false
+	}
+	exp, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return "", false
+	}
+	user, err := base64.RawURLEncoding.DecodeString(encodedUser)
+	if err != nil {
+		return "", false
+	}
+	return string(user), true
+}
+
+// authEnabled is true when a password or token is configured
+func (app *application) authEnabled() bool {
+	return app.config.authPassword != "" || app.config.authToken != ""
+}
+
+func equalSecret(given, want string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(given), []byte(want)) == 1
+}
+
+// authenticate returns who made the request: the session cookie, or a
+// bearer token for API clients like OpenAI SDKs
+func (app *application) authenticate(r *http.Request) (string, bool) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if user, ok := app.sessions.verify(c.Value); ok {
+			return user, true
+		}
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && equalSecret(token, app.config.authToken) {
+		return "token", true
+	}
+	if app.isAdmin(r) {
+		return "admin-token", true
+	}
+	return "", false
+}
+
+// isAdmin reports whether the request carries the -admin-token
+func (app *application) isAdmin(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && equalSecret(token, app.config.adminToken)
+}
+
+// requireAdmin guards an /admin endpoint. signing in isn't enough, the
+// request needs the -admin-token as a bearer token. without one set the
+// endpoints aren't registered at all
+func (app *application) requireAdmin(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ollama-webchat admin"`)
+			app.clientError(w, http.StatusUnauthorized, "admin token required")
+			return
+		}
+		next(w, r)
+	})
+}
+
+// requireAuth guards every handler when auth is enabled. browsers are
+// sent to the login page, everything else gets a 401, websocket
+// upgrades included. the health probes stay open for load balancers,
+// watch links check their own token, see watch.go
+func (app *application) requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		watchPage := r.URL.Path == "/" && r.URL.Query().Has("watch")
+		// avatars go by random ids, watchers without a session see them
+		avatar := strings.HasPrefix(r.URL.Path, "/api/avatars/")
+		if !app.authEnabled() || r.URL.Path == "/login" || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || r.URL.Path == "/ws/watch" || watchPage || avatar {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, ok := app.authenticate(r); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method == http.MethodGet && r.URL.Path == "/" {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ollama-webchat"`)
+		app.clientError(w, http.StatusUnauthorized, "authentication required")
+	})
+}
+
+func (app *application) renderLogin(w http.ResponseWriter, status int, errMsg string) {
+	t := template.Must(template.ParseFiles("login.html"))
+	data := struct {
+		Error    string
+		Password bool
+	}{
+		Error:    errMsg,
+		Password: app.config.authPassword != "",
+	}
+	w.WriteHeader(status)
+	if err := t.Execute(w, data); err != nil {
+		app.logger.Error(fmt.Sprintf("Template execution error: %v", err))
+	}
+}
+
+// login page
+func (app *application) handleLoginPage(w http.ResponseWriter, r *http.Request) {
+	app.renderLogin(w, http.StatusOK, "")
+}
+
+// checks the credentials and sets the session cookie
+func (app *application) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		app.renderLogin(w, http.StatusBadRequest, "Invalid form.")
+		return
+	}
+
+	var user string
+	switch {
+	case app.config.authPassword != "" &&
+		equalSecret(r.PostForm.Get("username"), app.config.authUser) &&
+		equalSecret(r.PostForm.Get("password"), app.config.authPassword):
+		user = app.config.authUser
+	case equalSecret(r.PostForm.Get("token"), app.config.authToken):
+		user = "token"
+	default:
+		app.logger.Info("Login failed", "remote", r.RemoteAddr)
+		app.renderLogin(w, http.StatusUnauthorized, "Wrong credentials.")
+		return
+	}
+
+	app.logger.Info("Login", "user", user, "remote", r.RemoteAddr)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    app.sessions.issue(user),
+		Path:     "/",
+		MaxAge:   int(app.sessions.ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// clears the session cookie
+func (app *application) handleLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+)
+
+// model servers the chat can run on, -backend
+const (
+	backendOllama = "ollama"
+	backendOpenAI = "openai"
+)
+
+// llmBackend is what the chat and tool engine needs from a model
+// server. requests and answers are in the ollama/api types whichever
+// server it is, backends convert them to their own API
+type llmBackend interface {
+	// Chat sends req and returns the whole answer
+	Chat(ctx context.Context, req *api.ChatRequest) (api.ChatResponse, error)
+	// Stream sends req and calls fn with every part of the answer as it's
+	// written. the last part has Done set and the token counts
+	Stream(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error
+	ListModels(ctx context.Context) (*api.ListResponse, error)
+	Embed(ctx context.Context, req *api.EmbedRequest) (*api.EmbedResponse, error)
+}
+
+// tokenLogprob is the log probability of a token the model wrote, and
+// of the tokens it could have written instead. it has the shape of
+// OpenAI's logprobs content
+type tokenLogprob struct {
+	Token       string         `json:"token"`
+	Logprob     float64        `json:"logprob"`
+	TopLogprobs []tokenLogprob `json:"top_logprobs,omitempty"`
+}
+
+type logprobsKey struct{}
+
+type logprobsRequest struct {
+	top int
+	fn  func([]tokenLogprob)
+}
+
+// withLogprobs asks the backend for the logprobs of the answer, with
+// the top most likely alternatives of every token. fn gets them as they
+// come, before the part of the answer they belong to. only the OpenAI
+// backend has them, Ollama's API doesn't return any and fn is never
+// called
+func withLogprobs(ctx context.Context, top int, fn func([]tokenLogprob)) context.Context {
+	return context.WithValue(ctx, logprobsKey{}, &logprobsRequest{top: top, fn: fn})
+}
+
+func logprobsFrom(ctx context.Context) *logprobsRequest {
+	lr, _ := ctx.Value(logprobsKey{}).(*logprobsRequest)
+	return lr
+}
+
+// newBackend builds the -backend. the Ollama servers are returned too,
+// nil with other backends, for what only Ollama does: pulling and
+// deleting models, warm-up and benchmarks, which go to every server
+func newBackend(cfg config) (llmBackend, *ollamaBackend, error) {
+	switch cfg.backend {
+	case backendOllama:
+		backend, err := newOllamaBackend(cfg.ollamaURL, cfg.ollamaBalance)
+		if err != nil {
+			return nil, nil, err
+		}
+		return backend, backend, nil
+	case backendOpenAI:
+		backend, err := newOpenAIBackend(cfg.openAIURL, cfg.openAIKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return backend, nil, nil
+	}
+	return nil, nil, fmt.Errorf("-backend must be %s or %s", backendOllama, backendOpenAI)
+}
+
+// collectChat runs a chat with stream and puts the parts of the answer
+// together into one response
+func collectChat(stream func(api.ChatResponseFunc) error) (api.ChatResponse, error) {
+	var whole api.ChatResponse
+	var content strings.Builder
+	var calls []api.ToolCall
+	err := stream(func(resp api.ChatResponse) error {
+		content.WriteString(resp.Message.Content)
+		calls = append(calls, resp.Message.ToolCalls...)
+		if resp.Done {
+			whole = resp
+		}
+		return nil
+	})
+	whole.Message.Role = "assistant"
+	whole.Message.Content = content.String()
+	whole.Message.ToolCalls = calls
+	return whole, err
+}
+
+// ollamaOnly returns the Ollama servers for handlers that manage Ollama
+// itself, answering 501 with other backends
+func (app *application) ollamaOnly(w http.ResponseWriter) (*ollamaBackend, bool) {
+	if app.ollama == nil {
+		app.clientError(w, http.StatusNotImplemented, "only available with the ollama backend")
+		return nil, false
+	}
+	return app.ollama, true
+}
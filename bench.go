@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// the same prompts are used for every run so results can be
+// compared between models and between Ollama versions
+var benchmarkPrompts = []string{
+	"Reply with the single word: ready",
+	"Explain in three sentences why the sky is blue.",
+	"Write a Go function that reverses a string, without explanation.",
+	"List ten countries in Europe and their capitals.",
+}
+
+type benchmarkPromptResult struct {
+	Prompt         string  `json:"prompt"`
+	FirstTokenMS   int64   `json:"first_token_ms"`
+	TotalMS        int64   `json:"total_ms"`
+	PromptTokens   int     `json:"prompt_tokens"`
+	Tokens         int     `json:"tokens"`
+	TokensPerSec   float64 `json:"tokens_per_second"`
+	LoadDurationMS int64   `json:"load_ms"`
+}
+
+type benchmarkResult struct {
+	Model           string                  `json:"model"`
+	OllamaVersion   string                  `json:"ollama_version"`
+	StartedAt       time.Time               `json:"started_at"`
+	Prompts         []benchmarkPromptResult `json:"prompts"`
+	AvgTokensPerSec float64                 `json:"avg_tokens_per_second"`
+	AvgFirstTokenMS int64                   `json:"avg_first_token_ms"`
+	MemoryBytes     int64                   `json:"memory_bytes"`
+	VRAMBytes       int64                   `json:"vram_bytes"`
+	// the Ollama server it ran on when there are several
+	Server string `json:"server,omitempty"`
+}
+
+// runBenchmark sends every benchmark prompt to the model as a fresh
+// single-message chat and collects timings from the streamed response
+func runBenchmark(ctx context.Context, client *api.Client, model string) (benchmarkResult, error) {
+	result := benchmarkResult{
+		Model:     model,
+		StartedAt: time.Now().UTC(),
+	}
+
+	version, err := client.Version(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to get Ollama version: %w", err)
+	}
+	result.OllamaVersion = version
+
+	var totalTPS float64
+	var totalFirstToken int64
+
+	for _, prompt := range benchmarkPrompts {
+		req := &api.ChatRequest{
+			Model:    model,
+			Messages: []api.Message{{Role: "user", Content: prompt}},
+		}
+
+		start := time.Now()
+		var firstToken time.Duration
+		var metrics api.Metrics
+
+		err := client.Chat(ctx, req, func(resp api.ChatResponse) error {
+			if firstToken == 0 && resp.Message.Content != "" {
+				firstToken = time.Since(start)
+			}
+			if resp.Done {
+				metrics = resp.Metrics
+			}
+			return nil
+		})
+		if err != nil {
+			return result, fmt.Errorf("benchmark prompt failed: %w", err)
+		}
+
+		pr := benchmarkPromptResult{
+			Prompt:         prompt,
+			FirstTokenMS:   firstToken.Milliseconds(),
+			TotalMS:        time.Since(start).Milliseconds(),
+			PromptTokens:   metrics.PromptEvalCount,
+			Tokens:         metrics.EvalCount,
+			LoadDurationMS: metrics.LoadDuration.Milliseconds(),
+		}
+		if metrics.EvalDuration > 0 {
+			pr.TokensPerSec = float64(metrics.EvalCount) / metrics.EvalDuration.Seconds()
+		}
+
+		totalTPS += pr.TokensPerSec
+		totalFirstToken += pr.FirstTokenMS
+		result.Prompts = append(result.Prompts, pr)
+	}
+
+	result.AvgTokensPerSec = totalTPS / float64(len(result.Prompts))
+	result.AvgFirstTokenMS = totalFirstToken / int64(len(result.Prompts))
+
+	// the model is still loaded after the run so ps reports its footprint
+	running, err := client.ListRunning(ctx)
+	if err == nil {
+		for _, m := range running.Models {
+			if m.Name == model || m.Model == model {
+				result.MemoryBytes = m.Size
+				result.VRAMBytes = m.SizeVRAM
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// benchmarkHistory appends results to a JSON lines file
+type benchmarkHistory struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (h *benchmarkHistory) add(result benchmarkResult) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(result)
+}
+
+// all returns every stored result, optionally only for one model
+func (h *benchmarkHistory) all(model string) ([]benchmarkResult, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	results := []benchmarkResult{}
+
+	f, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return results, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r benchmarkResult
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue
+		}
+		if model == "" || r.Model == model {
+			results = append(results, r)
+		}
+	}
+	return results, scanner.Err()
+}
+
+// runs the benchmark against a model and stores the result. with
+// several Ollama servers server picks the one to measure, the first by
+// default, see /admin/ollama/servers
+func (app *application) handleAdminRunBenchmark(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Model  string `json:"model"`
+		Server string `json:"server"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if input.Model == "" {
+		input.Model = app.config.ollamaModel
+	}
+
+	ollama, ok := app.ollamaOnly(w)
+	if !ok {
+		return
+	}
+	server, ok := ollama.server(input.Server)
+	if !ok {
+		app.clientError(w, http.StatusBadRequest, "server is not one of the Ollama servers")
+		return
+	}
+
+	app.audit(r, "model.benchmark", "model", input.Model, "server", server.url)
+
+	result, err := runBenchmark(r.Context(), server.client, input.Model)
+	if err != nil {
+		app.ollamaError(w, err)
+		return
+	}
+	if len(ollama.servers) > 1 {
+		result.Server = server.url
+	}
+
+	if err := app.benchmarks.add(result); err != nil {
+		app.logger.Error(fmt.Sprintf("Failed to store benchmark: %v", err))
+	}
+
+	app.writeJSON(w, http.StatusOK, result)
+}
+
+// lists previous benchmark results, filtered with ?model=
+func (app *application) handleAdminBenchmarkHistory(w http.ResponseWriter, r *http.Request) {
+	results, err := app.benchmarks.all(r.URL.Query().Get("model"))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.writeJSON(w, http.StatusOK, results)
+}
+
+// runBenchCommand implements the "bench" subcommand so a benchmark
+// can be run from the shell without starting the web server
+func runBenchCommand(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	model := fs.String("LLM", "llama3.1:8b", "Ollama model to benchmark")
+	ollamaURL := fs.String("Ollama Server", "http://localhost:11434", "Address of the Ollama server")
+	historyPath := fs.String("bench-history", "benchmarks.jsonl", "File benchmark results are appended to")
+	fs.Parse(args)
+
+	client, err := newOllamaClient(*ollamaURL)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Benchmarking %s...\n", *model)
+	result, err := runBenchmark(context.Background(), client, *model)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range result.Prompts {
+		fmt.Printf("  %-60.60s first token %5dms  %6.1f tok/s\n", p.Prompt, p.FirstTokenMS, p.TokensPerSec)
+	}
+	fmt.Printf("Ollama %s: avg %.1f tok/s, avg first token %dms, memory %s (VRAM %s)\n",
+		result.OllamaVersion, result.AvgTokensPerSec, result.AvgFirstTokenMS,
+		formatBytes(result.MemoryBytes), formatBytes(result.VRAMBytes))
+
+	history := &benchmarkHistory{path: *historyPath}
+	if err := history.add(result); err != nil {
+		return fmt.Errorf("failed to store result: %v", err)
+	}
+
+	// show the previous run so regressions stand out
+	previous, err := history.all(*model)
+	if err == nil && len(previous) > 1 {
+		prev := previous[len(previous)-2]
+		fmt.Printf("Previous run (Ollama %s, %s): avg %.1f tok/s, avg first token %dms\n",
+			prev.OllamaVersion, prev.StartedAt.Format(time.DateTime), prev.AvgTokensPerSec, prev.AvgFirstTokenMS)
+	}
+
+	return nil
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
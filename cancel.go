@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// beginTurn returns the context for the turn that just took the turn
+// lock. a cancel message from any client of the conversation cancels it
+func (c *conversation) beginTurn() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancelTurn = cancel
+	return ctx, func() {
+		c.mu.Lock()
+		c.cancelTurn = nil
+		c.mu.Unlock()
+		cancel()
+	}
+}
+
+// cancel aborts the running turn, false if there was none
+func (c *conversation) cancel() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancelTurn == nil {
+		return false
+	}
+	c.cancelTurn()
+	return true
+}
+
+// handleCancelMessage stops the answer being generated. the turn itself
+// sends what was written so far
+func (app *application) handleCancelMessage(client *wsClient, conv *conversation) {
+	if conv.cancel() {
+		app.logger.Info("Turn cancelled", "conversation", conv.id)
+		return
+	}
+	client.send(Message{
+		Type:    "notice",
+		Content: "Nothing is being generated.",
+		Time:    time.Now().Format("15:04:05"),
+	})
+}
+
+// cancelledReply keeps what the model wrote before the turn was
+// cancelled. an empty partial answer isn't added to the history
+func (app *application) cancelledReply(conv *conversation, partial, language string, turn *turnInfo) *chatMessage {
+	turn.cancelled = true
+
+	msg := api.Message{Role: "assistant", Content: strings.TrimSpace(partial)}
+	if msg.Content == "" {
+		return &chatMessage{Message: msg}
+	}
+	reply := conv.add(chatMessage{Message: msg, Language: language})
+	return &reply
+}
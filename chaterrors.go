@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// errors are sent to the client as error messages with a code it can
+// act on, and a text to show the user
+const (
+	// Ollama couldn't be reached at all
+	errOllamaUnreachable = "ollama_unreachable"
+	// the model isn't installed on the Ollama server
+	errModelNotFound = "model_not_found"
+	// the conversation doesn't fit the model's context any more
+	errContextOverflow = "context_overflow"
+	// a tool call of the turn failed, the turn goes on without it
+	errToolFailed = "tool_failed"
+	// the client sends more than the limits allow, see retry_after
+	errRateLimited = "rate_limited"
+	// any other error Ollama returned
+	errOllama = "ollama_error"
+)
+
+var contextOverflowRe = regexp.MustCompile(`(?i)context (length|window|size)|exceeds? .*context|too many tokens|prompt is too long`)
+
+// chatError works out the code and the text for the user of an error a
+// turn failed with
+func chatError(err error, model string) (code, text string) {
+	var status api.StatusError
+	isStatus := errors.As(err, &status)
+	var netErr net.Error
+
+	switch {
+	case isStatus && status.StatusCode == http.StatusNotFound,
+		strings.Contains(err.Error(), "model") && strings.Contains(err.Error(), "not found"):
+		return errModelNotFound, "The model " + model + " isn't installed on the AI service. Pick another model or ask an admin to pull it."
+	case contextOverflowRe.MatchString(err.Error()):
+		return errContextOverflow, "The conversation is too long for the model. Clear the history with /reset or start a new conversation."
+	case errors.As(err, &netErr), strings.Contains(err.Error(), "connection refused"):
+		return errOllamaUnreachable, "Sorry, I'm having trouble connecting to the AI service. Please try again later."
+	}
+	return errOllama, "Sorry, the AI service couldn't answer. Please try again later."
+}
+
+// errorMessage is the error message with code sent to clients
+func errorMessage(code, text string) Message {
+	return Message{
+		Type:    "error",
+		Code:    code,
+		Content: text,
+		Time:    time.Now().Format("15:04:05"),
+	}
+}
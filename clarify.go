@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ollama/ollama/api"
+)
+
+// questions asked when the model calls a tool with arguments that look
+// guessed. the user's answer is handled as a turn of the same intent
+var toolQuestions = map[string]string{
+	"get_weather": "Which place would you like the weather for?",
+}
+
+// intentQuestion returns a question to ask instead of acting on an
+// intent the classifier isn't sure about, "" to go ahead
+func (app *application) intentQuestion(decision intent, route intentRoute) string {
+	if decision.Name == intentChat || route.Clarify == "" {
+		return ""
+	}
+	if decision.Confidence >= app.config.clarifyBelow {
+		return ""
+	}
+	return route.Clarify
+}
+
+// toolQuestion returns a question to ask instead of running a tool call
+// whose arguments the user never gave, "" to run it
+func (app *application) toolQuestion(conv *conversation, call api.ToolCall) string {
+	question, ok := toolQuestions[call.Function.Name]
+	if !ok || app.config.clarifyBelow <= 0 {
+		return ""
+	}
+
+	switch call.Function.Name {
+	case "get_weather":
+		location, _ := call.Function.Arguments["location"].(string)
+		// "Paris, France" is fine when the user only wrote Paris
+		place, _, _ := strings.Cut(location, ",")
+		place = strings.TrimSpace(place)
+		if strings.EqualFold(location, conv.defaultLocation()) {
+			return ""
+		}
+		if place == "" || !conv.mentions(place) {
+			return question
+		}
+	}
+	return ""
+}
+
+// clarify stores a question as the answer of the turn. the intent is
+// kept on the message so the reply to it is not classified again
+func (app *application) clarify(conv *conversation, question, intentName, lang string) *chatMessage {
+	app.logger.Info("Asking for clarification", "intent", intentName)
+	reply := conv.add(chatMessage{
+		Message:       api.Message{Role: "assistant", Content: question},
+		Language:      lang,
+		Clarification: intentName,
+	})
+	return &reply
+}
+
+// pendingClarification returns the intent of the question the last
+// answer asked, "" if it wasn't a clarification question
+func (c *conversation) pendingClarification() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := len(c.messages) - 1; i >= 0; i-- {
+		if c.messages[i].Role == "assistant" {
+			return c.messages[i].Clarification
+		}
+	}
+	return ""
+}
+
+// mentions reports whether the user wrote text as a whole word or words
+// anywhere in the conversation. what the model wrote doesn't count, it
+// may be where the guess came from, and "Nice" isn't in "nicer"
+func (c *conversation) mentions(text string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	text = strings.ToLower(text)
+	for _, m := range c.messages {
+		if m.Role == "user" && containsWord(strings.ToLower(m.Content), text) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsWord reports whether word is in s with no letter or digit
+// right before or after it
+func containsWord(s, word string) bool {
+	if word == "" {
+		return false
+	}
+	for from := 0; ; {
+		i := strings.Index(s[from:], word)
+		if i < 0 {
+			return false
+		}
+		start, end := from+i, from+i+len(word)
+		before, _ := utf8.DecodeLastRuneInString(s[:start])
+		after, _ := utf8.DecodeRuneInString(s[end:])
+		if !isWordRune(before) && !isWordRune(after) {
+			return true
+		}
+		_, size := utf8.DecodeRuneInString(s[start:])
+		from = start + size
+	}
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
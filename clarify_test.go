@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestMentions(t *testing.T) {
+	conv := newConversation()
+	conv.add(chatMessage{Message: api.Message{Role: "system", Content: "You know Berlin well."}})
+	conv.add(chatMessage{Message: api.Message{Role: "user", Content: "Is it warm in São Paulo or nicer in Bogotá?"}})
+	conv.add(chatMessage{Message: api.Message{Role: "assistant", Content: "Lisbon is warm too."}})
+
+	tests := []struct {
+		place string
+		want  bool
+	}{
+		{"São Paulo", true},
+		{"são paulo", true},
+		{"Bogotá", true},
+		{"Paulo", true},
+		// only as part of a word
+		{"Nice", false},
+		{"Sã", false},
+		// only the model wrote them
+		{"Berlin", false},
+		{"Lisbon", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := conv.mentions(tt.place); got != tt.want {
+			t.Errorf("mentions(%q) = %v, want %v", tt.place, got, tt.want)
+		}
+	}
+}
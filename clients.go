@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsClient wraps a websocket connection so several goroutines can write
+// to it. gorilla/websocket allows only one concurrent writer
+type wsClient struct {
+	conn *websocket.Conn
+	// set instead of conn for a client on the SSE stream, see ssechat.go
+	sse *sseWriter
+	mu  sync.Mutex
+	// wire format negotiated during the upgrade, see protocol.go
+	protocol int
+	// id of the conversation the socket is attached to, guarded by the
+	// registry's mutex once the client is added
+	conv string
+	// the socket only watches conv, see watch.go
+	watching bool
+}
+
+// how long a write may take before the client counts as gone. turns send
+// to every socket of a conversation, one that stopped reading mustn't
+// hold them up for longer
+const wsWriteTimeout = 10 * time.Second
+
+func newWSClient(conn *websocket.Conn) *wsClient {
+	return &wsClient{conn: conn, protocol: protocolVersion(conn.Subprotocol())}
+}
+
+func (c *wsClient) send(msg Message) error {
+	if c.sse != nil {
+		return c.sse.sendData(msg)
+	}
+	data, err := encodeMessage(msg, c.protocol)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		// the socket is unusable after a failed write, closing it ends
+		// the read loop, which cleans up
+		c.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// read reads the next message from the client in its protocol
+func (c *wsClient) read() (Message, error) {
+	if c.protocol >= 2 {
+		var e envelope
+		err := c.conn.ReadJSON(&e)
+		return e.message(), err
+	}
+	var msg Message
+	err := c.conn.ReadJSON(&msg)
+	return msg, err
+}
+
+// clientRegistry tracks the connected websocket clients
+type clientRegistry struct {
+	mu      sync.Mutex
+	clients map[*wsClient]struct{}
+}
+
+func (r *clientRegistry) add(c *wsClient) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.clients == nil {
+		r.clients = make(map[*wsClient]struct{})
+	}
+	r.clients[c] = struct{}{}
+}
+
+// move attaches c to another conversation
+func (r *clientRegistry) move(c *wsClient, conv string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c.conv = conv
+}
+
+func (r *clientRegistry) remove(c *wsClient) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.clients, c)
+}
+
+// sendIf sends a message to the clients match picks. failed writes are
+// ignored here, the client's read loop notices the broken connection
+func (r *clientRegistry) sendIf(match func(*wsClient) bool, msg Message) {
+	r.mu.Lock()
+	var clients []*wsClient
+	for c := range r.clients {
+		if match(c) {
+			clients = append(clients, c)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, c := range clients {
+		c.send(msg)
+	}
+}
+
+// broadcast sends a message to every connected client
+func (r *clientRegistry) broadcast(msg Message) {
+	r.sendIf(func(*wsClient) bool { return true }, msg)
+}
+
+// sendTo sends a message to the clients attached to a conversation,
+// watchers included
+func (r *clientRegistry) sendTo(conv string, msg Message) {
+	r.sendIf(func(c *wsClient) bool { return c.conv == conv }, msg)
+}
+
+// sendToWatchers sends a message to the clients watching a conversation
+func (r *clientRegistry) sendToWatchers(conv string, msg Message) {
+	r.sendIf(func(c *wsClient) bool { return c.watching && c.conv == conv }, msg)
+}
+
+// system event kinds sent on the "system" channel
+const (
+	eventModelSwitched = "model_switched"
+	eventFailover      = "failover"
+	eventMaintenance   = "maintenance"
+	eventQuota         = "quota"
+	eventNotice        = "notice"
+	eventTakeover      = "takeover"
+	eventHandback      = "handback"
+	eventMerged        = "merged"
+)
+
+// systemEvent sends a server status message to every connected client.
+// these are shown apart from the chat and never become part of the history
+func (app *application) systemEvent(event, content string) {
+	app.logger.Info("System event", "event", event, "content", content)
+	app.clients.broadcast(Message{
+		Type:    "system",
+		Event:   event,
+		Content: content,
+		Time:    time.Now().Format("15:04:05"),
+	})
+}
+
+// sends an announcement, e.g. planned maintenance, to all connected clients
+func (app *application) handleAdminSystemEvent(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Event   string `json:"event"`
+		Content string `json:"content"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if input.Content == "" {
+		app.clientError(w, http.StatusBadRequest, "content is required")
+		return
+	}
+
+	switch input.Event {
+	case "":
+		input.Event = eventNotice
+	case eventNotice, eventMaintenance:
+	default:
+		app.clientError(w, http.StatusBadRequest, "event must be notice or maintenance")
+		return
+	}
+
+	app.audit(r, "system.event", "event", input.Event, "content", input.Content)
+	app.systemEvent(input.Event, input.Content)
+	app.writeJSON(w, http.StatusOK, map[string]string{"status": "sent"})
+}
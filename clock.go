@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// local models often get today's date wrong. with -inject-date every
+// turn tells the model the date and time, in the user's timezone when
+// the page sent it, so questions like "what day is it" don't need the
+// get_time tool
+
+// dateNote tells the model the current date and time, and how the user
+// writes dates
+func dateNote(now time.Time, locale string) api.Message {
+	zone := now.Location().String()
+	if zone == "Local" {
+		zone = "the server's timezone"
+	}
+	content := fmt.Sprintf("It is now %s, %s (%s, UTC%s).",
+		now.Format("Monday, 2 January 2006"), now.Format("15:04"), zone, now.Format("-07:00"))
+	if locale != "" {
+		content += fmt.Sprintf(" The user's locale is %s, write dates and times the way it does.", locale)
+	}
+	return api.Message{Role: "system", Content: content}
+}
+
+// requestLocale returns the first language of the Accept-Language header
+func requestLocale(r *http.Request) string {
+	locale, _, _ := strings.Cut(r.Header.Get("Accept-Language"), ",")
+	locale, _, _ = strings.Cut(locale, ";")
+	locale = strings.TrimSpace(locale)
+	if locale == "*" {
+		return ""
+	}
+	return locale
+}
+
+func (c *conversation) setClock(timezone *time.Location, locale string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if timezone != nil {
+		c.timezone = timezone
+	}
+	if locale != "" {
+		c.locale = locale
+	}
+}
+
+// now returns the current time in the user's timezone, the server's if
+// the page didn't send one, and the user's locale
+func (c *conversation) now() (time.Time, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timezone == nil {
+		return time.Now(), c.locale
+	}
+	return time.Now().In(c.timezone), c.locale
+}
+
+// handleTimezoneMessage stores the IANA timezone the browser is in
+func (app *application) handleTimezoneMessage(client *wsClient, conv *conversation, content string) {
+	content = strings.TrimSpace(content)
+	loc, err := time.LoadLocation(content)
+	if err != nil || content == "" {
+		client.send(Message{
+			Type:    "notice",
+			Content: fmt.Sprintf("%q is not a timezone.", content),
+			Time:    time.Now().Format("15:04:05"),
+		})
+		return
+	}
+	conv.setClock(loc, "")
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+const (
+	// characters of a conversation that are embedded and shown to the
+	// labelling model
+	clusterDigestChars = 2000
+	clusterSampleChars = 300
+	// k-means rounds, it settles well before this on chat sized inputs
+	clusterIterations = 30
+)
+
+const clusterLabelPrompt = `Below are excerpts from conversations that are about a similar topic. Name the topic in 2 to 4 words, like "Go concurrency" or "Trip planning". Answer with the name only.`
+
+type clusterMember struct {
+	ID      string    `json:"id"`
+	Title   string    `json:"title"`
+	Updated time.Time `json:"updated"`
+}
+
+type topicCluster struct {
+	ID            int             `json:"id"`
+	Label         string          `json:"label"`
+	Size          int             `json:"size"`
+	Conversations []clusterMember `json:"conversations"`
+}
+
+type clusterSnapshot struct {
+	UpdatedAt     *time.Time     `json:"updated_at"`
+	Conversations int            `json:"conversations"`
+	Clusters      []topicCluster `json:"clusters"`
+}
+
+// topicClusters groups conversations by topic every -cluster-interval.
+// embeddings are kept per conversation version so unchanged
+// conversations aren't embedded again
+type topicClusters struct {
+	mu       sync.Mutex
+	snapshot clusterSnapshot
+	vectors  map[string]embeddedDigest
+}
+
+type embeddedDigest struct {
+	version int
+	vector  []float64
+}
+
+func newTopicClusters() *topicClusters {
+	return &topicClusters{snapshot: clusterSnapshot{Clusters: []topicCluster{}}, vectors: make(map[string]embeddedDigest)}
+}
+
+// all returns every stored conversation
+func (s *conversationStore) all() []*conversation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	convs := make([]*conversation, 0, len(s.byID))
+	for _, stored := range s.byID {
+		convs = append(convs, stored.conv)
+	}
+	return convs
+}
+
+// digest is the text a conversation is clustered by: its summary and
+// what the user asked. title is the first question
+func (c *conversation) digest() (digest, title string, updated time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var b strings.Builder
+	if c.summary != "" {
+		b.WriteString(c.summary + "\n")
+	}
+	for _, m := range c.messages {
+		if m.Role != "user" || m.Content == "" {
+			continue
+		}
+		if title == "" {
+			title = truncate(m.Content, 80)
+		}
+		b.WriteString(m.Content + "\n")
+		updated = m.Created
+	}
+	return truncate(b.String(), clusterDigestChars), title, updated
+}
+
+func truncate(s string, n int) string {
+	s = strings.TrimSpace(s)
+	if r := []rune(s); len(r) > n {
+		return string(r[:n]) + "…"
+	}
+	return s
+}
+
+// runClustering clusters the conversations every interval until ctx is
+// done, starting right away
+func (app *application) runClustering(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := app.clusterConversations(ctx); err != nil {
+			app.logger.Error(fmt.Sprintf("Error clustering conversations: %v", err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// clusterConversations embeds the digest of every conversation, groups
+// them with k-means and has the model label each group
+func (app *application) clusterConversations(ctx context.Context) error {
+	client := app.backend
+
+	type item struct {
+		member clusterMember
+		digest string
+		vector []float64
+	}
+	var items []item
+	var toEmbed []int
+	var texts []string
+
+	app.clusters.mu.Lock()
+	cached := app.clusters.vectors
+	app.clusters.mu.Unlock()
+	vectors := make(map[string]embeddedDigest)
+
+	for _, conv := range app.conversations.all() {
+		// incognito conversations stay out of anything derived from them
+		if conv.isIncognito() {
+			continue
+		}
+		digest, title, updated := conv.digest()
+		if digest == "" {
+			continue
+		}
+		_, version := conv.snapshot()
+		it := item{member: clusterMember{ID: conv.id, Title: title, Updated: updated}, digest: digest}
+		if e, ok := cached[conv.id]; ok && e.version == version {
+			it.vector = e.vector
+		} else {
+			toEmbed = append(toEmbed, len(items))
+			texts = append(texts, digest)
+		}
+		vectors[conv.id] = embeddedDigest{version: version}
+		items = append(items, it)
+	}
+
+	if len(texts) > 0 {
+		resp, err := client.Embed(ctx, &api.EmbedRequest{Model: app.config.clusterModel, Input: texts})
+		if err != nil {
+			return err
+		}
+		if len(resp.Embeddings) != len(texts) {
+			return fmt.Errorf("got %d embeddings for %d conversations", len(resp.Embeddings), len(texts))
+		}
+		for i, idx := range toEmbed {
+			items[idx].vector = normalize(resp.Embeddings[i])
+		}
+	}
+	for _, it := range items {
+		e := vectors[it.member.ID]
+		e.vector = it.vector
+		vectors[it.member.ID] = e
+	}
+
+	points := make([][]float64, len(items))
+	for i, it := range items {
+		points[i] = it.vector
+	}
+	k := clusterCount(len(items), app.config.clusterMax)
+	assignment := kMeans(points, k)
+
+	groups := make([][]item, k)
+	for i, c := range assignment {
+		groups[c] = append(groups[c], items[i])
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return len(groups[i]) > len(groups[j]) })
+
+	clusters := []topicCluster{}
+	for _, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		sort.Slice(group, func(i, j int) bool { return group[i].member.Updated.After(group[j].member.Updated) })
+		cluster := topicCluster{ID: len(clusters) + 1, Size: len(group)}
+		var samples []string
+		for _, it := range group {
+			cluster.Conversations = append(cluster.Conversations, it.member)
+			if len(samples) < 5 {
+				samples = append(samples, truncate(it.digest, clusterSampleChars))
+			}
+		}
+		label, err := app.clusterLabel(ctx, samples)
+		if err != nil {
+			app.logger.Error(fmt.Sprintf("Error labelling cluster: %v", err))
+			label = group[0].member.Title
+		}
+		cluster.Label = label
+		clusters = append(clusters, cluster)
+	}
+
+	now := time.Now()
+	app.clusters.mu.Lock()
+	app.clusters.snapshot = clusterSnapshot{UpdatedAt: &now, Conversations: len(items), Clusters: clusters}
+	app.clusters.vectors = vectors
+	app.clusters.mu.Unlock()
+	app.logger.Debug("Clustered conversations", "conversations", len(items), "clusters", len(clusters), "embedded", len(texts))
+	return nil
+}
+
+// clusterLabel has the model name what the samples have in common
+func (app *application) clusterLabel(ctx context.Context, samples []string) (string, error) {
+	resp, err := app.backend.Chat(ctx, &api.ChatRequest{
+		Model: app.config.ollamaModel,
+		Messages: []api.Message{
+			{Role: "system", Content: clusterLabelPrompt},
+			{Role: "user", Content: strings.Join(samples, "\n---\n")},
+		},
+	})
+	return truncate(strings.Trim(resp.Message.Content, " \n\"'."), 60), err
+}
+
+// clusterCount picks k for n conversations, about sqrt(n/2)
+func clusterCount(n, most int) int {
+	if n < 4 {
+		return max(n, 1)
+	}
+	return min(max(int(math.Round(math.Sqrt(float64(n)/2))), 2), most)
+}
+
+func normalize(v []float32) []float64 {
+	out := make([]float64, len(v))
+	var norm float64
+	for i, x := range v {
+		out[i] = float64(x)
+		norm += float64(x) * float64(x)
+	}
+	if norm = math.Sqrt(norm); norm > 0 {
+		for i := range out {
+			out[i] /= norm
+		}
+	}
+	return out
+}
+
+func dot(a, b []float64) float64 {
+	var sum float64
+	for i := range min(len(a), len(b)) {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+// kMeans clusters unit vectors by cosine similarity and returns the
+// cluster of each point. centers are seeded k-means++ style from a
+// fixed seed, so the same input gives the same clusters
+func kMeans(points [][]float64, k int) []int {
+	assignment := make([]int, len(points))
+	if len(points) == 0 {
+		return assignment
+	}
+	rng := rand.New(rand.NewPCG(1, 1))
+
+	centers := [][]float64{points[rng.IntN(len(points))]}
+	for len(centers) < k {
+		// the next center is likely far from the ones picked so far
+		weights := make([]float64, len(points))
+		var total float64
+		for i, p := range points {
+			nearest := 0.0
+			for _, c := range centers {
+				nearest = max(nearest, dot(p, c))
+			}
+			weights[i] = math.Max(1-nearest, 0)
+			total += weights[i]
+		}
+		if total == 0 {
+			break
+		}
+		r := rng.Float64() * total
+		i := 0
+		for ; i < len(points)-1 && r > weights[i]; i++ {
+			r -= weights[i]
+		}
+		centers = append(centers, points[i])
+	}
+
+	for range clusterIterations {
+		changed := false
+		for i, p := range points {
+			best, bestSim := 0, math.Inf(-1)
+			for c, center := range centers {
+				if sim := dot(p, center); sim > bestSim {
+					best, bestSim = c, sim
+				}
+			}
+			if assignment[i] != best {
+				assignment[i], changed = best, true
+			}
+		}
+
+		sums := make([][]float64, len(centers))
+		for i, p := range points {
+			c := assignment[i]
+			if sums[c] == nil {
+				sums[c] = make([]float64, len(p))
+			}
+			for d := range p {
+				sums[c][d] += p[d]
+			}
+		}
+		for c, sum := range sums {
+			// an empty cluster keeps its center
+			if sum != nil {
+				var norm float64
+				for _, x := range sum {
+					norm += x * x
+				}
+				if norm = math.Sqrt(norm); norm > 0 {
+					for d := range sum {
+						sum[d] /= norm
+					}
+				}
+				centers[c] = sum
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	return assignment
+}
+
+// shows the latest clustering of the conversations by topic
+func (app *application) handleClusters(w http.ResponseWriter, r *http.Request) {
+	app.clusters.mu.Lock()
+	snapshot := app.clusters.snapshot
+	app.clusters.mu.Unlock()
+	app.writeJSON(w, http.StatusOK, snapshot)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// slash commands typed into the chat run on the server instead of going
+// to the model. their results come back as server messages with the
+// command event. /snippet is expanded separately, see snippets.go
+const eventCommand = "command"
+
+// the argument may span lines, e.g. a /system prompt
+var commandRe = regexp.MustCompile(`(?s)^/([a-z]+)(?:\s+(.*))?$`)
+
+// commands are the names handleCommand runs. other messages starting
+// with a slash, like a path, go to the model
+var commands = map[string]bool{"reset": true, "model": true, "system": true, "retry": true, "help": true}
+
+var commandHelp = []string{
+	"/reset clears the history",
+	"/model [name] shows or switches the model, /model default goes back to the default",
+	"/system [prompt] shows or sets the system prompt, /system default restores the default",
+	"/retry writes the last answer again",
+	"/snippet [name] inserts a snippet, or lists them",
+}
+
+// handleCommand runs msg if it's a slash command and reports whether it
+// was one
+func (app *application) handleCommand(client *wsClient, conv *conversation, ip string, msg Message) bool {
+	match := commandRe.FindStringSubmatch(strings.TrimSpace(msg.Content))
+	if match == nil || !commands[match[1]] {
+		return false
+	}
+	name, arg := match[1], strings.TrimSpace(match[2])
+	reply := func(content string) {
+		client.send(Message{
+			Type:    "server",
+			Event:   eventCommand,
+			Content: content,
+			Time:    time.Now().Format("15:04:05"),
+		})
+	}
+
+	switch name {
+	case "reset":
+		conv.turn.lock(func(int) {})
+		conv.reset()
+		conv.turn.unlock()
+		app.logger.Info("History cleared", "conversation", conv.id)
+		reply("The history is cleared, the model and system prompt are kept.")
+
+	case "model":
+		if arg == "" {
+			reply(fmt.Sprintf("Chatting with %s.", app.conversationModel(conv)))
+			return true
+		}
+		if arg == "default" {
+			arg = ""
+		}
+		model, err := app.switchModel(conv, arg)
+		if err != nil {
+			reply(err.Error())
+			return true
+		}
+		reply(fmt.Sprintf("Now chatting with %s.", model))
+
+	case "system":
+		switch arg {
+		case "":
+			reply("The system prompt is: " + app.systemPrompt(conv))
+		case "default":
+			app.setSystemPrompt(conv, "")
+			reply("The system prompt is back to the default.")
+		default:
+			app.setSystemPrompt(conv, arg)
+			reply("System prompt updated.")
+		}
+
+	case "retry":
+		if !app.regenerate(client, conv, ip, msg.Language, modelOptions{}) {
+			reply("There's no answer to write again.")
+		}
+
+	case "help":
+		reply("Commands:\n" + strings.Join(commandHelp, "\n"))
+	}
+	return true
+}
+
+// reset clears the history and what was derived from it. the settings
+// of the conversation are kept
+func (c *conversation) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = nil
+	c.version++
+	c.summary, c.summaryUpTo = "", 0
+	c.graphUpTo = c.nextID
+	c.toolCalls = nil
+	c.notes = nil
+}
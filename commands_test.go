@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestCommandRe(t *testing.T) {
+	tests := []struct {
+		content string
+		match   bool
+		name    string
+		arg     string
+	}{
+		{"/reset", true, "reset", ""},
+		{"/model llama3", true, "model", "llama3"},
+		{"/model   llama3  ", true, "model", "llama3  "},
+		{"/system You are terse.\nAnswer in one line.", true, "system", "You are terse.\nAnswer in one line."},
+		{"/help\n", true, "help", ""},
+		// handleCommand only runs the names in commands
+		{"/unknown arg", true, "unknown", "arg"},
+		{"/usr/bin/env", false, "", ""},
+		{"/Reset", false, "", ""},
+		{"reset", false, "", ""},
+		{"please /reset", false, "", ""},
+		{"/", false, "", ""},
+	}
+
+	for _, tt := range tests {
+		m := commandRe.FindStringSubmatch(tt.content)
+		if (m != nil) != tt.match {
+			t.Errorf("%q matched %v, want %v", tt.content, m != nil, tt.match)
+			continue
+		}
+		if m != nil && (m[1] != tt.name || m[2] != tt.arg) {
+			t.Errorf("%q = command %q arg %q, want %q %q", tt.content, m[1], m[2], tt.name, tt.arg)
+		}
+	}
+}
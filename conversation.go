@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// turnLock serializes turns of a conversation. A turn appends the user
+// message, any tool calls and the answer to the history, so two turns
+// running at once (the same conversation open on two devices) would
+// interleave their messages
+type turnLock struct {
+	mu      sync.Mutex
+	waiting atomic.Int32
+}
+
+// lock blocks until no other turn is running. if the conversation is
+// busy queued is called first with the number of turns ahead of this one
+func (l *turnLock) lock(queued func(ahead int)) {
+	if l.mu.TryLock() {
+		return
+	}
+
+	ahead := int(l.waiting.Add(1))
+	queued(ahead)
+
+	l.mu.Lock()
+	l.waiting.Add(-1)
+}
+
+func (l *turnLock) unlock() {
+	l.mu.Unlock()
+}
+
+// chatMessage is a message in the conversation history together with
+// the bookkeeping needed to edit it safely from several clients
+type chatMessage struct {
+	ID       int       `json:"id"`
+	Version  int       `json:"version"`
+	Created  time.Time `json:"created"`
+	Language string    `json:"language,omitempty"`
+	// tables found in the content, kept so they can be downloaded and searched
+	Tables []markdownTable `json:"tables,omitempty"`
+	// intent of the turn when this answer is a clarification question
+	Clarification string `json:"clarification,omitempty"`
+	// whether the answer came from tool results, see provenance.go
+	Provenance *provenance `json:"provenance,omitempty"`
+	// the human agent who wrote this answer, see operator.go
+	Operator string `json:"operator,omitempty"`
+	// every answer written for a regenerated turn, the one shown, from
+	// 1, and the one the user went on with, see variants.go
+	Variants []answerVariant `json:"variants,omitempty"`
+	Variant  int             `json:"variant,omitempty"`
+	Kept     int             `json:"kept,omitempty"`
+	// tokens and time the answer took, see usage.go
+	Usage *messageUsage `json:"usage,omitempty"`
+	// the draft and review of an answer written with -refine, only
+	// returned by the refinement endpoint
+	Refinement *refinement `json:"-"`
+	api.Message
+}
+
+// conversation is the message history sent to Ollama on every turn.
+// Every change bumps the version of the message it touches and of the
+// conversation as a whole, edits and deletes have to name the version
+// they expect so a stale client can't overwrite a newer change
+type conversation struct {
+	id   string
+	turn turnLock
+	// who the conversation belongs to and when it was started, see
+	// conversationapi.go. owner is set once when it's created
+	owner   string
+	created time.Time
+
+	mu      sync.Mutex
+	version int
+	// cancels the running turn, see cancel.go
+	cancelTurn context.CancelFunc
+	nextID     int
+	messages   []*chatMessage
+
+	// calls per tool over the whole conversation, for tool budgets
+	toolCalls map[string]int
+
+	// the model's scratchpad, by title
+	notes map[string]scratchNote
+
+	artifacts artifactStore
+
+	// where the user is, from the browser or GeoIP
+	location string
+	// metric or imperial, "" for the -units default
+	units string
+	// the user's timezone and locale, for -inject-date, see clock.go
+	timezone *time.Location
+	locale   string
+
+	// keep message content out of the logs
+	incognito bool
+	// left out of the list and the knowledge graph, see archive.go
+	archived bool
+
+	// the admin answering instead of the model, see operator.go
+	operator string
+	// cleans up what users write, nil for the -input-filters default,
+	// see inputfilter.go
+	inputFilter *inputFilter
+
+	// name given by the user, "" until it's renamed
+	title string
+	// replaces the default system prompt, "" for the default
+	systemPrompt string
+
+	// model picked by the user, "" for -LLM
+	model string
+	// temperature, seed etc. set by the user, over the flag defaults
+	options modelOptions
+
+	// prompt tokens per character, learned from Ollama's counts
+	tokensPerChar float64
+
+	// model written summary of the messages up to summaryUpTo, with
+	// -history summary
+	summary     string
+	summaryUpTo int
+
+	// last message the knowledge graph has been extracted from
+	graphUpTo int
+}
+
+// versionConflictError is returned when an edit or delete was based on
+// an outdated version of the message
+type versionConflictError struct {
+	ID       int `json:"id"`
+	Expected int `json:"expected_version"`
+	Current  int `json:"current_version"`
+}
+
+func (e *versionConflictError) Error() string {
+	return fmt.Sprintf("message %d is at version %d, not %d", e.ID, e.Current, e.Expected)
+}
+
+var errMessageNotFound = errors.New("message not found")
+
+// append adds a message to the end of the history and returns a copy
+// of the stored message
+func (c *conversation) append(msg api.Message) chatMessage {
+	return c.add(chatMessage{Message: msg})
+}
+
+// add is append for messages that carry metadata, the id and version
+// of m are assigned here. Created is set unless m has one
+func (c *conversation) add(m chatMessage) chatMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nextID++
+	c.version++
+	stored := &m
+	stored.ID = c.nextID
+	stored.Version = 1
+	if stored.Created.IsZero() {
+		stored.Created = time.Now()
+	}
+	c.messages = append(c.messages, stored)
+	return *stored
+}
+
+// len returns the number of messages in the history
+func (c *conversation) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.messages)
+}
+
+// apiMessages returns a copy of the history in the form Ollama expects
+func (c *conversation) apiMessages() []api.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	msgs := make([]api.Message, len(c.messages))
+	for i, m := range c.messages {
+		msgs[i] = m.Message
+	}
+	return msgs
+}
+
+// snapshot returns copies of the stored messages and the conversation version
+func (c *conversation) snapshot() ([]chatMessage, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	msgs := make([]chatMessage, len(c.messages))
+	for i, m := range c.messages {
+		msgs[i] = *m
+	}
+	return msgs, c.version
+}
+
+// message returns a copy of the message with the given id
+func (c *conversation) message(id int) (chatMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := c.find(id)
+	if i < 0 {
+		return chatMessage{}, false
+	}
+	return *c.messages[i], true
+}
+
+// find returns the index of a message, the caller must hold c.mu
+func (c *conversation) find(id int) int {
+	for i, m := range c.messages {
+		if m.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// edit replaces the content of a message if it's still at expectedVersion
+func (c *conversation) edit(id, expectedVersion int, content string) (chatMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := c.find(id)
+	if i < 0 {
+		return chatMessage{}, errMessageNotFound
+	}
+	msg := c.messages[i]
+	if msg.Version != expectedVersion {
+		return chatMessage{}, &versionConflictError{ID: id, Expected: expectedVersion, Current: msg.Version}
+	}
+
+	msg.Content = content
+	// the tools didn't write the edited text
+	msg.Provenance = nil
+	if msg.Role == "assistant" {
+		msg.Tables = parseMarkdownTables(content)
+	}
+	msg.Version++
+	c.version++
+	return *msg, nil
+}
+
+// delete removes a message if it's still at expectedVersion
+func (c *conversation) delete(id, expectedVersion int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := c.find(id)
+	if i < 0 {
+		return errMessageNotFound
+	}
+	if c.messages[i].Version != expectedVersion {
+		return &versionConflictError{ID: id, Expected: expectedVersion, Current: c.messages[i].Version}
+	}
+
+	c.messages = append(c.messages[:i], c.messages[i+1:]...)
+	c.version++
+	return nil
+}
+
+// countToolCall records that the model called a tool
+func (c *conversation) countToolCall(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.toolCalls == nil {
+		c.toolCalls = make(map[string]int)
+	}
+	c.toolCalls[name]++
+}
+
+// toolCallCount returns how often a tool was called in this conversation
+func (c *conversation) toolCallCount(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.toolCalls[name]
+}
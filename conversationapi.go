@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// conversations belong to whoever started them: the signed in user, or
+// without auth the browser, by a random id kept in the owner cookie.
+// an owner can list their conversations, start, rename and delete them
+// and switch a socket between them, over the websocket or REST
+const ownerCookie = "owner"
+
+// owner returns who the request comes from, "" when it's anonymous
+func (app *application) owner(r *http.Request) string {
+	if app.authEnabled() {
+		if user, ok := app.authenticate(r); ok {
+			return "user:" + user
+		}
+		return ""
+	}
+	if c, err := r.Cookie(ownerCookie); err == nil && c.Value != "" {
+		return "browser:" + c.Value
+	}
+	return ""
+}
+
+// setOwnerCookie gives a browser its owner id on the first visit
+func (app *application) setOwnerCookie(w http.ResponseWriter, r *http.Request) {
+	if app.authEnabled() {
+		return
+	}
+	if c, err := r.Cookie(ownerCookie); err == nil && c.Value != "" {
+		return
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     ownerCookie,
+		Value:    hex.EncodeToString(b),
+		Path:     "/",
+		MaxAge:   int((365 * 24 * time.Hour).Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (c *conversation) setTitle(title string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.title = title
+}
+
+// conversationInfo describes a conversation in the list
+type conversationInfo struct {
+	ID           string    `json:"id"`
+	Title        string    `json:"title"`
+	Model        string    `json:"model,omitempty"`
+	SystemPrompt string    `json:"system_prompt,omitempty"`
+	Messages     int       `json:"messages"`
+	Created      time.Time `json:"created"`
+	Updated      time.Time `json:"updated"`
+	Archived     bool      `json:"archived,omitempty"`
+}
+
+// info describes c. untitled conversations are named after their first
+// user message
+func (c *conversation) info() conversationInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info := conversationInfo{
+		ID:           c.id,
+		Title:        c.title,
+		Model:        c.model,
+		SystemPrompt: c.systemPrompt,
+		Created:      c.created,
+		Updated:      c.created,
+		Archived:     c.archived,
+	}
+	for _, m := range c.messages {
+		if m.Role == "system" {
+			continue
+		}
+		info.Messages++
+		info.Updated = m.Created
+		if info.Title == "" && m.Role == "user" {
+			info.Title = titleFrom(m.Content)
+		}
+	}
+	if info.Title == "" {
+		info.Title = "New conversation"
+	}
+	return info
+}
+
+// titleFrom shortens a message to a title of at most 40 characters
+func titleFrom(content string) string {
+	title := strings.Join(strings.Fields(content), " ")
+	if utf8.RuneCountInString(title) <= 40 {
+		return title
+	}
+	runes := []rune(title)
+	return strings.TrimSpace(string(runes[:39])) + "…"
+}
+
+// ownedConversation returns conv if owner may manage it
+func (app *application) ownedConversation(id, owner string) (*conversation, bool) {
+	conv, ok := app.conversations.get(id)
+	if !ok || owner == "" || conv.owner != owner {
+		return nil, false
+	}
+	return conv, true
+}
+
+// conversationSettings are the fields that can be set when a
+// conversation is created or changed. nil leaves a field as it is
+type conversationSettings struct {
+	Title        *string `json:"title"`
+	Model        *string `json:"model"`
+	SystemPrompt *string `json:"system_prompt"`
+}
+
+// applySettings checks the settings and sets them on conv. the error
+// is meant for the user
+func (app *application) applySettings(ctx context.Context, conv *conversation, s conversationSettings) error {
+	if s.Model != nil {
+		model := strings.TrimSpace(*s.Model)
+		if model != "" {
+			ok, err := app.modelInstalled(ctx, model)
+			if err != nil {
+				app.logger.Error(fmt.Sprintf("Error listing models: %v", err))
+				return fmt.Errorf("the model list isn't available right now")
+			}
+			if !ok {
+				return fmt.Errorf("%s isn't installed on the server", model)
+			}
+		}
+		conv.setModel(model)
+	}
+	if s.Title != nil {
+		conv.setTitle(strings.TrimSpace(*s.Title))
+	}
+	if s.SystemPrompt != nil {
+		app.setSystemPrompt(conv, strings.TrimSpace(*s.SystemPrompt))
+	}
+	return nil
+}
+
+// conversationList lists owner's conversations that aren't archived
+func (app *application) conversationList(owner string) []conversationInfo {
+	return app.filteredConversations(owner, func(c *conversation) bool { return !c.isArchived() })
+}
+
+func (app *application) filteredConversations(owner string, keep func(*conversation) bool) []conversationInfo {
+	infos := []conversationInfo{}
+	for _, conv := range app.conversations.owned(owner) {
+		if keep(conv) {
+			infos = append(infos, conv.info())
+		}
+	}
+	return infos
+}
+
+// lists the caller's conversations, the archived ones with
+// ?archived=true. ?q= searches all of them, archived or not
+func (app *application) handleListConversations(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	archived := r.URL.Query().Get("archived") == "true"
+	keep := func(c *conversation) bool {
+		if query != "" {
+			return c.matches(query)
+		}
+		return c.isArchived() == archived
+	}
+	app.writeJSON(w, http.StatusOK, map[string]any{"conversations": app.filteredConversations(app.owner(r), keep)})
+}
+
+// starts a conversation, connect to it with /ws?conversation=<id>
+func (app *application) handleCreateConversation(w http.ResponseWriter, r *http.Request) {
+	var input conversationSettings
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	conv := app.conversations.create(app.owner(r))
+	if err := app.applySettings(r.Context(), conv, input); err != nil {
+		app.conversations.remove(conv.id)
+		app.clientError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	app.writeJSON(w, http.StatusCreated, conv.info())
+}
+
+// renames a conversation or changes its model or system prompt
+func (app *application) handleUpdateConversation(w http.ResponseWriter, r *http.Request) {
+	conv, ok := app.ownedConversation(r.PathValue("conversation"), app.owner(r))
+	if !ok {
+		app.clientError(w, http.StatusNotFound, "conversation not found")
+		return
+	}
+
+	var input conversationSettings
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := app.applySettings(r.Context(), conv, input); err != nil {
+		app.clientError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	app.writeJSON(w, http.StatusOK, conv.info())
+}
+
+// deletes a conversation and its history
+func (app *application) handleDeleteConversation(w http.ResponseWriter, r *http.Request) {
+	conv, ok := app.ownedConversation(r.PathValue("conversation"), app.owner(r))
+	if !ok {
+		app.clientError(w, http.StatusNotFound, "conversation not found")
+		return
+	}
+	app.conversations.remove(conv.id)
+	app.logger.Info("Conversation deleted", "conversation", conv.id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// conversationMessages manage the owner's conversations over the
+// websocket. they're handled off the socket's read loop like control
+// messages, but may switch the conversation the socket is attached to
+var conversationMessages = map[string]bool{
+	"list_conversations":  true,
+	"new_conversation":    true,
+	"switch_conversation": true,
+	"rename_conversation": true,
+	"delete_conversation": true,
+	"system_prompt":       true,
+}
+
+// socketConversation is the conversation a socket is attached to. only
+// the socket's message goroutine switches it, the read loop reads it
+type socketConversation struct {
+	owner string
+	conv  atomic.Pointer[conversation]
+}
+
+// handleConversationMessage handles one of the conversationMessages.
+// msg.Conversation names the conversation, the current one if empty
+func (app *application) handleConversationMessage(client *wsClient, current *socketConversation, msg Message) {
+	conv := current.conv.Load()
+	notice := func(content string) {
+		client.send(Message{
+			Type:    "notice",
+			Content: content,
+			Time:    time.Now().Format("15:04:05"),
+		})
+	}
+	target := func() (*conversation, bool) {
+		if msg.Conversation == "" || msg.Conversation == conv.id {
+			return conv, true
+		}
+		c, ok := app.ownedConversation(msg.Conversation, current.owner)
+		if !ok {
+			notice("That conversation doesn't exist.")
+		}
+		return c, ok
+	}
+
+	switch msg.Type {
+	case "list_conversations":
+		app.sendConversationList(client, current.owner)
+	case "new_conversation":
+		next := app.conversations.create(current.owner)
+		next.setTitle(strings.TrimSpace(msg.Content))
+		app.switchConversation(client, current, next)
+	case "switch_conversation":
+		if next, ok := target(); ok && next != conv {
+			app.switchConversation(client, current, next)
+		}
+	case "rename_conversation":
+		if c, ok := target(); ok {
+			c.setTitle(strings.TrimSpace(msg.Content))
+			app.sendConversationList(client, current.owner)
+		}
+	case "delete_conversation":
+		c, ok := target()
+		if !ok {
+			return
+		}
+		app.conversations.remove(c.id)
+		app.logger.Info("Conversation deleted", "conversation", c.id)
+		if c == conv {
+			app.switchConversation(client, current, app.conversations.create(current.owner))
+		} else {
+			app.sendConversationList(client, current.owner)
+		}
+	case "system_prompt":
+		if c, ok := target(); ok {
+			if !app.setSystemPrompt(c, strings.TrimSpace(msg.Content)) {
+				notice("The system prompt is unchanged.")
+				return
+			}
+			if c.len() > 0 {
+				notice("System prompt updated, the conversation so far is kept.")
+			} else {
+				notice("System prompt updated.")
+			}
+			app.sendConversationList(client, current.owner)
+		}
+	}
+}
+
+// switchConversation attaches the socket to next and tells the client,
+// which then loads next's history
+func (app *application) switchConversation(client *wsClient, current *socketConversation, next *conversation) {
+	prev := current.conv.Load()
+	app.conversations.attach(next.id, current.owner)
+	current.conv.Store(next)
+	app.clients.move(client, next.id)
+	app.conversations.detach(prev)
+
+	app.logger.Info("Switched conversation", "from", prev.id, "to", next.id)
+	client.send(Message{
+		Type:    "conversation",
+		Content: next.id,
+		Time:    time.Now().Format("15:04:05"),
+		Server:  &app.version,
+	})
+	app.sendConversationList(client, current.owner)
+}
+
+func (app *application) sendConversationList(client *wsClient, owner string) {
+	client.send(Message{
+		Type:          "conversations",
+		Time:          time.Now().Format("15:04:05"),
+		Conversations: app.conversationList(owner),
+	})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// conversationStore holds the conversation of every connected client.
+// each socket gets its own, so two tabs don't share a history. a
+// conversation outlives its socket for a while so a reloaded tab or a
+// reconnect can pick it up again with /ws?conversation=<id>
+type conversationStore struct {
+	mu   sync.Mutex
+	byID map[string]*storedConversation
+	idle time.Duration
+}
+
+type storedConversation struct {
+	conv *conversation
+	// sockets attached, and when the last one left
+	clients  int
+	lastSeen time.Time
+	// kept even when idle, for demo data
+	pinned bool
+}
+
+func newConversationStore(idle time.Duration) *conversationStore {
+	return &conversationStore{byID: make(map[string]*storedConversation), idle: idle}
+}
+
+func newConversation() *conversation {
+	b := make([]byte, 12)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	return &conversation{id: id, created: time.Now(), artifacts: artifactStore{conversation: id}}
+}
+
+// attach returns the conversation with the given id if owner owns it,
+// or a new one for owner, and counts the caller as connected to it.
+// knowing an id isn't enough to join someone else's conversation
+func (s *conversationStore) attach(id, owner string) *conversation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.byID[id]
+	if !ok || owner == "" || stored.conv.owner != owner {
+		conv := newConversation()
+		conv.owner = owner
+		stored = &storedConversation{conv: conv}
+		s.byID[conv.id] = stored
+	}
+	stored.clients++
+	return stored.conv
+}
+
+// create stores a new conversation for owner. nobody is connected to it
+// yet, so it expires like one whose clients left just now
+func (s *conversationStore) create(owner string) *conversation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conv := newConversation()
+	conv.owner = owner
+	s.byID[conv.id] = &storedConversation{conv: conv, lastSeen: time.Now()}
+	return conv
+}
+
+// remove drops a conversation, sockets still attached keep their copy
+// until they switch or disconnect
+func (s *conversationStore) remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.byID[id]; !ok {
+		return false
+	}
+	delete(s.byID, id)
+	return true
+}
+
+// removeUnattached drops a conversation nobody is connected to. false
+// if it doesn't exist or a socket is attached
+func (s *conversationStore) removeUnattached(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.byID[id]
+	if !ok || stored.clients > 0 {
+		return false
+	}
+	delete(s.byID, id)
+	return true
+}
+
+// owned returns owner's conversations, newest first. conversations
+// without an owner aren't listed for anyone
+func (s *conversationStore) owned(owner string) []*conversation {
+	if owner == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	var convs []*conversation
+	for _, stored := range s.byID {
+		if stored.conv.owner == owner {
+			convs = append(convs, stored.conv)
+		}
+	}
+	s.mu.Unlock()
+
+	slices.SortFunc(convs, func(a, b *conversation) int {
+		return b.created.Compare(a.created)
+	})
+	return convs
+}
+
+// keep stores conv so it never expires
+func (s *conversationStore) keep(conv *conversation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byID[conv.id] = &storedConversation{conv: conv, lastSeen: time.Now(), pinned: true}
+}
+
+// detach marks a socket as gone, the conversation is kept until it has
+// been idle for the store's idle time
+func (s *conversationStore) detach(conv *conversation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stored, ok := s.byID[conv.id]; ok {
+		stored.clients--
+		stored.lastSeen = time.Now()
+	}
+}
+
+func (s *conversationStore) get(id string) (*conversation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.byID[id]
+	if !ok {
+		return nil, false
+	}
+	return stored.conv, true
+}
+
+// expire drops conversations nobody has been connected to for the idle
+// time and returns how many were dropped
+func (s *conversationStore) expire(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for id, stored := range s.byID {
+		if !stored.pinned && stored.clients <= 0 && now.Sub(stored.lastSeen) > s.idle {
+			delete(s.byID, id)
+			n++
+		}
+	}
+	return n
+}
+
+// expireConversations runs expire every interval until ctx is done
+func (app *application) expireConversations(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n := app.conversations.expire(now); n > 0 {
+				app.logger.Debug("Expired idle conversations", "count", n)
+			}
+		}
+	}
+}
+
+// adminConversation looks up the conversation named in the request
+// path for admin handlers and writes a 404 if there is none. they're
+// behind requireAdmin already, the check here keeps the lookup from
+// being reused on a path that isn't. user endpoints use ownConversation
+func (app *application) adminConversation(w http.ResponseWriter, r *http.Request) (*conversation, bool) {
+	conv, ok := app.conversations.get(r.PathValue("conversation"))
+	if !ok || !app.isAdmin(r) {
+		app.clientError(w, http.StatusNotFound, "conversation not found")
+		return nil, false
+	}
+	return conv, true
+}
+
+// ownConversation is adminConversation for the conversation's owner,
+// others get the same 404 as for one that doesn't exist
+func (app *application) ownConversation(w http.ResponseWriter, r *http.Request) (*conversation, bool) {
+	conv, ok := app.ownedConversation(r.PathValue("conversation"), app.owner(r))
+	if !ok {
+		app.clientError(w, http.StatusNotFound, "conversation not found")
+		return nil, false
+	}
+	return conv, true
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAttachOwner(t *testing.T) {
+	store := newConversationStore(time.Hour)
+	alice := store.attach("", "user:alice")
+	anonymous := store.attach("", "")
+
+	tests := []struct {
+		name  string
+		id    string
+		owner string
+		same  *conversation // nil when a new conversation is expected
+	}{
+		{"owner gets theirs back", alice.id, "user:alice", alice},
+		{"someone else gets a new one", alice.id, "user:bob", nil},
+		{"anonymous can't join an owned one", alice.id, "", nil},
+		{"anonymous can't resume an anonymous one", anonymous.id, "", nil},
+		{"an owner can't take an anonymous one", anonymous.id, "user:alice", nil},
+		{"unknown id", "nope", "user:alice", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conv := store.attach(tt.id, tt.owner)
+			if tt.same != nil {
+				if conv != tt.same {
+					t.Fatalf("attach(%s, %s) = %s, want %s", tt.id, tt.owner, conv.id, tt.same.id)
+				}
+				return
+			}
+			if conv.id == tt.id {
+				t.Fatalf("attach(%s, %s) joined the existing conversation", tt.id, tt.owner)
+			}
+			if conv.owner != tt.owner {
+				t.Errorf("new conversation owner = %q, want %q", conv.owner, tt.owner)
+			}
+		})
+	}
+}
+
+func TestOwnConversation(t *testing.T) {
+	tests := []struct {
+		name string
+		// auth on with these tokens, off when empty
+		authToken  string
+		adminToken string
+		owner      string
+		cookie     string
+		bearer     string
+		found      bool
+	}{
+		{name: "browser owner", owner: "browser:b1", cookie: "b1", found: true},
+		{name: "other browser", owner: "browser:b1", cookie: "b2"},
+		{name: "no cookie", owner: "browser:b1"},
+		{name: "unowned conversation", owner: "", cookie: "b1"},
+		{name: "signed in owner", authToken: "t", owner: "user:token", bearer: "t", found: true},
+		{name: "wrong token", authToken: "t", owner: "user:token", bearer: "x"},
+		{name: "owner cookie with auth on", authToken: "t", owner: "browser:b1", cookie: "b1"},
+		{name: "admin isn't the owner", authToken: "t", adminToken: "a", owner: "user:token", bearer: "a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := testApplication(config{authToken: tt.authToken, adminToken: tt.adminToken})
+			conv := app.conversations.create(tt.owner)
+
+			r := testConversationRequest(conv.id, tt.cookie, tt.bearer)
+			w := httptest.NewRecorder()
+			got, ok := app.ownConversation(w, r)
+			if ok != tt.found {
+				t.Fatalf("ownConversation found %v, want %v", ok, tt.found)
+			}
+			if ok && got != conv {
+				t.Fatalf("ownConversation = %s, want %s", got.id, conv.id)
+			}
+			if !ok && w.Code != http.StatusNotFound {
+				t.Errorf("status = %d, want 404", w.Code)
+			}
+		})
+	}
+}
+
+func TestAdminConversation(t *testing.T) {
+	tests := []struct {
+		name       string
+		adminToken string
+		bearer     string
+		found      bool
+	}{
+		{name: "admin token", adminToken: "a", bearer: "a", found: true},
+		{name: "auth token", adminToken: "a", bearer: "t"},
+		{name: "no token", adminToken: "a"},
+		{name: "no admin token set", bearer: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := testApplication(config{authToken: "t", adminToken: tt.adminToken})
+			conv := app.conversations.create("user:token")
+
+			w := httptest.NewRecorder()
+			_, ok := app.adminConversation(w, testConversationRequest(conv.id, "", tt.bearer))
+			if ok != tt.found {
+				t.Fatalf("adminConversation found %v, want %v", ok, tt.found)
+			}
+			if !ok && w.Code != http.StatusNotFound {
+				t.Errorf("status = %d, want 404", w.Code)
+			}
+		})
+	}
+}
+
+func testApplication(cfg config) *application {
+	return &application{
+		logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		config:        cfg,
+		conversations: newConversationStore(time.Hour),
+		sessions:      newSessionSigner("test", time.Hour),
+	}
+}
+
+// testConversationRequest is a request for a conversation's endpoint,
+// with an owner cookie and a bearer token if they're set
+func testConversationRequest(id, cookie, bearer string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/api/conversations/"+id+"/messages", nil)
+	r.SetPathValue("conversation", id)
+	if cookie != "" {
+		r.AddCookie(&http.Cookie{Name: ownerCookie, Value: cookie})
+	}
+	if bearer != "" {
+		r.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	return r
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// usageCounter counts usage per key in fixed windows. quotas and limits
+// use it so that with -redis every instance sees the same counts
+type usageCounter interface {
+	// add adds n to the count of key, starting a window of the given
+	// length if the key has none running. it returns the new count and
+	// when the window ends. add with n = 0 reads the count
+	add(ctx context.Context, key string, n int, window time.Duration) (int, time.Time, error)
+}
+
+// memoryCounter keeps the counts in this process. windows that ran
+// out are dropped now and then as counts are added
+type memoryCounter struct {
+	mu        sync.Mutex
+	counts    map[string]*windowCount
+	lastSweep time.Time
+}
+
+// how often a memoryCounter drops the windows that ran out
+const counterSweepInterval = time.Minute
+
+type windowCount struct {
+	count   int
+	resetAt time.Time
+}
+
+func newMemoryCounter() *memoryCounter {
+	return &memoryCounter{counts: make(map[string]*windowCount)}
+}
+
+func (c *memoryCounter) add(ctx context.Context, key string, n int, window time.Duration) (int, time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastSweep) > counterSweepInterval {
+		for k, wc := range c.counts {
+			if now.After(wc.resetAt) {
+				delete(c.counts, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	wc, ok := c.counts[key]
+	if !ok || now.After(wc.resetAt) {
+		wc = &windowCount{resetAt: now.Add(window)}
+		c.counts[key] = wc
+	}
+	wc.count += n
+	return wc.count, wc.resetAt, nil
+}
+
+// redisPrefix namespaces every key this server writes to Redis
+const redisPrefix = "ollamachat:"
+
+// redisCounter shares the counts through Redis. keys expire with their
+// window so nothing needs cleaning up
+type redisCounter struct {
+	client *redis.Client
+	prefix string
+}
+
+// incrementScript adds to a counter and gives it an expiry if it's new,
+// atomically so two instances can't both start a window
+var incrementScript = redis.NewScript(`
+local count = redis.call("INCRBY", KEYS[1], ARGV[1])
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl < 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	ttl = tonumber(ARGV[2])
+end
+return {count, ttl}
+`)
+
+// newRedisClient connects to the -redis URL, nil if none is set
+func newRedisClient(rawURL string) (*redis.Client, error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -redis URL: %v", err)
+	}
+	return redis.NewClient(opts), nil
+}
+
+func (c *redisCounter) add(ctx context.Context, key string, n int, window time.Duration) (int, time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	res, err := incrementScript.Run(ctx, c.client, []string{c.prefix + key}, n, window.Milliseconds()).Int64Slice()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return int(res[0]), time.Now().Add(time.Duration(res[1]) * time.Millisecond), nil
+}
+
+// fallbackCounter uses the shared counter while it works and the local
+// one when it doesn't, so a Redis outage loosens limits to per instance
+// instead of taking the chat down
+type fallbackCounter struct {
+	shared usageCounter
+	local  *memoryCounter
+	logger *slog.Logger
+
+	mu       sync.Mutex
+	lastWarn time.Time
+}
+
+func (c *fallbackCounter) add(ctx context.Context, key string, n int, window time.Duration) (int, time.Time, error) {
+	count, resetAt, err := c.shared.add(ctx, key, n, window)
+	if err == nil {
+		return count, resetAt, nil
+	}
+
+	// one warning a minute is enough while Redis is down
+	c.mu.Lock()
+	if time.Since(c.lastWarn) > time.Minute {
+		c.lastWarn = time.Now()
+		c.logger.Warn("Shared counter unavailable, using local counts", "error", err)
+	}
+	c.mu.Unlock()
+	return c.local.add(ctx, key, n, window)
+}
+
+// newUsageCounter returns the Redis backed counter when -redis is set and
+// the in-memory one otherwise
+func newUsageCounter(client *redis.Client, logger *slog.Logger) usageCounter {
+	if client == nil {
+		return newMemoryCounter()
+	}
+	shared := &redisCounter{client: client, prefix: redisPrefix}
+	return &fallbackCounter{shared: shared, local: newMemoryCounter(), logger: logger}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// demoUser is a made up client. the addresses are from the ranges
+// reserved for documentation
+type demoUser struct {
+	ip       string
+	location string
+	units    string
+}
+
+var demoUsers = []demoUser{
+	{ip: "192.0.2.10", location: "Berlin", units: unitsMetric},
+	{ip: "192.0.2.24", location: "Denver", units: unitsImperial},
+	{ip: "198.51.100.7", location: "Lyon", units: unitsMetric},
+	{ip: "198.51.100.42", location: "Madrid", units: unitsMetric},
+	{ip: "203.0.113.5", location: "Seattle", units: unitsImperial},
+	{ip: "203.0.113.77", location: "London", units: unitsMetric},
+}
+
+// demoTurn is one question and the way it gets answered. a turn with a
+// tool gets the call, the tool's result and the answer built from it
+type demoTurn struct {
+	prompt string
+	tool   string
+	args   map[string]any
+	result string
+	answer string
+}
+
+// demoTopics are the building blocks of the seeded conversations.
+// {location} is replaced with the user's location
+var demoTopics = [][]demoTurn{
+	{
+		{prompt: "What's the weather in {location} today?", tool: "get_weather",
+			args:   map[string]any{"location": "{location}"},
+			result: `{"location":"{location}","forecast":"partly cloudy","high":18,"unit":"Celsius"}`,
+			answer: "It's partly cloudy in {location} today with a high of 18°C."},
+		{prompt: "Do I need an umbrella?",
+			answer: "Probably not, no rain is in the forecast. A light jacket should do."},
+	},
+	{
+		{prompt: "Explain how a hash map works in a few sentences",
+			answer: "A hash map stores key value pairs in an array of buckets. A hash function turns each key into a bucket index, " +
+				"so lookups, inserts and deletes take constant time on average. Keys that land in the same bucket are kept in a " +
+				"short list or probed for the next free slot, and the array is grown once it gets too full."},
+		{prompt: "And how does Go implement it?",
+			answer: "Go's map is a hash table of buckets holding eight entries each, with overflow buckets chained on. " +
+				"It grows incrementally, moving a few buckets on every write, so no single insert pays for the whole resize."},
+	},
+	{
+		{prompt: "Compare the three largest planets in a table",
+			answer: "| Planet | Diameter (km) | Moons |\n|---|---|---|\n| Jupiter | 139,820 | 95 |\n| Saturn | 116,460 | 146 |\n| Uranus | 50,724 | 28 |\n\n" +
+				"Jupiter is the largest by far, Saturn has the most known moons."},
+	},
+	{
+		{prompt: "What's the latest news about the Go release?", tool: "web_search",
+			args:   map[string]any{"query": "Go release news"},
+			result: `{"query":"Go release news","results":[{"title":"Go 1.25 is released","url":"https://go.dev/blog/go1.25","snippet":"The Go team is happy to announce Go 1.25."}]}`,
+			answer: "Go 1.25 was released recently, the announcement is on the Go blog: https://go.dev/blog/go1.25"},
+	},
+	{
+		{prompt: "Write a haiku about autumn",
+			answer: "Crisp leaves drift and fall\nthe maple lets go of red\nsmoke curls from chimneys"},
+		{prompt: "Now one about winter",
+			answer: "Snow hushes the road\nfootprints fill before morning\nthe kettle sings on"},
+	},
+	{
+		{prompt: "Is it warm enough for a swim in {location} right now?", tool: "get_weather",
+			args:   map[string]any{"location": "{location}"},
+			result: `{"location":"{location}","forecast":"sunny","high":27,"unit":"Celsius"}`,
+			answer: "It's sunny and 27°C in {location}, warm enough for a swim if the water has caught up."},
+	},
+	{
+		{prompt: "How do I reverse a slice in Go?",
+			answer: "Since Go 1.21 you can use slices.Reverse:\n\n```go\ns := []int{1, 2, 3}\nslices.Reverse(s)\n```\n\nIt reverses the slice in place."},
+	},
+}
+
+// seedDemoData fills the store with n conversations between the demo
+// users and a model, with tool calls, and backfills the usage log, so
+// the UI, stats and reports can be worked on without chatting first.
+// the same seed gives the same data
+func (app *application) seedDemoData(n int, seed uint64) []string {
+	rng := rand.New(rand.NewPCG(seed, seed))
+	now := time.Now()
+	var records []usageRecord
+	var ids []string
+
+	for range n {
+		user := demoUsers[rng.IntN(len(demoUsers))]
+		conv := newConversation()
+		conv.location = user.location
+		conv.units = user.units
+		at := now.Add(-time.Hour - time.Duration(rng.Int64N(int64(14*24*time.Hour))))
+
+		conv.add(chatMessage{Created: at, Message: api.Message{Role: "system", Content: "You are a helpful assistant."}})
+		for _, i := range rng.Perm(len(demoTopics))[:1+rng.IntN(3)] {
+			for _, turn := range demoTopics[i] {
+				at = at.Add(time.Duration(30+rng.IntN(600)) * time.Second)
+				latency := time.Duration(800+rng.IntN(6000)) * time.Millisecond
+				rec := app.seedDemoTurn(conv, turn, user, at, latency)
+				rec.PromptTokens = 40 + rng.IntN(900)
+				rec.CompletionTokens = 20 + rng.IntN(400)
+				records = append(records, rec)
+			}
+		}
+
+		app.conversations.keep(conv)
+		ids = append(ids, conv.id)
+	}
+
+	// the usage log expects records in time order
+	sort.Slice(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	for _, rec := range records {
+		app.usage.add(rec)
+	}
+	return ids
+}
+
+// seedDemoTurn adds one turn to conv as if it had been answered at at
+func (app *application) seedDemoTurn(conv *conversation, turn demoTurn, user demoUser, at time.Time, latency time.Duration) usageRecord {
+	fill := func(s string) string { return strings.ReplaceAll(s, "{location}", user.location) }
+	rec := usageRecord{Time: at.Add(latency), Client: user.ip, Model: app.config.ollamaModel, Latency: latency}
+
+	conv.add(chatMessage{Created: at, Message: api.Message{Role: "user", Content: fill(turn.prompt)}})
+	if turn.tool != "" {
+		args := make(api.ToolCallFunctionArguments)
+		for k, v := range turn.args {
+			args[k] = fill(fmt.Sprint(v))
+		}
+		conv.add(chatMessage{Created: at, Message: api.Message{
+			Role:      "assistant",
+			ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: turn.tool, Arguments: args}}},
+		}})
+		conv.add(chatMessage{Created: at, Message: api.Message{Role: "tool", Content: fill(turn.result), ToolName: turn.tool}})
+		conv.countToolCall(turn.tool)
+		rec.Tools = []string{turn.tool}
+	}
+
+	answer := fill(turn.answer)
+	conv.add(chatMessage{
+		Created: at.Add(latency),
+		Tables:  parseMarkdownTables(answer),
+		Message: api.Message{Role: "assistant", Content: answer},
+	})
+	return rec
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+)
+
+var applyDiffTool = functionTool("apply_diff",
+	"Change an existing artifact by applying a unified diff to its latest version, "+
+		"instead of creating the whole document again",
+	[]string{"name", "diff"},
+	map[string]toolProperty{
+		"name": {Type: api.PropertyType{"string"}, Description: "Name of the artifact to change"},
+		"diff": {Type: api.PropertyType{"string"}, Description: "Unified diff with @@ hunk headers, context lines and -/+ lines"},
+	})
+
+type diffHunk struct {
+	oldStart int
+	oldLines []string // context and removed lines, the text the hunk expects
+	newLines []string // context and added lines, what replaces it
+}
+
+var hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,\d+)? \+\d+(?:,\d+)? @@`)
+
+// parseUnifiedDiff reads the hunks of a unified diff. file headers are
+// skipped since the tool is only ever applied to one artifact
+func parseUnifiedDiff(diff string) ([]diffHunk, error) {
+	var hunks []diffHunk
+	var current *diffHunk
+
+	for _, line := range strings.Split(strings.TrimRight(diff, "\n"), "\n") {
+		if m := hunkHeader.FindStringSubmatch(line); m != nil {
+			start, _ := strconv.Atoi(m[1])
+			hunks = append(hunks, diffHunk{oldStart: start})
+			current = &hunks[len(hunks)-1]
+			continue
+		}
+		if current == nil {
+			// --- / +++ headers or commentary before the first hunk
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, `\`):
+			// "\ No newline at end of file"
+		case strings.HasPrefix(line, "-"):
+			current.oldLines = append(current.oldLines, line[1:])
+		case strings.HasPrefix(line, "+"):
+			current.newLines = append(current.newLines, line[1:])
+		case strings.HasPrefix(line, " "):
+			current.oldLines = append(current.oldLines, line[1:])
+			current.newLines = append(current.newLines, line[1:])
+		case line == "":
+			// some models drop the space of empty context lines
+			current.oldLines = append(current.oldLines, "")
+			current.newLines = append(current.newLines, "")
+		default:
+			return nil, fmt.Errorf("hunk %d: unexpected line %q", len(hunks), line)
+		}
+	}
+
+	if len(hunks) == 0 {
+		return nil, fmt.Errorf("no @@ hunks found in diff")
+	}
+	return hunks, nil
+}
+
+// applyUnifiedDiff applies a diff to text. line numbers in hunk headers
+// are only a hint: models often get them slightly wrong, so the expected
+// lines are searched for starting at the hinted position. a hunk whose
+// lines can't be found makes the whole diff fail
+func applyUnifiedDiff(text, diff string) (string, error) {
+	hunks, err := parseUnifiedDiff(diff)
+	if err != nil {
+		return "", err
+	}
+
+	trailingNewline := strings.HasSuffix(text, "\n")
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if text == "" {
+		lines = nil
+	}
+
+	var out []string
+	pos := 0
+	for i, h := range hunks {
+		at := findLines(lines, h.oldLines, pos, h.oldStart-1)
+		if at < 0 {
+			return "", fmt.Errorf("hunk %d: the lines it changes were not found in the artifact", i+1)
+		}
+		out = append(out, lines[pos:at]...)
+		out = append(out, h.newLines...)
+		pos = at + len(h.oldLines)
+	}
+	out = append(out, lines[pos:]...)
+
+	result := strings.Join(out, "\n")
+	if trailingNewline {
+		result += "\n"
+	}
+	return result, nil
+}
+
+// findLines looks for want in lines at or after from, checking the
+// positions closest to hint first. it returns -1 if there's no match
+func findLines(lines, want []string, from, hint int) int {
+	matches := func(at int) bool {
+		if at < from || at+len(want) > len(lines) {
+			return false
+		}
+		for i, w := range want {
+			if strings.TrimRight(lines[at+i], " \t") != strings.TrimRight(w, " \t") {
+				return false
+			}
+		}
+		return true
+	}
+
+	hint = max(hint, from)
+	for d := 0; hint-d >= from || hint+d <= len(lines); d++ {
+		if matches(hint + d) {
+			return hint + d
+		}
+		if d > 0 && matches(hint-d) {
+			return hint - d
+		}
+	}
+	return -1
+}
+
+// runApplyDiffTool applies a diff to the latest version of an artifact
+// and stores the result as a new version
+func runApplyDiffTool(ctx context.Context, args api.ToolCallFunctionArguments) string {
+	env := toolEnvFrom(ctx)
+	name := args["name"].(string)
+
+	current, ok := env.conv.artifacts.get(name, 0)
+	if !ok {
+		return toolError("artifact_not_found", fmt.Sprintf("there is no artifact named %q, create it first", name))
+	}
+
+	updated, err := applyUnifiedDiff(current.Content, args["diff"].(string))
+	if err != nil {
+		return toolError("diff_failed", err.Error()+". Check the context lines against the latest version of the artifact.")
+	}
+
+	info := env.conv.artifacts.save(name, "", updated)
+	env.turn.emitArtifact(info)
+
+	js, _ := json.Marshal(map[string]any{
+		"status":  "applied",
+		"name":    info.Name,
+		"version": info.Version,
+		"url":     info.URL,
+	})
+	return string(js)
+}
+
+// toolError formats an error result for the model
+func toolError(code, message string) string {
+	js, _ := json.Marshal(map[string]string{"error": code, "message": message})
+	return string(js)
+}
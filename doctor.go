@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// certWarnBefore is how close to expiry a certificate gets a warning
+const certWarnBefore = 14 * 24 * time.Hour
+
+// doctorCheck is the outcome of one doctor check. hint says how to fix
+// a failure or warning
+type doctorCheck struct {
+	status string
+	name   string
+	detail string
+	hint   string
+}
+
+const (
+	doctorPass = "PASS"
+	doctorWarn = "WARN"
+	doctorFail = "FAIL"
+	doctorSkip = "SKIP"
+)
+
+// runDoctorCommand checks that the server could start and work with the
+// given flags, which are the same as the server's
+func runDoctorCommand(args []string) error {
+	var cfg config
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	app := &application{config: cfg}
+	var checks []doctorCheck
+	checks = append(checks, app.checkOllama(ctx)...)
+	checks = append(checks, checkStorage(cfg)...)
+	checks = append(checks, checkCredentials(ctx, cfg)...)
+	checks = append(checks, checkCertificates(ctx, cfg)...)
+	checks = append(checks, checkPort(cfg.port))
+
+	failed := 0
+	for _, c := range checks {
+		fmt.Printf("%-4s  %s", c.status, c.name)
+		if c.detail != "" {
+			fmt.Printf(": %s", c.detail)
+		}
+		fmt.Println()
+		if c.hint != "" && (c.status == doctorFail || c.status == doctorWarn) {
+			fmt.Printf("      hint: %s\n", c.hint)
+		}
+		if c.status == doctorFail {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	fmt.Println("All checks passed")
+	return nil
+}
+
+// checkOllama checks the model server answers and has the models the
+// flags name installed
+func (app *application) checkOllama(ctx context.Context) []doctorCheck {
+	check := doctorCheck{name: "Ollama at " + app.config.ollamaURL}
+	hint := `start Ollama with "ollama serve" or point -"Ollama Server" at it`
+	if app.config.backend == backendOpenAI {
+		check.name = "OpenAI compatible API at " + app.config.openAIURL
+		hint = "check -openai-url and -openai-api-key"
+	}
+	backend, client, err := newBackend(app.config)
+	var checks []doctorCheck
+	ollama, _ := backend.(*ollamaBackend)
+	if ollama != nil && len(ollama.servers) > 1 {
+		// a box that's down is worth a warning, the others take over
+		for _, s := range ollama.servers {
+			c := doctorCheck{status: doctorPass, name: "Ollama server " + s.url}
+			if _, err := s.client.Version(ctx); err != nil {
+				c.status, c.detail = doctorWarn, err.Error()
+				c.hint = "chats go to the other servers until it's back"
+			}
+			checks = append(checks, c)
+		}
+	}
+	var list *api.ListResponse
+	switch {
+	case err != nil:
+	case ollama != nil:
+		var version string
+		version, err = ollama.Version(ctx)
+		check.detail = "version " + version
+	default:
+		// other servers have no version, listing the models shows they
+		// answer and take the key
+		list, err = backend.ListModels(ctx)
+		check.detail = "answers"
+	}
+	if err != nil {
+		check.status, check.detail = doctorFail, err.Error()
+		check.hint = hint
+		return append(checks, check, doctorCheck{status: doctorSkip, name: "Models", detail: "the model server isn't reachable"})
+	}
+	check.status = doctorPass
+	checks = append(checks, check)
+
+	if list == nil {
+		list, err = backend.ListModels(ctx)
+	}
+	if err != nil {
+		return append(checks, doctorCheck{status: doctorFail, name: "Models", detail: err.Error()})
+	}
+	installed := installedModels(list)
+
+	models := []string{app.config.ollamaModel}
+	switch {
+	case app.config.intentModel != "":
+		models = append(models, app.config.intentModel)
+	case app.config.intentClassifier == "embedding":
+		models = append(models, "nomic-embed-text")
+	}
+	if app.config.clusterInterval > 0 {
+		models = append(models, app.config.clusterModel)
+	}
+	if app.config.knowledgeGraph && app.config.graphModel != "" {
+		models = append(models, app.config.graphModel)
+	}
+	if app.config.draftModel != "" {
+		models = append(models, app.config.draftModel)
+	}
+	for _, model := range models {
+		c := doctorCheck{status: doctorPass, name: "Model " + model, detail: "installed"}
+		if !installed[model] {
+			c.status, c.detail = doctorFail, "not installed"
+			if client != nil {
+				c.hint = "ollama pull " + model
+			}
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+// checkStorage checks the files the server appends to can be written
+func checkStorage(cfg config) []doctorCheck {
+	files := []struct{ flag, path string }{
+		{"-bench-history", cfg.benchHistory},
+		{"-snippets", cfg.snippets},
+		{"-access-log", cfg.accessLog},
+		{"-event-log", cfg.eventLog},
+	}
+
+	var checks []doctorCheck
+	for _, f := range files {
+		if f.path == "" || strings.Contains(f.path, "://") {
+			continue
+		}
+		c := doctorCheck{status: doctorPass, name: "Writable " + f.path, detail: f.flag}
+		if err := checkWritable(f.path); err != nil {
+			c.status, c.detail = doctorFail, err.Error()
+			c.hint = "fix the permissions of the file and its directory or change " + f.flag
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+// checkWritable opens path for appending, removing it again if it had to
+// be created
+func checkWritable(path string) error {
+	_, err := os.Stat(path)
+	created := errors.Is(err, os.ErrNotExist)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if created {
+		os.Remove(path)
+	}
+	return nil
+}
+
+// checkCredentials makes a real call with each configured credential
+func checkCredentials(ctx context.Context, cfg config) []doctorCheck {
+	var checks []doctorCheck
+
+	weather := doctorCheck{name: "Weather provider"}
+	provider, err := newWeatherProvider(cfg.weatherProvider, cfg.weatherAPIKey)
+	if err == nil {
+		_, err = provider.current(ctx, "London")
+	}
+	switch {
+	case err != nil:
+		weather.status, weather.detail = doctorFail, err.Error()
+		weather.hint = "check -weather-provider and -weather-api-key, or use -weather-provider mock"
+	case isMockWeather(provider):
+		weather.status, weather.detail = doctorWarn, "using mock data"
+		weather.hint = "set -weather-provider open-meteo or an OpenWeatherMap key for real forecasts"
+	default:
+		weather.status, weather.detail = doctorPass, "answered a forecast for London"
+	}
+	checks = append(checks, weather)
+
+	search, err := newSearchProvider(cfg.searchProvider, cfg.searxngURL)
+	if err == nil && search != nil {
+		_, err = search.search(ctx, "ollama")
+	}
+	if err != nil || search != nil {
+		c := doctorCheck{status: doctorPass, name: "Web search", detail: "answered a search"}
+		if err != nil {
+			c.status, c.detail = doctorFail, err.Error()
+			c.hint = "check -search-provider and -searxng-url, SearxNG needs the json format enabled"
+		}
+		checks = append(checks, c)
+	}
+
+	if cfg.smtpServer != "" {
+		c := doctorCheck{status: doctorPass, name: "SMTP server " + cfg.smtpServer, detail: "accepted the connection"}
+		if err := checkSMTP(cfg); err != nil {
+			c.status, c.detail = doctorFail, err.Error()
+			c.hint = "check -smtp-server, -smtp-user and -smtp-password"
+		} else if cfg.smtpUser != "" {
+			c.detail = "signed in as " + cfg.smtpUser
+		}
+		checks = append(checks, c)
+	}
+
+	if cfg.redis != "" {
+		c := doctorCheck{status: doctorPass, name: "Redis", detail: "ping ok"}
+		rdb, err := newRedisClient(cfg.redis)
+		if err == nil {
+			err = rdb.Ping(ctx).Err()
+			rdb.Close()
+		}
+		if err != nil {
+			c.status, c.detail = doctorFail, err.Error()
+			c.hint = "check -redis, including the password and database in the URL"
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+// checkSMTP connects to -smtp-server and signs in like sendEmail would,
+// without sending anything
+func checkSMTP(cfg config) error {
+	client, err := smtp.Dial(cfg.smtpServer)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	host, _, _ := net.SplitHostPort(cfg.smtpServer)
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if cfg.smtpUser != "" {
+		if err := client.Auth(smtp.PlainAuth("", cfg.smtpUser, cfg.smtpPassword, host)); err != nil {
+			return err
+		}
+	}
+	return client.Quit()
+}
+
+func isMockWeather(p weatherProvider) bool {
+	_, ok := p.(mockWeather)
+	return ok
+}
+
+// checkCertificates checks the certificates of the https services the
+// server talks to aren't expired or about to
+func checkCertificates(ctx context.Context, cfg config) []doctorCheck {
+	endpoints := []string{cfg.ollamaURL}
+	if cfg.reportWebhook != "" {
+		endpoints = append(endpoints, cfg.reportWebhook)
+	}
+	switch provider, _ := newWeatherProvider(cfg.weatherProvider, cfg.weatherAPIKey); provider.(type) {
+	case *openMeteo:
+		endpoints = append(endpoints, openMeteoGeocodeURL, openMeteoForecastURL)
+	case *openWeatherMap:
+		endpoints = append(endpoints, openWeatherMapURL)
+	}
+	switch provider, _ := newSearchProvider(cfg.searchProvider, cfg.searxngURL); p := provider.(type) {
+	case *searxng:
+		endpoints = append(endpoints, p.baseURL)
+	case *duckDuckGo:
+		endpoints = append(endpoints, duckDuckGoURL)
+	}
+
+	var checks []doctorCheck
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Scheme != "https" {
+			continue
+		}
+		checks = append(checks, checkCertificate(ctx, u))
+	}
+	return checks
+}
+
+func checkCertificate(ctx context.Context, u *url.URL) doctorCheck {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "443")
+	}
+	c := doctorCheck{name: "Certificate of " + u.Hostname()}
+
+	dialer := &tls.Dialer{Config: &tls.Config{ServerName: u.Hostname()}}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		c.status, c.detail = doctorFail, err.Error()
+		c.hint = "the certificate must be valid for " + u.Hostname() + " and signed by a trusted CA"
+		return c
+	}
+	defer conn.Close()
+
+	expires := conn.(*tls.Conn).ConnectionState().PeerCertificates[0].NotAfter
+	left := time.Until(expires)
+	c.status = doctorPass
+	c.detail = fmt.Sprintf("expires %s (in %d days)", expires.Format(time.DateOnly), int(left.Hours()/24))
+	if left < certWarnBefore {
+		c.status = doctorWarn
+		c.hint = "renew the certificate of " + u.Hostname()
+	}
+	return c
+}
+
+// checkPort checks nothing else is listening on the server's port
+func checkPort(port int) doctorCheck {
+	c := doctorCheck{status: doctorPass, name: fmt.Sprintf("Port %d", port), detail: "free"}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		c.status, c.detail = doctorFail, err.Error()
+		c.hint = "stop the process using the port or pick another with -port"
+		return c
+	}
+	l.Close()
+	return c
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// with -draft-model a small, fast model writes a draft of the answer
+// while the main model works on the real one. the draft is streamed to
+// the client as draft messages, each with the draft so far, and the
+// answer replaces it when it arrives. drafts have no tools and aren't
+// kept in the history, they're only there so a slow model doesn't leave
+// the user looking at nothing
+
+// how often the draft so far is sent while it's written
+const draftInterval = 150 * time.Millisecond
+
+// startDraft streams a draft answer to prompt until stop is called. stop
+// waits for the draft to end, so none is sent after the answer
+func (app *application) startDraft(ctx context.Context, conv *conversation, prompt string, turn *turnInfo) (stop func()) {
+	model := app.config.draftModel
+	// the draft model may not see images, and drafting with the model
+	// that answers anyway saves nothing
+	if model == "" || len(turn.images) > 0 || model == app.conversationModel(conv) {
+		return func() {}
+	}
+
+	// the history without tool calls and results, the draft model
+	// might not handle them
+	var msgs []api.Message
+	for _, m := range conv.promptMessages() {
+		if m.Role != "tool" && m.Content != "" {
+			msgs = append(msgs, api.Message{Role: m.Role, Content: m.Content})
+		}
+	}
+	if len(msgs) == 0 {
+		msgs = append(msgs, api.Message{Role: "system", Content: app.systemPrompt(conv)})
+	}
+	msgs = app.trimHistory(conv, append(msgs, api.Message{Role: "user", Content: prompt}))
+
+	ctx, cancel := context.WithCancel(ctx)
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+
+		var draft strings.Builder
+		var sent time.Time
+		req := &api.ChatRequest{Model: model, Messages: msgs}
+		err := app.backend.Stream(ctx, req, func(resp api.ChatResponse) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			draft.WriteString(resp.Message.Content)
+			if draft.Len() > 0 && (resp.Done || time.Since(sent) >= draftInterval) {
+				sent = time.Now()
+				turn.emit(Message{
+					Type:    "draft",
+					Content: draft.String(),
+					Time:    sent.Format("15:04:05"),
+				})
+			}
+			return nil
+		})
+		if err != nil && ctx.Err() == nil {
+			app.logger.Debug("Draft failed", "model", model, "error", err)
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-finished
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxEmailBytes is the largest inbound email accepted, attachments
+// included
+const maxEmailBytes = 10 << 20
+
+// emailThreads maps the Message-IDs of a thread to its conversation, so
+// a reply from any mail client lands in the conversation it answers
+type emailThreads struct {
+	mu          sync.Mutex
+	byMessageID map[string]string
+}
+
+func newEmailThreads() *emailThreads {
+	return &emailThreads{byMessageID: make(map[string]string)}
+}
+
+// find returns the conversation of the first referenced message it knows
+func (t *emailThreads) find(ids []string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, id := range ids {
+		if conv, ok := t.byMessageID[id]; ok {
+			return conv, true
+		}
+	}
+	return "", false
+}
+
+func (t *emailThreads) add(conv string, ids ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, id := range ids {
+		if id != "" {
+			t.byMessageID[id] = conv
+		}
+	}
+}
+
+// inboundEmail is what the gateway needs from a parsed email
+type inboundEmail struct {
+	from       *mail.Address
+	subject    string
+	messageID  string
+	references []string
+	text       string
+	// set on bounces, vacation replies and other mail sent by software
+	autoSubmitted bool
+}
+
+// parseEmail reads a raw RFC 5322 message
+func parseEmail(raw io.Reader) (*inboundEmail, error) {
+	msg, err := mail.ReadMessage(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email: %v", err)
+	}
+	from, err := msg.Header.AddressList("From")
+	if err != nil || len(from) == 0 {
+		return nil, fmt.Errorf("invalid email: no From address")
+	}
+
+	e := &inboundEmail{from: from[0], messageID: msg.Header.Get("Message-ID")}
+	if auto := strings.ToLower(msg.Header.Get("Auto-Submitted")); auto != "" && auto != "no" {
+		e.autoSubmitted = true
+	}
+	dec := new(mime.WordDecoder)
+	if e.subject, err = dec.DecodeHeader(msg.Header.Get("Subject")); err != nil {
+		e.subject = msg.Header.Get("Subject")
+	}
+	// the message answered comes last in References, In-Reply-To has it
+	// on its own
+	e.references = strings.Fields(msg.Header.Get("References"))
+	if id := strings.TrimSpace(msg.Header.Get("In-Reply-To")); id != "" && !slices.Contains(e.references, id) {
+		e.references = append(e.references, id)
+	}
+
+	text, err := emailText(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email: %v", err)
+	}
+	e.text = stripQuotedReply(text)
+	return e, nil
+}
+
+// emailText returns the plain text of a body, the first text/plain part
+// of a multipart one, or the text of an HTML only one
+func emailText(contentType, encoding string, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		var html string
+		parts := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := parts.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+			text, err := emailText(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil {
+				return "", err
+			}
+			partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			switch {
+			case text == "":
+			case partType == "text/html" && html == "":
+				html = text
+			case partType != "text/html":
+				return text, nil
+			}
+		}
+		return html, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &newlineSkipper{r: body})
+	}
+	switch mediaType {
+	case "text/plain":
+		b, err := io.ReadAll(body)
+		return strings.ReplaceAll(string(b), "\r\n", "\n"), err
+	case "text/html":
+		b, err := io.ReadAll(body)
+		return htmlText(string(b)), err
+	}
+	// attachments
+	return "", nil
+}
+
+// newlineSkipper drops the line breaks base64 bodies are wrapped with
+type newlineSkipper struct {
+	r io.Reader
+}
+
+func (n *newlineSkipper) Read(p []byte) (int, error) {
+	for {
+		k, err := n.r.Read(p)
+		j := 0
+		for _, b := range p[:k] {
+			if b != '\r' && b != '\n' {
+				p[j] = b
+				j++
+			}
+		}
+		if j > 0 || err != nil {
+			return j, err
+		}
+	}
+}
+
+// stripQuotedReply drops the quoted message and signature mail clients
+// put under a reply, the conversation already has them
+func stripQuotedReply(text string) string {
+	var kept []string
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if line == "-- " || trimmed == "-----Original Message-----" ||
+			(strings.HasPrefix(trimmed, "On ") && strings.HasSuffix(trimmed, "wrote:")) {
+			break
+		}
+		if strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.TrimSpace(strings.Join(kept, "\n"))
+}
+
+// emailAllowed checks the sender against -email-allow, a list of
+// addresses and @domains. an empty list allows everyone
+func emailAllowed(allow, address string) bool {
+	if strings.TrimSpace(allow) == "" {
+		return true
+	}
+	address = strings.ToLower(address)
+	for _, entry := range strings.Split(allow, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if strings.HasPrefix(entry, "@") && strings.HasSuffix(address, entry) || entry == address {
+			return true
+		}
+	}
+	return false
+}
+
+// handleInboundEmail takes an email from a mail server or forwarding
+// service and answers it by email. the body is the raw message, or a
+// form with it in body-mime (Mailgun) or email (SendGrid)
+func (app *application) handleInboundEmail(w http.ResponseWriter, r *http.Request) {
+	if app.config.emailSecret != "" && !emailWebhookAuthorized(r, app.config.emailSecret) {
+		app.clientError(w, http.StatusUnauthorized, "invalid webhook secret")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxEmailBytes)
+
+	var raw io.Reader = r.Body
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" || mediaType == "application/x-www-form-urlencoded" {
+		if err := r.ParseMultipartForm(maxEmailBytes); err != nil && err != http.ErrNotMultipart {
+			app.clientError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		value := r.PostFormValue("body-mime")
+		if value == "" {
+			value = r.PostFormValue("email")
+		}
+		raw = strings.NewReader(value)
+	}
+
+	email, err := parseEmail(raw)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if email.autoSubmitted {
+		// answering would start a mail loop
+		app.logger.Debug("Ignoring automatic email", "from", email.from.Address)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if !emailAllowed(app.config.emailAllow, email.from.Address) {
+		app.logger.Warn("Ignoring email from a sender not in -email-allow", "from", email.from.Address)
+		app.clientError(w, http.StatusForbidden, "sender not allowed")
+		return
+	}
+	if email.text == "" && email.subject == "" {
+		app.clientError(w, http.StatusBadRequest, "the email is empty")
+		return
+	}
+
+	// answering takes longer than forwarding services wait
+	w.WriteHeader(http.StatusAccepted)
+	go app.answerEmail(email)
+}
+
+// emailWebhookAuthorized checks the -email-webhook-secret, as a bearer
+// token or the password of basic auth, which forwarding services put
+// in the webhook URL
+func emailWebhookAuthorized(r *http.Request, secret string) bool {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return equalSecret(token, secret)
+	}
+	_, password, ok := r.BasicAuth()
+	return ok && equalSecret(password, secret)
+}
+
+// answerEmail runs a turn for an email in the conversation of its thread
+// and mails the answer back
+func (app *application) answerEmail(email *inboundEmail) {
+	conv := newConversation()
+	if id, ok := app.emailThreads.find(email.references); ok {
+		if c, ok := app.conversations.get(id); ok {
+			conv = c
+		}
+	}
+	if _, ok := app.conversations.get(conv.id); !ok {
+		// threads can go quiet for days, they aren't expired
+		app.conversations.keep(conv)
+	}
+	app.emailThreads.add(conv.id, email.messageID)
+
+	prompt := email.text
+	if prompt == "" {
+		prompt = email.subject
+	}
+	sender := strings.ToLower(email.from.Address)
+	app.logger.Debug("Received email", "from", sender, "conversation", conv.id, "msg", app.loggable(conv, prompt))
+
+	if refusal := app.checkQuota(conv, sender, prompt); refusal != "" {
+		app.replyByEmail(conv, email, 0, refusal)
+		return
+	}
+
+	conv.turn.lock(func(ahead int) {
+		app.logger.Debug("Email queued", "conversation", conv.id, "ahead", ahead)
+	})
+
+	app.event(event{Type: eventMessage, Conversation: conv.id, Client: sender})
+	turn := &turnInfo{started: time.Now()}
+	ctx, done := conv.beginTurn()
+	answer, err := app.callOllama(ctx, conv, prompt, turn)
+	done()
+	app.evictHistory(conv)
+	conv.turn.unlock()
+	app.recordUsage(nil, sender, turn)
+	if err != nil {
+		app.logger.Error(fmt.Sprintf("Error calling Ollama: %v", err))
+		app.event(event{Type: eventError, Conversation: conv.id, Client: sender, Model: turn.model, Error: err.Error()})
+		app.replyByEmail(conv, email, 0, "Sorry, I'm having trouble connecting to the AI service. Please try again later.")
+		return
+	}
+
+	app.event(event{
+		Type:             eventAnswer,
+		Conversation:     conv.id,
+		Client:           sender,
+		Model:            turn.model,
+		PromptTokens:     turn.promptTokens,
+		CompletionTokens: turn.completionTokens,
+		LatencyMS:        millisSince(turn.started),
+	})
+	app.replyByEmail(conv, email, answer.ID, answer.Content)
+}
+
+// replyByEmail sends text as a reply to email, threaded under it. it
+// goes to the From address -email-allow checked, never Reply-To
+func (app *application) replyByEmail(conv *conversation, email *inboundEmail, id int, text string) {
+	from, _ := mail.ParseAddress(app.config.emailFrom)
+	_, domain, _ := strings.Cut(from.Address, "@")
+	// random, the conversation id would let anyone who sees the mail
+	// open the conversation
+	messageID := fmt.Sprintf("<%s.%d.%d@%s>", randomID(12), id, time.Now().UnixNano(), domain)
+	app.emailThreads.add(conv.id, messageID)
+
+	subject := email.subject
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+	references := email.references
+	if email.messageID != "" {
+		references = append(references, email.messageID)
+	}
+
+	var msg bytes.Buffer
+	header := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&msg, "%s: %s\r\n", name, value)
+		}
+	}
+	header("From", from.String())
+	header("To", email.from.String())
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", messageID)
+	header("In-Reply-To", email.messageID)
+	header("References", strings.Join(references, " "))
+	// keeps vacation responders from answering the answer, RFC 3834
+	header("Auto-Submitted", "auto-replied")
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	msg.WriteString("\r\n")
+	qp := quotedprintable.NewWriter(&msg)
+	qp.Write([]byte(strings.ReplaceAll(text, "\n", "\r\n")))
+	qp.Close()
+
+	if err := app.sendEmail(from.Address, email.from.Address, msg.Bytes()); err != nil {
+		app.logger.Error(fmt.Sprintf("Error sending email to %s: %v", email.from.Address, err))
+		return
+	}
+	app.logger.Debug("Sent email reply", "to", email.from.Address, "conversation", conv.id)
+}
+
+// sendEmail sends through -smtp-server, with STARTTLS when the server
+// offers it and PLAIN auth when -smtp-user is set
+func (app *application) sendEmail(from, to string, msg []byte) error {
+	var auth smtp.Auth
+	if app.config.smtpUser != "" {
+		host, _, _ := net.SplitHostPort(app.config.smtpServer)
+		auth = smtp.PlainAuth("", app.config.smtpUser, app.config.smtpPassword, host)
+	}
+	return smtp.SendMail(app.config.smtpServer, auth, from, []string{to}, msg)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// event is one line of the analytics event log. events never carry
+// message content, only what happened and how long it took
+type event struct {
+	Time             time.Time `json:"time"`
+	Type             string    `json:"type"`
+	Conversation     string    `json:"conversation,omitempty"`
+	Client           string    `json:"client,omitempty"`
+	Model            string    `json:"model,omitempty"`
+	Tool             string    `json:"tool,omitempty"`
+	PromptTokens     int       `json:"prompt_tokens,omitempty"`
+	CompletionTokens int       `json:"completion_tokens,omitempty"`
+	LatencyMS        float64   `json:"latency_ms,omitempty"`
+	Error            string    `json:"error,omitempty"`
+	// the variant kept out of how many were written, see variants.go
+	Variant  int `json:"variant,omitempty"`
+	Variants int `json:"variants,omitempty"`
+}
+
+// event types
+const (
+	eventMessage  = "message"
+	eventAnswer   = "answer"
+	eventToolCall = "tool_call"
+	eventError    = "error"
+
+	eventVariantKept = "variant_kept"
+)
+
+const (
+	// events waiting to be written, more are dropped until the writer
+	// catches up
+	eventQueueSize = 1024
+	// longest wait between dials of a socket that went away
+	maxEventRedial = time.Minute
+)
+
+// eventLog appends events as JSON lines to a file or a socket, for
+// loading into Loki, ClickHouse and the like. a nil log drops events.
+// lines are written by a goroutine of their own, so a slow or missing
+// socket never holds up a turn
+type eventLog struct {
+	target string
+	logger *slog.Logger
+	queue  chan []byte
+	// only used by write
+	w io.WriteCloser
+}
+
+// openEventLog opens target, which is a file path or a tcp://, udp://
+// or unix:// address
+func openEventLog(target string, logger *slog.Logger) (*eventLog, error) {
+	l := &eventLog{target: target, logger: logger, queue: make(chan []byte, eventQueueSize)}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	go l.write()
+	return l, nil
+}
+
+func (l *eventLog) open() error {
+	for _, scheme := range []string{"tcp", "udp", "unix"} {
+		if addr, ok := strings.CutPrefix(l.target, scheme+"://"); ok {
+			conn, err := net.DialTimeout(scheme, addr, 5*time.Second)
+			if err != nil {
+				return err
+			}
+			l.w = conn
+			return nil
+		}
+	}
+
+	f, err := os.OpenFile(l.target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	l.w = f
+	return nil
+}
+
+// emit queues e, stamping the time if it's not set
+func (l *eventLog) emit(e event) error {
+	if l == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	js, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	select {
+	case l.queue <- append(js, '\n'):
+		return nil
+	default:
+		return fmt.Errorf("event log queue full, %s event dropped", e.Type)
+	}
+}
+
+// write writes the queued lines. a socket that went away is dialled
+// again with a growing wait in between, the queue fills up meanwhile
+func (l *eventLog) write() {
+	var wait time.Duration
+	for line := range l.queue {
+		for l.w == nil {
+			if err := l.open(); err != nil {
+				wait = min(max(2*wait, time.Second), maxEventRedial)
+				l.logger.Error(fmt.Sprintf("Event log unavailable, retrying in %s: %v", wait, err))
+				time.Sleep(wait)
+				continue
+			}
+			wait = 0
+		}
+		if _, err := l.w.Write(line); err != nil {
+			l.logger.Error(fmt.Sprintf("Error writing event: %v", err))
+			l.w.Close()
+			l.w = nil
+		}
+	}
+}
+
+// event logs e to the event log, if there is one
+func (app *application) event(e event) {
+	app.metrics.observeEvent(e)
+	if err := app.events.emit(e); err != nil {
+		app.logger.Error(fmt.Sprintf("Error writing event: %v", err))
+	}
+}
+
+// millisSince returns the time since start in milliseconds, for LatencyMS
+func millisSince(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
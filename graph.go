@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+const (
+	// the store stops taking new entities beyond this, known ones are
+	// still updated
+	maxGraphEntities = 10000
+	// conversations waiting for extraction, more are dropped until the
+	// worker catches up
+	graphQueueSize = 64
+)
+
+const graphPrompt = `Extract the entities and the relations between them from the conversation below, for a knowledge graph.
+Entity types are person, project, organization, place, product, concept, event or other.
+Only use what the conversation states, don't guess. Use the full name of an entity every time.
+Answer with JSON like {"entities": [{"name": "Project Apollo", "type": "project"}], "relations": [{"from": "Alice", "relation": "leads", "to": "Project Apollo"}]}.
+Answer {"entities": [], "relations": []} if there is nothing worth keeping.`
+
+var queryKnowledgeTool = functionTool("query_knowledge",
+	"Look up what earlier conversations said about a person, project, organization or other thing, e.g. \"what do we know about project X?\"",
+	[]string{"query"},
+	map[string]toolProperty{
+		"query": {Type: api.PropertyType{"string"}, Description: "Name of the thing to look up"},
+	})
+
+type graphEntity struct {
+	Name          string    `json:"name"`
+	Type          string    `json:"type"`
+	Mentions      int       `json:"mentions"`
+	Conversations []string  `json:"conversations"`
+	FirstSeen     time.Time `json:"first_seen"`
+	LastSeen      time.Time `json:"last_seen"`
+}
+
+type graphRelation struct {
+	From          string    `json:"from"`
+	Relation      string    `json:"relation"`
+	To            string    `json:"to"`
+	Mentions      int       `json:"mentions"`
+	Conversations []string  `json:"conversations"`
+	LastSeen      time.Time `json:"last_seen"`
+}
+
+// graphExtraction is what the model answers with
+type graphExtraction struct {
+	Entities []struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	} `json:"entities"`
+	Relations []struct {
+		From     string `json:"from"`
+		Relation string `json:"relation"`
+		To       string `json:"to"`
+	} `json:"relations"`
+}
+
+// knowledgeGraph holds the entities and relations extracted from all
+// conversations, keyed by lower case name. it's kept in memory
+type knowledgeGraph struct {
+	mu        sync.RWMutex
+	entities  map[string]*graphEntity
+	relations map[string]*graphRelation
+
+	queue chan *conversation
+}
+
+func newKnowledgeGraph() *knowledgeGraph {
+	return &knowledgeGraph{
+		entities:  make(map[string]*graphEntity),
+		relations: make(map[string]*graphRelation),
+		queue:     make(chan *conversation, graphQueueSize),
+	}
+}
+
+func graphKey(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// add merges an extraction from a conversation into the graph
+func (g *knowledgeGraph) add(x graphExtraction, conv string, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, e := range x.Entities {
+		g.entity(e.Name, e.Type, conv, now, true)
+	}
+	for _, r := range x.Relations {
+		relation := strings.ToLower(strings.TrimSpace(r.Relation))
+		from, to := g.entity(r.From, "", conv, now, false), g.entity(r.To, "", conv, now, false)
+		if from == nil || to == nil || relation == "" || from == to {
+			continue
+		}
+		key := graphKey(from.Name) + "|" + relation + "|" + graphKey(to.Name)
+		rel, ok := g.relations[key]
+		if !ok {
+			rel = &graphRelation{From: from.Name, Relation: relation, To: to.Name}
+			g.relations[key] = rel
+		}
+		rel.Mentions++
+		rel.LastSeen = now
+		if !slices.Contains(rel.Conversations, conv) {
+			rel.Conversations = append(rel.Conversations, conv)
+		}
+	}
+}
+
+// entity finds or creates an entity. mention counts it as mentioned,
+// relations only create the entities they name if they're missing
+func (g *knowledgeGraph) entity(name, kind, conv string, now time.Time, mention bool) *graphEntity {
+	name = strings.Join(strings.Fields(name), " ")
+	key := graphKey(name)
+	if key == "" {
+		return nil
+	}
+	e, ok := g.entities[key]
+	if !ok {
+		if len(g.entities) >= maxGraphEntities {
+			return nil
+		}
+		e = &graphEntity{Name: name, FirstSeen: now}
+		g.entities[key] = e
+		mention = true
+	}
+	if !mention {
+		return e
+	}
+	// the first specific type given sticks
+	if e.Type == "" || e.Type == "other" {
+		e.Type = strings.ToLower(strings.TrimSpace(kind))
+	}
+	e.Mentions++
+	e.LastSeen = now
+	if !slices.Contains(e.Conversations, conv) {
+		e.Conversations = append(e.Conversations, conv)
+	}
+	return e
+}
+
+// search returns the entities whose name contains query, or all of them
+// for an empty query, the most mentioned first
+func (g *knowledgeGraph) search(query string, limit int) []graphEntity {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	query = graphKey(query)
+	found := []graphEntity{}
+	for key, e := range g.entities {
+		if strings.Contains(key, query) || (query != "" && strings.Contains(query, key) && len(key) > 3) {
+			found = append(found, *e)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		// an exact match goes first
+		if a, b := graphKey(found[i].Name) == query, graphKey(found[j].Name) == query; a != b {
+			return a
+		}
+		if found[i].Mentions != found[j].Mentions {
+			return found[i].Mentions > found[j].Mentions
+		}
+		return found[i].Name < found[j].Name
+	})
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found
+}
+
+// lookup returns the entity with the given name and its relations
+func (g *knowledgeGraph) lookup(name string) (graphEntity, []graphRelation, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	key := graphKey(name)
+	e, ok := g.entities[key]
+	if !ok {
+		return graphEntity{}, nil, false
+	}
+	relations := []graphRelation{}
+	for _, r := range g.relations {
+		if graphKey(r.From) == key || graphKey(r.To) == key {
+			relations = append(relations, *r)
+		}
+	}
+	sort.Slice(relations, func(i, j int) bool { return relations[i].Mentions > relations[j].Mentions })
+	return *e, relations, true
+}
+
+// unextracted returns the user and assistant messages the knowledge
+// graph hasn't seen yet
+func (c *conversation) unextracted() []chatMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var msgs []chatMessage
+	for _, m := range c.messages {
+		if m.ID > c.graphUpTo && (m.Role == "user" || m.Role == "assistant") && m.Content != "" {
+			msgs = append(msgs, *m)
+		}
+	}
+	return msgs
+}
+
+func (c *conversation) setGraphUpTo(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.graphUpTo = id
+}
+
+// queueGraphExtraction has the conversation's new messages extracted in
+// the background. incognito and archived conversations are left out
+func (app *application) queueGraphExtraction(conv *conversation) {
+	if app.graph == nil || conv.isIncognito() || conv.isArchived() {
+		return
+	}
+	select {
+	case app.graph.queue <- conv:
+	default:
+		app.logger.Debug("Knowledge graph queue full, extraction skipped", "conversation", conv.id)
+	}
+}
+
+// runGraphExtraction works through the queue until ctx is done
+func (app *application) runGraphExtraction(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case conv := <-app.graph.queue:
+			if err := app.extractGraph(ctx, conv); err != nil {
+				app.logger.Error(fmt.Sprintf("Error extracting knowledge graph: %v", err))
+			}
+		}
+	}
+}
+
+// extractGraph asks the model for the entities and relations in the
+// messages added since the last extraction. on failure they're tried
+// again with the next turn's messages
+func (app *application) extractGraph(ctx context.Context, conv *conversation) error {
+	msgs := conv.unextracted()
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	var transcript strings.Builder
+	for _, m := range msgs {
+		fmt.Fprintf(&transcript, "%s: %s\n", m.Role, m.Content)
+	}
+
+	model := app.config.graphModel
+	if model == "" {
+		model = app.config.ollamaModel
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+
+	var answer strings.Builder
+	err := app.backend.Stream(ctx, &api.ChatRequest{
+		Model: model,
+		Messages: []api.Message{
+			{Role: "system", Content: graphPrompt},
+			{Role: "user", Content: transcript.String()},
+		},
+		Format: json.RawMessage(`"json"`),
+		Stream: new(bool),
+	}, func(resp api.ChatResponse) error {
+		answer.WriteString(resp.Message.Content)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var x graphExtraction
+	if err := json.Unmarshal([]byte(answer.String()), &x); err != nil {
+		return fmt.Errorf("unexpected extraction answer %q", answer.String())
+	}
+	app.graph.add(x, conv.id, time.Now())
+	conv.setGraphUpTo(msgs[len(msgs)-1].ID)
+	app.logger.Debug("Extracted knowledge graph", "conversation", conv.id, "entities", len(x.Entities), "relations", len(x.Relations))
+	return nil
+}
+
+// runKnowledgeTool answers query_knowledge with the best matching
+// entities and their relations. what only archived conversations said
+// is left out
+func (app *application) runKnowledgeTool(ctx context.Context, args api.ToolCallFunctionArguments) string {
+	// the schema requires query to be a string
+	query := args["query"].(string)
+
+	type known struct {
+		Name      string   `json:"name"`
+		Type      string   `json:"type,omitempty"`
+		Mentions  int      `json:"mentions"`
+		Relations []string `json:"relations"`
+	}
+	var results []known
+	for _, e := range app.graph.search(query, 50) {
+		if len(results) == 5 {
+			break
+		}
+		if !app.remembered(e.Conversations) {
+			continue
+		}
+		_, relations, _ := app.graph.lookup(e.Name)
+		k := known{Name: e.Name, Type: e.Type, Mentions: e.Mentions, Relations: []string{}}
+		for _, r := range relations {
+			if len(k.Relations) == 20 {
+				break
+			}
+			if app.remembered(r.Conversations) {
+				k.Relations = append(k.Relations, r.From+" "+r.Relation+" "+r.To)
+			}
+		}
+		results = append(results, k)
+	}
+
+	result := map[string]any{"query": query, "entities": results}
+	if len(results) == 0 {
+		result["entities"] = []known{}
+		result["note"] = "Nothing is known about this from earlier conversations"
+	}
+	js, _ := json.Marshal(result)
+	return string(js)
+}
+
+// lists entities, the most mentioned first. q filters by name
+func (app *application) handleListEntities(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			app.clientError(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		limit = min(n, 1000)
+	}
+	app.writeJSON(w, http.StatusOK, map[string]any{"entities": app.graph.search(r.URL.Query().Get("q"), limit)})
+}
+
+// shows one entity with its relations
+func (app *application) handleGetEntity(w http.ResponseWriter, r *http.Request) {
+	e, relations, ok := app.graph.lookup(r.PathValue("name"))
+	if !ok {
+		app.clientError(w, http.StatusNotFound, "entity not found")
+		return
+	}
+	app.writeJSON(w, http.StatusOK, map[string]any{"entity": e, "relations": relations})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// how long /readyz waits for Ollama before calling it unreachable
+const readinessTimeout = 5 * time.Second
+
+// reports the process is up, for liveness probes. it doesn't look at
+// Ollama, a restart wouldn't bring that back
+func (app *application) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	app.writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// reports whether the server can answer, for readiness probes and load
+// balancers: Ollama has to be reachable and have the -model installed.
+// 503 otherwise
+func (app *application) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	version, err := app.checkReady(ctx)
+	if err != nil {
+		app.logger.Debug("Not ready", "error", err)
+		app.writeJSON(w, http.StatusServiceUnavailable, map[string]string{
+			"status": "unavailable",
+			"error":  err.Error(),
+		})
+		return
+	}
+	app.writeJSON(w, http.StatusOK, map[string]string{
+		"status": "ready",
+		"ollama": version,
+		"model":  app.config.ollamaModel,
+	})
+}
+
+// checkReady returns the Ollama version if Ollama answers and has the
+// configured model. other backends have no version, it's empty
+func (app *application) checkReady(ctx context.Context) (string, error) {
+	var version string
+	if ollama, ok := app.backend.(*ollamaBackend); ok {
+		var err error
+		version, err = ollama.Version(ctx)
+		if err != nil {
+			return "", fmt.Errorf("ollama unreachable: %v", err)
+		}
+	}
+	list, err := app.backend.ListModels(ctx)
+	if err != nil {
+		return "", fmt.Errorf("listing models: %v", err)
+	}
+	if !installedModels(list)[app.config.ollamaModel] {
+		return "", fmt.Errorf("model %s is not installed", app.config.ollamaModel)
+	}
+	return version, nil
+}
+
+// installedModels returns the names of the models in list, with and
+// without the :latest tag
+func installedModels(list *api.ListResponse) map[string]bool {
+	installed := make(map[string]bool)
+	for _, m := range list.Models {
+		installed[m.Name] = true
+		installed[strings.TrimSuffix(m.Name, ":latest")] = true
+	}
+	return installed
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// newOllamaClient builds the Ollama API client for server. it's made
+// once at startup and shared, api.Client is safe for concurrent use and
+// the transport keeps connections to Ollama open between requests
+func newOllamaClient(server string) (*api.Client, error) {
+	ollamaURLParsed, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Ollama URL: %v", err)
+	}
+	return api.NewClient(ollamaURLParsed, modelServerClient()), nil
+}
+
+// modelServerClient is the HTTP client for a model server
+func modelServerClient() *http.Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: 10 * time.Second,
+		// a connection per turn that can run at the same time, the model
+		// server is usually the only host
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 32,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	// no overall timeout, an answer streams for as long as the model
+	// writes and loading a model can take minutes. requests end with
+	// their context
+	return &http.Client{Transport: transport}
+}
+
+// writeJSON sends data to the client as a JSON document
+func (app *application) writeJSON(w http.ResponseWriter, status int, data any) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+	w.Write([]byte("\n"))
+}
+
+// readJSON decodes a request body into dst, rejecting unknown fields
+// so typos in admin requests don't silently do nothing
+func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+	return app.readJSONLimit(w, r, dst, 1<<20)
+}
+
+// readJSONLimit is readJSON for bodies that may be larger than 1MB
+func (app *application) readJSONLimit(w http.ResponseWriter, r *http.Request, dst any, limit int64) error {
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return fmt.Errorf("invalid request body: %v", err)
+	}
+	return nil
+}
+
+// serverError logs the error and sends a generic 500 to the client
+func (app *application) serverError(w http.ResponseWriter, err error) {
+	app.logger.Error(err.Error())
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+// clientError sends a JSON error with the given status code
+func (app *application) clientError(w http.ResponseWriter, status int, msg string) {
+	app.writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// heuristicRule attaches tools to a turn when the prompt contains a
+// keyword or matches a regex. a rule without tools attaches the weather
+// tool, which is what every keyword used to do. a rule with a language
+// only applies to prompts detected as that language
+type heuristicRule struct {
+	Keyword  string   `json:"keyword,omitempty"`
+	Regex    string   `json:"regex,omitempty"`
+	Tools    []string `json:"tools,omitempty"`
+	Language string   `json:"language,omitempty"`
+}
+
+type heuristicsConfig struct {
+	Rules []heuristicRule `json:"rules"`
+	// tool descriptions by language and tool name, sent instead of the
+	// English ones so small models match them to the prompt
+	Descriptions map[string]map[string]string `json:"descriptions,omitempty"`
+}
+
+// defaultHeuristics are used when no heuristics file is given
+var defaultHeuristics = heuristicsConfig{Rules: []heuristicRule{
+	{Keyword: "current weather"}, {Keyword: "weather today"}, {Keyword: "weather now"}, {Keyword: "weather in"},
+	{Keyword: "today's weather"}, {Keyword: "what's the weather"}, {Keyword: "how's the weather"},
+	{Keyword: "temperature in"}, {Keyword: "temperature at"}, {Keyword: "temp in"},
+	{Keyword: "current news", Tools: []string{"web_search"}}, {Keyword: "latest news", Tools: []string{"web_search"}},
+	{Keyword: "today's news", Tools: []string{"web_search"}},
+	{Keyword: "current time", Tools: []string{"get_time"}}, {Keyword: "what time is it", Tools: []string{"get_time"}},
+	{Keyword: "current date", Tools: []string{"get_time"}}, {Keyword: "what date is it", Tools: []string{"get_time"}},
+	{Keyword: "remind me", Tools: []string{"set_reminder"}}, {Keyword: "reminder", Tools: []string{"set_reminder", "list_reminders"}},
+	{Keyword: "stock price", Tools: []string{"web_search"}}, {Keyword: "current stock", Tools: []string{"web_search"}},
+	{Keyword: "live"}, {Keyword: "now"}, {Keyword: "currently"}, {Keyword: "today"},
+	{Keyword: "real-time"}, {Keyword: "up-to-date"},
+
+	{Keyword: "wetter", Language: "de"}, {Keyword: "temperatur", Language: "de"},
+	{Keyword: "wie spät", Language: "de", Tools: []string{"get_time"}}, {Keyword: "heute", Language: "de"},
+	{Keyword: "erinnere mich", Language: "de", Tools: []string{"set_reminder"}}, {Keyword: "jetzt", Language: "de"}, {Keyword: "aktuell", Language: "de"},
+
+	{Keyword: "el tiempo", Language: "es"}, {Keyword: "clima", Language: "es"},
+	{Keyword: "temperatura", Language: "es"}, {Keyword: "qué hora", Language: "es", Tools: []string{"get_time"}},
+	{Keyword: "recuérdame", Language: "es", Tools: []string{"set_reminder"}}, {Keyword: "hoy", Language: "es"}, {Keyword: "ahora", Language: "es"},
+
+	{Keyword: "météo", Language: "fr"}, {Keyword: "quel temps", Language: "fr"},
+	{Keyword: "température", Language: "fr"}, {Keyword: "quelle heure", Language: "fr", Tools: []string{"get_time"}},
+	{Keyword: "rappelle-moi", Language: "fr", Tools: []string{"set_reminder"}}, {Keyword: "aujourd'hui", Language: "fr"}, {Keyword: "maintenant", Language: "fr"},
+}, Descriptions: map[string]map[string]string{
+	"de": {"get_weather": "Ruft das aktuelle Wetter für einen Ort ab", "get_time": "Gibt das aktuelle Datum und die Uhrzeit in einer Zeitzone zurück"},
+	"es": {"get_weather": "Obtiene el tiempo actual de un lugar", "get_time": "Obtiene la fecha y la hora actuales en una zona horaria"},
+	"fr": {"get_weather": "Donne la météo actuelle d'un lieu", "get_time": "Donne la date et l'heure actuelles dans un fuseau horaire"},
+}}
+
+type compiledRule struct {
+	keyword  string
+	regex    *regexp.Regexp
+	tools    api.Tools
+	language string
+}
+
+// heuristics decides which tools a prompt needs from keyword rules.
+// the rules can come from a file which is reloaded when it changes
+type heuristics struct {
+	tools        *toolRegistry
+	mu           sync.RWMutex
+	rules        []compiledRule
+	descriptions map[string]map[string]string
+	path         string
+	modTime      time.Time
+}
+
+func newHeuristics(path string, tools *toolRegistry) (*heuristics, error) {
+	h := &heuristics{path: path, tools: tools}
+	if path == "" {
+		// default rules for web_search fall back to the weather tool
+		// when search is off, like every rule did before it existed.
+		// rules for other tools that are off are dropped
+		defaults := defaultHeuristics
+		defaults.Rules = nil
+		for _, r := range defaultHeuristics.Rules {
+			named := r.Tools
+			r.Tools = tools.registered(r.Tools)
+			if len(named) > 0 && len(r.Tools) == 0 && !slices.Contains(named, "web_search") {
+				continue
+			}
+			defaults.Rules = append(defaults.Rules, r)
+		}
+		rules, err := compileHeuristics(defaults, tools)
+		if err != nil {
+			return nil, err
+		}
+		h.rules = rules
+		h.descriptions = defaultHeuristics.Descriptions
+		return h, nil
+	}
+	if _, err := h.reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func compileHeuristics(cfg heuristicsConfig, registry *toolRegistry) ([]compiledRule, error) {
+	var rules []compiledRule
+	for _, r := range cfg.Rules {
+		rule := compiledRule{keyword: strings.ToLower(r.Keyword), language: r.Language}
+		switch {
+		case r.Regex != "":
+			re, err := regexp.Compile("(?i)" + r.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid heuristic regex %q: %v", r.Regex, err)
+			}
+			rule.regex = re
+		case r.Keyword == "":
+			return nil, fmt.Errorf("heuristic rule needs a keyword or a regex")
+		}
+
+		names := r.Tools
+		if len(names) == 0 {
+			names = []string{"get_weather"}
+		}
+		for _, name := range names {
+			tool, ok := registry.schema(name)
+			if !ok {
+				return nil, fmt.Errorf("heuristic rule names unknown tool %q", name)
+			}
+			rule.tools = append(rule.tools, tool)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func findTool(tools api.Tools, name string) (api.Tool, bool) {
+	for _, t := range tools {
+		if t.Function.Name == name {
+			return t, true
+		}
+	}
+	return api.Tool{}, false
+}
+
+// reload reads the file again if it changed. a broken file leaves the
+// current rules in place and is reported once, not on every check
+func (h *heuristics) reload() (bool, error) {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return false, err
+	}
+
+	h.mu.Lock()
+	unchanged := info.ModTime().Equal(h.modTime)
+	h.modTime = info.ModTime()
+	h.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		return false, err
+	}
+	var cfg heuristicsConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return false, fmt.Errorf("invalid heuristics file: %v", err)
+	}
+	rules, err := compileHeuristics(cfg, h.tools)
+	if err != nil {
+		return false, err
+	}
+
+	h.mu.Lock()
+	h.rules = rules
+	h.descriptions = cfg.Descriptions
+	h.mu.Unlock()
+	return true, nil
+}
+
+// watch checks the heuristics file for changes until ctx is done
+func (app *application) watchHeuristics(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := app.heuristics.reload()
+			if err != nil {
+				app.logger.Error(fmt.Sprintf("Error reloading heuristics: %v", err))
+				continue
+			}
+			if changed {
+				app.logger.Info("Reloaded heuristics", "path", app.heuristics.path)
+			}
+		}
+	}
+}
+
+// match returns the tools the prompt needs, nil if it needs none. lang is
+// the detected language of the prompt, "" if unknown
+func (h *heuristics) match(prompt, lang string) api.Tools {
+	promptLower := strings.ToLower(prompt)
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var tools api.Tools
+	seen := map[string]bool{}
+	for _, r := range h.rules {
+		if r.language != "" && r.language != lang {
+			continue
+		}
+		if r.regex != nil && !r.regex.MatchString(prompt) {
+			continue
+		}
+		if r.regex == nil && !strings.Contains(promptLower, r.keyword) {
+			continue
+		}
+		for _, t := range r.tools {
+			if !seen[t.Function.Name] {
+				seen[t.Function.Name] = true
+				tools = append(tools, t)
+			}
+		}
+	}
+	return tools
+}
+
+// localize swaps in the tool descriptions for lang where there are any
+func (h *heuristics) localize(tools api.Tools, lang string) api.Tools {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	descriptions := h.descriptions[lang]
+	if len(descriptions) == 0 {
+		return tools
+	}
+
+	localized := make(api.Tools, len(tools))
+	for i, t := range tools {
+		if d, ok := descriptions[t.Function.Name]; ok {
+			t.Function.Description = d
+		}
+		localized[i] = t
+	}
+	return localized
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"github.com/ollama/ollama/api"
+)
+
+// how the history is cut down before it's sent to the model
+const (
+	historyAll    = "all"
+	historyWindow = "window"
+	historyTokens = "tokens"
+)
+
+// calibrate learns how many tokens a character of this conversation is
+// worth from the prompt size Ollama reported for a request. the largest
+// ratio seen is kept, since a cached prompt prefix makes Ollama report
+// fewer tokens than were sent
+func (c *conversation) calibrate(msgs []api.Message, promptTokens int) {
+	chars := 0
+	for _, m := range msgs {
+		chars += len(m.Content)
+	}
+	if chars == 0 || promptTokens <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokensPerChar = max(c.tokensPerChar, float64(promptTokens)/float64(chars))
+}
+
+// estimateMessageTokens estimates the prompt size of msgs, using the
+// calibrated ratio once the model has answered at least once
+func (c *conversation) estimateMessageTokens(msgs []api.Message) int {
+	c.mu.Lock()
+	ratio := c.tokensPerChar
+	c.mu.Unlock()
+
+	n := 0
+	for _, m := range msgs {
+		if ratio > 0 {
+			// a few tokens per message for the role markers
+			n += int(float64(len(m.Content))*ratio) + 4
+		} else {
+			n += estimateTokens(m.Content) + 4
+		}
+	}
+	return n
+}
+
+// trimHistory drops the oldest messages that don't fit the -history
+// limits, with the summary strategy the summary keeps the prompt small
+// instead, see summary.go. system messages and the current turn, from
+// the latest user message on, are always kept, and a tool result is
+// never kept without the call it answers
+func (app *application) trimHistory(conv *conversation, msgs []api.Message) []api.Message {
+	if app.config.historyStrategy == historyAll || app.config.historyStrategy == historySummary {
+		return msgs
+	}
+
+	var system, older []api.Message
+	current := len(msgs)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Role == "user" {
+			current = i
+			break
+		}
+	}
+	for _, m := range msgs[:current] {
+		if m.Role == "system" {
+			system = append(system, m)
+		} else {
+			older = append(older, m)
+		}
+	}
+	turn := msgs[current:]
+
+	switch app.config.historyStrategy {
+	case historyWindow:
+		if len(older) > app.config.historyMessages {
+			older = older[len(older)-app.config.historyMessages:]
+		}
+	case historyTokens:
+		budget := app.config.historyTokens - conv.estimateMessageTokens(system) - conv.estimateMessageTokens(turn)
+		for len(older) > 0 && conv.estimateMessageTokens(older) > budget {
+			older = older[1:]
+		}
+	}
+
+	// drop results whose call was trimmed away
+	for len(older) > 0 && older[0].Role == "tool" {
+		older = older[1:]
+	}
+
+	if dropped := len(msgs) - len(system) - len(older) - len(turn); dropped > 0 {
+		app.logger.Debug("Trimmed history", "conversation", conv.id, "dropped", dropped)
+	}
+
+	trimmed := make([]api.Message, 0, len(system)+len(older)+len(turn))
+	trimmed = append(trimmed, system...)
+	trimmed = append(trimmed, older...)
+	return append(trimmed, turn...)
+}
+
+// evictTurns drops the oldest turns of the stored history until at most
+// max messages besides system messages are left. turns go whole so a
+// tool result never loses its call, and the latest turn is always kept.
+// the summary, if there is one, still covers what was dropped. it
+// returns how many messages were dropped
+func (c *conversation) evictTurns(max int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	system, turns := mergeTurns(c.messages)
+	kept := len(c.messages) - len(system)
+	dropped := make(map[*chatMessage]bool)
+	for len(turns) > 1 && kept > max {
+		for _, m := range turns[0] {
+			dropped[m] = true
+		}
+		kept -= len(turns[0])
+		turns = turns[1:]
+	}
+	if len(dropped) == 0 {
+		return 0
+	}
+
+	msgs := make([]*chatMessage, 0, len(c.messages)-len(dropped))
+	for _, m := range c.messages {
+		if !dropped[m] {
+			msgs = append(msgs, m)
+		}
+	}
+	c.messages = msgs
+	c.version++
+	return len(dropped)
+}
+
+// evictHistory applies -max-history-messages to conv
+func (app *application) evictHistory(conv *conversation) {
+	if app.config.maxHistoryMessages <= 0 {
+		return
+	}
+	if n := conv.evictTurns(app.config.maxHistoryMessages); n > 0 {
+		app.logger.Debug("Evicted old turns", "conversation", conv.id, "messages", n)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+)
+
+// image formats vision models accept
+var imageTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/webp": true,
+	"image/gif":  true,
+}
+
+// maxImages is how many images one message may carry
+const maxImages = 4
+
+// maxMessageBytes is the largest message a client may send: the images
+// base64 encoded, a third larger than they are, and room for the text
+func (app *application) maxMessageBytes() int64 {
+	return int64(maxImages)*int64(app.config.maxImageBytes)*4/3 + 1<<20
+}
+
+// decodeImages checks the base64 images attached to a message, plain or
+// as data: URLs, and returns them decoded for Ollama
+func (app *application) decodeImages(encoded []string) ([]api.ImageData, error) {
+	if len(encoded) > maxImages {
+		return nil, fmt.Errorf("at most %d images can be attached to a message", maxImages)
+	}
+
+	images := make([]api.ImageData, 0, len(encoded))
+	for i, s := range encoded {
+		// data:image/png;base64,....
+		if strings.HasPrefix(s, "data:") {
+			_, data, ok := strings.Cut(s, ",")
+			if !ok {
+				return nil, fmt.Errorf("image %d is not a valid data URL", i+1)
+			}
+			s = data
+		}
+		if base64.StdEncoding.DecodedLen(len(s)) > app.config.maxImageBytes+3 {
+			return nil, fmt.Errorf("image %d is larger than %s", i+1, formatBytes(int64(app.config.maxImageBytes)))
+		}
+
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("image %d is not valid base64", i+1)
+		}
+		if len(data) > app.config.maxImageBytes {
+			return nil, fmt.Errorf("image %d is larger than %s", i+1, formatBytes(int64(app.config.maxImageBytes)))
+		}
+		// the content is checked, whatever the client claims it is
+		if kind := http.DetectContentType(data); !imageTypes[kind] {
+			return nil, fmt.Errorf("image %d is not a PNG, JPEG, WebP or GIF image", i+1)
+		}
+		images = append(images, api.ImageData(data))
+	}
+	return images, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"time"
+)
+
+// incognitoPlaceholder is logged instead of message content while a
+// conversation is incognito. quotas and usage records still apply since
+// those don't hold any content, see app.loggable
+const incognitoPlaceholder = "[incognito]"
+
+func (c *conversation) setIncognito(on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.incognito = on
+}
+
+func (c *conversation) isIncognito() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.incognito
+}
+
+// handleIncognitoMessage turns incognito mode on or off for the
+// conversation, content is "on" or "off"
+func (app *application) handleIncognitoMessage(client *wsClient, conv *conversation, content string) {
+	on := content == "on"
+	conv.setIncognito(on)
+	app.logger.Info("Incognito mode changed", "on", on)
+
+	notice := "Incognito is off, messages may appear in server logs again."
+	if on {
+		notice = "Incognito is on, messages are kept out of server logs."
+	}
+	client.send(Message{
+		Type:    "notice",
+		Content: notice,
+		Time:    time.Now().Format("15:04:05"),
+	})
+}
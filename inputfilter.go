@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// input filters clean up what users write before it's shown to the
+// others in a conversation, its watchers and the other sockets on it,
+// and before the model sees it. the -input-filters file sets the
+// default, admins can give a conversation its own, e.g.
+//
+//	{
+//	  "profanity": ["darn", "heck"],
+//	  "links": "allow",
+//	  "allowed_domains": ["example.com"]
+//	}
+type inputFilterConfig struct {
+	// words masked with asterisks, matched whole and ignoring case
+	Profanity []string `json:"profanity,omitempty"`
+	// what happens to links: keep (the default), strip, or allow only
+	// those to allowed_domains and their subdomains
+	Links          string   `json:"links,omitempty"`
+	AllowedDomains []string `json:"allowed_domains,omitempty"`
+}
+
+const (
+	linksKeep  = "keep"
+	linksStrip = "strip"
+	linksAllow = "allow"
+)
+
+const linkRemoved = "[link removed]"
+
+var linkRe = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+
+// inputFilter is a compiled inputFilterConfig
+type inputFilter struct {
+	config    inputFilterConfig
+	profanity *regexp.Regexp
+}
+
+func newInputFilter(cfg inputFilterConfig) (*inputFilter, error) {
+	switch cfg.Links {
+	case "":
+		cfg.Links = linksKeep
+	case linksKeep, linksStrip, linksAllow:
+	default:
+		return nil, fmt.Errorf("links must be keep, strip or allow, not %q", cfg.Links)
+	}
+	for i, domain := range cfg.AllowedDomains {
+		cfg.AllowedDomains[i] = strings.ToLower(strings.TrimPrefix(domain, "."))
+	}
+
+	f := &inputFilter{config: cfg}
+	var words []string
+	for _, w := range cfg.Profanity {
+		if w = strings.TrimSpace(w); w != "" {
+			words = append(words, regexp.QuoteMeta(w))
+		}
+	}
+	if len(words) > 0 {
+		f.profanity = regexp.MustCompile(`(?i)\b(?:` + strings.Join(words, "|") + `)\b`)
+	}
+	return f, nil
+}
+
+// loadInputFilter reads the -input-filters file
+func loadInputFilter(path string) (*inputFilter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg inputFilterConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid input filter config: %v", err)
+	}
+	return newInputFilter(cfg)
+}
+
+// apply returns content with profanity masked and links handled
+func (f *inputFilter) apply(content string) string {
+	if f.profanity != nil {
+		content = f.profanity.ReplaceAllStringFunc(content, func(word string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(word))
+		})
+	}
+	switch f.config.Links {
+	case linksStrip:
+		content = linkRe.ReplaceAllString(content, linkRemoved)
+	case linksAllow:
+		content = linkRe.ReplaceAllStringFunc(content, func(link string) string {
+			if f.allowed(link) {
+				return link
+			}
+			return linkRemoved
+		})
+	}
+	return content
+}
+
+// allowed reports whether link goes to one of the allowed domains
+func (f *inputFilter) allowed(link string) bool {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range f.config.AllowedDomains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *conversation) setInputFilter(f *inputFilter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inputFilter = f
+}
+
+// filterInput applies the conversation's input filter, or the
+// -input-filters default, to what a user wrote
+func (app *application) filterInput(conv *conversation, content string) string {
+	conv.mu.Lock()
+	f := conv.inputFilter
+	conv.mu.Unlock()
+	if f == nil {
+		f = app.inputFilter
+	}
+	if f == nil {
+		return content
+	}
+	return f.apply(content)
+}
+
+// returns the input filter of a conversation, its own or the default
+func (app *application) handleAdminGetInputFilter(w http.ResponseWriter, r *http.Request) {
+	conv, ok := app.adminConversation(w, r)
+	if !ok {
+		return
+	}
+	conv.mu.Lock()
+	f := conv.inputFilter
+	conv.mu.Unlock()
+
+	own := f != nil
+	if !own {
+		f = app.inputFilter
+	}
+	var cfg inputFilterConfig
+	if f != nil {
+		cfg = f.config
+	}
+	app.writeJSON(w, http.StatusOK, map[string]any{"filter": cfg, "default": !own})
+}
+
+// gives a conversation its own input filter
+func (app *application) handleAdminPutInputFilter(w http.ResponseWriter, r *http.Request) {
+	conv, ok := app.adminConversation(w, r)
+	if !ok {
+		return
+	}
+	var cfg inputFilterConfig
+	if err := app.readJSON(w, r, &cfg); err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	f, err := newInputFilter(cfg)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	app.audit(r, "conversation.input_filter", "conversation", conv.id)
+	conv.setInputFilter(f)
+	app.writeJSON(w, http.StatusOK, map[string]any{"filter": f.config, "default": false})
+}
+
+// goes back to the -input-filters default
+func (app *application) handleAdminDeleteInputFilter(w http.ResponseWriter, r *http.Request) {
+	conv, ok := app.adminConversation(w, r)
+	if !ok {
+		return
+	}
+	app.audit(r, "conversation.input_filter", "conversation", conv.id, "filter", "default")
+	conv.setInputFilter(nil)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ollama/ollama/api"
+)
+
+// intent is what a classifier thinks the user wants from a turn
+type intent struct {
+	Name       string
+	Confidence float64
+	// tools the classifier picked itself, nil to use the route's tools
+	Tools api.Tools
+}
+
+// intentClassifier decides the intent of a prompt. the intent picks the
+// tools, model and persona of the turn through its route
+type intentClassifier interface {
+	name() string
+	classify(ctx context.Context, prompt, lang string) (intent, error)
+}
+
+const (
+	intentCurrentInfo = "current_info"
+	intentChat        = "chat"
+	intentReminder    = "reminder"
+)
+
+// intentRoute is what an intent changes about a turn. examples and the
+// description are what the embedding and llm classifiers compare against
+type intentRoute struct {
+	Description string   `json:"description,omitempty"`
+	Examples    []string `json:"examples,omitempty"`
+	Tools       []string `json:"tools,omitempty"`
+	Model       string   `json:"model,omitempty"`
+	Persona     string   `json:"persona,omitempty"`
+	// asked when the classifier isn't confident about this intent
+	Clarify string `json:"clarify,omitempty"`
+
+	tools api.Tools
+}
+
+var defaultIntentRoutes = map[string]intentRoute{
+	intentCurrentInfo: {
+		Description: "needs live information such as the weather, the time or the news",
+		Examples: []string{
+			"what's the weather in Paris",
+			"will it rain tomorrow",
+			"how warm is it outside right now",
+			"what time is it in Tokyo",
+			"latest news today",
+		},
+		Tools:   []string{"get_weather", "get_time", "web_search"},
+		Clarify: "Should I look up live information for this, like the current weather? If so, for which place?",
+	},
+	intentReminder: {
+		Description: "wants to be reminded of something later or asks about their reminders",
+		Examples: []string{
+			"remind me in 20 minutes to take the pizza out",
+			"remind me at 5pm to call mum",
+			"set a reminder for tomorrow at 9",
+			"what reminders do I have",
+		},
+		Tools: []string{"set_reminder", "list_reminders"},
+	},
+	intentChat: {
+		Description: "anything that can be answered from general knowledge",
+		Examples: []string{
+			"tell me a joke",
+			"explain how recursion works",
+			"write a short poem about the sea",
+			"what is the capital of France",
+			"help me fix this code",
+		},
+	},
+}
+
+// loadIntentRoutes reads routes from a JSON file keyed by intent name,
+// the defaults are used without a file
+func loadIntentRoutes(path string, registry *toolRegistry) (map[string]intentRoute, error) {
+	routes := defaultIntentRoutes
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		routes = nil
+		if err := json.Unmarshal(data, &routes); err != nil {
+			return nil, fmt.Errorf("invalid intent routes: %v", err)
+		}
+		if _, ok := routes[intentChat]; !ok {
+			return nil, fmt.Errorf("intent routes need a %q intent", intentChat)
+		}
+	}
+
+	resolved := make(map[string]intentRoute, len(routes))
+	for name, route := range routes {
+		// the defaults name optional tools like web_search, a file has
+		// to name registered ones
+		if path == "" {
+			route.Tools = registry.registered(route.Tools)
+		}
+		route.tools = nil
+		for _, t := range route.Tools {
+			tool, ok := registry.schema(t)
+			if !ok {
+				return nil, fmt.Errorf("intent %q names unknown tool %q", name, t)
+			}
+			route.tools = append(route.tools, tool)
+		}
+		resolved[name] = route
+	}
+	return resolved, nil
+}
+
+// newIntentClassifier returns the classifier selected by -intent-classifier
+func (app *application) newIntentClassifier(kind string) (intentClassifier, error) {
+	switch kind {
+	case "", "keyword":
+		return &keywordClassifier{heuristics: app.heuristics}, nil
+	case "embedding":
+		model := app.config.intentModel
+		if model == "" {
+			model = "nomic-embed-text"
+		}
+		return &embeddingClassifier{app: app, model: model}, nil
+	case "llm":
+		model := app.config.intentModel
+		if model == "" {
+			model = app.config.ollamaModel
+		}
+		return &llmClassifier{app: app, model: model}, nil
+	default:
+		return nil, fmt.Errorf("unknown intent classifier %q, use keyword, embedding or llm", kind)
+	}
+}
+
+// classifyIntent runs the configured classifier, falling back to the
+// keyword rules if it fails. every decision is logged so the rules,
+// examples and thresholds can be tuned from the logs
+func (app *application) classifyIntent(ctx context.Context, conv *conversation, prompt, lang string) (intent, intentRoute) {
+	classifier := app.classifier
+	decision, err := classifier.classify(ctx, prompt, lang)
+	if err != nil {
+		app.logger.Error(fmt.Sprintf("Error classifying intent with %s: %v", classifier.name(), err))
+		classifier = &keywordClassifier{heuristics: app.heuristics}
+		decision, _ = classifier.classify(ctx, prompt, lang)
+	}
+
+	route, ok := app.intentRoutes[decision.Name]
+	if !ok {
+		decision.Name = intentChat
+		route = app.intentRoutes[intentChat]
+	}
+	if decision.Tools == nil {
+		decision.Tools = route.tools
+	}
+
+	app.logger.Info("Intent",
+		"classifier", classifier.name(),
+		"intent", decision.Name,
+		"confidence", math.Round(decision.Confidence*100)/100,
+		"tools", len(decision.Tools),
+		"prompt", app.loggable(conv, prompt),
+	)
+	return decision, route
+}
+
+// keywordClassifier is the heuristics file wrapped as a classifier.
+// keyword hits are fairly reliable, their absence much less so
+type keywordClassifier struct {
+	heuristics *heuristics
+}
+
+func (c *keywordClassifier) name() string { return "keyword" }
+
+func (c *keywordClassifier) classify(ctx context.Context, prompt, lang string) (intent, error) {
+	if tools := c.heuristics.match(prompt, lang); len(tools) > 0 {
+		return intent{Name: intentCurrentInfo, Confidence: 0.9, Tools: tools}, nil
+	}
+	return intent{Name: intentChat, Confidence: 0.6}, nil
+}
+
+// embeddingClassifier picks the intent whose examples are most similar
+// to the prompt. the examples are embedded once, on first use
+type embeddingClassifier struct {
+	app   *application
+	model string
+
+	mu       sync.Mutex
+	examples map[string][][]float32
+}
+
+func (c *embeddingClassifier) name() string { return "embedding" }
+
+func (c *embeddingClassifier) embed(ctx context.Context, input []string) ([][]float32, error) {
+	client := c.app.backend
+	resp, err := client.Embed(ctx, &api.EmbedRequest{Model: c.model, Input: input})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Embeddings) != len(input) {
+		return nil, errors.New("embedding count doesn't match the input")
+	}
+	return resp.Embeddings, nil
+}
+
+func (c *embeddingClassifier) exampleVectors(ctx context.Context) (map[string][][]float32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.examples != nil {
+		return c.examples, nil
+	}
+
+	// one request for all examples, in a fixed order
+	var names, input []string
+	for name, route := range c.app.intentRoutes {
+		for _, e := range route.Examples {
+			names = append(names, name)
+			input = append(input, e)
+		}
+	}
+	if len(input) == 0 {
+		return nil, errors.New("no intent has examples")
+	}
+	vectors, err := c.embed(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	c.examples = make(map[string][][]float32)
+	for i, name := range names {
+		c.examples[name] = append(c.examples[name], vectors[i])
+	}
+	return c.examples, nil
+}
+
+func (c *embeddingClassifier) classify(ctx context.Context, prompt, lang string) (intent, error) {
+	examples, err := c.exampleVectors(ctx)
+	if err != nil {
+		return intent{}, err
+	}
+	vectors, err := c.embed(ctx, []string{prompt})
+	if err != nil {
+		return intent{}, err
+	}
+
+	best := intent{Name: intentChat}
+	for name, vecs := range examples {
+		for _, v := range vecs {
+			if sim := cosineSimilarity(vectors[0], v); sim > best.Confidence {
+				best = intent{Name: name, Confidence: sim}
+			}
+		}
+	}
+	return best, nil
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+// llmClassifier asks a (preferably small) model to pick the intent
+type llmClassifier struct {
+	app   *application
+	model string
+}
+
+func (c *llmClassifier) name() string { return "llm" }
+
+func (c *llmClassifier) classify(ctx context.Context, prompt, lang string) (intent, error) {
+	names := make([]string, 0, len(c.app.intentRoutes))
+	for name := range c.app.intentRoutes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("Classify the intent of the message. The intents are:\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "- %s: %s\n", name, c.app.intentRoutes[name].Description)
+	}
+	b.WriteString("\nAnswer with JSON like {\"intent\": \"chat\", \"confidence\": 0.8}.\n\n")
+	fmt.Fprintf(&b, "Message: %s", prompt)
+
+	resp, err := c.app.backend.Chat(ctx, &api.ChatRequest{
+		Model:    c.model,
+		Messages: []api.Message{{Role: "user", Content: b.String()}},
+		Format:   json.RawMessage(`"json"`),
+	})
+	if err != nil {
+		return intent{}, err
+	}
+	answer := resp.Message.Content
+
+	var out struct {
+		Intent     string  `json:"intent"`
+		Confidence float64 `json:"confidence"`
+	}
+	if err := json.Unmarshal([]byte(answer), &out); err != nil {
+		return intent{}, fmt.Errorf("unexpected classifier answer %q", answer)
+	}
+	if _, ok := c.app.intentRoutes[out.Intent]; !ok {
+		return intent{}, fmt.Errorf("classifier answered unknown intent %q", out.Intent)
+	}
+	return intent{Name: out.Intent, Confidence: min(max(out.Confidence, 0), 1)}, nil
+}
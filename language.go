@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/ollama/ollama/api"
+)
+
+// common function words per language. counting them is crude but good
+// enough to tell the major European languages apart, and it needs no
+// model call or external library
+var languageStopwords = map[string][]string{
+	"en": {"the", "and", "is", "are", "what", "how", "you", "of", "to", "in", "it", "this", "that", "with", "for", "can", "do", "my", "i", "me"},
+	"de": {"der", "die", "das", "und", "ist", "sind", "wie", "was", "ich", "du", "nicht", "ein", "eine", "mit", "für", "auf", "heute", "wetter", "mir", "bitte"},
+	"es": {"el", "la", "los", "las", "y", "es", "que", "qué", "cómo", "como", "en", "de", "un", "una", "por", "para", "hoy", "tiempo", "está", "mi"},
+	"fr": {"le", "la", "les", "et", "est", "que", "quel", "quelle", "comment", "je", "tu", "vous", "un", "une", "pour", "avec", "pas", "aujourd'hui", "temps", "il"},
+	"it": {"il", "lo", "la", "gli", "e", "è", "che", "come", "cosa", "di", "un", "una", "per", "con", "non", "oggi", "tempo", "sono", "mi", "qual"},
+	"pt": {"o", "a", "os", "as", "e", "é", "que", "como", "de", "um", "uma", "para", "com", "não", "hoje", "tempo", "está", "eu", "você", "qual"},
+	"nl": {"de", "het", "een", "en", "is", "zijn", "wat", "hoe", "ik", "je", "niet", "met", "voor", "van", "vandaag", "weer", "mij", "dat", "op", "er"},
+}
+
+var languageNames = map[string]string{
+	"en": "English",
+	"de": "German",
+	"es": "Spanish",
+	"fr": "French",
+	"it": "Italian",
+	"pt": "Portuguese",
+	"nl": "Dutch",
+}
+
+var stopwordSets = func() map[string]map[string]bool {
+	sets := make(map[string]map[string]bool)
+	for lang, words := range languageStopwords {
+		sets[lang] = make(map[string]bool)
+		for _, w := range words {
+			sets[lang][w] = true
+		}
+	}
+	return sets
+}()
+
+// detectLanguage returns the ISO 639-1 code of the most likely language
+// of text, or "" if the text is too short or ambiguous to tell
+func detectLanguage(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+
+	scores := make(map[string]int)
+	for _, w := range words {
+		for lang, set := range stopwordSets {
+			if set[w] {
+				scores[lang]++
+			}
+		}
+	}
+
+	best, bestScore, second := "", 0, 0
+	for lang, score := range scores {
+		switch {
+		case score > bestScore:
+			best, bestScore, second = lang, score, bestScore
+		case score > second:
+			second = score
+		}
+	}
+
+	// require a couple of hits and a clear winner
+	if bestScore < 2 || bestScore == second {
+		return ""
+	}
+	return best
+}
+
+// replyLanguage decides which language the model should answer in. an
+// explicit language from the client or the -reply-language flag wins
+// over detection
+func (app *application) replyLanguage(requested, prompt string) string {
+	if requested != "" {
+		return requested
+	}
+	switch app.config.replyLanguage {
+	case "off":
+		return ""
+	case "auto", "":
+		return detectLanguage(prompt)
+	default:
+		return app.config.replyLanguage
+	}
+}
+
+// languageInstruction is added to the request (not the stored history)
+// because small models tend to drift back to English on their own
+func languageInstruction(lang string) api.Message {
+	name, ok := languageNames[lang]
+	if !ok {
+		name = lang
+	}
+	return api.Message{
+		Role:    "system",
+		Content: fmt.Sprintf("Reply in %s, the language the user wrote in.", name),
+	}
+}
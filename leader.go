@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// leaderElection picks the one instance that runs jobs which must not run
+// on every instance, like the usage report webhook. with Redis the
+// leader holds a lease it keeps renewing; without Redis the instance is
+// alone and always leads
+type leaderElection struct {
+	client *redis.Client
+	logger *slog.Logger
+	key    string
+	id     string
+	lease  time.Duration
+
+	mu      sync.Mutex
+	leading bool
+	changed chan struct{}
+}
+
+func newLeaderElection(client *redis.Client, logger *slog.Logger) *leaderElection {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &leaderElection{
+		client:  client,
+		logger:  logger,
+		key:     redisPrefix + "leader",
+		id:      hex.EncodeToString(b),
+		lease:   15 * time.Second,
+		leading: client == nil,
+		changed: make(chan struct{}),
+	}
+}
+
+// renewScript extends the lease only if this instance still holds it
+var renewScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseScript gives the lease up only if this instance holds it
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// run takes part in the election until ctx is done, then steps down so
+// another instance can take over without waiting for the lease to expire
+func (l *leaderElection) run(ctx context.Context) {
+	if l.client == nil {
+		return
+	}
+
+	ticker := time.NewTicker(l.lease / 3)
+	defer ticker.Stop()
+	for {
+		l.setLeading(l.campaign(ctx))
+
+		select {
+		case <-ctx.Done():
+			if l.isLeader() {
+				releaseScript.Run(context.Background(), l.client, []string{l.key}, l.id)
+				l.setLeading(false)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// campaign renews the lease held by this instance or tries to take a
+// free one. losing touch with Redis means losing the lead, since
+// another instance may take over once the lease runs out
+func (l *leaderElection) campaign(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, l.lease/3)
+	defer cancel()
+
+	if l.isLeader() {
+		renewed, err := renewScript.Run(ctx, l.client, []string{l.key}, l.id, l.lease.Milliseconds()).Int()
+		return err == nil && renewed == 1
+	}
+	ok, err := l.client.SetNX(ctx, l.key, l.id, l.lease).Result()
+	return err == nil && ok
+}
+
+func (l *leaderElection) setLeading(leading bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.leading == leading {
+		return
+	}
+	l.leading = leading
+	l.logger.Info("Leader election", "instance", l.id, "leading", leading)
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *leaderElection) isLeader() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leading
+}
+
+// watch returns the current state and a channel closed when it changes
+func (l *leaderElection) watch() (bool, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leading, l.changed
+}
+
+// whileLeading runs job whenever this instance leads. the job's context
+// is cancelled when the lead is lost, and it's started again when the
+// lead comes back
+func (l *leaderElection) whileLeading(ctx context.Context, name string, job func(context.Context)) {
+	for {
+		leading, changed := l.watch()
+		if !leading {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+				continue
+			}
+		}
+
+		l.logger.Info("Starting background job", "job", name)
+		jobCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			job(jobCtx)
+		}()
+
+		select {
+		case <-ctx.Done():
+		case <-changed:
+			l.logger.Info("Stopping background job", "job", name)
+		}
+		cancel()
+		<-done
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// setLocation stores the default location of the conversation, used for
+// the weather when the user doesn't name a place
+func (c *conversation) setLocation(location string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.location = location
+}
+
+func (c *conversation) defaultLocation() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.location
+}
+
+// locationNote tells the model where the user is. it's only added to
+// requests that carry the weather tool
+func locationNote(location string) api.Message {
+	return api.Message{
+		Role:    "system",
+		Content: fmt.Sprintf("The user is in or near %s. Use this location for get_weather when they don't name a place.", location),
+	}
+}
+
+// geoIPLocation looks up the city of ip with the -geoip service. the
+// URL has {ip} replaced and must answer JSON with a "city" field, like
+// ip-api.com or ipapi.co do
+func (app *application) geoIPLocation(ctx context.Context, ip string) (string, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || addr.IsLoopback() || addr.IsPrivate() {
+		return "", nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	u := strings.ReplaceAll(app.config.geoIP, "{ip}", url.PathEscape(ip))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("geoip lookup returned %s", resp.Status)
+	}
+	var out struct {
+		City string `json:"city"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	return out.City, nil
+}
+
+// locateClient sets the default location from GeoIP, unless one is set
+// already. a location sent by the browser always wins
+func (app *application) locateClient(conv *conversation, ip string) {
+	if conv.defaultLocation() != "" {
+		return
+	}
+	city, err := app.geoIPLocation(context.Background(), ip)
+	if err != nil {
+		app.logger.Error(fmt.Sprintf("Error looking up location: %v", err))
+		return
+	}
+	if city != "" && conv.defaultLocation() == "" {
+		app.logger.Debug("Default location from GeoIP", "location", app.loggable(conv, city))
+		conv.setLocation(city)
+	}
+}
+
+// handleLocationMessage stores a location sent by the client, either a
+// place name or coarse "lat,lon" from browser geolocation
+func (app *application) handleLocationMessage(client *wsClient, conv *conversation, location string) {
+	location = strings.TrimSpace(location)
+	if location == "" || len(location) > 100 {
+		client.send(Message{
+			Type:    "notice",
+			Content: "That location couldn't be used.",
+			Time:    time.Now().Format("15:04:05"),
+		})
+		return
+	}
+
+	conv.setLocation(location)
+	client.send(Message{
+		Type:    "notice",
+		Content: fmt.Sprintf("Using %s as your location for the weather.", location),
+		Time:    time.Now().Format("15:04:05"),
+	})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// what -log-content lets into the logs from messages
+const (
+	logContentHash     = "hash"
+	logContentTruncate = "truncate"
+	logContentFull     = "full"
+)
+
+// logTruncateLength is how much of a message the truncate policy keeps
+const logTruncateLength = 40
+
+// loggable returns content the way it may appear in logs. by default
+// only a short hash is logged, which is enough to tell messages apart
+// and to find repeats without storing what users wrote. incognito
+// conversations log nothing at all
+func (app *application) loggable(conv *conversation, content string) string {
+	if conv.isIncognito() {
+		return incognitoPlaceholder
+	}
+
+	switch app.config.logContent {
+	case logContentFull:
+		return content
+	case logContentTruncate:
+		runes := []rune(content)
+		if len(runes) <= logTruncateLength {
+			return content
+		}
+		return fmt.Sprintf("%s… (%d chars)", string(runes[:logTruncateLength]), len(runes))
+	default:
+		sum := sha256.Sum256([]byte(content))
+		return fmt.Sprintf("sha256:%s (%d chars)", hex.EncodeToString(sum[:])[:12], len(content))
+	}
+}
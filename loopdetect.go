@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ollama/ollama/api"
+)
+
+// weaker models sometimes keep asking for the same tool call even though
+// the result is already in the history. these are what they get told
+const (
+	loopCorrection = "You already called these tools and their results are above. " +
+		"Do not call any tools again, answer the user's question with the information you have."
+	loopAbortMessage = "Sorry, I got stuck repeating the same tool call and couldn't finish an answer. " +
+		"Please try rephrasing your question."
+)
+
+// recordCall remembers a tool call made this turn and reports whether
+// the exact same call (tool and arguments) was already made
+func (t *turnInfo) recordCall(call api.ToolCall) bool {
+	if t.seenCalls == nil {
+		t.seenCalls = make(map[string]bool)
+	}
+	key := toolKey(call.Function.Name, call.Function.Arguments)
+	if t.seenCalls[key] {
+		return true
+	}
+	t.seenCalls[key] = true
+	return false
+}
+
+// onlyRepeats reports whether every call was already made this turn
+func (t *turnInfo) onlyRepeats(calls []api.ToolCall) bool {
+	for _, call := range calls {
+		if !t.seenCalls[toolKey(call.Function.Name, call.Function.Arguments)] {
+			return false
+		}
+	}
+	return len(calls) > 0
+}
+
+// repeatedCallResult is sent back instead of running a duplicate call
+func repeatedCallResult(call api.ToolCall) string {
+	js, _ := json.Marshal(map[string]string{
+		"error": "repeated_call",
+		"message": fmt.Sprintf("%s was already called with these arguments, use the earlier result.",
+			call.Function.Name),
+	})
+	return string(js)
+}
@@ -9,9 +9,11 @@ import (
 	"log"
 	"log/slog"
 	"net/http"
-	"net/url"
+	"net/mail"
 	"os"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -53,22 +55,47 @@ var weatherTool = api.Tool{
 	},
 }
 
-// handleToolCall processes tool calls from the model
-func handleToolCall(toolCall api.ToolCall) string {
-	switch toolCall.Function.Name {
-	case "get_weather":
-		// Extract location from arguments
-		location, ok := toolCall.Function.Arguments["location"].(string)
-		if !ok {
-			return "Error: location parameter is required"
-		}
-		return getWeatherTool(location)
-	default:
+// handleToolCall processes tool calls from the model. results that
+// were already prefetched are used instead of calling the tool again
+func (app *application) handleToolCall(ctx context.Context, conv *conversation, toolCall api.ToolCall, turn *turnInfo) string {
+	if result, ok := app.toolBudgets.use(toolCall.Function.Name, turn, conv); !ok {
+		app.logger.Debug("Tool budget exceeded", "tool", toolCall.Function.Name)
+		return result
+	}
+
+	if result, ok := turn.prefetched.take(toolCall); ok {
+		return result
+	}
+
+	tool, ok := app.tools.get(toolCall.Function.Name)
+	if !ok {
 		return fmt.Sprintf("Unknown tool: %s", toolCall.Function.Name)
 	}
+
+	// make sure the arguments match the schema before running anything
+	if result := validateToolArgs(tool.Schema(), toolCall.Function.Arguments); result != "" {
+		app.logger.Debug("Invalid tool arguments", "tool", toolCall.Function.Name, "result", result)
+		return result
+	}
+
+	start := len(turn.progressLog)
+	ctx = withToolEnv(ctx, &toolEnv{
+		conv:   conv,
+		turn:   turn,
+		tool:   tool.Name(),
+		report: turn.reporter(tool.Name()),
+	})
+	result := tool.Execute(ctx, toolCall.Function.Arguments)
+
+	if app.config.toolProgressSummary {
+		result = summarizeProgress(result, turn.progressLog[start:])
+	}
+	return result
 }
 
 var upgrader = websocket.Upgrader{
+	// clients that offer none of these get the legacy format
+	Subprotocols: []string{protocolV2},
 	// add proper validation logic before deploying
 	CheckOrigin: func(r *http.Request) bool {
 		return true // Allow connections from any origin, good for testing, bad for security
@@ -79,133 +106,287 @@ type Message struct {
 	Type    string `json:"type"`
 	Content string `json:"content"`
 	Time    string `json:"time"`
-}
-
-// keeps growing with each ollama call so that ai can keep
-// track of the conversation
-var chatHistory []api.Message
-
-// requiresCurrentInfo analyzes the prompt to determine if it needs real-time/current information
-func requiresCurrentInfo(prompt string) bool {
-	promptLower := strings.ToLower(prompt)
-
-	// Keywords that indicate need for current information
-	currentInfoKeywords := []string{
-		"current weather", "weather today", "weather now", "weather in",
-		"today's weather", "what's the weather", "how's the weather",
-		"temperature in", "temperature at", "temp in",
-		"current news", "latest news", "today's news",
-		"current time", "what time is it",
-		"current date", "what date is it",
-		"stock price", "current stock",
-		"live", "now", "currently", "today",
-		"real-time", "up-to-date",
-	}
-
-	for _, keyword := range currentInfoKeywords {
-		if strings.Contains(promptLower, keyword) {
-			return true
-		}
-	}
-
-	return false
+	ID      int    `json:"id,omitempty"`
+	Version int    `json:"version,omitempty"`
+	Event   string `json:"event,omitempty"`
+	// language of the message, clients can set it to pick the reply language
+	Language string `json:"language,omitempty"`
+	// set on tool_progress, agent_step and artifact messages
+	Progress *toolProgress `json:"progress,omitempty"`
+	Step     *agentStep    `json:"step,omitempty"`
+	Artifact *artifactInfo `json:"artifact,omitempty"`
+	// the tool, its arguments and what it returned on tool_call and
+	// tool_result messages
+	Name   string         `json:"name,omitempty"`
+	Args   map[string]any `json:"args,omitempty"`
+	Result string         `json:"result,omitempty"`
+	// CSV downloads for the tables in an answer
+	Tables []string `json:"tables,omitempty"`
+	// whether an answer is grounded in tool results
+	Provenance *provenance `json:"provenance,omitempty"`
+	// what went wrong on an error message, see chaterrors.go
+	Code string `json:"code,omitempty"`
+	// seconds until a rate_limited client may send again
+	RetryAfter int `json:"retry_after,omitempty"`
+	// base64 images attached to a user message, for vision models
+	Images []string `json:"images,omitempty"`
+	// the server build, sent with the conversation message on connect
+	Server *buildVersion `json:"server,omitempty"`
+	// the conversation a conversation management message is about, and
+	// the owner's conversations on a conversations message
+	Conversation  string             `json:"conversation,omitempty"`
+	Conversations []conversationInfo `json:"conversations,omitempty"`
+	// the human agent who wrote an answer, or who is watching as an
+	// operator on the watching message
+	Operator string `json:"operator,omitempty"`
+	// the display name and avatar of who wrote a user message
+	Author *messageAuthor `json:"author,omitempty"`
+	// the variant of a regenerated answer shown, from 1, and how many
+	// there are
+	Variant  int `json:"variant,omitempty"`
+	Variants int `json:"variants,omitempty"`
+	// the answer rendered as sanitized HTML, with -markdown
+	HTML string `json:"html,omitempty"`
+	// tokens and time the answer took
+	Usage *messageUsage `json:"usage,omitempty"`
 }
 
 // callOllama sends a user prompt to Ollama using Chat API and returns the response.
 // if ollama model requests tool use this is handled internally by the func
-// the func won't return data back to the chat client until ollama has 
+// the func won't return data back to the chat client until ollama has
 // reached a 'done' state.
-func (app *application) callOllama(prompt string) (string, error) {
-	// Parse the Ollama URL
-	ollamaURLParsed, err := url.Parse(app.config.ollamaURL)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse Ollama URL: %v", err)
-	}
+// conv is the conversation of the client that sent the prompt, turn
+// carries per-turn options in and token usage back out. when ctx is
+// cancelled the partial answer is returned and turn.cancelled is set
+func (app *application) callOllama(ctx context.Context, conv *conversation, prompt string, turn *turnInfo) (*chatMessage, error) {
+	// the model calls of the turn go to one server
+	ctx = withServerAffinity(ctx)
 
-	// Create Ollama client
-	client := api.NewClient(ollamaURLParsed, http.DefaultClient)
+	// only the first reply of a conversation has no earlier answer
+	turn.followUp = conv.len() > 2
 
 	// Add system message if this is the first message
-	if len(chatHistory) == 0 {
+	if conv.len() == 0 {
 		systemMessage := api.Message{
-			Role: "system",
-			Content: `You are a helpful assistant. When you have access to tools, 
-			use them to provide accurate, current information.`,
+			Role:    "system",
+			Content: app.systemPrompt(conv),
 		}
-		chatHistory = append(chatHistory, systemMessage)
+		conv.append(systemMessage)
 	}
 
+	// a reply to a clarification question continues the asked intent
+	pending := conv.pendingClarification()
+
 	// Add user message to chat history
 	userMessage := api.Message{
 		Role:    "user",
 		Content: prompt,
+		Images:  turn.images,
 	}
-	chatHistory = append(chatHistory, userMessage)
+	conv.add(chatMessage{Message: userMessage, Language: detectLanguage(prompt)})
 
 	// Check if the prompt requires current information
 	// this is a sanity check to stop the ai from calling tools
-	// unless necessary. each model has different tendencies for 
+	// unless necessary. each model has different tendencies for
 	// how often it tries to call tools
-	needsTools := requiresCurrentInfo(prompt)
+	// keywords and tool descriptions follow the language the user wrote
+	// in, even when replies aren't forced into it
+	promptLanguage := turn.language
+	if promptLanguage == "" {
+		promptLanguage = detectLanguage(prompt)
+	}
+	var decision intent
+	var route intentRoute
+	if r, ok := app.intentRoutes[pending]; ok {
+		decision, route = intent{Name: pending, Confidence: 1, Tools: r.tools}, r
+	} else {
+		decision, route = app.classifyIntent(ctx, conv, prompt, promptLanguage)
+	}
+	neededTools := decision.Tools
+
+	app.logger.Debug("Prompt analysis", "need tools", len(neededTools) > 0)
+
+	// the intent can route the turn to another model, but a model the
+	// user picked is always used
+	model := app.conversationModel(conv)
+	if route.Model != "" && conv.chosenModel() == "" {
+		model = route.Model
+	}
+	turn.model = model
 
-	app.logger.Debug("Prompt analysis", "need tools", needsTools)
+	// fold old turns into a summary before they overflow the context
+	app.summarizeHistory(ctx, conv, turn)
+
+	// generate models have no tool calling unless given a chat template
+	if !app.modelSettings(model).tools() && len(neededTools) > 0 {
+		app.logger.Debug("Dropping tools for generate model", "model", model)
+		neededTools = nil
+	}
+
+	location := conv.defaultLocation()
+	units := app.unitPreference(conv)
+
+	// ask the model to stay in the user's language
+	replyLanguage := app.replyLanguage(turn.language, prompt)
+	requestMessages := func() []api.Message {
+		msgs := app.trimHistory(conv, conv.promptMessages())
+		if route.Persona != "" {
+			msgs = append(msgs, api.Message{Role: "system", Content: route.Persona})
+		}
+		if _, ok := findTool(neededTools, "get_weather"); ok && location != "" {
+			msgs = append(msgs, locationNote(location))
+		}
+		if units != "" {
+			msgs = append(msgs, unitInstruction(units))
+		}
+		if app.config.injectDate {
+			msgs = append(msgs, dateNote(conv.now()))
+		}
+		if replyLanguage != "" {
+			msgs = append(msgs, languageInstruction(replyLanguage))
+		}
+		return msgs
+	}
+	app.logger.Debug("Reply language", "language", replyLanguage)
 
-	// Create context
-	ctx := context.Background()
+	// better to ask than to answer the wrong question
+	if question := app.intentQuestion(decision, route); question != "" {
+		return app.clarify(conv, question, decision.Name, replyLanguage), nil
+	}
 
 	// Create chat request - include tools if needed
 	var tools api.Tools
-	if needsTools {
-		tools = api.Tools{weatherTool}
-		app.logger.Debug("Including weather tool in request")
+	if len(neededTools) > 0 {
+		tools = neededTools
+		app.logger.Debug("Including tools in request", "tools", len(tools))
+
+		// start fetching tool data while the model is thinking
+		turn.prefetched = app.prefetchTools(conv, prompt, tools)
 	} else {
 		app.logger.Debug("No tools included - using internal knowledge")
 	}
 
+	// tools like the scratchpad are useful on any turn, not just ones
+	// needing current info
+	tools = append(tools, app.tools.alwaysOn()...)
+	tools = app.heuristics.localize(tools, promptLanguage)
+
+	options := app.conversationOptions(conv).merge(turn.options).request()
+
+	// requests are streamed so a cancelled turn still has the answer
+	// written so far
 	req := &api.ChatRequest{
-		Model:    app.config.ollamaModel,
-		Messages: chatHistory,
-		Stream:   new(bool),
+		Model:    model,
+		Messages: requestMessages(),
 		Tools:    tools,
+		Options:  options,
 	}
 
 	// Call Ollama chat API
 	var response strings.Builder
-	var lastMessage api.Message
-
-	err = client.Chat(ctx, req, func(resp api.ChatResponse) error {
-		response.WriteString(resp.Message.Content)
-		app.logger.Debug("Ollama", "response", resp.Message.Content)
-		lastMessage = resp.Message
-		return nil
-	})
+	var toolCalls []api.ToolCall
+	sendChat := func(req *api.ChatRequest) error {
+		response.Reset()
+		toolCalls = nil
+		err := app.chat(ctx, req, func(resp api.ChatResponse) error {
+			response.WriteString(resp.Message.Content)
+			toolCalls = append(toolCalls, resp.Message.ToolCalls...)
+			if resp.Done {
+				conv.calibrate(req.Messages, resp.PromptEvalCount)
+			}
+			turn.countResponse(resp)
+			return nil
+		})
+		app.logger.Debug("Ollama", "response", app.loggable(conv, response.String()))
+		return err
+	}
 
+	err := sendChat(req)
+	if ctx.Err() != nil {
+		return app.cancelledReply(conv, response.String(), replyLanguage, turn), nil
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to call Ollama API: %v", err)
+		return nil, fmt.Errorf("failed to call Ollama API: %w", err)
 	}
 
 	responseContent := strings.TrimSpace(response.String())
 
-	// Handle tool calls if present
-	if len(lastMessage.ToolCalls) > 0 {
-		app.logger.Debug("Processing tool calls", "tools", len(lastMessage.ToolCalls))
+	// the heuristics sent no tools but the model says it needs live data.
+	// ask once more with the tools that fetch it
+	if app.config.retryWithTools && len(neededTools) == 0 && len(toolCalls) == 0 &&
+		app.modelSettings(model).tools() && admitsIgnorance(responseContent) {
+		if live := app.liveTools(); len(live) > 0 {
+			app.logger.Debug("Model lacks live data, retrying with tools", "tools", len(live))
+			neededTools = live
+			tools = app.heuristics.localize(append(live, tools...), promptLanguage)
+			turn.prefetched = app.prefetchTools(conv, prompt, live)
+			req = &api.ChatRequest{
+				Model:    model,
+				Messages: requestMessages(),
+				Tools:    tools,
+				Options:  options,
+			}
+			err = sendChat(req)
+			if ctx.Err() != nil {
+				return app.cancelledReply(conv, response.String(), replyLanguage, turn), nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to call Ollama API: %w", err)
+			}
+			responseContent = strings.TrimSpace(response.String())
+		}
+	}
+
+	// run the tools the model asks for and send the results back until it
+	// answers without calling more, for at most -max-tool-iterations rounds
+	maxIterations := app.config.maxToolIterations
+	for iteration := 1; len(toolCalls) > 0; iteration++ {
+		app.logger.Debug("Processing tool calls", "tools", len(toolCalls), "iteration", iteration)
+
+		// ask for arguments the model had to guess instead of running the
+		// tool with them
+		for _, toolCall := range toolCalls {
+			if question := app.toolQuestion(conv, toolCall); question != "" {
+				return app.clarify(conv, question, decision.Name, replyLanguage), nil
+			}
+		}
+		turn.emitStep(iteration, maxIterations, toolCalls)
 
 		// Add the assistant's message with tool calls to history
 		assistantMessage := api.Message{
 			Role:      "assistant",
 			Content:   responseContent,
-			ToolCalls: lastMessage.ToolCalls,
+			ToolCalls: toolCalls,
 		}
-		chatHistory = append(chatHistory, assistantMessage)
+		conv.append(assistantMessage)
 
 		// Process each tool call
-		for _, toolCall := range lastMessage.ToolCalls {
+		for _, toolCall := range toolCalls {
 			fnName := toolCall.Function.Name
 			fnArgs := toolCall.Function.Arguments
 
-			app.logger.Debug("Processing tool calls", "tool", fnName, "args", fnArgs)
+			app.logger.Debug("Processing tool calls", "tool", fnName, "args", app.loggable(conv, fnArgs.String()))
 
-			toolResult := handleToolCall(toolCall)
+			turn.emitToolCall(toolCall)
+
+			// don't run the same call twice in one turn
+			var toolResult string
+			if turn.recordCall(toolCall) {
+				app.logger.Debug("Repeated tool call", "tool", fnName)
+				toolResult = repeatedCallResult(toolCall)
+			} else {
+				toolStarted := time.Now()
+				toolResult = convertUnits(app.handleToolCall(ctx, conv, toolCall, turn), units)
+				turn.recordGrounding(fnName, toolResult)
+				app.event(event{
+					Type:         eventToolCall,
+					Conversation: conv.id,
+					Model:        model,
+					Tool:         fnName,
+					LatencyMS:    millisSince(toolStarted),
+				})
+			}
+			turn.emitToolResult(fnName, toolResult)
 
 			// Add tool result as a tool message
 			toolMessage := api.Message{
@@ -213,39 +394,96 @@ func (app *application) callOllama(prompt string) (string, error) {
 				Content:  toolResult,
 				ToolName: toolCall.Function.Name,
 			}
-			chatHistory = append(chatHistory, toolMessage)
+			conv.append(toolMessage)
 		}
 
-		// Make another call to get the final response
-		finalReq := &api.ChatRequest{
-			Model:    app.config.ollamaModel,
-			Messages: chatHistory,
-			Stream:   new(bool),
-			Tools:    api.Tools{weatherTool},
+		// send the results back. after the last round the model has to
+		// answer without tools
+		req = &api.ChatRequest{
+			Model:    model,
+			Messages: requestMessages(),
+			Tools:    tools,
+			Options:  options,
+		}
+		lastRound := iteration >= maxIterations
+		if lastRound {
+			app.logger.Debug("Tool iteration limit reached", "iterations", iteration)
+			req.Messages = append(req.Messages, api.Message{Role: "system", Content: iterationLimit})
+			req.Tools = nil
 		}
 
-		var finalResponse strings.Builder
-		err = client.Chat(ctx, finalReq, func(resp api.ChatResponse) error {
-			finalResponse.WriteString(resp.Message.Content)
-			app.logger.Debug("ollama", "final response", resp.Message.Content)
-			return nil
-		})
-
+		err = sendChat(req)
+		if ctx.Err() != nil {
+			return app.cancelledReply(conv, response.String(), replyLanguage, turn), nil
+		}
 		if err != nil {
-			return "", fmt.Errorf("failed to call Ollama API for final response: %v", err)
+			return nil, fmt.Errorf("failed to call Ollama API for final response: %w", err)
 		}
 
-		responseContent = strings.TrimSpace(finalResponse.String())
+		// the model asked for the calls it just made again instead of
+		// answering. tell it to stop and retry once without tools
+		if !lastRound && turn.onlyRepeats(toolCalls) {
+			app.logger.Debug("Tool call loop detected", "tools", len(toolCalls))
+
+			req.Messages = append(requestMessages(), api.Message{
+				Role:    "system",
+				Content: loopCorrection,
+			})
+			req.Tools = nil
+
+			err = sendChat(req)
+			if ctx.Err() != nil {
+				return app.cancelledReply(conv, response.String(), replyLanguage, turn), nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to call Ollama API for final response: %w", err)
+			}
+			lastRound = true
+		}
+
+		responseContent = strings.TrimSpace(response.String())
+		if lastRound {
+			if responseContent == "" && len(toolCalls) > 0 {
+				responseContent = loopAbortMessage
+			}
+			break
+		}
+	}
+
+	// -refine reviews the answer and writes it again before it's shown
+	var refined *refinement
+	if app.config.refine && responseContent != "" && responseContent != loopAbortMessage {
+		responseContent, refined = app.refine(ctx, conv, model, prompt, responseContent, options, turn)
+		if ctx.Err() != nil {
+			return app.cancelledReply(conv, responseContent, replyLanguage, turn), nil
+		}
 	}
 
 	// Add assistant's final response to chat history
 	assistantMessage := api.Message{
 		Role:    "assistant",
-		Content: responseContent,
+		Content: app.postProcess(responseContent, turn),
 	}
-	chatHistory = append(chatHistory, assistantMessage)
-
-	return responseContent, nil
+	var source *provenance
+	if app.config.provenance {
+		source = answerProvenance(assistantMessage.Content, turn.grounding)
+	}
+	answer := chatMessage{
+		Message:    assistantMessage,
+		Created:    time.Now(),
+		Language:   replyLanguage,
+		Tables:     parseMarkdownTables(assistantMessage.Content),
+		Provenance: source,
+		Usage:      turn.usage(),
+		Refinement: refined,
+	}
+	if len(turn.variants) > 0 {
+		answer.Variants = append(slices.Clone(turn.variants), variantOf(answer))
+		answer.Variant = len(answer.Variants)
+	}
+	reply := conv.add(answer)
+	app.queueGraphExtraction(conv)
+	return &reply, nil
 }
 
 // chat client page
@@ -256,57 +494,292 @@ func (app *application) handleWebSocket(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	defer conn.Close()
+	// a frame is read whole before the images in it are checked
+	conn.SetReadLimit(app.maxMessageBytes())
+
+	// every socket has its own conversation. a reconnecting client names
+	// the one it had so the history survives reloads. the socket can
+	// switch to another of the owner's conversations later
+	current := &socketConversation{owner: app.owner(r)}
+	conv := app.conversations.attach(r.URL.Query().Get("conversation"), current.owner)
+	current.conv.Store(conv)
+	defer func() { app.conversations.detach(current.conv.Load()) }()
 
-	app.logger.Info("Web client connected")
+	client := newWSClient(conn)
+	client.conv = conv.id
+	app.clients.add(client)
+	defer app.clients.remove(client)
+	client.send(Message{
+		Type:    "conversation",
+		Content: conv.id,
+		Time:    time.Now().Format("15:04:05"),
+		Server:  &app.version,
+	})
+
+	app.logger.Info("Web client connected", "conversation", conv.id, "protocol", client.protocol)
 
+	if app.config.warmup {
+		go app.warmUp(app.conversationModel(conv))
+	}
+	if app.config.geoIP != "" {
+		go app.locateClient(conv, clientIP(r))
+	}
+	if r.URL.Query().Get("incognito") == "1" {
+		conv.setIncognito(true)
+	}
+	conv.setClock(nil, requestLocale(r))
+
+	session := app.startSession(client, current, clientIP(r))
+	defer session.close()
 	for {
-		var msg Message
-		err := conn.ReadJSON(&msg)
+		msg, err := client.read()
 		if err != nil {
 			app.logger.Error(fmt.Sprintf("Error reading message: %v", err))
 			break
 		}
-		app.logger.Debug("Received message", "msg", msg.Content)
+		app.receive(session, msg)
+	}
 
-		// Call Ollama with the user's message
-		ollamaResponse, err := app.callOllama(msg.Content)
-		if err != nil {
-			app.logger.Error(fmt.Sprintf("Error calling Ollama: %v", err))
+	app.logger.Info("Client disconnected")
+}
+
+// chatSession handles the messages of one chat client, a websocket or
+// an SSE stream, see ssechat.go. messages are handled in order off the
+// read loop, so a cancel can be read while an answer is being generated
+type chatSession struct {
+	client  *wsClient
+	current *socketConversation
+	ip      string
 
-			// Send error message to client
-			response := Message{
-				Type:    "server",
-				Content: "Sorry, I'm having trouble connecting to the AI service. Please try again later.",
-				Time:    time.Now().Format("15:04:05"),
+	mu       sync.Mutex
+	incoming chan Message
+	closed   bool
+}
+
+func (app *application) startSession(client *wsClient, current *socketConversation, ip string) *chatSession {
+	s := &chatSession{client: client, current: current, ip: ip, incoming: make(chan Message, 16)}
+	go func() {
+		for msg := range s.incoming {
+			if conversationMessages[msg.Type] {
+				app.handleConversationMessage(client, current, msg)
+				continue
+			}
+			app.handleClientMessage(client, current.conv.Load(), ip, msg)
+			if !controlMessages[msg.Type] {
+				app.limiter.release(ip)
 			}
-			conn.WriteJSON(response)
-			continue
 		}
+	}()
+	return s
+}
 
-		// Send back the Ollama response
-		response := Message{
-			Type:    "server",
-			Content: ollamaResponse,
-			Time:    time.Now().Format("15:04:05"),
+// receive queues a message the client sent. false if the session is
+// closed
+func (app *application) receive(s *chatSession, msg Message) bool {
+	conv := s.current.conv.Load()
+	app.logger.Debug("Received message", "msg", app.loggable(conv, msg.Content))
+
+	if msg.Type == "cancel" {
+		app.handleCancelMessage(s.client, conv)
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	// refuse rather than queue what's over the limits
+	if !controlMessages[msg.Type] && !conversationMessages[msg.Type] {
+		if hit := app.limiter.acquire(s.ip, conv.id); hit != nil {
+			app.logger.Info("Rate limited", "client", s.ip, "conversation", conv.id, "reason", hit.message)
+			rateLimited(s.client, hit)
+			return true
 		}
+	}
+	s.incoming <- msg
+	return true
+}
 
-		err = conn.WriteJSON(response)
-		if err != nil {
-			app.logger.Error(fmt.Sprintf("Error writing message: %v", err))
-			break
+func (s *chatSession) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	close(s.incoming)
+}
+
+// controlMessages change the conversation's settings, every other
+// message is a chat message that gets answered
+var controlMessages = map[string]bool{
+	"set_model":  true,
+	"location":   true,
+	"incognito":  true,
+	"units":      true,
+	"options":    true,
+	"watch_link": true,
+	"variant":    true,
+	"timezone":   true,
+}
+
+// handleClientMessage handles a websocket message other than cancel
+func (app *application) handleClientMessage(client *wsClient, conv *conversation, ip string, msg Message) {
+	switch msg.Type {
+	case "set_model":
+		app.handleSetModelMessage(client, conv, msg.Content)
+	case "location":
+		app.handleLocationMessage(client, conv, msg.Content)
+	case "incognito":
+		app.handleIncognitoMessage(client, conv, msg.Content)
+	case "units":
+		app.handleUnitsMessage(client, conv, msg.Content)
+	case "options":
+		app.handleOptionsMessage(client, conv, msg.Content)
+	case "watch_link":
+		app.handleWatchLinkMessage(client, conv)
+	case "variant":
+		app.handleVariantMessage(client, conv, msg)
+	case "timezone":
+		app.handleTimezoneMessage(client, conv, msg.Content)
+	case "regenerate":
+		app.handleRegenerateMessage(client, conv, ip, msg)
+	default:
+		if app.handleCommand(client, conv, ip, msg) {
+			return
 		}
+		app.answerMessage(client, conv, ip, msg, nil)
 	}
+}
 
-	app.logger.Info("Client disconnected")
+// answerMessage runs one chat turn for a message from client and sends
+// the answer back. regen is set when the turn writes the last answer
+// again, see variants.go
+func (app *application) answerMessage(client *wsClient, conv *conversation, ip string, msg Message, regen *regeneration) {
+	images, err := app.decodeImages(msg.Images)
+	if err != nil {
+		client.send(Message{
+			Type:    "notice",
+			Content: err.Error(),
+			Time:    time.Now().Format("15:04:05"),
+		})
+		return
+	}
+
+	content, ok := app.expandSnippet(conv.owner, msg.Content)
+	if !ok {
+		client.send(Message{
+			Type:    "notice",
+			Content: content,
+			Time:    time.Now().Format("15:04:05"),
+		})
+		return
+	}
+	msg.Content = app.filterInput(conv, content)
+
+	// refuse early rather than going over the quota mid-answer
+	if refusal := app.checkQuota(conv, ip, msg.Content); refusal != "" {
+		client.send(Message{
+			Type:    "quota",
+			Content: refusal,
+			Time:    time.Now().Format("15:04:05"),
+		})
+		return
+	}
+
+	// wait for any turn already running on the conversation
+	conv.turn.lock(func(ahead int) {
+		client.send(Message{
+			Type:    "queued",
+			Content: fmt.Sprintf("Another message is being answered, yours is queued (%d ahead).", ahead),
+			Time:    time.Now().Format("15:04:05"),
+		})
+	})
+
+	// everything the turn sends goes to the conversation's watchers too
+	send := func(m Message) error {
+		app.clients.sendToWatchers(conv.id, m)
+		return client.send(m)
+	}
+	app.clients.sendToWatchers(conv.id, Message{Type: "user", Content: msg.Content, Time: time.Now().Format("15:04:05"), Author: app.profiles.author(conv.owner)})
+
+	// a human agent answers conversations they took over
+	if conv.heldBy() != "" {
+		app.holdForOperator(conv, msg.Content, images)
+		conv.turn.unlock()
+		return
+	}
+
+	// Call Ollama with the user's message
+	app.event(event{Type: eventMessage, Conversation: conv.id, Client: ip})
+	turn := &turnInfo{language: msg.Language, images: images, emit: func(m Message) { send(m) }, started: time.Now()}
+	if regen != nil {
+		turn.variants, turn.options = regen.variants, regen.options
+	} else {
+		app.recordKeptVariant(conv, ip)
+	}
+	ctx, done := conv.beginTurn()
+	stopDraft := app.startDraft(ctx, conv, msg.Content, turn)
+	ollamaResponse, err := app.callOllama(ctx, conv, msg.Content, turn)
+	stopDraft()
+	done()
+	app.evictHistory(conv)
+	conv.turn.unlock()
+	app.recordUsage(client, ip, turn)
+	if err != nil {
+		app.logger.Error(fmt.Sprintf("Error calling Ollama: %v", err))
+		app.event(event{Type: eventError, Conversation: conv.id, Client: ip, Model: turn.model, Error: err.Error()})
+
+		// Send error message to client
+		send(errorMessage(chatError(err, turn.model)))
+		return
+	}
+
+	app.event(event{
+		Type:             eventAnswer,
+		Conversation:     conv.id,
+		Client:           ip,
+		Model:            turn.model,
+		PromptTokens:     turn.promptTokens,
+		CompletionTokens: turn.completionTokens,
+		LatencyMS:        millisSince(turn.started),
+	})
+
+	// Send back the Ollama response, or what it had so far when cancelled
+	response := Message{
+		Type:       "server",
+		Content:    ollamaResponse.Content,
+		Time:       time.Now().Format("15:04:05"),
+		ID:         ollamaResponse.ID,
+		Version:    ollamaResponse.Version,
+		Language:   ollamaResponse.Language,
+		Tables:     tableURLs(conv, *ollamaResponse),
+		Provenance: ollamaResponse.Provenance,
+		Variant:    ollamaResponse.Variant,
+		Variants:   len(ollamaResponse.Variants),
+		HTML:       app.renderHTML(ollamaResponse.Content),
+		Usage:      turn.usage(),
+	}
+	if turn.cancelled {
+		response.Type = "cancelled"
+	}
+
+	err = send(response)
+	if err != nil {
+		app.logger.Error(fmt.Sprintf("Error writing message: %v", err))
+	}
 }
 
 // write the home page
 func (app *application) handleHome(w http.ResponseWriter, r *http.Request) {
+	app.setOwnerCookie(w, r)
 	t := template.Must(template.ParseFiles("index.html"))
 	data := struct {
-		Time string
+		Time  string
+		Auth  bool
+		Build string
 	}{
-		Time: time.Now().Format("15:04:05"),
+		Time:  time.Now().Format("15:04:05"),
+		Auth:  app.authEnabled(),
+		Build: app.version.Build,
 	}
 	err := t.Execute(w, data)
 	if err != nil {
@@ -319,20 +792,334 @@ func (app *application) handleHome(w http.ResponseWriter, r *http.Request) {
 type config struct {
 	port        int
 	ollamaModel string
-	ollamaURL   string
+	// one or more servers, see ollamabackend.go
+	ollamaURL     string
+	ollamaBalance string
+	// the model server, see backend.go
+	backend   string
+	openAIURL string
+	openAIKey string
+	// what conversations start with, see systemprompt.go
+	systemPrompt     string
+	systemPromptFile string
+	// -temperature, -seed etc., see options.go
+	options      modelOptions
+	benchHistory string
+	// saved prompts and canned replies, see snippets.go
+	snippets    string
+	warmup      bool
+	toolTTLs    string
+	toolBudgets string
+	// rounds of tool calls per turn before the model must answer
+	maxToolIterations int
+	// ask again with tools when a turn without them gets "I can't know"
+	retryWithTools bool
+	// add tool progress updates to the result the model sees
+	toolProgressSummary bool
+	scratchpad          bool
+	artifacts           bool
+	// mark answers as grounded in tool results or model knowledge
+	provenance bool
+	// send answers rendered as sanitized HTML too, see markdown.go
+	markdown bool
+	// review and rewrite every answer before it's shown, see refine.go
+	refine bool
+	// tell the model the date and time every turn, see clock.go
+	injectDate bool
+	// small model streaming a draft while the answer is written, see draft.go
+	draftModel string
+	// entities and relations from conversations, see graph.go
+	knowledgeGraph bool
+	graphModel     string
+	// topic clusters of the conversations, see clusters.go
+	clusterInterval time.Duration
+	clusterModel    string
+	clusterMax      int
+	// set_reminder and list_reminders, see reminders.go
+	reminders       bool
+	reminderWebhook string
+	// auto, off or a fixed language code
+	replyLanguage string
+	outputFilters string
+	// masking and link rules for what users write, see inputfilter.go
+	inputFilters string
+	heuristics   string
+
+	// intent classification, see intent.go
+	intentClassifier string
+	intentModel      string
+	intentRoutes     string
+	clarifyBelow     float64
+	geoIP            string
+	units            string
+	logContent       string
+	conversationIdle time.Duration
+	eventLog         string
+	weatherProvider  string
+	weatherAPIKey    string
+	searchProvider   string
+	searxngURL       string
+	sseFlushInterval time.Duration
+	sseFlushBytes    int
+	sseGzip          bool
+	maxImageBytes    int
+
+	// history trimming, see history.go
+	historyStrategy string
+	historyMessages int
+	historyTokens   int
+	// most messages kept in memory per conversation, 0 for no limit
+	maxHistoryMessages int
+	modelConfig        string
+
+	// redis:// URL for counters shared between instances
+	redis string
+
+	// access log, see accesslog.go
+	accessLog        string
+	accessLogFormat  string
+	accessLogMaxSize int64
+	accessLogMaxAge  time.Duration
+	accessLogKeep    int
+
+	// sign in with a user and password and/or a token, see auth.go
+	authUser      string
+	authPassword  string
+	authToken     string
+	adminToken    string
+	sessionSecret string
+	sessionTTL    time.Duration
+
+	// encrypts the files with conversation text in them, see seal.go
+	encryptionPassphrase string
+
+	// prompts from MQTT topics, see mqtt.go
+	mqttBroker   string
+	mqttTopics   string
+	mqttClientID string
+	mqttUser     string
+	mqttPassword string
+
+	// prompts by email, see email.go
+	emailFrom    string
+	emailAllow   string
+	emailSecret  string
+	smtpServer   string
+	smtpUser     string
+	smtpPassword string
+
+	// sample data for development, see demo.go
+	demoConversations int
+	demoSeed          uint64
+
+	// look for new releases, off by default, see update.go
+	updateCheck    bool
+	updateRepo     string
+	updateInterval time.Duration
+
+	// tokens per client per day, 0 is unlimited
+	tokenQuota        int
+	minResponseTokens int
+	// chat messages per minute and answers at once, 0 is unlimited
+	rateLimit             int
+	conversationRateLimit int
+	maxConcurrent         int
+
+	// usage reports are POSTed here daily when set
+	reportWebhook string
 }
 
 type application struct {
 	logger *slog.Logger
 	config config
+	// shared by every request to the model server. ollama is nil unless
+	// it's the backend
+	backend    llmBackend
+	ollama     *ollamaBackend
+	pulls      pullTracker
+	benchmarks *benchmarkHistory
+	snippets   *snippetStore
+	// display names and avatars, see profile.go
+	profiles *profileStore
+
+	// applied to every answer before it's stored and sent
+	postProcessors []postProcessor
+	// nil unless -markdown
+	markdown *markdownRenderer
+	// default for conversations without their own, nil for none
+	inputFilter *inputFilter
+
+	// shared between instances with -redis
+	counter usageCounter
+	quota   *tokenQuota
+	limiter *rateLimiter
+	usage   *usageLog
+
+	metrics     *serverMetrics
+	toolCache   *toolCache
+	toolBudgets *toolBudgets
+	clients     clientRegistry
+	streams     sseStreams
+	heuristics  *heuristics
+	tools       *toolRegistry
+	weather     weatherProvider
+	// nil unless -search-provider or -searxng-url is set
+	search searchProvider
+
+	conversations *conversationStore
+	events        *eventLog
+	sessions      *sessionSigner
+	accessLogFile *rotatingFile
+	// picks the instance running cluster wide jobs
+	leader *leaderElection
+
+	classifier   intentClassifier
+	intentRoutes map[string]intentRoute
+	// per-model settings from -model-config
+	models map[string]modelSettings
+	// build of the running binary, see version.go
+	version buildVersion
+	// nil unless -update-check is set
+	updates *updateChecker
+	// nil unless -knowledge-graph is set
+	graph *knowledgeGraph
+	// nil unless -cluster-interval is set
+	clusters *topicClusters
+	// pending reminders, see reminders.go
+	reminders *reminderScheduler
+	// email threads and their conversations, see email.go
+	emailThreads *emailThreads
+}
+
+// registerFlags defines the server's command line flags with their
+// defaults. subcommands that need the server's settings use them too
+func (cfg *config) registerFlags(fs *flag.FlagSet) {
+	fs.IntVar(&cfg.port, "port", 4000, "Web client port")
+	fs.StringVar(&cfg.ollamaModel, "LLM", "llama3.1:8b", "Ollama model to use")
+	fs.StringVar(&cfg.ollamaURL, "Ollama Server", "http://localhost:11434", "Address of the Ollama server, or a comma separated list to spread chats over several")
+	fs.StringVar(&cfg.ollamaBalance, "ollama-balance", balanceRoundRobin, "How chats are spread over several Ollama servers: round-robin or least-loaded")
+	fs.StringVar(&cfg.backend, "backend", backendOllama, "Model server the chat runs on: ollama, or openai for any OpenAI compatible API")
+	fs.StringVar(&cfg.openAIURL, "openai-url", "https://api.openai.com/v1", "Base URL of the OpenAI compatible API, with -backend openai")
+	fs.StringVar(&cfg.openAIKey, "openai-api-key", os.Getenv("OPENAI_API_KEY"), "API key for -openai-url, defaults to $OPENAI_API_KEY")
+	fs.StringVar(&cfg.systemPrompt, "system-prompt", defaultSystemPrompt, "System prompt new conversations start with")
+	fs.StringVar(&cfg.systemPromptFile, "system-prompt-file", "", "File to read the system prompt from, instead of -system-prompt")
+	cfg.options.registerFlags(fs)
+	fs.BoolVar(&cfg.warmup, "warmup", false, "Load the model when a client connects so the first reply is fast")
+	fs.StringVar(&cfg.benchHistory, "bench-history", "benchmarks.jsonl", "File benchmark results are appended to")
+	fs.StringVar(&cfg.snippets, "snippets", "snippets.json", "File snippets are saved to, empty to keep them in memory")
+	fs.StringVar(&cfg.encryptionPassphrase, "encryption-passphrase", os.Getenv("ENCRYPTION_PASSPHRASE"), "Encrypts the -snippets file and state exports with a key derived from it, defaults to $ENCRYPTION_PASSPHRASE")
+	fs.StringVar(&cfg.replyLanguage, "reply-language", "auto", "Language replies are written in: auto (same as the user), off, or a language code")
+	fs.StringVar(&cfg.toolTTLs, "tool-cache-ttl", "get_weather=10m,web_search=10m", "Per-tool result cache lifetimes, e.g. get_weather=10m")
+	fs.StringVar(&cfg.toolBudgets, "tool-budgets", "", "Per-tool call limits, e.g. get_weather=turn:3,conversation:20,hour:60")
+	fs.IntVar(&cfg.maxToolIterations, "max-tool-iterations", 5, "Rounds of tool calls the model may chain in one turn before it has to answer")
+	fs.BoolVar(&cfg.retryWithTools, "retry-with-tools", true, "Retry a turn once with the live data tools when the model answers it has no current information")
+	fs.BoolVar(&cfg.toolProgressSummary, "tool-progress-summary", false, "Append tool progress updates to the tool result sent to the model")
+	fs.BoolVar(&cfg.scratchpad, "scratchpad", false, "Give the model note taking tools scoped to the conversation")
+	fs.BoolVar(&cfg.reminders, "reminders", true, "Let the model set reminders that show up in the chat when they're due")
+	fs.StringVar(&cfg.reminderWebhook, "reminder-webhook", "", "URL due reminders are POSTed to as JSON, in addition to the chat")
+	fs.BoolVar(&cfg.knowledgeGraph, "knowledge-graph", false, "Extract people, projects and other entities from conversations into a graph the model can query")
+	fs.StringVar(&cfg.graphModel, "graph-model", "", "Model that extracts the knowledge graph, defaults to -LLM")
+	fs.DurationVar(&cfg.clusterInterval, "cluster-interval", 0, "Group the conversations by topic this often for /api/clusters, 0 to turn it off")
+	fs.StringVar(&cfg.clusterModel, "cluster-model", "nomic-embed-text", "Embedding model conversations are clustered with")
+	fs.IntVar(&cfg.clusterMax, "cluster-max", 12, "Most topic clusters to make")
+	fs.BoolVar(&cfg.artifacts, "artifacts", false, "Let the model create standalone documents and code files")
+	fs.BoolVar(&cfg.provenance, "provenance", true, "Mark answers as grounded in tool results or as model knowledge")
+	fs.BoolVar(&cfg.markdown, "markdown", false, "Send answers rendered from markdown to sanitized HTML as well")
+	fs.BoolVar(&cfg.injectDate, "inject-date", true, "Tell the model the current date and time, in the user's timezone, on every turn")
+	fs.BoolVar(&cfg.refine, "refine", false, "Have the model review each answer against the question and tool results and revise it before it's shown")
+	fs.StringVar(&cfg.draftModel, "draft-model", "", "Small model that streams a quick draft while -LLM writes the answer, empty for none")
+	fs.StringVar(&cfg.outputFilters, "output-filters", "", "JSON file with rules for stripping boilerplate from answers")
+	fs.StringVar(&cfg.inputFilters, "input-filters", "", "JSON file with profanity and link rules applied to what users write")
+	fs.StringVar(&cfg.heuristics, "heuristics", "", "JSON file with the keyword rules that attach tools, reloaded when it changes")
+	fs.StringVar(&cfg.intentClassifier, "intent-classifier", "keyword", "How to classify prompts: keyword, embedding or llm")
+	fs.StringVar(&cfg.intentModel, "intent-model", "", "Model for the embedding or llm intent classifier")
+	fs.StringVar(&cfg.intentRoutes, "intent-routes", "", "JSON file with the tools, model and persona per intent")
+	fs.StringVar(&cfg.modelConfig, "model-config", "", "JSON file with per-model settings, e.g. the generate API and a prompt template for base models")
+	fs.StringVar(&cfg.weatherProvider, "weather-provider", "", "Weather data source: mock, open-meteo or openweathermap (default openweathermap with an API key, else mock)")
+	fs.StringVar(&cfg.weatherAPIKey, "weather-api-key", "", "OpenWeatherMap API key, or set OPENWEATHERMAP_API_KEY")
+	fs.StringVar(&cfg.searchProvider, "search-provider", "", "Web search for the web_search tool: searxng, duckduckgo or off (default searxng with -searxng-url, else off)")
+	fs.StringVar(&cfg.searxngURL, "searxng-url", "", "Base URL of a SearxNG instance with the JSON format enabled")
+	fs.DurationVar(&cfg.sseFlushInterval, "sse-flush-interval", 0, "Coalesce server-sent events and write them every interval, 0 writes each event at once")
+	fs.IntVar(&cfg.sseFlushBytes, "sse-flush-bytes", 4096, "Write coalesced server-sent events early once this many bytes are buffered")
+	fs.BoolVar(&cfg.sseGzip, "sse-gzip", false, "Gzip server-sent event streams for clients that accept it")
+	fs.StringVar(&cfg.historyStrategy, "history", historyAll, "How the history is trimmed to fit the context: all (no trimming), window, tokens or summary")
+	fs.IntVar(&cfg.historyMessages, "history-messages", 20, "Earlier messages kept with -history window")
+	fs.IntVar(&cfg.historyTokens, "history-tokens", 6000, "Prompt token budget with -history tokens or summary")
+	fs.IntVar(&cfg.maxHistoryMessages, "max-history-messages", 0, "Most messages, besides system messages, a conversation keeps; the oldest turns are dropped beyond it. 0 for no limit")
+	fs.IntVar(&cfg.maxImageBytes, "max-image-size", 5<<20, "Largest image in bytes a user can attach to a message")
+	fs.StringVar(&cfg.eventLog, "event-log", "", "Append analytics events as JSON lines to this file or tcp://, udp:// or unix:// address")
+	fs.DurationVar(&cfg.conversationIdle, "conversation-idle", time.Hour, "How long a conversation is kept after its last client disconnects")
+	fs.StringVar(&cfg.logContent, "log-content", logContentHash, "How message content appears in logs: hash, truncate or full (for development)")
+	fs.StringVar(&cfg.units, "units", "", "Default units for tool results and answers: metric or imperial, empty to leave them as reported")
+	fs.StringVar(&cfg.geoIP, "geoip", "", "GeoIP service for a default location, e.g. http://ip-api.com/json/{ip}")
+	fs.Float64Var(&cfg.clarifyBelow, "clarify-below", 0.5, "Ask a clarification question when intent confidence is below this, 0 to never ask")
+
+	fs.StringVar(&cfg.authUser, "auth-user", "admin", "User name for signing in with -auth-password")
+	fs.StringVar(&cfg.authPassword, "auth-password", os.Getenv("AUTH_PASSWORD"), "Password required to use the chat, defaults to $AUTH_PASSWORD")
+	fs.StringVar(&cfg.authToken, "auth-token", os.Getenv("AUTH_TOKEN"), "Token accepted at sign in and as a Bearer token by the API, defaults to $AUTH_TOKEN")
+	fs.StringVar(&cfg.adminToken, "admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token the /admin endpoints require, they're disabled without one, defaults to $ADMIN_TOKEN")
+	fs.StringVar(&cfg.sessionSecret, "session-secret", os.Getenv("SESSION_SECRET"), "Key session cookies are signed with, random per start if empty")
+	fs.DurationVar(&cfg.sessionTTL, "session-ttl", 24*time.Hour, "How long a sign in lasts")
+	fs.StringVar(&cfg.accessLog, "access-log", "", "File to write an access log line per request to, empty to disable")
+	fs.StringVar(&cfg.accessLogFormat, "access-log-format", accessLogCLF, "Access log format: clf or json")
+	fs.Int64Var(&cfg.accessLogMaxSize, "access-log-max-size", 100<<20, "Rotate the access log once it reaches this many bytes, 0 for no limit")
+	fs.DurationVar(&cfg.accessLogMaxAge, "access-log-max-age", 24*time.Hour, "Rotate the access log after this long, 0 for no limit")
+	fs.IntVar(&cfg.accessLogKeep, "access-log-keep", 7, "Rotated access logs to keep")
+	fs.StringVar(&cfg.redis, "redis", "", "Redis URL, e.g. redis://localhost:6379/0, to share quota counts between instances")
+	fs.IntVar(&cfg.tokenQuota, "token-quota", 0, "Tokens each client IP may use per day, 0 for no limit")
+	fs.IntVar(&cfg.minResponseTokens, "min-response-tokens", 256, "Tokens that must be left in the quota for an answer before a message is accepted")
+	fs.IntVar(&cfg.rateLimit, "rate-limit", 60, "Chat messages each client IP may send per minute, 0 for no limit")
+	fs.IntVar(&cfg.conversationRateLimit, "conversation-rate-limit", 20, "Chat messages per minute in one conversation, 0 for no limit")
+	fs.IntVar(&cfg.maxConcurrent, "max-concurrent", 3, "Answers each client IP may have queued or running at once, 0 for no limit")
+	fs.BoolVar(&cfg.updateCheck, "update-check", false, "Check GitHub for new releases and report them on /version")
+	fs.StringVar(&cfg.updateRepo, "update-repo", "topcutter/ollama_webchat_go", "GitHub repository checked with -update-check")
+	fs.DurationVar(&cfg.updateInterval, "update-interval", 24*time.Hour, "How often to check for new releases")
+	fs.StringVar(&cfg.mqttBroker, "mqtt-broker", "", "MQTT broker to take prompts from, e.g. tcp://localhost:1883")
+	fs.StringVar(&cfg.mqttTopics, "mqtt-topics", "", "MQTT topics to answer and where to reply, e.g. home/ask=home/answer,sensors/+/ask (replies to <topic>/reply)")
+	fs.StringVar(&cfg.mqttClientID, "mqtt-client-id", "", "MQTT client id, empty lets the broker assign one")
+	fs.StringVar(&cfg.mqttUser, "mqtt-user", "", "MQTT user name")
+	fs.StringVar(&cfg.mqttPassword, "mqtt-password", os.Getenv("MQTT_PASSWORD"), "MQTT password, defaults to $MQTT_PASSWORD")
+	fs.StringVar(&cfg.emailFrom, "email-from", "", "Address email answers are sent from, enables the inbound email webhook at /email/inbound")
+	fs.StringVar(&cfg.emailAllow, "email-allow", "", "Addresses and @domains whose email is answered, e.g. alice@example.com,@example.org, empty for anyone, which needs -email-webhook-secret")
+	fs.StringVar(&cfg.emailSecret, "email-webhook-secret", os.Getenv("EMAIL_WEBHOOK_SECRET"), "Secret the inbound email webhook requires, as a bearer token or basic auth password, defaults to $EMAIL_WEBHOOK_SECRET")
+	fs.StringVar(&cfg.smtpServer, "smtp-server", "", "SMTP server email answers are sent through, e.g. smtp.example.com:587")
+	fs.StringVar(&cfg.smtpUser, "smtp-user", "", "SMTP user name")
+	fs.StringVar(&cfg.smtpPassword, "smtp-password", os.Getenv("SMTP_PASSWORD"), "SMTP password, defaults to $SMTP_PASSWORD")
+	fs.IntVar(&cfg.demoConversations, "demo-data", 0, "Seed this many sample conversations and their usage on start, for development")
+	fs.Uint64Var(&cfg.demoSeed, "demo-seed", 1, "Random seed for -demo-data, the same seed gives the same data")
+	fs.StringVar(&cfg.reportWebhook, "report-webhook", "", "URL the daily and weekly usage reports are POSTed to")
 }
 
 func main() {
+	// subcommands are handled before the server flags are parsed
+	if len(os.Args) > 1 {
+		var run func([]string) error
+		switch os.Args[1] {
+		case "bench":
+			run = runBenchCommand
+		case "doctor":
+			run = runDoctorCommand
+		case "abtest":
+			run = runABTestCommand
+		case "export":
+			run = runExportCommand
+		case "import":
+			run = runImportCommand
+		}
+		if run != nil {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	var cfg config
 
 	// Create a LevelVar to control the log level dynamically
 	var levelVar slog.LevelVar
-	levelVar.Set(slog.LevelDebug) // set to LevelInfo if you don't want to see 
+	levelVar.Set(slog.LevelDebug) // set to LevelInfo if you don't want to see
 	// ai response in the terminal
 
 	// Create a logger with a handler that respects the level
@@ -340,31 +1127,366 @@ func main() {
 		Level: &levelVar,
 	}))
 
-	// command line flags with standard defaults
-	flag.IntVar(&cfg.port, "port", 4000, "Web client port")
-	flag.StringVar(&cfg.ollamaModel, "LLM", "llama3.1:8b", "Ollama model to use")
-	flag.StringVar(&cfg.ollamaURL, "Ollama Server", "http://localhost:11434", "Address of the Ollama server")
-
+	cfg.registerFlags(flag.CommandLine)
 	flag.Parse()
 
+	if cfg.units != "" && cfg.units != unitsMetric && cfg.units != unitsImperial {
+		logger.Error("-units must be metric or imperial")
+		os.Exit(1)
+	}
+	if err := cfg.options.validate(); err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	if err := cfg.loadSystemPrompt(); err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	if cfg.clusterInterval > 0 && (cfg.clusterInterval < time.Minute || cfg.clusterMax < 1) {
+		logger.Error("-cluster-interval must be at least a minute and -cluster-max at least 1")
+		os.Exit(1)
+	}
+	if cfg.maxToolIterations < 1 {
+		logger.Error("-max-tool-iterations must be at least 1")
+		os.Exit(1)
+	}
+	if cfg.updateCheck && cfg.updateInterval < time.Minute {
+		logger.Error("-update-interval must be at least a minute")
+		os.Exit(1)
+	}
+	if cfg.emailFrom != "" {
+		if _, err := mail.ParseAddress(cfg.emailFrom); err != nil {
+			logger.Error(fmt.Sprintf("-email-from is not an email address: %v", err))
+			os.Exit(1)
+		}
+		if cfg.smtpServer == "" {
+			logger.Error("-email-from needs -smtp-server")
+			os.Exit(1)
+		}
+		// From can be forged, without either anyone could have the
+		// server mail answers to any address
+		if cfg.emailAllow == "" && cfg.emailSecret == "" {
+			logger.Error("-email-from needs -email-allow or -email-webhook-secret")
+			os.Exit(1)
+		}
+	}
+	if cfg.accessLogFormat != accessLogCLF && cfg.accessLogFormat != accessLogJSON {
+		logger.Error("-access-log-format must be clf or json")
+		os.Exit(1)
+	}
+
+	switch cfg.historyStrategy {
+	case historyAll, historyWindow, historyTokens, historySummary:
+	default:
+		logger.Error("-history must be all, window, tokens or summary")
+		os.Exit(1)
+	}
+	if cfg.maxHistoryMessages < 0 {
+		logger.Error("-max-history-messages can't be negative")
+		os.Exit(1)
+	}
+
+	switch cfg.logContent {
+	case logContentHash, logContentTruncate, logContentFull:
+	default:
+		logger.Error("-log-content must be hash, truncate or full")
+		os.Exit(1)
+	}
+
+	toolTTLs, err := parseToolTTLs(cfg.toolTTLs)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	toolBudgets, err := parseToolBudgets(cfg.toolBudgets)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	rdb, err := newRedisClient(cfg.redis)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	counter := newUsageCounter(rdb, logger)
+
+	backend, ollama, err := newBackend(cfg)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	snippets, err := loadSnippets(cfg.snippets, cfg.encryptionPassphrase)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
 	// Declare an instance of the application struct that will
 	// be used for dependency injection
 	app := &application{
-		logger: logger,
-		config: cfg,
+		logger:      logger,
+		config:      cfg,
+		backend:     backend,
+		ollama:      ollama,
+		benchmarks:  &benchmarkHistory{path: cfg.benchHistory},
+		snippets:    snippets,
+		metrics:     newServerMetrics(),
+		toolCache:   newToolCache(toolTTLs),
+		toolBudgets: newToolBudgets(toolBudgets),
+		counter:     counter,
+		quota:       newTokenQuota(cfg.tokenQuota, 24*time.Hour, counter),
+		limiter:     newRateLimiter(cfg.rateLimit, cfg.conversationRateLimit, cfg.maxConcurrent, counter),
+		usage:       &usageLog{retention: 31 * 24 * time.Hour},
+
+		conversations: newConversationStore(cfg.conversationIdle),
+		sessions:      newSessionSigner(cfg.sessionSecret, cfg.sessionTTL),
+		leader:        newLeaderElection(rdb, logger),
+		reminders:     newReminderScheduler(),
+		profiles:      newProfileStore(),
+		version:       readBuildVersion(),
+	}
+
+	if cfg.markdown {
+		app.markdown = newMarkdownRenderer()
+	}
+
+	if cfg.inputFilters != "" {
+		app.inputFilter, err = loadInputFilter(cfg.inputFilters)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if cfg.outputFilters != "" {
+		filter, err := loadOutputFilter(cfg.outputFilters)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		app.postProcessors = append(app.postProcessors, filter)
+	}
+
+	app.weather, err = newWeatherProvider(cfg.weatherProvider, cfg.weatherAPIKey)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	app.search, err = newSearchProvider(cfg.searchProvider, cfg.searxngURL)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	if cfg.knowledgeGraph {
+		app.graph = newKnowledgeGraph()
+	}
+
+	app.tools = newToolRegistry()
+	if err := app.registerTools(); err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	heuristics, err := newHeuristics(cfg.heuristics, app.tools)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	app.heuristics = heuristics
+
+	if cfg.accessLog != "" {
+		app.accessLogFile, err = openRotatingFile(cfg.accessLog, cfg.accessLogMaxSize, cfg.accessLogMaxAge, cfg.accessLogKeep)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if cfg.eventLog != "" {
+		app.events, err = openEventLog(cfg.eventLog, logger)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	app.models, err = loadModelSettings(cfg.modelConfig)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	app.intentRoutes, err = loadIntentRoutes(cfg.intentRoutes, app.tools)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	app.classifier, err = app.newIntentClassifier(cfg.intentClassifier)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	if cfg.demoConversations > 0 {
+		ids := app.seedDemoData(cfg.demoConversations, cfg.demoSeed)
+		logger.Info("Seeded demo data", "conversations", len(ids), "first", ids[0])
 	}
 
 	http.HandleFunc("/", app.handleHome)
 	http.HandleFunc("/ws", app.handleWebSocket)
+	http.HandleFunc("GET /ws/watch", app.handleWatch)
+	http.HandleFunc("GET /metrics", app.handleMetrics)
+	http.HandleFunc("GET /version", app.handleVersion)
+	http.HandleFunc("GET /healthz", app.handleHealthz)
+	http.HandleFunc("GET /readyz", app.handleReadyz)
+
+	// conversation history
+	http.HandleFunc("GET /api/stream", app.handleChatStream)
+	http.HandleFunc("POST /api/chat", app.handleChatPost)
+	http.HandleFunc("GET /api/stats", app.handleStats)
+	http.HandleFunc("GET /api/models", app.handleListModels)
+	http.HandleFunc("GET /api/snippets", app.handleListSnippets)
+	http.HandleFunc("PUT /api/snippets/{name}", app.handlePutSnippet)
+	http.HandleFunc("DELETE /api/snippets/{name}", app.handleDeleteSnippet)
+	http.HandleFunc("GET /api/conversations", app.handleListConversations)
+	http.HandleFunc("POST /api/conversations", app.handleCreateConversation)
+	http.HandleFunc("PATCH /api/conversations/{conversation}", app.handleUpdateConversation)
+	http.HandleFunc("DELETE /api/conversations/{conversation}", app.handleDeleteConversation)
+	http.HandleFunc("POST /api/conversations/{conversation}/merge", app.handleMergeConversation)
+	http.HandleFunc("GET /api/profile", app.handleGetProfile)
+	http.HandleFunc("PUT /api/profile", app.handlePutProfile)
+	http.HandleFunc("PUT /api/profile/avatar", app.handlePutAvatar)
+	http.HandleFunc("DELETE /api/profile/avatar", app.handleDeleteAvatar)
+	http.HandleFunc("GET /api/avatars/{id}", app.handleGetAvatar)
+	http.HandleFunc("POST /api/conversations/{conversation}/archive", app.handleArchiveConversation)
+	http.HandleFunc("DELETE /api/conversations/{conversation}/archive", app.handleUnarchiveConversation)
+	http.HandleFunc("GET /api/conversations/{conversation}/messages", app.handleListMessages)
+	http.HandleFunc("PATCH /api/conversations/{conversation}/messages/{id}", app.handleEditMessage)
+	http.HandleFunc("DELETE /api/conversations/{conversation}/messages/{id}", app.handleDeleteMessage)
+	http.HandleFunc("GET /api/conversations/{conversation}/messages/{id}/tables/{n}", app.handleTableCSV)
+	http.HandleFunc("GET /api/conversations/{conversation}/messages/{id}/request", app.handleMessageRequest)
+	http.HandleFunc("GET /api/conversations/{conversation}/messages/{id}/refinement", app.handleMessageRefinement)
+	http.HandleFunc("GET /api/conversations/{conversation}/replay", app.handleReplay)
+	http.HandleFunc("GET /api/conversations/{conversation}/scratchpad", app.handleScratchpad)
+	http.HandleFunc("GET /api/conversations/{conversation}/artifacts", app.handleListArtifacts)
+	http.HandleFunc("GET /api/conversations/{conversation}/artifacts/{name}", app.handleDownloadArtifact)
+
+	// OpenAI compatible API
+	http.HandleFunc("POST /v1/chat/completions", app.handleChatCompletions)
+	http.HandleFunc("GET /v1/models", app.handleOpenAIModels)
+
+	// sign in, only needed with -auth-password or -auth-token
+	http.HandleFunc("GET /login", app.handleLoginPage)
+	http.HandleFunc("POST /login", app.handleLogin)
+	http.HandleFunc("POST /logout", app.handleLogout)
+
+	// admin endpoints take the -admin-token, without one they answer 404
+	admin := func(pattern string, handler http.HandlerFunc) {
+		if cfg.adminToken != "" {
+			http.Handle(pattern, app.requireAdmin(handler))
+		}
+	}
+	if cfg.adminToken == "" {
+		http.HandleFunc("/admin/", func(w http.ResponseWriter, r *http.Request) {
+			app.clientError(w, http.StatusNotFound, "the admin endpoints need -admin-token")
+		})
+	}
+
+	// model housekeeping
+	admin("GET /admin/ollama/servers", app.handleAdminOllamaServers)
+	admin("POST /admin/models/copy", app.handleAdminCopyModel)
+	admin("POST /admin/models/delete", app.handleAdminDeleteModel)
+	admin("POST /admin/models/pull", app.handleAdminPullModel)
+	admin("POST /admin/models/pull/cancel", app.handleAdminCancelPull)
+	admin("POST /admin/benchmark", app.handleAdminRunBenchmark)
+	admin("GET /admin/benchmark", app.handleAdminBenchmarkHistory)
+	admin("POST /admin/tools/cache/bust", app.handleAdminBustToolCache)
+	admin("POST /admin/system-event", app.handleAdminSystemEvent)
+	admin("GET /admin/reports/usage", app.handleUsageReport)
+	admin("PUT /admin/snippets/{name}", app.handleAdminPutSnippet)
+	admin("DELETE /admin/snippets/{name}", app.handleAdminDeleteSnippet)
+	admin("POST /admin/conversations/{conversation}/takeover", app.handleAdminTakeover)
+	admin("POST /admin/conversations/{conversation}/handback", app.handleAdminHandback)
+	admin("POST /admin/conversations/{conversation}/reply", app.handleAdminOperatorReply)
+	admin("GET /admin/conversations/{conversation}/input-filter", app.handleAdminGetInputFilter)
+	admin("PUT /admin/conversations/{conversation}/input-filter", app.handleAdminPutInputFilter)
+	admin("DELETE /admin/conversations/{conversation}/input-filter", app.handleAdminDeleteInputFilter)
+	admin("GET /admin/state", app.handleAdminExportState)
+	admin("POST /admin/state", app.handleAdminImportState)
+
+	// knowledge graph, only with -knowledge-graph
+	if app.graph != nil {
+		http.HandleFunc("GET /api/graph/entities", app.handleListEntities)
+		http.HandleFunc("GET /api/graph/entities/{name}", app.handleGetEntity)
+	}
+
+	// topic clusters, only with -cluster-interval
+	if cfg.clusterInterval > 0 {
+		app.clusters = newTopicClusters()
+		http.HandleFunc("GET /api/clusters", app.handleClusters)
+	}
+
+	// answers by email, only with -email-from
+	if cfg.emailFrom != "" {
+		app.emailThreads = newEmailThreads()
+		http.HandleFunc("POST /email/inbound", app.handleInboundEmail)
+	}
+
+	if cfg.mqttBroker != "" {
+		if err := app.startMQTT(); err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	go app.leader.run(context.Background())
+	if cfg.updateCheck {
+		app.updates = newUpdateChecker(cfg.updateRepo, app.version.Version, logger)
+		go app.updates.run(context.Background(), cfg.updateInterval)
+	}
+	if cfg.reportWebhook != "" {
+		go app.leader.whileLeading(context.Background(), "usage reports", app.runUsageReports)
+	}
+	if cfg.heuristics != "" {
+		go app.watchHeuristics(context.Background(), 2*time.Second)
+	}
+	go app.expireConversations(context.Background(), time.Minute)
+	if ollama, ok := app.backend.(*ollamaBackend); ok && len(ollama.servers) > 1 {
+		go ollama.checkHealth(context.Background(), ollamaHealthInterval, logger)
+	}
+	if app.graph != nil {
+		go app.runGraphExtraction(context.Background())
+	}
+	if app.clusters != nil {
+		go app.runClustering(context.Background(), cfg.clusterInterval)
+	}
+	if cfg.reminders {
+		go app.reminders.run(context.Background(), app.deliverReminder)
+	}
 
 	httpport := fmt.Sprintf(":%d", app.config.port)
-	logger.Info("Starting web server", "Addr", "http://localhost", "Port", httpport)
-	logger.Info("Make sure Ollama is running", "Addr", app.config.ollamaURL)
+	logger.Info("Starting web server", "Addr", "http://localhost", "Port", httpport, "Build", app.version.Build)
+	if app.ollama != nil {
+		logger.Info("Make sure Ollama is running", "Addr", app.config.ollamaURL)
+	} else {
+		logger.Info("Using an OpenAI compatible API", "Addr", app.config.openAIURL)
+	}
 	logger.Info("Current model", "Model", app.config.ollamaModel)
 
-	log.Fatal(http.ListenAndServe(httpport, nil))
-}
+	if !app.authEnabled() {
+		logger.Warn("No -auth-password or -auth-token set, anyone who can reach the server can use it")
+	}
+	if cfg.adminToken == "" {
+		logger.Info("No -admin-token set, the /admin endpoints are disabled")
+	}
 
+	log.Fatal(http.ListenAndServe(httpport, app.accessLog(app.requireAuth(http.DefaultServeMux))))
+}
 
 // provides mock weather data for the location provided by the prompt
 // most LLMs expect tools to return JSON. If the information is not
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// with -markdown answers are also sent rendered as HTML, in the html
+// field next to the raw content, so the page doesn't need a markdown
+// parser of its own. the model writes the markdown and could be talked
+// into writing anything, so the HTML is sanitized before it's sent
+type markdownRenderer struct {
+	md     goldmark.Markdown
+	policy *bluemonday.Policy
+}
+
+func newMarkdownRenderer() *markdownRenderer {
+	// raw HTML in the markdown is left out by goldmark already, the
+	// policy is what keeps scripts, styles and handlers out for sure
+	policy := bluemonday.UGCPolicy()
+	// the language of a fenced code block, for highlighting
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+#.-]+$`)).OnElements("code")
+	policy.AddTargetBlankToFullyQualifiedLinks(true)
+
+	return &markdownRenderer{
+		md:     goldmark.New(goldmark.WithExtensions(extension.GFM)),
+		policy: policy,
+	}
+}
+
+func (m *markdownRenderer) render(content string) (string, error) {
+	var buf bytes.Buffer
+	if err := m.md.Convert([]byte(content), &buf); err != nil {
+		return "", err
+	}
+	return m.policy.Sanitize(buf.String()), nil
+}
+
+// renderHTML returns content as sanitized HTML, "" when -markdown is off
+func (app *application) renderHTML(content string) string {
+	if app.markdown == nil || content == "" {
+		return ""
+	}
+	html, err := app.markdown.render(content)
+	if err != nil {
+		app.logger.Error(fmt.Sprintf("Error rendering markdown: %v", err))
+		return ""
+	}
+	return html
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// merging folds one conversation into another, for a topic that got
+// split across two threads. the source is deleted afterwards
+const (
+	mergeInterleave = "interleave"
+	mergeAppend     = "append"
+)
+
+// mergeTurns splits messages into system messages and turns, a turn
+// being a user message and everything up to the next one. turns are
+// merged whole so tool calls stay next to their results
+func mergeTurns(msgs []*chatMessage) (system []*chatMessage, turns [][]*chatMessage) {
+	for _, m := range msgs {
+		switch {
+		case m.Role == "system":
+			system = append(system, m)
+		case m.Role == "user" || len(turns) == 0:
+			turns = append(turns, []*chatMessage{m})
+		default:
+			turns[len(turns)-1] = append(turns[len(turns)-1], m)
+		}
+	}
+	return system, turns
+}
+
+// merge moves the history of src into c, interleaved by the time each
+// turn started or appended after c's own. only c's system prompt is
+// kept, unless it has none. the messages are renumbered, and get a
+// version no client has seen so edits based on the old numbers fail.
+// the summary is dropped so it's written again for the merged history,
+// src is left empty
+func (c *conversation) merge(src *conversation, mode string) {
+	// turns of either conversation can't run while they're merged
+	first, second := c, src
+	if src.id < c.id {
+		first, second = src, c
+	}
+	first.turn.lock(func(int) {})
+	defer first.turn.unlock()
+	second.turn.lock(func(int) {})
+	defer second.turn.unlock()
+
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	second.mu.Lock()
+	defer second.mu.Unlock()
+
+	system, turns := mergeTurns(c.messages)
+	srcSystem, srcTurns := mergeTurns(src.messages)
+	if len(system) == 0 {
+		system = srcSystem
+	}
+	turns = append(turns, srcTurns...)
+	if mode == mergeInterleave {
+		slices.SortStableFunc(turns, func(a, b []*chatMessage) int {
+			return a[0].Created.Compare(b[0].Created)
+		})
+	}
+
+	version := max(c.version, src.version) + 1
+	merged := make([]*chatMessage, 0, len(c.messages)+len(src.messages))
+	for _, m := range slices.Concat(append([][]*chatMessage{system}, turns...)...) {
+		m.ID = len(merged) + 1
+		m.Version = version
+		merged = append(merged, m)
+	}
+	c.messages = merged
+	c.nextID = len(merged)
+	c.version = version
+
+	c.summary, c.summaryUpTo = "", 0
+	c.graphUpTo = 0
+	c.title = ""
+	if c.toolCalls == nil && len(src.toolCalls) > 0 {
+		c.toolCalls = make(map[string]int)
+	}
+	for tool, n := range src.toolCalls {
+		c.toolCalls[tool] += n
+	}
+	if c.notes == nil && len(src.notes) > 0 {
+		c.notes = make(map[string]scratchNote)
+	}
+	for title, note := range src.notes {
+		if _, ok := c.notes[title]; !ok {
+			c.notes[title] = note
+		}
+	}
+	c.artifacts.adopt(&src.artifacts)
+
+	// the messages belong to c now
+	src.messages = nil
+	src.version = version
+}
+
+// adopt takes over the artifacts of src that s doesn't have one of the
+// same name of
+func (s *artifactStore) adopt(src *artifactStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	src.mu.Lock()
+	defer src.mu.Unlock()
+
+	for name, a := range src.byName {
+		if _, ok := s.byName[name]; ok {
+			continue
+		}
+		if s.byName == nil {
+			s.byName = make(map[string]*artifact)
+		}
+		s.byName[name] = a
+	}
+}
+
+// merges another of the caller's conversations into this one and
+// deletes it, 409 while a socket is attached to the other one. the title
+// is the one given, or the merged history's
+func (app *application) handleMergeConversation(w http.ResponseWriter, r *http.Request) {
+	owner := app.owner(r)
+	conv, ok := app.ownedConversation(r.PathValue("conversation"), owner)
+	if !ok {
+		app.clientError(w, http.StatusNotFound, "conversation not found")
+		return
+	}
+
+	var input struct {
+		From  string `json:"from"`
+		Mode  string `json:"mode"`
+		Title string `json:"title"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch input.Mode {
+	case "":
+		input.Mode = mergeInterleave
+	case mergeInterleave, mergeAppend:
+	default:
+		app.clientError(w, http.StatusBadRequest, "mode must be interleave or append")
+		return
+	}
+	src, ok := app.ownedConversation(input.From, owner)
+	if !ok {
+		app.clientError(w, http.StatusNotFound, "conversation to merge not found")
+		return
+	}
+	if src == conv {
+		app.clientError(w, http.StatusBadRequest, "a conversation can't be merged into itself")
+		return
+	}
+	// a socket still on src would go on chatting in a conversation
+	// nobody can find. src is gone before the merge, so none attaches
+	// while it runs
+	if !app.conversations.removeUnattached(src.id) {
+		app.clientError(w, http.StatusConflict, "the conversation to merge is open somewhere, switch away from it first")
+		return
+	}
+
+	conv.merge(src, input.Mode)
+	conv.setTitle(strings.TrimSpace(input.Title))
+	app.logger.Info("Conversations merged", "conversation", conv.id, "from", src.id, "mode", input.Mode)
+
+	now := time.Now().Format("15:04:05")
+	app.clients.sendTo(conv.id, Message{
+		Type:    "system",
+		Event:   eventMerged,
+		Content: "Another conversation was merged into this one.",
+		Time:    now,
+	})
+	// only watchers are left on src
+	app.clients.sendTo(src.id, Message{
+		Type:    "system",
+		Event:   eventNotice,
+		Content: "This conversation was merged into " + conv.info().Title + ".",
+		Time:    now,
+	})
+	app.writeJSON(w, http.StatusOK, conv.info())
+}
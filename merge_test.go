@@ -0,0 +1,80 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestMergeTurns(t *testing.T) {
+	msg := func(role, content string) *chatMessage {
+		return &chatMessage{Message: api.Message{Role: role, Content: content}}
+	}
+
+	tests := []struct {
+		name   string
+		msgs   []*chatMessage
+		system []string
+		turns  [][]string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:   "system only",
+			msgs:   []*chatMessage{msg("system", "s")},
+			system: []string{"s"},
+		},
+		{
+			name: "turns with tool calls",
+			msgs: []*chatMessage{
+				msg("system", "s"),
+				msg("user", "u1"),
+				msg("assistant", ""),
+				msg("tool", "t1"),
+				msg("assistant", "a1"),
+				msg("user", "u2"),
+				msg("assistant", "a2"),
+			},
+			system: []string{"s"},
+			turns:  [][]string{{"u1", "", "t1", "a1"}, {"u2", "a2"}},
+		},
+		{
+			name:  "answer before the first user message starts a turn",
+			msgs:  []*chatMessage{msg("assistant", "hello"), msg("user", "u1")},
+			turns: [][]string{{"hello"}, {"u1"}},
+		},
+		{
+			name:   "system message in the middle stays a system message",
+			msgs:   []*chatMessage{msg("user", "u1"), msg("system", "s"), msg("assistant", "a1")},
+			system: []string{"s"},
+			turns:  [][]string{{"u1", "a1"}},
+		},
+	}
+
+	contents := func(msgs []*chatMessage) []string {
+		var out []string
+		for _, m := range msgs {
+			out = append(out, m.Content)
+		}
+		return out
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			system, turns := mergeTurns(tt.msgs)
+			if got := contents(system); !slices.Equal(got, tt.system) {
+				t.Errorf("system = %q, want %q", got, tt.system)
+			}
+			if len(turns) != len(tt.turns) {
+				t.Fatalf("got %d turns, want %d", len(turns), len(tt.turns))
+			}
+			for i, turn := range turns {
+				if got := contents(turn); !slices.Equal(got, tt.turns[i]) {
+					t.Errorf("turn %d = %q, want %q", i, got, tt.turns[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// lists the conversation history with message ids and versions
+func (app *application) handleListMessages(w http.ResponseWriter, r *http.Request) {
+	conv, ok := app.ownConversation(w, r)
+	if !ok {
+		return
+	}
+
+	msgs, version := conv.snapshot()
+	if app.markdown == nil {
+		app.writeJSON(w, http.StatusOK, map[string]any{
+			"version":  version,
+			"messages": msgs,
+		})
+		return
+	}
+
+	// answers come with their HTML, as they do on the websocket
+	type renderedMessage struct {
+		chatMessage
+		HTML string `json:"html,omitempty"`
+	}
+	rendered := make([]renderedMessage, len(msgs))
+	for i, m := range msgs {
+		rendered[i] = renderedMessage{chatMessage: m}
+		if m.Role == "assistant" {
+			rendered[i].HTML = app.renderHTML(m.Content)
+		}
+	}
+	app.writeJSON(w, http.StatusOK, map[string]any{
+		"version":  version,
+		"messages": rendered,
+	})
+}
+
+// changes the content of a message. the request has to include the
+// version of the message it was based on
+func (app *application) handleEditMessage(w http.ResponseWriter, r *http.Request) {
+	conv, ok := app.ownConversation(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		app.clientError(w, http.StatusNotFound, "message not found")
+		return
+	}
+
+	var input struct {
+		Content string `json:"content"`
+		Version int    `json:"version"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	msg, err := conv.edit(id, input.Version, input.Content)
+	if err != nil {
+		app.messageError(w, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, msg)
+}
+
+// removes a message, the expected version is passed as ?version=
+func (app *application) handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	conv, ok := app.ownConversation(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		app.clientError(w, http.StatusNotFound, "message not found")
+		return
+	}
+
+	version, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest, "version query parameter is required")
+		return
+	}
+
+	if err := conv.delete(id, version); err != nil {
+		app.messageError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// messageError maps conversation errors to responses. conflicts are
+// returned with the current version so the client can refetch and retry
+func (app *application) messageError(w http.ResponseWriter, err error) {
+	var conflict *versionConflictError
+	switch {
+	case errors.As(err, &conflict):
+		app.writeJSON(w, http.StatusConflict, map[string]any{
+			"error":    "version_conflict",
+			"message":  conflict.Error(),
+			"conflict": conflict,
+		})
+	case errors.Is(err, errMessageNotFound):
+		app.clientError(w, http.StatusNotFound, err.Error())
+	default:
+		app.serverError(w, err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ollamaLatencyBuckets are the upper bounds in seconds of the Ollama
+// request latency histogram, from a cached short answer to a cold load
+var ollamaLatencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// histogram counts observations into cumulative buckets
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64, buckets []float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(buckets))
+	}
+	for i, le := range buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// serverMetrics counts what the server does for /metrics. counters are
+// keyed by label value. a nil serverMetrics counts nothing
+type serverMetrics struct {
+	mu sync.Mutex
+
+	messages int
+	answers  int
+	// by model, "" when there was none
+	errors map[string]int
+
+	ollamaLatency  map[string]*histogram
+	ollamaFailures map[string]int
+	// by model, then "prompt" or "completion"
+	tokens map[string]map[string]int
+
+	toolCalls map[string]int
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		errors:         make(map[string]int),
+		ollamaLatency:  make(map[string]*histogram),
+		ollamaFailures: make(map[string]int),
+		tokens:         make(map[string]map[string]int),
+		toolCalls:      make(map[string]int),
+	}
+}
+
+// observeEvent counts an analytics event. every source of turns (the
+// websocket, the OpenAI API, MQTT, email) already emits them
+func (m *serverMetrics) observeEvent(e event) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch e.Type {
+	case eventMessage:
+		m.messages++
+	case eventAnswer:
+		m.answers++
+	case eventError:
+		m.errors[e.Model]++
+	case eventToolCall:
+		m.toolCalls[e.Tool]++
+	}
+}
+
+// observeOllama records a chat request to Ollama and its token counts
+func (m *serverMetrics) observeOllama(model string, took time.Duration, promptTokens, completionTokens int, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.ollamaLatency[model]
+	if !ok {
+		h = &histogram{}
+		m.ollamaLatency[model] = h
+	}
+	h.observe(took.Seconds(), ollamaLatencyBuckets)
+	if err != nil {
+		m.ollamaFailures[model]++
+	}
+	if m.tokens[model] == nil {
+		m.tokens[model] = make(map[string]int)
+	}
+	m.tokens[model]["prompt"] += promptTokens
+	m.tokens[model]["completion"] += completionTokens
+}
+
+func (r *clientRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.clients)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func (m *serverMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeMetricHeader(w, "chat_messages_total", "counter", "User messages received, from any source.")
+	fmt.Fprintf(w, "chat_messages_total %d\n", m.messages)
+
+	writeMetricHeader(w, "chat_answers_total", "counter", "Answers sent.")
+	fmt.Fprintf(w, "chat_answers_total %d\n", m.answers)
+
+	writeMetricHeader(w, "chat_errors_total", "counter", "Turns that failed, by model.")
+	for _, model := range sortedKeys(m.errors) {
+		fmt.Fprintf(w, "chat_errors_total{model=%q} %d\n", model, m.errors[model])
+	}
+
+	writeMetricHeader(w, "ollama_request_duration_seconds", "histogram", "Time taken by chat requests to Ollama, by model.")
+	for _, model := range sortedKeys(m.ollamaLatency) {
+		h := m.ollamaLatency[model]
+		for i, le := range ollamaLatencyBuckets {
+			fmt.Fprintf(w, "ollama_request_duration_seconds_bucket{model=%q,le=\"%g\"} %d\n", model, le, h.counts[i])
+		}
+		fmt.Fprintf(w, "ollama_request_duration_seconds_bucket{model=%q,le=\"+Inf\"} %d\n", model, h.count)
+		fmt.Fprintf(w, "ollama_request_duration_seconds_sum{model=%q} %g\n", model, h.sum)
+		fmt.Fprintf(w, "ollama_request_duration_seconds_count{model=%q} %d\n", model, h.count)
+	}
+
+	writeMetricHeader(w, "ollama_request_failures_total", "counter", "Chat requests to Ollama that failed, by model.")
+	for _, model := range sortedKeys(m.ollamaFailures) {
+		fmt.Fprintf(w, "ollama_request_failures_total{model=%q} %d\n", model, m.ollamaFailures[model])
+	}
+
+	writeMetricHeader(w, "ollama_tokens_total", "counter", "Tokens Ollama reported, by model and type (prompt or completion).")
+	for _, model := range sortedKeys(m.tokens) {
+		for _, kind := range sortedKeys(m.tokens[model]) {
+			fmt.Fprintf(w, "ollama_tokens_total{model=%q,type=%q} %d\n", model, kind, m.tokens[model][kind])
+		}
+	}
+
+	writeMetricHeader(w, "tool_calls_total", "counter", "Tool calls run, by tool.")
+	for _, tool := range sortedKeys(m.toolCalls) {
+		fmt.Fprintf(w, "tool_calls_total{tool=%q} %d\n", tool, m.toolCalls[tool])
+	}
+}
+
+// serves metrics in the Prometheus text exposition format
+func (app *application) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	app.metrics.write(w)
+
+	writeMetricHeader(w, "websocket_connections", "gauge", "Connected websocket clients.")
+	fmt.Fprintf(w, "websocket_connections %d\n", app.clients.count())
+
+	stats := app.toolCache.snapshot()
+
+	fmt.Fprintln(w, "# HELP tool_cache_hits_total Tool calls answered from the cache.")
+	fmt.Fprintln(w, "# TYPE tool_cache_hits_total counter")
+	for _, s := range stats {
+		fmt.Fprintf(w, "tool_cache_hits_total{tool=%q} %d\n", s.Tool, s.Hits)
+	}
+
+	fmt.Fprintln(w, "# HELP tool_cache_misses_total Cacheable tool calls that had to run the tool.")
+	fmt.Fprintln(w, "# TYPE tool_cache_misses_total counter")
+	for _, s := range stats {
+		fmt.Fprintf(w, "tool_cache_misses_total{tool=%q} %d\n", s.Tool, s.Misses)
+	}
+
+	fmt.Fprintln(w, "# HELP tool_cache_entries Results currently held in the tool cache.")
+	fmt.Fprintln(w, "# TYPE tool_cache_entries gauge")
+	for _, s := range stats {
+		fmt.Fprintf(w, "tool_cache_entries{tool=%q} %d\n", s.Tool, s.Entries)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// which Ollama API a model is called with
+const (
+	modelAPIChat     = "chat"
+	modelAPIGenerate = "generate"
+)
+
+// defaultPromptTemplate renders the conversation as a plain transcript
+// for generate models that don't set their own
+const defaultPromptTemplate = `{{range .Messages}}{{if eq .Role "system"}}{{.Content}}
+
+{{else if eq .Role "user"}}User: {{.Content}}
+{{else if eq .Role "assistant"}}Assistant: {{.Content}}
+{{end}}{{end}}Assistant:`
+
+// modelSettings are the per-model options read from -model-config
+type modelSettings struct {
+	// chat (the default) or generate
+	API string `json:"api"`
+	// text/template turning the conversation into the prompt of a
+	// generate model. it gets .Messages, .System and .Prompt
+	PromptTemplate string `json:"prompt_template"`
+	// replaces the model's own chat template, in Ollama's template
+	// syntax. the model is then called through the generate API with
+	// .Tools available, JSON tool calls in the output are picked up
+	Template string `json:"template"`
+
+	prompt *template.Template
+}
+
+// promptData is what a prompt template is rendered with, named like
+// the variables of Ollama's own templates
+type promptData struct {
+	Messages []api.Message
+	Tools    api.Tools
+	// system messages joined together
+	System string
+	// the latest user message
+	Prompt string
+}
+
+// templateFuncs are the helpers Ollama templates commonly use
+var templateFuncs = template.FuncMap{
+	"json": func(v any) string {
+		js, _ := json.Marshal(v)
+		return string(js)
+	},
+	"currentDate": func() string {
+		return time.Now().Format("2006-01-02")
+	},
+}
+
+// tools reports whether the model can be offered tools
+func (m modelSettings) tools() bool {
+	return m.API != modelAPIGenerate || m.Template != ""
+}
+
+// loadModelSettings reads the per-model settings, keyed by model name
+func loadModelSettings(path string) (map[string]modelSettings, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var models map[string]modelSettings
+	if err := json.Unmarshal(data, &models); err != nil {
+		return nil, fmt.Errorf("invalid model config: %v", err)
+	}
+
+	for name, m := range models {
+		switch m.API {
+		case "":
+			m.API = modelAPIChat
+		case modelAPIChat, modelAPIGenerate:
+		default:
+			return nil, fmt.Errorf("model %q: api must be chat or generate", name)
+		}
+		text := m.PromptTemplate
+		if text == "" {
+			text = defaultPromptTemplate
+		}
+		// the chat API has no way to pass a template
+		if m.Template != "" {
+			m.API = modelAPIGenerate
+			text = m.Template
+		}
+		m.prompt, err = template.New(name).Funcs(templateFuncs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("model %q: invalid prompt template: %v", name, err)
+		}
+		models[name] = m
+	}
+	return models, nil
+}
+
+// modelSettings returns the settings for model, chat if it has none
+func (app *application) modelSettings(model string) modelSettings {
+	if m, ok := app.models[model]; ok {
+		return m
+	}
+	return modelSettings{API: modelAPIChat}
+}
+
+// renderPrompt flattens chat messages into a single prompt
+func (m modelSettings) renderPrompt(msgs []api.Message, tools api.Tools) (string, error) {
+	data := promptData{Messages: msgs}
+	if m.tools() {
+		data.Tools = tools
+	}
+	var system []string
+	for _, msg := range msgs {
+		switch msg.Role {
+		case "system":
+			system = append(system, msg.Content)
+		case "user":
+			data.Prompt = msg.Content
+		}
+	}
+	data.System = strings.Join(system, "\n\n")
+
+	var prompt strings.Builder
+	if err := m.prompt.Execute(&prompt, data); err != nil {
+		return "", err
+	}
+	return prompt.String(), nil
+}
+
+// chat sends req with the API configured for its model. generate models
+// get the conversation rendered into a raw prompt and their responses
+// are handed to fn as chat responses, so callers needn't care which
+// API was used. only generate models with a chat template can call
+// tools, and generate models need the Ollama backend
+func (app *application) chat(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) (err error) {
+	// latency and tokens for /metrics. a cancelled turn isn't a failure
+	start := time.Now()
+	var promptTokens, completionTokens int
+	handle := fn
+	fn = func(resp api.ChatResponse) error {
+		if resp.Done {
+			promptTokens += resp.PromptEvalCount
+			completionTokens += resp.EvalCount
+		}
+		return handle(resp)
+	}
+	defer func() {
+		failed := err
+		if ctx.Err() != nil {
+			failed = nil
+		}
+		app.metrics.observeOllama(req.Model, time.Since(start), promptTokens, completionTokens, failed)
+	}()
+
+	settings := app.modelSettings(req.Model)
+	if settings.API != modelAPIGenerate {
+		return app.backend.Stream(ctx, req, fn)
+	}
+	ollama, ok := app.backend.(*ollamaBackend)
+	if !ok {
+		return fmt.Errorf("%s uses the generate API, which needs the ollama backend", req.Model)
+	}
+
+	prompt, err := settings.renderPrompt(req.Messages, req.Tools)
+	if err != nil {
+		return fmt.Errorf("rendering prompt for %s: %v", req.Model, err)
+	}
+	genReq := &api.GenerateRequest{
+		Model:   req.Model,
+		Prompt:  prompt,
+		Raw:     true,
+		Stream:  req.Stream,
+		Options: req.Options,
+	}
+
+	// a tool call can only be told apart from an answer once the output
+	// is complete, so with tools it's held back until the end
+	holdBack := settings.tools() && len(req.Tools) > 0
+	var output strings.Builder
+	err = ollama.Generate(ctx, genReq, func(resp api.GenerateResponse) error {
+		chunk := api.ChatResponse{
+			Model:      resp.Model,
+			CreatedAt:  resp.CreatedAt,
+			Message:    api.Message{Role: "assistant", Content: resp.Response},
+			Done:       resp.Done,
+			DoneReason: resp.DoneReason,
+			Metrics:    resp.Metrics,
+		}
+		if !holdBack {
+			return fn(chunk)
+		}
+
+		output.WriteString(resp.Response)
+		if !resp.Done {
+			chunk.Message.Content = ""
+			return fn(chunk)
+		}
+		chunk.Message.Content = output.String()
+		if calls := parseToolCalls(chunk.Message.Content); calls != nil {
+			chunk.Message.Content = ""
+			chunk.Message.ToolCalls = calls
+		}
+		return fn(chunk)
+	})
+	// a cancelled turn keeps what was held back
+	if holdBack && err != nil && ctx.Err() != nil {
+		fn(api.ChatResponse{Model: req.Model, Message: api.Message{Role: "assistant", Content: output.String()}})
+	}
+	return err
+}
+
+// parseToolCalls reads tool calls a model wrote as text, either a single
+// {"name": ..., "arguments": ...} object or a list of them. models
+// differ on "arguments" or "parameters" and on wrapping the JSON in a
+// code fence. nil if the text isn't a tool call
+func parseToolCalls(text string) []api.ToolCall {
+	text = strings.TrimSpace(text)
+	text = strings.TrimPrefix(text, "<|python_tag|>")
+	text = strings.TrimPrefix(text, "```json")
+	text = strings.TrimPrefix(text, "```")
+	text = strings.TrimSuffix(text, "```")
+	text = strings.TrimSpace(text)
+
+	type call struct {
+		Name       string                        `json:"name"`
+		Arguments  api.ToolCallFunctionArguments `json:"arguments"`
+		Parameters api.ToolCallFunctionArguments `json:"parameters"`
+	}
+	var calls []call
+	if strings.HasPrefix(text, "[") {
+		if err := json.Unmarshal([]byte(text), &calls); err != nil {
+			return nil
+		}
+	} else {
+		var c call
+		if err := json.Unmarshal([]byte(text), &c); err != nil {
+			return nil
+		}
+		calls = []call{c}
+	}
+
+	var toolCalls []api.ToolCall
+	for i, c := range calls {
+		if c.Name == "" {
+			return nil
+		}
+		args := c.Arguments
+		if args == nil {
+			args = c.Parameters
+		}
+		toolCalls = append(toolCalls, api.ToolCall{Function: api.ToolCallFunction{Index: i, Name: c.Name, Arguments: args}})
+	}
+	return toolCalls
+}
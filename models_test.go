@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseToolCalls(t *testing.T) {
+	type call struct {
+		name string
+		args map[string]any
+	}
+
+	tests := []struct {
+		name string
+		text string
+		want []call
+	}{
+		{
+			name: "single object",
+			text: `{"name": "get_weather", "arguments": {"location": "Paris"}}`,
+			want: []call{{"get_weather", map[string]any{"location": "Paris"}}},
+		},
+		{
+			name: "parameters instead of arguments",
+			text: `{"name": "get_weather", "parameters": {"location": "Paris"}}`,
+			want: []call{{"get_weather", map[string]any{"location": "Paris"}}},
+		},
+		{
+			name: "code fence",
+			text: "```json\n{\"name\": \"get_time\", \"arguments\": {}}\n```",
+			want: []call{{"get_time", map[string]any{}}},
+		},
+		{
+			name: "python tag",
+			text: `<|python_tag|>{"name": "get_time", "arguments": {}}`,
+			want: []call{{"get_time", map[string]any{}}},
+		},
+		{
+			name: "list",
+			text: `[{"name": "a", "arguments": {"x": 1}}, {"name": "b", "arguments": {}}]`,
+			want: []call{{"a", map[string]any{"x": float64(1)}}, {"b", map[string]any{}}},
+		},
+		{
+			name: "plain answer",
+			text: "The weather in Paris is sunny.",
+		},
+		{
+			name: "object without a name",
+			text: `{"location": "Paris"}`,
+		},
+		{
+			name: "list with a nameless call",
+			text: `[{"name": "a", "arguments": {}}, {"arguments": {}}]`,
+		},
+		{
+			name: "broken JSON",
+			text: `{"name": "a", "arguments": {`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseToolCalls(tt.text)
+			if tt.want == nil {
+				if got != nil {
+					t.Fatalf("parseToolCalls = %v, want nil", got)
+				}
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d calls, want %d", len(got), len(tt.want))
+			}
+			for i, want := range tt.want {
+				fn := got[i].Function
+				if fn.Name != want.name || fn.Index != i {
+					t.Errorf("call %d = %s at %d, want %s at %d", i, fn.Name, fn.Index, want.name, i)
+				}
+				if !reflect.DeepEqual(map[string]any(fn.Arguments), want.args) {
+					t.Errorf("call %d arguments = %v, want %v", i, fn.Arguments, want.args)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// setModel picks the model for the conversation, "" goes back to -LLM
+func (c *conversation) setModel(model string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.model = model
+}
+
+func (c *conversation) chosenModel() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.model
+}
+
+// conversationModel is the model answering in conv unless an intent
+// route sends the turn elsewhere
+func (app *application) conversationModel(conv *conversation) string {
+	if model := conv.chosenModel(); model != "" {
+		return model
+	}
+	return app.config.ollamaModel
+}
+
+type modelInfo struct {
+	Name          string `json:"name"`
+	Size          int64  `json:"size"`
+	Family        string `json:"family,omitempty"`
+	ParameterSize string `json:"parameter_size,omitempty"`
+	Quantization  string `json:"quantization,omitempty"`
+}
+
+// installedModels lists the models the Ollama server has
+func (app *application) installedModels(ctx context.Context) ([]modelInfo, error) {
+	list, err := app.backend.ListModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	models := make([]modelInfo, 0, len(list.Models))
+	for _, m := range list.Models {
+		models = append(models, modelInfo{
+			Name:          m.Name,
+			Size:          m.Size,
+			Family:        m.Details.Family,
+			ParameterSize: m.Details.ParameterSize,
+			Quantization:  m.Details.QuantizationLevel,
+		})
+	}
+	return models, nil
+}
+
+// modelInstalled reports whether the Ollama server has model
+func (app *application) modelInstalled(ctx context.Context, model string) (bool, error) {
+	models, err := app.installedModels(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, m := range models {
+		if m.Name == model {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// lists the models a conversation can switch to
+func (app *application) handleListModels(w http.ResponseWriter, r *http.Request) {
+	models, err := app.installedModels(r.Context())
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.writeJSON(w, http.StatusOK, map[string]any{
+		"default": app.config.ollamaModel,
+		"models":  models,
+	})
+}
+
+// switchModel switches the model of the conversation and returns the
+// one it now uses. only installed models are accepted, an empty name
+// restores the default. the error is meant for the user
+func (app *application) switchModel(conv *conversation, model string) (string, error) {
+	model = strings.TrimSpace(model)
+	if model != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		found, err := app.modelInstalled(ctx, model)
+		if err != nil {
+			app.logger.Error(fmt.Sprintf("Error listing models: %v", err))
+			return "", errors.New("the model list isn't available right now")
+		}
+		if !found {
+			return "", fmt.Errorf("%s isn't installed on the server", model)
+		}
+	}
+
+	conv.setModel(model)
+	model = app.conversationModel(conv)
+	app.logger.Info("Conversation model", "conversation", conv.id, "model", model)
+	if app.config.warmup {
+		go app.warmUp(model)
+	}
+	return model, nil
+}
+
+// handleSetModelMessage switches the model of the conversation
+func (app *application) handleSetModelMessage(client *wsClient, conv *conversation, model string) {
+	model, err := app.switchModel(conv, model)
+	if err != nil {
+		client.send(Message{
+			Type:    "notice",
+			Content: err.Error(),
+			Time:    time.Now().Format("15:04:05"),
+		})
+		return
+	}
+	client.send(Message{
+		Type:    "system",
+		Event:   eventModelSwitched,
+		Content: fmt.Sprintf("Now chatting with %s.", model),
+		Time:    time.Now().Format("15:04:05"),
+	})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttClientName is who MQTT turns count against in usage and quotas
+const mqttClientName = "mqtt"
+
+// mqttRoute ties a subscribed topic to the conversation its prompts go
+// to. answers go to reply, or to the message's topic + "/reply"
+type mqttRoute struct {
+	topic string
+	reply string
+	conv  *conversation
+}
+
+// mqttRequest is a JSON payload. a plain text payload is the prompt on
+// its own
+type mqttRequest struct {
+	Prompt       string `json:"prompt"`
+	Conversation string `json:"conversation,omitempty"`
+	ReplyTopic   string `json:"reply_topic,omitempty"`
+}
+
+// mqttReply is sent for JSON requests, plain text requests get the
+// answer as plain text
+type mqttReply struct {
+	Answer       string `json:"answer,omitempty"`
+	Error        string `json:"error,omitempty"`
+	Conversation string `json:"conversation"`
+	ID           int    `json:"id,omitempty"`
+}
+
+// parseMQTTTopics reads a list like "home/ask=home/answer,sensors/+/ask".
+// wildcards are allowed in the subscribed topic
+func parseMQTTTopics(s string) ([]mqttRoute, error) {
+	var routes []mqttRoute
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		topic, reply, _ := strings.Cut(part, "=")
+		topic, reply = strings.TrimSpace(topic), strings.TrimSpace(reply)
+		if topic == "" || strings.ContainsAny(reply, "+#") {
+			return nil, fmt.Errorf("invalid MQTT topic %q, expected topic or topic=reply-topic", part)
+		}
+		routes = append(routes, mqttRoute{topic: topic, reply: reply})
+	}
+	return routes, nil
+}
+
+// checkMQTTReply returns why answers mustn't be published on topic:
+// wildcards can't be published to, and a subscribed topic would bring
+// the answer back in as the next prompt
+func checkMQTTReply(routes []mqttRoute, topic string) error {
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("invalid reply topic %q", topic)
+	}
+	for _, route := range routes {
+		if mqttTopicMatches(route.topic, topic) {
+			return fmt.Errorf("the reply topic %s is subscribed too", topic)
+		}
+	}
+	return nil
+}
+
+// mqttTopicMatches reports whether topic matches the subscription
+// filter, which may contain + and # wildcards
+func mqttTopicMatches(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, level := range f {
+		switch {
+		case level == "#":
+			return true
+		case i >= len(t):
+			return false
+		case level != "+" && level != t[i]:
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// startMQTT connects to -mqtt-broker and answers prompts published on
+// -mqtt-topics. every topic gets a conversation of its own that is kept
+// for as long as the server runs. a JSON request can only name one of
+// those conversations
+func (app *application) startMQTT() error {
+	routes, err := parseMQTTTopics(app.config.mqttTopics)
+	if err != nil {
+		return err
+	}
+	if len(routes) == 0 {
+		return fmt.Errorf("-mqtt-broker needs -mqtt-topics")
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(app.config.mqttBroker).
+		SetClientID(app.config.mqttClientID).
+		SetUsername(app.config.mqttUser).
+		SetPassword(app.config.mqttPassword).
+		SetAutoReconnect(true).
+		// turns take a while, they run off the client's goroutine
+		SetOrderMatters(false)
+
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		// subscriptions are renewed on every reconnect
+		for _, route := range routes {
+			token := client.Subscribe(route.topic, 1, func(client mqtt.Client, msg mqtt.Message) {
+				go app.answerMQTT(client, routes, route, msg)
+			})
+			if token.Wait() && token.Error() != nil {
+				app.logger.Error(fmt.Sprintf("Error subscribing to MQTT topic %s: %v", route.topic, token.Error()))
+				continue
+			}
+			app.logger.Info("Subscribed to MQTT topic", "topic", route.topic, "conversation", route.conv.id)
+		}
+	})
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		app.logger.Warn("MQTT connection lost", "error", err)
+	})
+
+	for i := range routes {
+		routes[i].conv = newConversation()
+		routes[i].conv.owner = mqttClientName
+		app.conversations.keep(routes[i].conv)
+	}
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if token.WaitTimeout(10*time.Second) && token.Error() != nil {
+		return fmt.Errorf("failed to connect to MQTT broker: %v", token.Error())
+	}
+	return nil
+}
+
+// answerMQTT runs a turn for a published prompt and publishes the answer
+func (app *application) answerMQTT(client mqtt.Client, routes []mqttRoute, route mqttRoute, msg mqtt.Message) {
+	var req mqttRequest
+	isJSON := json.Unmarshal(msg.Payload(), &req) == nil
+	if !isJSON {
+		req = mqttRequest{Prompt: string(msg.Payload())}
+	}
+
+	replyTopic := req.ReplyTopic
+	if replyTopic == "" {
+		replyTopic = route.reply
+	}
+	if replyTopic == "" {
+		replyTopic = msg.Topic() + "/reply"
+	}
+	if err := checkMQTTReply(routes, replyTopic); err != nil {
+		app.logger.Error(fmt.Sprintf("Not answering on MQTT topic %s: %v", msg.Topic(), err))
+		return
+	}
+
+	conv := route.conv
+	publish := func(reply mqttReply) {
+		reply.Conversation = conv.id
+		payload := []byte(reply.Answer)
+		if reply.Error != "" {
+			payload = []byte(reply.Error)
+		}
+		if isJSON {
+			payload, _ = json.Marshal(reply)
+		}
+		token := client.Publish(replyTopic, 1, false, payload)
+		if token.Wait() && token.Error() != nil {
+			app.logger.Error(fmt.Sprintf("Error publishing to MQTT topic %s: %v", replyTopic, token.Error()))
+		}
+	}
+
+	if req.Conversation != "" {
+		c, ok := app.ownedConversation(req.Conversation, mqttClientName)
+		if !ok {
+			publish(mqttReply{Error: "conversation not found"})
+			return
+		}
+		conv = c
+	}
+
+	prompt := strings.TrimSpace(req.Prompt)
+	if prompt == "" {
+		publish(mqttReply{Error: "the prompt is empty"})
+		return
+	}
+	app.logger.Debug("Received MQTT message", "topic", msg.Topic(), "msg", app.loggable(conv, prompt))
+
+	if refusal := app.checkQuota(conv, mqttClientName, prompt); refusal != "" {
+		publish(mqttReply{Error: refusal})
+		return
+	}
+
+	conv.turn.lock(func(ahead int) {
+		app.logger.Debug("MQTT message queued", "topic", msg.Topic(), "ahead", ahead)
+	})
+
+	app.event(event{Type: eventMessage, Conversation: conv.id, Client: mqttClientName})
+	turn := &turnInfo{started: time.Now()}
+	ctx, done := conv.beginTurn()
+	answer, err := app.callOllama(ctx, conv, prompt, turn)
+	done()
+	app.evictHistory(conv)
+	conv.turn.unlock()
+	app.recordUsage(nil, mqttClientName, turn)
+	if err != nil {
+		app.logger.Error(fmt.Sprintf("Error calling Ollama: %v", err))
+		app.event(event{Type: eventError, Conversation: conv.id, Client: mqttClientName, Model: turn.model, Error: err.Error()})
+		publish(mqttReply{Error: "Sorry, I'm having trouble connecting to the AI service. Please try again later."})
+		return
+	}
+
+	app.event(event{
+		Type:             eventAnswer,
+		Conversation:     conv.id,
+		Client:           mqttClientName,
+		Model:            turn.model,
+		PromptTokens:     turn.promptTokens,
+		CompletionTokens: turn.completionTokens,
+		LatencyMS:        millisSince(turn.started),
+	})
+	publish(mqttReply{Answer: answer.Content, ID: answer.ID})
+}
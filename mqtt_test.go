@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestCheckMQTTReply(t *testing.T) {
+	routes := []mqttRoute{
+		{topic: "home/ask", reply: "home/answer"},
+		{topic: "sensors/+/ask"},
+		{topic: "debug/#"},
+	}
+
+	tests := []struct {
+		topic string
+		ok    bool
+	}{
+		{"home/answer", true},
+		{"sensors/kitchen/answer", true},
+		{"sensors/kitchen/ask/answer", true},
+		{"", false},
+		{"home/+", false},
+		{"home/#", false},
+		// the answer would come back in as the next prompt
+		{"home/ask", false},
+		{"sensors/kitchen/ask", false},
+		{"debug", false},
+		{"debug/answers", false},
+	}
+
+	for _, tt := range tests {
+		err := checkMQTTReply(routes, tt.topic)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkMQTTReply(%q) = %v, want ok %v", tt.topic, err, tt.ok)
+		}
+	}
+}
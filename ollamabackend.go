@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// -"Ollama Server" takes a comma separated list of servers, e.g. the
+// GPU boxes of a home lab. requests are spread over them with
+// -ollama-balance, a server that can't be reached is skipped until the
+// health check finds it back, and a request it failed is sent to the
+// next one. a server without the requested model passes it on too, so
+// the boxes needn't all have the same models
+const (
+	balanceRoundRobin  = "round-robin"
+	balanceLeastLoaded = "least-loaded"
+)
+
+// how often the servers are checked when there are several
+const ollamaHealthInterval = 15 * time.Second
+
+// ollamaServer is one of the Ollama servers
+type ollamaServer struct {
+	url      string
+	client   *api.Client
+	inFlight atomic.Int64
+	requests atomic.Int64
+	failures atomic.Int64
+
+	mu        sync.Mutex
+	down      bool
+	lastError string
+}
+
+func (s *ollamaServer) setDown(down bool, err error) (changed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed = s.down != down
+	s.down = down
+	if err != nil {
+		s.lastError = err.Error()
+	}
+	return changed
+}
+
+func (s *ollamaServer) isDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.down
+}
+
+// ollamaBackend is the default backend, one or more Ollama servers
+type ollamaBackend struct {
+	servers []*ollamaServer
+	balance string
+	next    atomic.Uint64
+}
+
+func newOllamaBackend(urls, balance string) (*ollamaBackend, error) {
+	switch balance {
+	case balanceRoundRobin, balanceLeastLoaded:
+	default:
+		return nil, fmt.Errorf("-ollama-balance must be %s or %s", balanceRoundRobin, balanceLeastLoaded)
+	}
+	b := &ollamaBackend{balance: balance}
+	for _, u := range strings.Split(urls, ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		client, err := newOllamaClient(u)
+		if err != nil {
+			return nil, err
+		}
+		b.servers = append(b.servers, &ollamaServer{url: u, client: client})
+	}
+	if len(b.servers) == 0 {
+		return nil, errors.New(`-"Ollama Server" needs at least one address`)
+	}
+	return b, nil
+}
+
+// order returns the servers in the order a request tries them: the
+// picked one, the other healthy ones, then those that are down, which
+// may be back before the health check notices
+func (b *ollamaBackend) order() []*ollamaServer {
+	return b.ordered(int((b.next.Add(1) - 1) % uint64(len(b.servers))))
+}
+
+// ordered is order starting from the server at index start
+func (b *ollamaBackend) ordered(start int) []*ollamaServer {
+	n := len(b.servers)
+	servers := make([]*ollamaServer, 0, n)
+	for i := range n {
+		servers = append(servers, b.servers[(start+i)%n])
+	}
+	if b.balance == balanceLeastLoaded {
+		slices.SortStableFunc(servers, func(x, y *ollamaServer) int {
+			return int(x.inFlight.Load() - y.inFlight.Load())
+		})
+	}
+	slices.SortStableFunc(servers, func(x, y *ollamaServer) int {
+		return boolOrder(x.isDown()) - boolOrder(y.isDown())
+	})
+	return servers
+}
+
+func boolOrder(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// serverAffinity keeps the calls of a turn on the server that answered
+// the first of them, so tool rounds find the prompt in its KV cache
+type serverAffinity struct {
+	mu     sync.Mutex
+	server *ollamaServer
+}
+
+type affinityKey struct{}
+
+// withServerAffinity returns a context whose calls stick to one server,
+// callOllama sets it for every turn
+func withServerAffinity(ctx context.Context) context.Context {
+	return context.WithValue(ctx, affinityKey{}, &serverAffinity{})
+}
+
+// order returns the servers for the next call of the turn: the one it's
+// pinned to first, unless it's down. the first call takes its turn in
+// the balancing like any other request
+func (a *serverAffinity) order(b *ollamaBackend) []*ollamaServer {
+	a.mu.Lock()
+	pinned := a.server
+	a.mu.Unlock()
+	if pinned == nil || pinned.isDown() {
+		return b.order()
+	}
+	servers := b.ordered(slices.Index(b.servers, pinned))
+	if i := slices.Index(servers, pinned); i > 0 {
+		servers = append([]*ollamaServer{pinned}, slices.Delete(servers, i, i+1)...)
+	}
+	return servers
+}
+
+func (a *serverAffinity) pin(s *ollamaServer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.server = s
+}
+
+// try runs call on the servers in order until one succeeds or fails in
+// a way the next one can't help with. answered reports whether part of
+// the answer has been passed on already, then it's too late to switch
+func (b *ollamaBackend) try(ctx context.Context, answered func() bool, call func(*api.Client) error) error {
+	servers := b.order
+	affinity, _ := ctx.Value(affinityKey{}).(*serverAffinity)
+	if affinity != nil {
+		servers = func() []*ollamaServer { return affinity.order(b) }
+	}
+	var err error
+	for _, s := range servers() {
+		s.requests.Add(1)
+		s.inFlight.Add(1)
+		err = call(s.client)
+		s.inFlight.Add(-1)
+		if err == nil {
+			s.setDown(false, nil)
+			if affinity != nil {
+				affinity.pin(s)
+			}
+			return nil
+		}
+		if ctx.Err() != nil || (answered != nil && answered()) {
+			return err
+		}
+		s.failures.Add(1)
+		switch {
+		case ollamaUnreachable(err):
+			s.setDown(true, err)
+		case modelMissing(err):
+			// another server may have it
+		default:
+			return err
+		}
+	}
+	return err
+}
+
+// onAll runs call on every server, for model housekeeping that has to
+// reach all of them. a server without the model is passed over as long
+// as one has it, other failures are returned with the server's address
+func (b *ollamaBackend) onAll(call func(*ollamaServer) error) error {
+	var errs []error
+	var missing error
+	done := false
+	for _, s := range b.servers {
+		err := call(s)
+		switch {
+		case err == nil:
+			done = true
+		case modelMissing(err):
+			missing = err
+		default:
+			errs = append(errs, fmt.Errorf("%s: %w", s.url, err))
+		}
+	}
+	if !done && len(errs) == 0 {
+		return missing
+	}
+	return errors.Join(errs...)
+}
+
+// server returns the server with the given address, the first one for ""
+func (b *ollamaBackend) server(url string) (*ollamaServer, bool) {
+	if url == "" {
+		return b.servers[0], true
+	}
+	for _, s := range b.servers {
+		if s.url == url {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// ollamaUnreachable reports whether err means the server is down
+// rather than that it refused the request
+func ollamaUnreachable(err error) bool {
+	var netErr net.Error
+	var status api.StatusError
+	switch {
+	case errors.As(err, &netErr), strings.Contains(err.Error(), "connection refused"):
+		return true
+	case errors.As(err, &status):
+		return status.StatusCode == http.StatusBadGateway ||
+			status.StatusCode == http.StatusServiceUnavailable ||
+			status.StatusCode == http.StatusGatewayTimeout
+	}
+	return false
+}
+
+func modelMissing(err error) bool {
+	var status api.StatusError
+	return errors.As(err, &status) && status.StatusCode == http.StatusNotFound
+}
+
+func (b *ollamaBackend) Chat(ctx context.Context, req *api.ChatRequest) (api.ChatResponse, error) {
+	r := *req
+	r.Stream = new(bool)
+	return collectChat(func(fn api.ChatResponseFunc) error { return b.Stream(ctx, &r, fn) })
+}
+
+func (b *ollamaBackend) Stream(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+	answered := false
+	return b.try(ctx, func() bool { return answered }, func(client *api.Client) error {
+		return client.Chat(ctx, req, func(resp api.ChatResponse) error {
+			answered = true
+			return fn(resp)
+		})
+	})
+}
+
+// Generate is for models configured with the generate API, which only
+// Ollama has
+func (b *ollamaBackend) Generate(ctx context.Context, req *api.GenerateRequest, fn api.GenerateResponseFunc) error {
+	answered := false
+	return b.try(ctx, func() bool { return answered }, func(client *api.Client) error {
+		return client.Generate(ctx, req, func(resp api.GenerateResponse) error {
+			answered = true
+			return fn(resp)
+		})
+	})
+}
+
+// ListModels lists the models of every server that answers, those
+// several have once
+func (b *ollamaBackend) ListModels(ctx context.Context) (*api.ListResponse, error) {
+	if len(b.servers) == 1 {
+		return b.servers[0].client.List(ctx)
+	}
+	all := &api.ListResponse{}
+	seen := make(map[string]bool)
+	var err error
+	answered := false
+	for _, s := range b.servers {
+		list, lerr := s.client.List(ctx)
+		if lerr != nil {
+			err = lerr
+			continue
+		}
+		answered = true
+		for _, m := range list.Models {
+			if !seen[m.Name] {
+				seen[m.Name] = true
+				all.Models = append(all.Models, m)
+			}
+		}
+	}
+	if !answered {
+		return nil, err
+	}
+	return all, nil
+}
+
+func (b *ollamaBackend) Embed(ctx context.Context, req *api.EmbedRequest) (*api.EmbedResponse, error) {
+	var resp *api.EmbedResponse
+	err := b.try(ctx, nil, func(client *api.Client) error {
+		var err error
+		resp, err = client.Embed(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+// Version returns the version of the first server that answers
+func (b *ollamaBackend) Version(ctx context.Context) (string, error) {
+	var version string
+	err := b.try(ctx, nil, func(client *api.Client) error {
+		var err error
+		version, err = client.Version(ctx)
+		return err
+	})
+	return version, err
+}
+
+// checkHealth asks every server for its version each interval, taking
+// those that don't answer out of the rotation and back in when they do
+func (b *ollamaBackend) checkHealth(ctx context.Context, interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, s := range b.servers {
+			checkCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			_, err := s.client.Version(checkCtx)
+			cancel()
+			if ctx.Err() != nil {
+				return
+			}
+			if !s.setDown(err != nil, err) {
+				continue
+			}
+			if err != nil {
+				logger.Warn("Ollama server down", "server", s.url, "error", err)
+			} else {
+				logger.Info("Ollama server back up", "server", s.url)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ollamaServerStatus is a server in the admin listing
+type ollamaServerStatus struct {
+	URL       string `json:"url"`
+	Healthy   bool   `json:"healthy"`
+	InFlight  int64  `json:"in_flight"`
+	Requests  int64  `json:"requests"`
+	Failures  int64  `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// lists the Ollama servers with their health and load
+func (app *application) handleAdminOllamaServers(w http.ResponseWriter, r *http.Request) {
+	backend, ok := app.backend.(*ollamaBackend)
+	if !ok {
+		app.clientError(w, http.StatusNotImplemented, "only available with the ollama backend")
+		return
+	}
+	out := make([]ollamaServerStatus, len(backend.servers))
+	for i, s := range backend.servers {
+		s.mu.Lock()
+		out[i] = ollamaServerStatus{
+			URL:       s.url,
+			Healthy:   !s.down,
+			InFlight:  s.inFlight.Load(),
+			Requests:  s.requests.Load(),
+			Failures:  s.failures.Load(),
+			LastError: s.lastError,
+		}
+		s.mu.Unlock()
+	}
+	app.writeJSON(w, http.StatusOK, map[string]any{"balance": backend.balance, "servers": out})
+}
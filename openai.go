@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// the subset of the OpenAI chat completions API that maps onto Ollama,
+// so OpenAI SDKs can be pointed at this server
+
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    openAIContent    `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+// openAIContent is a message content, either a string or a list of
+// parts of which only the text ones are used
+type openAIContent string
+
+func (c *openAIContent) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*c = openAIContent(s)
+		return nil
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return errors.New("content must be a string or a list of parts")
+	}
+	var text []string
+	for _, p := range parts {
+		if p.Type == "text" {
+			text = append(text, p.Text)
+		}
+	}
+	*c = openAIContent(strings.Join(text, "\n"))
+	return nil
+}
+
+type openAIToolCall struct {
+	Index    *int   `json:"index,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name string `json:"name"`
+		// JSON encoded, unlike Ollama's
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type openAIRequest struct {
+	Model       string          `json:"model"`
+	Messages    []openAIMessage `json:"messages"`
+	Stream      bool            `json:"stream"`
+	Temperature *float64        `json:"temperature"`
+	TopP        *float64        `json:"top_p"`
+	MaxTokens   *int            `json:"max_tokens"`
+	Seed        *int            `json:"seed"`
+	Stop        json.RawMessage `json:"stop"`
+	// OpenAI tool definitions have the same shape as Ollama's
+	Tools         api.Tools `json:"tools"`
+	StreamOptions struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+	// only answered with the OpenAI backend, see withLogprobs
+	Logprobs    bool `json:"logprobs"`
+	TopLogprobs *int `json:"top_logprobs"`
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type openAIChoice struct {
+	Index        int             `json:"index"`
+	Message      *openAIMessage  `json:"message,omitempty"`
+	Delta        *openAIDelta    `json:"delta,omitempty"`
+	Logprobs     *openAILogprobs `json:"logprobs,omitempty"`
+	FinishReason *string         `json:"finish_reason"`
+}
+
+type openAILogprobs struct {
+	Content []tokenLogprob `json:"content"`
+}
+
+type openAIDelta struct {
+	Role      string           `json:"role,omitempty"`
+	Content   string           `json:"content,omitempty"`
+	ToolCalls []openAIToolCall `json:"tool_calls,omitempty"`
+}
+
+type openAIResponse struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []openAIChoice `json:"choices"`
+	Usage   *openAIUsage   `json:"usage,omitempty"`
+}
+
+// openAIError answers in the OpenAI error format SDKs know how to read
+func (app *application) openAIError(w http.ResponseWriter, status int, errType, msg string) {
+	app.writeJSON(w, status, map[string]any{
+		"error": map[string]any{"message": msg, "type": errType, "code": nil},
+	})
+}
+
+// chatRequest converts the request to an Ollama chat request
+func (in openAIRequest) chatRequest() (*api.ChatRequest, error) {
+	req := &api.ChatRequest{
+		Model:   in.Model,
+		Tools:   in.Tools,
+		Options: map[string]any{},
+	}
+
+	// tool results refer to calls by id, Ollama by name
+	callNames := map[string]string{}
+	for _, m := range in.Messages {
+		msg := api.Message{Role: m.Role, Content: string(m.Content)}
+		switch m.Role {
+		case "system", "user":
+		case "developer":
+			msg.Role = "system"
+		case "assistant":
+			for _, call := range m.ToolCalls {
+				var args api.ToolCallFunctionArguments
+				if err := json.Unmarshal([]byte(call.Function.Arguments), &args); err != nil {
+					return nil, fmt.Errorf("arguments of tool call %s aren't a JSON object", call.ID)
+				}
+				callNames[call.ID] = call.Function.Name
+				msg.ToolCalls = append(msg.ToolCalls, api.ToolCall{
+					Function: api.ToolCallFunction{Name: call.Function.Name, Arguments: args},
+				})
+			}
+		case "tool":
+			msg.ToolName = callNames[m.ToolCallID]
+		default:
+			return nil, fmt.Errorf("unsupported role %q", m.Role)
+		}
+		req.Messages = append(req.Messages, msg)
+	}
+
+	if in.Temperature != nil {
+		req.Options["temperature"] = *in.Temperature
+	}
+	if in.TopP != nil {
+		req.Options["top_p"] = *in.TopP
+	}
+	if in.MaxTokens != nil {
+		req.Options["num_predict"] = *in.MaxTokens
+	}
+	if in.Seed != nil {
+		req.Options["seed"] = *in.Seed
+	}
+	if len(in.Stop) > 0 {
+		var stop []string
+		var one string
+		if err := json.Unmarshal(in.Stop, &one); err == nil {
+			stop = []string{one}
+		} else if err := json.Unmarshal(in.Stop, &stop); err != nil {
+			return nil, errors.New("stop must be a string or a list of strings")
+		}
+		req.Options["stop"] = stop
+	}
+	return req, nil
+}
+
+// openAIToolCalls converts Ollama tool calls, giving each an id
+func openAIToolCalls(calls []api.ToolCall, stream bool) []openAIToolCall {
+	out := make([]openAIToolCall, len(calls))
+	for i, call := range calls {
+		args, _ := json.Marshal(call.Function.Arguments)
+		out[i].ID = "call_" + randomID(12)
+		out[i].Type = "function"
+		out[i].Function.Name = call.Function.Name
+		out[i].Function.Arguments = string(args)
+		if stream {
+			out[i].Index = &i
+		}
+	}
+	return out
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// finishReason maps Ollama's done reason onto OpenAI's
+func finishReason(doneReason string, toolCalls bool) *string {
+	reason := "stop"
+	switch {
+	case toolCalls:
+		reason = "tool_calls"
+	case doneReason == "length":
+		reason = "length"
+	}
+	return &reason
+}
+
+// handles POST /v1/chat/completions. requests are stateless, the client
+// sends the whole conversation every time as with OpenAI
+func (app *application) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	var input openAIRequest
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		app.openAIError(w, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if len(input.Messages) == 0 {
+		app.openAIError(w, http.StatusBadRequest, "invalid_request_error", "messages is required")
+		return
+	}
+	if input.Model == "" {
+		input.Model = app.config.ollamaModel
+	}
+
+	req, err := input.chatRequest()
+	if err != nil {
+		app.openAIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	top := 0
+	if input.TopLogprobs != nil {
+		top = *input.TopLogprobs
+	}
+	if top < 0 || top > 20 || (top > 0 && !input.Logprobs) {
+		app.openAIError(w, http.StatusBadRequest, "invalid_request_error", "top_logprobs must be between 0 and 20 and needs logprobs")
+		return
+	}
+
+	// the same limits as chats in the page
+	ip := clientIP(r)
+	if hit := app.limiter.acquire(ip, ""); hit != nil {
+		app.logger.Info("Rate limited", "client", ip, "reason", hit.message)
+		if hit.retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(hit.retryAfter.Seconds()))))
+		}
+		app.openAIError(w, http.StatusTooManyRequests, "rate_limit_error", hit.message)
+		return
+	}
+	defer app.limiter.release(ip)
+	last := req.Messages[len(req.Messages)-1]
+	if refusal := app.checkQuotaFor(ip, req.Messages[:len(req.Messages)-1], last.Content); refusal != "" {
+		app.openAIError(w, http.StatusTooManyRequests, "insufficient_quota", refusal)
+		return
+	}
+
+	app.event(event{Type: eventMessage, Client: ip, Model: input.Model})
+	started := time.Now()
+	resp := openAIResponse{
+		ID:      "chatcmpl-" + randomID(12),
+		Created: started.Unix(),
+		Model:   input.Model,
+	}
+	usage := &openAIUsage{}
+	var content strings.Builder
+	var toolCalls []api.ToolCall
+	var doneReason string
+
+	// logprobs not sent yet. with the Ollama backend there are none and
+	// the answer has no logprobs, as if they weren't asked for
+	ctx := r.Context()
+	var logprobs []tokenLogprob
+	if input.Logprobs {
+		ctx = withLogprobs(ctx, top, func(lps []tokenLogprob) { logprobs = append(logprobs, lps...) })
+	}
+
+	var sse *sseWriter
+	if input.Stream {
+		sse, err = app.newSSEWriter(w, r)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		defer sse.close()
+
+		resp.Object = "chat.completion.chunk"
+		resp.Choices = []openAIChoice{{Delta: &openAIDelta{Role: "assistant"}}}
+		sse.sendData(resp)
+	}
+
+	err = app.chat(ctx, req, func(chunk api.ChatResponse) error {
+		usage.PromptTokens += chunk.PromptEvalCount
+		usage.CompletionTokens += chunk.EvalCount
+		if chunk.Done {
+			doneReason = chunk.DoneReason
+		}
+		if !input.Stream {
+			content.WriteString(chunk.Message.Content)
+			toolCalls = append(toolCalls, chunk.Message.ToolCalls...)
+			return nil
+		}
+
+		if chunk.Message.Content == "" && len(chunk.Message.ToolCalls) == 0 {
+			return nil
+		}
+		toolCalls = append(toolCalls, chunk.Message.ToolCalls...)
+		resp.Choices = []openAIChoice{{Delta: &openAIDelta{
+			Content:   chunk.Message.Content,
+			ToolCalls: openAIToolCalls(chunk.Message.ToolCalls, true),
+		}}}
+		if len(logprobs) > 0 {
+			resp.Choices[0].Logprobs = &openAILogprobs{Content: logprobs}
+			logprobs = nil
+		}
+		return sse.sendData(resp)
+	})
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	app.recordUsage(nil, ip, &turnInfo{
+		model:            input.Model,
+		started:          started,
+		promptTokens:     usage.PromptTokens,
+		completionTokens: usage.CompletionTokens,
+	})
+
+	if err != nil {
+		app.logger.Error(fmt.Sprintf("Error calling Ollama: %v", err))
+		app.event(event{Type: eventError, Client: ip, Model: input.Model, Error: err.Error()})
+		if input.Stream {
+			// the status line is gone, errors go in the stream
+			sse.sendData(map[string]any{"error": map[string]any{"message": err.Error(), "type": "server_error"}})
+			return
+		}
+		var statusErr api.StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			app.openAIError(w, http.StatusNotFound, "invalid_request_error", fmt.Sprintf("model %q not found", input.Model))
+			return
+		}
+		app.openAIError(w, http.StatusBadGateway, "server_error", "the model backend failed")
+		return
+	}
+
+	app.event(event{
+		Type:             eventAnswer,
+		Client:           ip,
+		Model:            input.Model,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		LatencyMS:        millisSince(started),
+	})
+
+	if input.Stream {
+		resp.Choices = []openAIChoice{{Delta: &openAIDelta{}, FinishReason: finishReason(doneReason, len(toolCalls) > 0)}}
+		sse.sendData(resp)
+		if input.StreamOptions.IncludeUsage {
+			resp.Choices = []openAIChoice{}
+			resp.Usage = usage
+			sse.sendData(resp)
+		}
+		sse.sendData("[DONE]")
+		return
+	}
+
+	resp.Object = "chat.completion"
+	message := &openAIMessage{
+		Role:      "assistant",
+		Content:   openAIContent(content.String()),
+		ToolCalls: openAIToolCalls(toolCalls, false),
+	}
+	resp.Choices = []openAIChoice{{Message: message, FinishReason: finishReason(doneReason, len(toolCalls) > 0)}}
+	if len(logprobs) > 0 {
+		resp.Choices[0].Logprobs = &openAILogprobs{Content: logprobs}
+	}
+	resp.Usage = usage
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// handles GET /v1/models, the installed Ollama models
+func (app *application) handleOpenAIModels(w http.ResponseWriter, r *http.Request) {
+	models, err := app.installedModels(r.Context())
+	if err != nil {
+		app.openAIError(w, http.StatusBadGateway, "server_error", "the model list isn't available")
+		return
+	}
+
+	type model struct {
+		ID      string `json:"id"`
+		Object  string `json:"object"`
+		Created int64  `json:"created"`
+		OwnedBy string `json:"owned_by"`
+	}
+	data := make([]model, len(models))
+	for i, m := range models {
+		data[i] = model{ID: m.Name, Object: "model", OwnedBy: "ollama"}
+	}
+	app.writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": data})
+}
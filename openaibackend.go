@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// openAIBackend talks to a server with the OpenAI chat completions API,
+// OpenAI itself, vLLM, llama.cpp's server, LM Studio and the like.
+// -openai-url is the API's base URL, e.g. https://api.openai.com/v1
+type openAIBackend struct {
+	base   string
+	key    string
+	client *http.Client
+}
+
+func newOpenAIBackend(base, key string) (*openAIBackend, error) {
+	if base == "" {
+		return nil, errors.New("the openai backend needs -openai-url")
+	}
+	if _, err := url.Parse(base); err != nil {
+		return nil, fmt.Errorf("failed to parse OpenAI URL: %v", err)
+	}
+	return &openAIBackend{
+		base:   strings.TrimSuffix(base, "/"),
+		key:    key,
+		client: modelServerClient(),
+	}, nil
+}
+
+// the request sent upstream. unlike openAIRequest, what the server
+// takes, unset options are left out
+type openAIBackendRequest struct {
+	Model         string                 `json:"model"`
+	Messages      []openAIBackendMessage `json:"messages"`
+	Stream        bool                   `json:"stream"`
+	StreamOptions *openAIStreamOptions   `json:"stream_options,omitempty"`
+	Tools         api.Tools              `json:"tools,omitempty"`
+	Temperature   *float64               `json:"temperature,omitempty"`
+	TopP          *float64               `json:"top_p,omitempty"`
+	MaxTokens     *int                   `json:"max_tokens,omitempty"`
+	Seed          *int                   `json:"seed,omitempty"`
+	Stop          []string               `json:"stop,omitempty"`
+	Format        *openAIResponseFormat  `json:"response_format,omitempty"`
+	Logprobs      bool                   `json:"logprobs,omitempty"`
+	TopLogprobs   *int                   `json:"top_logprobs,omitempty"`
+}
+
+type openAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type openAIResponseFormat struct {
+	Type string `json:"type"`
+}
+
+type openAIBackendMessage struct {
+	Role string `json:"role"`
+	// a string, or a list of parts when there are images
+	Content    any              `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type openAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *openAIImageURL `json:"image_url,omitempty"`
+}
+
+type openAIImageURL struct {
+	URL string `json:"url"`
+}
+
+// openAIErrorBody is the error body OpenAI compatible servers answer with
+type openAIErrorBody struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (b *openAIBackend) Chat(ctx context.Context, req *api.ChatRequest) (api.ChatResponse, error) {
+	return collectChat(func(fn api.ChatResponseFunc) error { return b.Stream(ctx, req, fn) })
+}
+
+// Stream always streams from the server, Ollama's req.Stream is only
+// about how the answer is handed to fn and fn gets the parts either way
+func (b *openAIBackend) Stream(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+	body := b.request(req)
+	lr := logprobsFrom(ctx)
+	if lr != nil {
+		body.Logprobs, body.TopLogprobs = true, &lr.top
+	}
+	resp, err := b.do(ctx, http.MethodPost, "/chat/completions", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	start := time.Now()
+	var firstToken time.Time
+	var usage *openAIUsage
+	var finish string
+	// tool calls come in pieces, the arguments a few characters at a time
+	var calls []*openAIToolCall
+	byIndex := make(map[int]*openAIToolCall)
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+		var chunk openAIResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("invalid stream chunk: %v", err)
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			if choice.FinishReason != nil {
+				finish = *choice.FinishReason
+			}
+			if lr != nil && choice.Logprobs != nil && len(choice.Logprobs.Content) > 0 {
+				lr.fn(choice.Logprobs.Content)
+			}
+			if choice.Delta == nil {
+				continue
+			}
+			for _, tc := range choice.Delta.ToolCalls {
+				index := len(calls)
+				if tc.Index != nil {
+					index = *tc.Index
+				}
+				call, ok := byIndex[index]
+				if !ok {
+					call = &openAIToolCall{}
+					byIndex[index] = call
+					calls = append(calls, call)
+				}
+				if tc.Function.Name != "" {
+					call.Function.Name = tc.Function.Name
+				}
+				call.Function.Arguments += tc.Function.Arguments
+			}
+			if choice.Delta.Content == "" {
+				continue
+			}
+			if firstToken.IsZero() {
+				firstToken = time.Now()
+			}
+			err := fn(api.ChatResponse{
+				Model:     req.Model,
+				CreatedAt: time.Now(),
+				Message:   api.Message{Role: "assistant", Content: choice.Delta.Content},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	last := api.ChatResponse{
+		Model:      req.Model,
+		CreatedAt:  time.Now(),
+		Message:    api.Message{Role: "assistant", ToolCalls: ollamaToolCalls(calls)},
+		Done:       true,
+		DoneReason: ollamaDoneReason(finish),
+	}
+	last.TotalDuration = time.Since(start)
+	if !firstToken.IsZero() {
+		last.EvalDuration = time.Since(firstToken)
+	}
+	if usage != nil {
+		last.PromptEvalCount = usage.PromptTokens
+		last.EvalCount = usage.CompletionTokens
+	}
+	return fn(last)
+}
+
+func (b *openAIBackend) ListModels(ctx context.Context) (*api.ListResponse, error) {
+	resp, err := b.do(ctx, http.MethodGet, "/models", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Data []struct {
+			ID      string `json:"id"`
+			Created int64  `json:"created"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid model list: %v", err)
+	}
+	list := &api.ListResponse{}
+	for _, m := range body.Data {
+		list.Models = append(list.Models, api.ListModelResponse{
+			Name:       m.ID,
+			Model:      m.ID,
+			ModifiedAt: time.Unix(m.Created, 0),
+		})
+	}
+	return list, nil
+}
+
+func (b *openAIBackend) Embed(ctx context.Context, req *api.EmbedRequest) (*api.EmbedResponse, error) {
+	resp, err := b.do(ctx, http.MethodPost, "/embeddings", map[string]any{
+		"model": req.Model,
+		"input": req.Input,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+		Usage *openAIUsage `json:"usage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid embeddings: %v", err)
+	}
+	embeddings := make([][]float32, len(body.Data))
+	for _, d := range body.Data {
+		if d.Index < 0 || d.Index >= len(embeddings) {
+			return nil, fmt.Errorf("embedding index %d out of range", d.Index)
+		}
+		embeddings[d.Index] = d.Embedding
+	}
+	out := &api.EmbedResponse{Model: req.Model, Embeddings: embeddings}
+	if body.Usage != nil {
+		out.PromptEvalCount = body.Usage.PromptTokens
+	}
+	return out, nil
+}
+
+// do sends a request to the API and returns the response if it
+// succeeded. errors are api.StatusErrors like Ollama's, so they're told
+// apart the same way
+func (b *openAIBackend) do(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, b.base+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	if b.key != "" {
+		req.Header.Set("Authorization", "Bearer "+b.key)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var errBody openAIErrorBody
+	msg := strings.TrimSpace(string(data))
+	if json.Unmarshal(data, &errBody) == nil && errBody.Error.Message != "" {
+		msg = errBody.Error.Message
+	}
+	return nil, api.StatusError{StatusCode: resp.StatusCode, Status: resp.Status, ErrorMessage: msg}
+}
+
+// request converts an Ollama chat request
+func (b *openAIBackend) request(req *api.ChatRequest) openAIBackendRequest {
+	out := openAIBackendRequest{
+		Model:         req.Model,
+		Messages:      openAIMessages(req.Messages),
+		Stream:        true,
+		StreamOptions: &openAIStreamOptions{IncludeUsage: true},
+		Tools:         req.Tools,
+	}
+	if len(req.Format) > 0 {
+		out.Format = &openAIResponseFormat{Type: "json_object"}
+	}
+
+	opts := req.Options
+	if v, ok := opts["temperature"].(float64); ok {
+		out.Temperature = &v
+	}
+	if v, ok := opts["top_p"].(float64); ok {
+		out.TopP = &v
+	}
+	if v, ok := optionInt(opts["num_predict"]); ok && v > 0 {
+		out.MaxTokens = &v
+	}
+	if v, ok := optionInt(opts["seed"]); ok {
+		out.Seed = &v
+	}
+	switch stop := opts["stop"].(type) {
+	case []string:
+		out.Stop = stop
+	case []any:
+		for _, s := range stop {
+			if s, ok := s.(string); ok {
+				out.Stop = append(out.Stop, s)
+			}
+		}
+	}
+	return out
+}
+
+// optionInt reads an integer option, which is a float64 after a trip
+// through JSON
+func optionInt(v any) (int, bool) {
+	switch v := v.(type) {
+	case int:
+		return v, true
+	case float64:
+		return int(v), true
+	}
+	return 0, false
+}
+
+// openAIMessages converts an Ollama conversation. Ollama tool calls have
+// no ids, so they get some and the tool results that follow answer them
+// in order
+func openAIMessages(messages []api.Message) []openAIBackendMessage {
+	out := make([]openAIBackendMessage, 0, len(messages))
+	var pending []openAIToolCall
+	for _, msg := range messages {
+		m := openAIBackendMessage{Role: msg.Role, Content: msg.Content}
+		switch msg.Role {
+		case "assistant":
+			pending = nil
+			if len(msg.ToolCalls) > 0 {
+				m.ToolCalls = openAIToolCalls(msg.ToolCalls, false)
+				for i := range m.ToolCalls {
+					if m.ToolCalls[i].Function.Arguments == "null" {
+						m.ToolCalls[i].Function.Arguments = "{}"
+					}
+				}
+				pending = m.ToolCalls
+				if msg.Content == "" {
+					m.Content = nil
+				}
+			}
+		case "tool":
+			for i, call := range pending {
+				if msg.ToolName == "" || call.Function.Name == msg.ToolName {
+					m.ToolCallID = call.ID
+					pending = append(pending[:i:i], pending[i+1:]...)
+					break
+				}
+			}
+			// a result whose call isn't in the history any more would be
+			// refused, it's passed on as a note instead
+			if m.ToolCallID == "" {
+				m.Role = "system"
+				m.Content = fmt.Sprintf("Result of the %s tool: %s", msg.ToolName, msg.Content)
+			}
+		}
+		if len(msg.Images) > 0 {
+			parts := []openAIContentPart{{Type: "text", Text: msg.Content}}
+			for _, img := range msg.Images {
+				parts = append(parts, openAIContentPart{
+					Type: "image_url",
+					ImageURL: &openAIImageURL{
+						URL: "data:" + http.DetectContentType(img) + ";base64," + base64.StdEncoding.EncodeToString(img),
+					},
+				})
+			}
+			m.Content = parts
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// ollamaToolCalls converts the tool calls of an answer back
+func ollamaToolCalls(calls []*openAIToolCall) []api.ToolCall {
+	var out []api.ToolCall
+	for _, call := range calls {
+		var tc api.ToolCall
+		tc.Function.Name = call.Function.Name
+		if call.Function.Arguments != "" {
+			json.Unmarshal([]byte(call.Function.Arguments), &tc.Function.Arguments)
+		}
+		if tc.Function.Arguments == nil {
+			tc.Function.Arguments = api.ToolCallFunctionArguments{}
+		}
+		out = append(out, tc)
+	}
+	return out
+}
+
+// ollamaDoneReason maps OpenAI's finish reason onto Ollama's done reason
+func ollamaDoneReason(finish string) string {
+	if finish == "length" {
+		return "length"
+	}
+	return "stop"
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestOpenAIMessages(t *testing.T) {
+	call := func(name string, args map[string]any) api.ToolCall {
+		return api.ToolCall{Function: api.ToolCallFunction{Name: name, Arguments: args}}
+	}
+
+	// what each converted message should be, tool call ids are random so
+	// results are checked against the calls they answer by index
+	type want struct {
+		role    string
+		content any
+		calls   []string
+		args    []string
+		answers int // index of the message with the call answered, -1 for none
+	}
+
+	tests := []struct {
+		name string
+		msgs []api.Message
+		want []want
+	}{
+		{
+			name: "plain chat",
+			msgs: []api.Message{
+				{Role: "system", Content: "s"},
+				{Role: "user", Content: "hi"},
+				{Role: "assistant", Content: "hello"},
+			},
+			want: []want{
+				{role: "system", content: "s", answers: -1},
+				{role: "user", content: "hi", answers: -1},
+				{role: "assistant", content: "hello", answers: -1},
+			},
+		},
+		{
+			name: "tool calls are answered in order by name",
+			msgs: []api.Message{
+				{Role: "user", Content: "weather and time?"},
+				{Role: "assistant", ToolCalls: []api.ToolCall{call("get_weather", map[string]any{"location": "Paris"}), call("get_time", nil)}},
+				{Role: "tool", ToolName: "get_time", Content: "12:00"},
+				{Role: "tool", ToolName: "get_weather", Content: "sunny"},
+				{Role: "assistant", Content: "Sunny at noon."},
+			},
+			want: []want{
+				{role: "user", content: "weather and time?", answers: -1},
+				{role: "assistant", content: nil, calls: []string{"get_weather", "get_time"}, args: []string{`{"location":"Paris"}`, "{}"}, answers: -1},
+				{role: "tool", content: "12:00", answers: 1},
+				{role: "tool", content: "sunny", answers: 1},
+				{role: "assistant", content: "Sunny at noon.", answers: -1},
+			},
+		},
+		{
+			name: "result without its call becomes a note",
+			msgs: []api.Message{
+				{Role: "user", Content: "hi"},
+				{Role: "tool", ToolName: "get_time", Content: "12:00"},
+			},
+			want: []want{
+				{role: "user", content: "hi", answers: -1},
+				{role: "system", content: "Result of the get_time tool: 12:00", answers: -1},
+			},
+		},
+		{
+			name: "a new answer drops calls that were never answered",
+			msgs: []api.Message{
+				{Role: "assistant", ToolCalls: []api.ToolCall{call("get_time", nil)}},
+				{Role: "assistant", Content: "never mind"},
+				{Role: "tool", ToolName: "get_time", Content: "12:00"},
+			},
+			want: []want{
+				{role: "assistant", content: nil, calls: []string{"get_time"}, args: []string{"{}"}, answers: -1},
+				{role: "assistant", content: "never mind", answers: -1},
+				{role: "system", content: "Result of the get_time tool: 12:00", answers: -1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := openAIMessages(tt.msgs)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d messages, want %d", len(got), len(tt.want))
+			}
+			used := make(map[string]bool)
+			for i, w := range tt.want {
+				m := got[i]
+				if m.Role != w.role || m.Content != w.content {
+					t.Errorf("message %d = %s %v, want %s %v", i, m.Role, m.Content, w.role, w.content)
+				}
+				if len(m.ToolCalls) != len(w.calls) {
+					t.Fatalf("message %d has %d tool calls, want %d", i, len(m.ToolCalls), len(w.calls))
+				}
+				for j, c := range m.ToolCalls {
+					if c.ID == "" || c.Function.Name != w.calls[j] || c.Function.Arguments != w.args[j] {
+						t.Errorf("message %d call %d = %s %s %s, want %s %s", i, j, c.ID, c.Function.Name, c.Function.Arguments, w.calls[j], w.args[j])
+					}
+				}
+				if w.answers < 0 {
+					if m.ToolCallID != "" {
+						t.Errorf("message %d answers %s, want no call", i, m.ToolCallID)
+					}
+					continue
+				}
+				// the result must answer the call of its tool, each call once
+				var answered string
+				for _, c := range got[w.answers].ToolCalls {
+					if c.ID == m.ToolCallID {
+						answered = c.Function.Name
+					}
+				}
+				if answered != tt.msgs[i].ToolName || used[m.ToolCallID] {
+					t.Errorf("message %d answers %q (%s), want the %s call once", i, m.ToolCallID, answered, tt.msgs[i].ToolName)
+				}
+				used[m.ToolCallID] = true
+			}
+		})
+	}
+}
+
+func TestOpenAIMessagesImages(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n")
+	got := openAIMessages([]api.Message{{Role: "user", Content: "what's this?", Images: []api.ImageData{png}}})
+
+	parts, ok := got[0].Content.([]openAIContentPart)
+	if !ok || len(parts) != 2 {
+		t.Fatalf("content = %#v, want a text and an image part", got[0].Content)
+	}
+	if parts[0].Type != "text" || parts[0].Text != "what's this?" {
+		t.Errorf("first part = %+v, want the text", parts[0])
+	}
+	if parts[1].Type != "image_url" || parts[1].ImageURL == nil || parts[1].ImageURL.URL != "data:image/png;base64,iVBORw0KGgo=" {
+		t.Errorf("second part = %+v, want the image as a data URL", parts[1])
+	}
+}
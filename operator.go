@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// an operator, a signed in admin, can take a conversation over from the
+// model: user messages are then only added to the history and the
+// operator answers them, by REST or from the watch page. the operator's
+// answers are kept as assistant messages marked with who wrote them, so
+// after the hand back the model sees the whole conversation
+
+// takeOver pauses the model in conv, false if operator already has it.
+// a turn that's running is cancelled
+func (app *application) takeOver(conv *conversation, operator string) bool {
+	conv.mu.Lock()
+	if conv.operator == operator {
+		conv.mu.Unlock()
+		return false
+	}
+	conv.operator = operator
+	conv.mu.Unlock()
+
+	conv.cancel()
+	app.logger.Info("Conversation taken over", "conversation", conv.id, "operator", operator)
+	app.clients.sendTo(conv.id, Message{
+		Type:    "system",
+		Event:   eventTakeover,
+		Content: "A human agent has joined the conversation.",
+		Time:    time.Now().Format("15:04:05"),
+	})
+	return true
+}
+
+// handBack lets the model answer in conv again, false if no operator
+// had it
+func (app *application) handBack(conv *conversation) bool {
+	conv.mu.Lock()
+	operator := conv.operator
+	conv.operator = ""
+	conv.mu.Unlock()
+	if operator == "" {
+		return false
+	}
+
+	app.logger.Info("Conversation handed back", "conversation", conv.id, "operator", operator)
+	app.clients.sendTo(conv.id, Message{
+		Type:    "system",
+		Event:   eventHandback,
+		Content: "You're chatting with the assistant again.",
+		Time:    time.Now().Format("15:04:05"),
+	})
+	return true
+}
+
+// heldBy returns the operator who has taken conv over, "" when the model
+// answers
+func (c *conversation) heldBy() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.operator
+}
+
+// holdForOperator adds a user message to a conversation an operator has
+// taken over, instead of answering it
+func (app *application) holdForOperator(conv *conversation, content string, images []api.ImageData) {
+	if conv.len() == 0 {
+		conv.append(api.Message{Role: "system", Content: app.systemPrompt(conv)})
+	}
+	conv.add(chatMessage{
+		Message:  api.Message{Role: "user", Content: content, Images: images},
+		Language: detectLanguage(content),
+	})
+}
+
+// operatorReply adds the operator's answer to the history and sends it
+// to the conversation's clients
+func (app *application) operatorReply(conv *conversation, operator, content string) chatMessage {
+	conv.turn.lock(func(int) {})
+	reply := conv.add(chatMessage{
+		Message:  api.Message{Role: "assistant", Content: content},
+		Operator: operator,
+	})
+	conv.turn.unlock()
+
+	app.clients.sendTo(conv.id, Message{
+		Type:     "server",
+		Content:  reply.Content,
+		Time:     reply.Created.Format("15:04:05"),
+		ID:       reply.ID,
+		Version:  reply.Version,
+		Operator: operator,
+		HTML:     app.renderHTML(reply.Content),
+	})
+	return reply
+}
+
+// operatorName is how an operator signed in with r is shown
+func (app *application) operatorName(r *http.Request) string {
+	// the admin token says nothing about who holds it
+	if user, ok := app.authenticate(r); ok && user != "admin-token" {
+		return user
+	}
+	return "operator"
+}
+
+// pauses the model, the admin answers until the conversation is handed back
+func (app *application) handleAdminTakeover(w http.ResponseWriter, r *http.Request) {
+	conv, ok := app.adminConversation(w, r)
+	if !ok {
+		return
+	}
+	operator := app.operatorName(r)
+	app.audit(r, "conversation.takeover", "conversation", conv.id, "operator", operator)
+	app.takeOver(conv, operator)
+	app.writeJSON(w, http.StatusOK, map[string]string{"status": "taken over", "operator": operator})
+}
+
+// lets the model answer again
+func (app *application) handleAdminHandback(w http.ResponseWriter, r *http.Request) {
+	conv, ok := app.adminConversation(w, r)
+	if !ok {
+		return
+	}
+	app.audit(r, "conversation.handback", "conversation", conv.id)
+	if !app.handBack(conv) {
+		app.clientError(w, http.StatusConflict, "conversation isn't taken over")
+		return
+	}
+	app.writeJSON(w, http.StatusOK, map[string]string{"status": "handed back"})
+}
+
+// answers the user as the operator, only while the conversation is
+// taken over
+func (app *application) handleAdminOperatorReply(w http.ResponseWriter, r *http.Request) {
+	conv, ok := app.adminConversation(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Content string `json:"content"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	input.Content = strings.TrimSpace(input.Content)
+	if input.Content == "" {
+		app.clientError(w, http.StatusBadRequest, "content is required")
+		return
+	}
+	if conv.heldBy() == "" {
+		app.clientError(w, http.StatusConflict, "take the conversation over first")
+		return
+	}
+	operator := app.operatorName(r)
+	content, ok := app.expandSnippet(app.owner(r), input.Content)
+	if !ok {
+		app.clientError(w, http.StatusUnprocessableEntity, content)
+		return
+	}
+
+	app.audit(r, "conversation.reply", "conversation", conv.id, "operator", operator)
+	app.writeJSON(w, http.StatusCreated, app.operatorReply(conv, operator, content))
+}
+
+// handleOperatorMessage handles what a watcher signed in as an admin
+// sends: takeover, handback, or a reply while the conversation is taken
+// over
+func (app *application) handleOperatorMessage(client *wsClient, conv *conversation, operator string, msg Message) {
+	notice := func(content string) {
+		client.send(Message{
+			Type:    "notice",
+			Content: content,
+			Time:    time.Now().Format("15:04:05"),
+		})
+	}
+
+	switch msg.Type {
+	case "takeover":
+		app.takeOver(conv, operator)
+	case "handback":
+		if !app.handBack(conv) {
+			notice("The conversation isn't taken over.")
+		}
+	default:
+		// canned replies are the operator's or workspace snippets
+		content, ok := app.expandSnippet("user:"+operator, strings.TrimSpace(msg.Content))
+		switch {
+		case !ok:
+			notice(content)
+		case content == "":
+		case conv.heldBy() == "":
+			notice("Take the conversation over before replying.")
+		default:
+			app.operatorReply(conv, operator, content)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// modelOptions are the sampling and context options passed to Ollama.
+// unset fields leave the model's own default in place
+type modelOptions struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	NumPredict  *int     `json:"num_predict,omitempty"`
+	NumCtx      *int     `json:"num_ctx,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+// validate checks the options are in the ranges Ollama accepts
+func (o modelOptions) validate() error {
+	switch {
+	case o.Temperature != nil && (*o.Temperature < 0 || *o.Temperature > 2):
+		return errors.New("temperature must be between 0 and 2")
+	case o.TopP != nil && (*o.TopP < 0 || *o.TopP > 1):
+		return errors.New("top_p must be between 0 and 1")
+	case o.NumPredict != nil && *o.NumPredict < -2:
+		return errors.New("num_predict must be -1 (no limit), -2 (fill the context) or more")
+	case o.NumCtx != nil && *o.NumCtx < 1:
+		return errors.New("num_ctx must be at least 1")
+	case len(o.Stop) > 8:
+		return errors.New("at most 8 stop sequences are allowed")
+	}
+	return nil
+}
+
+// merge returns o with the fields set in over replacing its own
+func (o modelOptions) merge(over modelOptions) modelOptions {
+	if over.Temperature != nil {
+		o.Temperature = over.Temperature
+	}
+	if over.TopP != nil {
+		o.TopP = over.TopP
+	}
+	if over.NumPredict != nil {
+		o.NumPredict = over.NumPredict
+	}
+	if over.NumCtx != nil {
+		o.NumCtx = over.NumCtx
+	}
+	if over.Seed != nil {
+		o.Seed = over.Seed
+	}
+	if over.Stop != nil {
+		o.Stop = over.Stop
+	}
+	return o
+}
+
+// request returns the options as ChatRequest.Options, nil if none are set
+func (o modelOptions) request() map[string]any {
+	js, _ := json.Marshal(o)
+	var opts map[string]any
+	json.Unmarshal(js, &opts)
+	if len(opts) == 0 {
+		return nil
+	}
+	return opts
+}
+
+func (o modelOptions) String() string {
+	opts := o.request()
+	if opts == nil {
+		return "the model's defaults"
+	}
+	var parts []string
+	for _, name := range []string{"temperature", "top_p", "num_predict", "num_ctx", "seed", "stop"} {
+		switch v := opts[name].(type) {
+		case nil:
+		case float64:
+			// large seeds would otherwise print in e notation
+			parts = append(parts, name+"="+strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			parts = append(parts, fmt.Sprintf("%s=%v", name, v))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// registerFlags defines a flag per option. a flag that isn't given
+// leaves the option unset
+func (o *modelOptions) registerFlags(fs *flag.FlagSet) {
+	float := func(dst **float64) func(string) error {
+		return func(s string) error {
+			v, err := strconv.ParseFloat(s, 64)
+			*dst = &v
+			return err
+		}
+	}
+	integer := func(dst **int) func(string) error {
+		return func(s string) error {
+			v, err := strconv.Atoi(s)
+			*dst = &v
+			return err
+		}
+	}
+	fs.Func("temperature", "Sampling temperature, 0 to 2, unset uses the model's default", float(&o.Temperature))
+	fs.Func("top-p", "Nucleus sampling probability, 0 to 1", float(&o.TopP))
+	fs.Func("num-predict", "Most tokens an answer may have, -1 for no limit", integer(&o.NumPredict))
+	fs.Func("num-ctx", "Context window in tokens", integer(&o.NumCtx))
+	fs.Func("seed", "Random seed, the same seed and prompt give the same answer", integer(&o.Seed))
+	fs.Func("stop", "Stop sequence, can be given more than once", func(s string) error {
+		o.Stop = append(o.Stop, s)
+		return nil
+	})
+}
+
+// conversationOptions returns the -temperature etc. defaults with the
+// conversation's own settings on top
+func (app *application) conversationOptions(conv *conversation) modelOptions {
+	return app.config.options.merge(conv.chosenOptions())
+}
+
+func (c *conversation) setOptions(o modelOptions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.options = o
+}
+
+func (c *conversation) chosenOptions() modelOptions {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.options
+}
+
+// handleOptionsMessage sets the conversation's model options from a JSON
+// object like {"temperature":0.2,"seed":42}. fields left out keep their
+// value, an empty message goes back to the server defaults
+func (app *application) handleOptionsMessage(client *wsClient, conv *conversation, content string) {
+	notice := func(content string) {
+		client.send(Message{
+			Type:    "notice",
+			Content: content,
+			Time:    time.Now().Format("15:04:05"),
+		})
+	}
+
+	var opts modelOptions
+	if strings.TrimSpace(content) != "" {
+		dec := json.NewDecoder(strings.NewReader(content))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&opts); err != nil {
+			notice(fmt.Sprintf("Invalid model options: %v", err))
+			return
+		}
+		opts = conv.chosenOptions().merge(opts)
+	}
+	if err := opts.validate(); err != nil {
+		notice("Invalid model options: " + err.Error())
+		return
+	}
+
+	conv.setOptions(opts)
+	app.logger.Info("Conversation options", "conversation", conv.id, "options", opts.String())
+	notice("Using " + app.conversationOptions(conv).String() + ".")
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ollama/ollama/api"
+)
+
+// postProcessor changes the model's answer before it's stored and sent
+// to the client. steps run in order, each gets the output of the last
+type postProcessor func(content string, turn *turnInfo) string
+
+// turnInfo describes a single turn. the caller of callOllama fills in
+// the request side, the rest is filled in while the turn runs
+type turnInfo struct {
+	// language the client asked the reply to be in
+	language string
+
+	// images attached to the user's message
+	images []api.ImageData
+
+	// the conversation already had an assistant reply before this one
+	followUp bool
+
+	// model that answered, the intent may route away from the default
+	model string
+
+	// when the turn got its go after waiting for earlier turns
+	started time.Time
+
+	// tool results fetched speculatively, and calls made, this turn
+	prefetched *toolPrefetch
+	toolCalls  map[string]int
+	seenCalls  map[string]bool
+	// results of grounding tools, for the answer's provenance
+	grounding []toolOutput
+
+	// emit is set by the caller to stream updates (tool progress,
+	// artifacts) to the client while the turn runs
+	emit        func(Message)
+	progressLog []toolProgress
+
+	// the client cancelled the turn, the answer is partial
+	cancelled bool
+
+	// answers written before when the turn is regenerated, and the
+	// sampling options it uses over the conversation's
+	variants []answerVariant
+	options  modelOptions
+
+	// token counts reported by Ollama over all calls of the turn
+	promptTokens     int
+	completionTokens int
+	// time Ollama spent on the chat calls of the turn, and generating
+	// their tokens
+	totalDuration time.Duration
+	evalDuration  time.Duration
+	evalTokens    int
+}
+
+// postProcess runs the model's answer through every configured step
+func (app *application) postProcess(content string, turn *turnInfo) string {
+	for _, step := range app.postProcessors {
+		content = step(content, turn)
+	}
+	return strings.TrimSpace(content)
+}
+
+// outputFilterConfig is read from the -output-filters file, e.g.
+//
+//	{
+//	  "patterns": ["(?i)^as an ai language model,?\\s*"],
+//	  "similar": [{"text": "I hope this helps!", "threshold": 0.8}],
+//	  "strip_repeated_greetings": true
+//	}
+type outputFilterConfig struct {
+	// regular expressions, matches are removed
+	Patterns []string `json:"patterns"`
+	// sentences that are close enough to one of these are removed
+	Similar []struct {
+		Text      string  `json:"text"`
+		Threshold float64 `json:"threshold"`
+	} `json:"similar"`
+	// drop "Hello!" style openers from every answer but the first
+	StripRepeatedGreetings bool `json:"strip_repeated_greetings"`
+}
+
+var greetingPattern = regexp.MustCompile(`(?i)^\s*(hello|hi|hey|greetings|good (morning|afternoon|evening))( there)?[!,.]\s*`)
+
+var sentencePattern = regexp.MustCompile(`[^.!?\n]+[.!?]*\s*`)
+
+// loadOutputFilter builds a post-processing step from a filter config file
+func loadOutputFilter(path string) (postProcessor, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg outputFilterConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid output filter config: %v", err)
+	}
+
+	var patterns []*regexp.Regexp
+	for _, p := range cfg.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid output filter pattern %q: %v", p, err)
+		}
+		patterns = append(patterns, re)
+	}
+
+	type similarRule struct {
+		words     map[string]bool
+		threshold float64
+	}
+	var similar []similarRule
+	for _, s := range cfg.Similar {
+		threshold := s.Threshold
+		if threshold <= 0 {
+			threshold = 0.8
+		}
+		similar = append(similar, similarRule{words: wordSet(s.Text), threshold: threshold})
+	}
+
+	return func(content string, turn *turnInfo) string {
+		for _, re := range patterns {
+			content = re.ReplaceAllString(content, "")
+		}
+
+		if len(similar) > 0 {
+			content = sentencePattern.ReplaceAllStringFunc(content, func(sentence string) string {
+				words := wordSet(sentence)
+				for _, rule := range similar {
+					if jaccard(words, rule.words) >= rule.threshold {
+						return ""
+					}
+				}
+				return sentence
+			})
+		}
+
+		if cfg.StripRepeatedGreetings && turn.followUp {
+			content = greetingPattern.ReplaceAllString(content, "")
+		}
+
+		return content
+	}, nil
+}
+
+func wordSet(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, w := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		set[w] = true
+	}
+	return set
+}
+
+// jaccard is the share of words two sets have in common
+func jaccard(a, b map[string]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	shared := 0
+	for w := range a {
+		if b[w] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/ollama/ollama/api"
+)
+
+// toolPrefetch holds tool results that were started speculatively while
+// the first model call was still running. When the model then asks for
+// the same tool with the same arguments the result is already there (or
+// at least on its way) instead of starting the round trip from scratch
+type toolPrefetch struct {
+	mu      sync.Mutex
+	results map[string]*prefetchResult
+}
+
+type prefetchResult struct {
+	done  chan struct{}
+	value string
+}
+
+// toolKey identifies a tool call by name and arguments. Arguments are
+// compared case-insensitively so "Paris" and "paris" share a result
+func toolKey(name string, args map[string]any) string {
+	js, _ := json.Marshal(args) // map keys are sorted by encoding/json
+	return name + ":" + strings.ToLower(string(js))
+}
+
+// start runs fn in the background and stores its result under the tool call
+func (p *toolPrefetch) start(name string, args map[string]any, fn func() string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.results == nil {
+		p.results = make(map[string]*prefetchResult)
+	}
+	key := toolKey(name, args)
+	if _, ok := p.results[key]; ok {
+		return
+	}
+
+	res := &prefetchResult{done: make(chan struct{})}
+	p.results[key] = res
+	go func() {
+		res.value = fn()
+		close(res.done)
+	}()
+}
+
+// take returns the prefetched result for a tool call, waiting for it to
+// finish if it's still running. ok is false if nothing was prefetched
+func (p *toolPrefetch) take(toolCall api.ToolCall) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+
+	p.mu.Lock()
+	res, ok := p.results[toolKey(toolCall.Function.Name, toolCall.Function.Arguments)]
+	p.mu.Unlock()
+	if !ok {
+		return "", false
+	}
+
+	<-res.done
+	return res.value, true
+}
+
+// matches "in Paris", "for New York", "at San Francisco airport"...
+var locationPattern = regexp.MustCompile(`\b(?:in|for|at)\s+([A-Z][\p{L}'-]*(?:\s+[A-Z][\p{L}'-]*)*)`)
+
+// guessLocation pulls a likely place name out of the prompt. it only
+// needs to be right often enough to be worth a speculative fetch,
+// the model still decides the real arguments
+func guessLocation(prompt string) string {
+	m := locationPattern.FindStringSubmatch(prompt)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// prefetchTools starts fetching the data the model is likely to ask for
+func (app *application) prefetchTools(conv *conversation, prompt string, tools api.Tools) *toolPrefetch {
+	p := &toolPrefetch{}
+
+	weather, ok := app.tools.get("get_weather")
+	if _, attached := findTool(tools, "get_weather"); !ok || !attached {
+		return p
+	}
+	location := guessLocation(prompt)
+	if location == "" {
+		location = conv.defaultLocation()
+	}
+	if location != "" {
+		app.logger.Debug("Prefetching weather", "location", app.loggable(conv, location))
+		args := map[string]any{"location": location}
+		p.start("get_weather", args, func() string {
+			return weather.Execute(context.Background(), args)
+		})
+	}
+
+	return p
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// every owner can pick a display name and upload an avatar. watchers
+// and operators see them with the owner's messages, and state exports
+// carry them. avatars are served by a random id, not by owner, the
+// owner id of a browser is its cookie
+//
+//	GET    /api/profile         the caller's profile
+//	PUT    /api/profile         sets the display name
+//	PUT    /api/profile/avatar  uploads the avatar, the image is the body
+//	DELETE /api/profile/avatar
+//	GET    /api/avatars/{id}
+
+const (
+	maxDisplayNameLen = 40
+	maxAvatarBytes    = 256 << 10
+)
+
+type profile struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"display_name,omitempty"`
+	Avatar      []byte `json:"avatar,omitempty"`
+	AvatarType  string `json:"avatar_type,omitempty"`
+}
+
+// messageAuthor is who wrote a user message, as watchers see it
+type messageAuthor struct {
+	Name   string `json:"name,omitempty"`
+	Avatar string `json:"avatar,omitempty"`
+}
+
+type profileStore struct {
+	mu      sync.Mutex
+	byOwner map[string]*profile
+	byID    map[string]*profile
+}
+
+func newProfileStore() *profileStore {
+	return &profileStore{byOwner: make(map[string]*profile), byID: make(map[string]*profile)}
+}
+
+// update changes owner's profile, creating it first if needed
+func (s *profileStore) update(owner string, change func(p *profile)) profile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.byOwner[owner]
+	if !ok {
+		b := make([]byte, 12)
+		rand.Read(b)
+		p = &profile{ID: hex.EncodeToString(b)}
+		s.byOwner[owner] = p
+		s.byID[p.ID] = p
+	}
+	change(p)
+	return *p
+}
+
+func (s *profileStore) get(owner string) (profile, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.byOwner[owner]
+	if !ok {
+		return profile{}, false
+	}
+	return *p, true
+}
+
+func (s *profileStore) avatar(id string) ([]byte, string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.byID[id]
+	if !ok || p.Avatar == nil {
+		return nil, "", false
+	}
+	return p.Avatar, p.AvatarType, true
+}
+
+// author returns how owner's messages are attributed, nil without a
+// profile
+func (s *profileStore) author(owner string) *messageAuthor {
+	p, ok := s.get(owner)
+	if !ok || (p.DisplayName == "" && p.Avatar == nil) {
+		return nil
+	}
+	return p.author()
+}
+
+func (p profile) author() *messageAuthor {
+	a := &messageAuthor{Name: p.DisplayName}
+	if p.Avatar != nil {
+		a.Avatar = "/api/avatars/" + p.ID
+	}
+	return a
+}
+
+// all returns every profile by owner, for state exports
+func (s *profileStore) all() map[string]profile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := make(map[string]profile, len(s.byOwner))
+	for owner, p := range s.byOwner {
+		all[owner] = *p
+	}
+	return all
+}
+
+// merge adds imported profiles, owners who have one keep theirs
+func (s *profileStore) merge(byOwner map[string]profile) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for owner, p := range byOwner {
+		if _, ok := s.byOwner[owner]; ok || p.ID == "" {
+			continue
+		}
+		if _, taken := s.byID[p.ID]; taken {
+			continue
+		}
+		s.byOwner[owner] = &p
+		s.byID[p.ID] = &p
+		n++
+	}
+	return n
+}
+
+// profileOwner is app.owner for the profile endpoints, anonymous
+// callers have no profile
+func (app *application) profileOwner(w http.ResponseWriter, r *http.Request) (string, bool) {
+	owner := app.owner(r)
+	if owner == "" {
+		app.clientError(w, http.StatusForbidden, "sign in to have a profile")
+		return "", false
+	}
+	return owner, true
+}
+
+func (app *application) handleGetProfile(w http.ResponseWriter, r *http.Request) {
+	owner, ok := app.profileOwner(w, r)
+	if !ok {
+		return
+	}
+	p, _ := app.profiles.get(owner)
+	app.writeJSON(w, http.StatusOK, p.author())
+}
+
+func (app *application) handlePutProfile(w http.ResponseWriter, r *http.Request) {
+	owner, ok := app.profileOwner(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		DisplayName string `json:"display_name"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	name := strings.Join(strings.Fields(input.DisplayName), " ")
+	if utf8.RuneCountInString(name) > maxDisplayNameLen {
+		app.clientError(w, http.StatusUnprocessableEntity, "the display name is too long")
+		return
+	}
+	p := app.profiles.update(owner, func(p *profile) { p.DisplayName = name })
+	app.writeJSON(w, http.StatusOK, p.author())
+}
+
+func (app *application) handlePutAvatar(w http.ResponseWriter, r *http.Request) {
+	owner, ok := app.profileOwner(w, r)
+	if !ok {
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAvatarBytes))
+	if err != nil {
+		app.clientError(w, http.StatusRequestEntityTooLarge, "the avatar must be at most 256 KB")
+		return
+	}
+	kind := http.DetectContentType(data)
+	if !imageTypes[kind] {
+		app.clientError(w, http.StatusUnsupportedMediaType, "the avatar must be a PNG, JPEG, WebP or GIF image")
+		return
+	}
+	p := app.profiles.update(owner, func(p *profile) { p.Avatar, p.AvatarType = data, kind })
+	app.writeJSON(w, http.StatusOK, p.author())
+}
+
+func (app *application) handleDeleteAvatar(w http.ResponseWriter, r *http.Request) {
+	owner, ok := app.profileOwner(w, r)
+	if !ok {
+		return
+	}
+	app.profiles.update(owner, func(p *profile) { p.Avatar, p.AvatarType = nil, "" })
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) handleGetAvatar(w http.ResponseWriter, r *http.Request) {
+	data, kind, ok := app.profiles.avatar(r.PathValue("id"))
+	if !ok {
+		app.clientError(w, http.StatusNotFound, "avatar not found")
+		return
+	}
+	w.Header().Set("Content-Type", kind)
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(data)
+}
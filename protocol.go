@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// websocket subprotocols. clients that don't ask for one get the legacy
+// flat Message, clients asking for protocolV2 get envelopes
+const (
+	protocolLegacy = 1
+	protocolV2     = "ollamachat.v2"
+)
+
+// envelope is the v2 wire format. the message type and a full timestamp
+// sit on the outside, everything else type specific goes in data
+type envelope struct {
+	V    int          `json:"v"`
+	Type string       `json:"type"`
+	Time time.Time    `json:"time"`
+	Data envelopeData `json:"data"`
+}
+
+type envelopeData struct {
+	Content  string         `json:"content,omitempty"`
+	ID       int            `json:"id,omitempty"`
+	Version  int            `json:"version,omitempty"`
+	Event    string         `json:"event,omitempty"`
+	Language string         `json:"language,omitempty"`
+	Progress *toolProgress  `json:"progress,omitempty"`
+	Step     *agentStep     `json:"step,omitempty"`
+	Artifact *artifactInfo  `json:"artifact,omitempty"`
+	Name     string         `json:"name,omitempty"`
+	Args     map[string]any `json:"args,omitempty"`
+	Result   string         `json:"result,omitempty"`
+	Tables   []string       `json:"tables,omitempty"`
+	Images   []string       `json:"images,omitempty"`
+	Server   *buildVersion  `json:"server,omitempty"`
+
+	Provenance *provenance `json:"provenance,omitempty"`
+	Code       string      `json:"code,omitempty"`
+	RetryAfter int         `json:"retry_after,omitempty"`
+
+	Conversation  string             `json:"conversation,omitempty"`
+	Conversations []conversationInfo `json:"conversations,omitempty"`
+	Operator      string             `json:"operator,omitempty"`
+	Variant       int                `json:"variant,omitempty"`
+	Variants      int                `json:"variants,omitempty"`
+	HTML          string             `json:"html,omitempty"`
+	Usage         *messageUsage      `json:"usage,omitempty"`
+}
+
+// protocolVersion maps the negotiated subprotocol to a version number
+func protocolVersion(subprotocol string) int {
+	if subprotocol == protocolV2 {
+		return 2
+	}
+	return protocolLegacy
+}
+
+func newEnvelope(msg Message) envelope {
+	return envelope{
+		V:    2,
+		Type: msg.Type,
+		Time: time.Now(),
+		Data: envelopeData{
+			Content:  msg.Content,
+			ID:       msg.ID,
+			Version:  msg.Version,
+			Event:    msg.Event,
+			Language: msg.Language,
+			Progress: msg.Progress,
+			Step:     msg.Step,
+			Artifact: msg.Artifact,
+			Name:     msg.Name,
+			Args:     msg.Args,
+			Result:   msg.Result,
+			Tables:   msg.Tables,
+			Images:   msg.Images,
+			Server:   msg.Server,
+
+			Provenance: msg.Provenance,
+			Code:       msg.Code,
+			RetryAfter: msg.RetryAfter,
+
+			Conversation:  msg.Conversation,
+			Conversations: msg.Conversations,
+			Operator:      msg.Operator,
+			Variant:       msg.Variant,
+			Variants:      msg.Variants,
+			HTML:          msg.HTML,
+			Usage:         msg.Usage,
+		},
+	}
+}
+
+// message turns an envelope sent by a v2 client back into a Message so
+// the handlers don't need to know which protocol the client speaks
+func (e envelope) message() Message {
+	return Message{
+		Type:     e.Type,
+		Content:  e.Data.Content,
+		Time:     e.Time.Format("15:04:05"),
+		ID:       e.Data.ID,
+		Version:  e.Data.Version,
+		Event:    e.Data.Event,
+		Language: e.Data.Language,
+		Images:   e.Data.Images,
+
+		Conversation: e.Data.Conversation,
+	}
+}
+
+// encodeMessage renders msg in the given protocol version
+func encodeMessage(msg Message, version int) ([]byte, error) {
+	if version >= 2 {
+		return json.Marshal(newEnvelope(msg))
+	}
+	return json.Marshal(msg)
+}
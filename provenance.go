@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// groundingTools fetch facts from outside the model. an answer written
+// after one of them returned is grounded in what it returned, other
+// tools (notes, artifacts, reminders) only keep what the model wrote
+var groundingTools = map[string]bool{
+	"get_weather":     true,
+	"web_search":      true,
+	"get_time":        true,
+	"query_knowledge": true,
+}
+
+const (
+	provenanceGrounded = "grounded"
+	provenanceModel    = "model"
+)
+
+// provenance tells how far an answer is backed by tool results
+type provenance struct {
+	// grounded if tool results were in front of the model when it
+	// answered, model if it answered from its own knowledge
+	Kind string `json:"kind"`
+	// the tools whose results the answer was written from
+	Sources []string `json:"sources,omitempty"`
+	// sentences that repeat something a tool returned
+	Spans []provenanceSpan `json:"spans,omitempty"`
+}
+
+// provenanceSpan is a part of the answer, as byte offsets into its
+// content, and the tool it came from
+type provenanceSpan struct {
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+	Source string `json:"source"`
+}
+
+// toolOutput is a result a grounding tool returned this turn
+type toolOutput struct {
+	tool   string
+	result string
+}
+
+// recordGrounding keeps the result of a grounding tool for the answer's
+// provenance. failed calls ground nothing
+func (t *turnInfo) recordGrounding(tool, result string) {
+	if !groundingTools[tool] || toolFailed(result) {
+		return
+	}
+	t.grounding = append(t.grounding, toolOutput{tool: tool, result: result})
+}
+
+// toolFailed reports whether a tool result is an error rather than data
+func toolFailed(result string) bool {
+	if strings.HasPrefix(result, "Error") || strings.HasPrefix(result, "Unknown tool") {
+		return true
+	}
+	var obj map[string]any
+	if json.Unmarshal([]byte(result), &obj) != nil {
+		return false
+	}
+	_, failed := obj["error"]
+	return failed
+}
+
+var (
+	sentenceEnd = regexp.MustCompile(`[.!?]+(\s+|$)|\n+`)
+	numberRe    = regexp.MustCompile(`\d+(?:[.,:]\d+)*`)
+)
+
+// answerProvenance works out the provenance of an answer from the tool
+// results of its turn. a sentence counts as coming from a tool when a
+// number in it, or two of its longer words, appear in the tool's result
+func answerProvenance(content string, grounding []toolOutput) *provenance {
+	if len(grounding) == 0 {
+		return &provenance{Kind: provenanceModel}
+	}
+
+	p := &provenance{Kind: provenanceGrounded}
+	results := make([]string, len(grounding))
+	for i, g := range grounding {
+		if !slices.Contains(p.Sources, g.tool) {
+			p.Sources = append(p.Sources, g.tool)
+		}
+		results[i] = strings.ToLower(g.result)
+	}
+
+	start := 0
+	for _, loc := range append(sentenceEnd.FindAllStringIndex(content, -1), []int{len(content), len(content)}) {
+		sentence := content[start:loc[0]]
+		end := loc[1]
+		if loc[0] < len(content) && content[loc[0]] != '\n' {
+			// the punctuation belongs to the sentence
+			sentence = strings.TrimRightFunc(content[start:loc[1]], unicode.IsSpace)
+		}
+		if best := groundedIn(sentence, results); best >= 0 {
+			trimmed := strings.TrimLeftFunc(sentence, unicode.IsSpace)
+			s := start + len(sentence) - len(trimmed)
+			p.Spans = append(p.Spans, provenanceSpan{Start: s, End: start + len(sentence), Source: grounding[best].tool})
+		}
+		start = end
+		if start >= len(content) {
+			break
+		}
+	}
+	return p
+}
+
+// groundedIn returns the index of the result that backs the sentence
+// best, -1 if none does
+func groundedIn(sentence string, results []string) int {
+	lower := strings.ToLower(sentence)
+	numbers := numberRe.FindAllString(lower, -1)
+	var words []string
+	for _, w := range strings.FieldsFunc(lower, func(r rune) bool { return !unicode.IsLetter(r) }) {
+		if len([]rune(w)) >= 5 && !slices.Contains(words, w) {
+			words = append(words, w)
+		}
+	}
+
+	best, bestScore := -1, 0
+	for i, result := range results {
+		score := 0
+		for _, n := range numbers {
+			if strings.Contains(result, n) {
+				score += 2
+			}
+		}
+		for _, w := range words {
+			if strings.Contains(result, w) {
+				score++
+			}
+		}
+		if score >= 2 && score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
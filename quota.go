@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// tokenQuota limits how many tokens (prompt and completion) a client can
+// use per window. clients are identified by IP address
+type tokenQuota struct {
+	limit   int
+	window  time.Duration
+	counter usageCounter
+}
+
+func newTokenQuota(limit int, window time.Duration, counter usageCounter) *tokenQuota {
+	return &tokenQuota{
+		limit:   limit,
+		window:  window,
+		counter: counter,
+	}
+}
+
+// remaining returns how many tokens the client has left and when the
+// quota resets. a zero limit means unlimited
+func (q *tokenQuota) remaining(client string) (int, time.Time) {
+	if q.limit <= 0 {
+		return -1, time.Time{}
+	}
+	// the counter only fails when it has no fallback, let the client in
+	used, resetAt, err := q.counter.add(context.Background(), "quota:"+client, 0, q.window)
+	if err != nil {
+		return -1, time.Time{}
+	}
+	return max(q.limit-used, 0), resetAt
+}
+
+// record adds the tokens of a finished turn to the client's usage
+func (q *tokenQuota) record(client string, tokens int) {
+	if q.limit <= 0 {
+		return
+	}
+	q.counter.add(context.Background(), "quota:"+client, tokens, q.window)
+}
+
+// estimateTokens is a rough count for text that hasn't been tokenized
+// yet, about four characters per token for English
+func estimateTokens(s string) int {
+	return len(s)/4 + 1
+}
+
+// estimatePromptTokens estimates the size of the next request: the
+// whole history plus the new prompt is sent on every turn
+func estimatePromptTokens(history []api.Message, prompt string) int {
+	n := estimateTokens(prompt)
+	for _, m := range history {
+		n += estimateTokens(m.Content)
+	}
+	return n
+}
+
+// checkQuota refuses a turn up front if the client's remaining quota
+// can't cover the prompt plus a minimal answer. it returns the message
+// to show the user, or "" if the turn can go ahead
+func (app *application) checkQuota(conv *conversation, client, prompt string) string {
+	return app.checkQuotaFor(client, app.trimHistory(conv, conv.promptMessages()), prompt)
+}
+
+// checkQuotaFor is checkQuota for a prompt with the given history, for
+// requests that bring their own like the OpenAI API
+func (app *application) checkQuotaFor(client string, history []api.Message, prompt string) string {
+	remaining, resetAt := app.quota.remaining(client)
+	if remaining < 0 {
+		return ""
+	}
+
+	needed := estimatePromptTokens(history, prompt) + app.config.minResponseTokens
+	if remaining < needed {
+		return fmt.Sprintf("Your token quota is used up (%d left, this message needs about %d). It resets %s.",
+			remaining, needed, resetAt.Format("Mon 15:04"))
+	}
+	return ""
+}
+
+// clientIP identifies the client for quotas and limits
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// recordUsage logs the turn for usage reports, charges its tokens to the
+// client and warns them once less than a tenth of their quota is left
+func (app *application) recordUsage(client *wsClient, ip string, turn *turnInfo) {
+	var tools []string
+	for name, n := range turn.toolCalls {
+		for range n {
+			tools = append(tools, name)
+		}
+	}
+	app.usage.add(usageRecord{
+		Time:             time.Now(),
+		Client:           ip,
+		Model:            turn.model,
+		PromptTokens:     turn.promptTokens,
+		CompletionTokens: turn.completionTokens,
+		Tools:            tools,
+		Latency:          time.Since(turn.started),
+	})
+
+	before, _ := app.quota.remaining(ip)
+	app.quota.record(ip, turn.promptTokens+turn.completionTokens)
+	after, resetAt := app.quota.remaining(ip)
+
+	threshold := app.config.tokenQuota / 10
+	// turns that didn't come in over a socket have nobody to warn
+	if client != nil && after >= 0 && before >= threshold && after < threshold {
+		client.send(Message{
+			Type:    "system",
+			Event:   eventQuota,
+			Content: fmt.Sprintf("You have %d tokens left until %s.", after, resetAt.Format("Mon 15:04")),
+			Time:    time.Now().Format("15:04:05"),
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits chat messages per minute, per client IP and per
+// conversation, and how many answers a client IP may have queued or
+// running at once. the per minute counts go through the usage counter
+// so instances sharing -redis share them, concurrent answers are
+// counted per instance
+type rateLimiter struct {
+	perIP           int
+	perConversation int
+	concurrent      int
+	counter         usageCounter
+
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func newRateLimiter(perIP, perConversation, concurrent int, counter usageCounter) *rateLimiter {
+	return &rateLimiter{
+		perIP:           perIP,
+		perConversation: perConversation,
+		concurrent:      concurrent,
+		counter:         counter,
+		active:          make(map[string]int),
+	}
+}
+
+// rateLimitHit says which limit a message ran into and when to try
+// again. retryAfter is 0 when it depends on an answer finishing
+type rateLimitHit struct {
+	message    string
+	retryAfter time.Duration
+}
+
+// acquire counts a chat message from ip in conversation conv and returns
+// the limit it's over, nil if it may go ahead. a message that's let
+// through has to be released once it's answered. conv is "" for
+// requests outside a conversation, only the ip limits apply to them
+func (l *rateLimiter) acquire(ip, conv string) *rateLimitHit {
+	l.mu.Lock()
+	if l.concurrent > 0 && l.active[ip] >= l.concurrent {
+		l.mu.Unlock()
+		return &rateLimitHit{message: fmt.Sprintf("Too many of your messages are being answered at once (at most %d), wait for one to finish.", l.concurrent)}
+	}
+	l.active[ip]++
+	l.mu.Unlock()
+
+	var hit *rateLimitHit
+	if conv != "" {
+		hit = l.count("rate:conversation:"+conv, l.perConversation, "this conversation")
+	}
+	if hit == nil {
+		hit = l.count("rate:ip:"+ip, l.perIP, "your address")
+	}
+	if hit != nil {
+		l.release(ip)
+	}
+	return hit
+}
+
+// count adds a message to key's one minute window, nil if it's within
+// the limit. the counter only fails when it has no fallback, the
+// message is let through then
+func (l *rateLimiter) count(key string, limit int, who string) *rateLimitHit {
+	if limit <= 0 {
+		return nil
+	}
+	n, resetAt, err := l.counter.add(context.Background(), key, 1, time.Minute)
+	if err != nil || n <= limit {
+		return nil
+	}
+	return &rateLimitHit{
+		message:    fmt.Sprintf("Too many messages from %s, the limit is %d a minute.", who, limit),
+		retryAfter: time.Until(resetAt),
+	}
+}
+
+// release ends a message acquire let through, once it was answered
+func (l *rateLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[ip] <= 1 {
+		delete(l.active, ip)
+		return
+	}
+	l.active[ip]--
+}
+
+// rateLimited tells the client its message was refused and when it may
+// send again
+func rateLimited(client *wsClient, hit *rateLimitHit) {
+	msg := errorMessage(errRateLimited, hit.message)
+	if hit.retryAfter > 0 {
+		msg.RetryAfter = int(math.Ceil(hit.retryAfter.Seconds()))
+	}
+	client.send(msg)
+}
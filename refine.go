@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+)
+
+// with -refine the model's answer is a first draft. a second pass
+// reviews it against the question and the tool results of the turn,
+// and unless the review found nothing a third pass writes the answer
+// again with the review in mind. only the final answer is shown, the
+// draft and the review are kept with it for the refinement endpoint
+
+const critiqueInstruction = "You review answers before they're sent. Check the draft answer " +
+	"against the user's question and the tool results: list factual errors, claims the tool " +
+	"results contradict, parts of the question left unanswered and anything unclear. " +
+	"If nothing needs to change, reply with only OK."
+
+const reviseInstruction = "Write the draft answer to the user's question again, fixing the " +
+	"problems the review lists. Keep the language and what was right in the draft. Reply with " +
+	"the improved answer only, without mentioning the draft or the review."
+
+// refinement is how an answer came about with -refine
+type refinement struct {
+	Draft    string `json:"draft"`
+	Critique string `json:"critique"`
+	// false when the review found nothing to change
+	Revised bool `json:"revised"`
+}
+
+// turnToolResults returns the results of the tool calls made since the
+// latest user message
+func (c *conversation) turnToolResults() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var results []string
+	for i := len(c.messages) - 1; i >= 0 && c.messages[i].Role != "user"; i-- {
+		if m := c.messages[i]; m.Role == "tool" {
+			results = append([]string{m.Content}, results...)
+		}
+	}
+	return results
+}
+
+// refine reviews and rewrites draft, the answer to prompt. the draft is
+// returned unchanged when a pass fails, a cancelled ctx is left for the
+// caller to check
+func (app *application) refine(ctx context.Context, conv *conversation, model, prompt, draft string, options map[string]any, turn *turnInfo) (string, *refinement) {
+	complete := func(instruction, input string) (string, error) {
+		var out strings.Builder
+		req := &api.ChatRequest{
+			Model: model,
+			Messages: []api.Message{
+				{Role: "system", Content: instruction},
+				{Role: "user", Content: input},
+			},
+			Options: options,
+		}
+		err := app.chat(ctx, req, func(resp api.ChatResponse) error {
+			out.WriteString(resp.Message.Content)
+			turn.countResponse(resp)
+			return nil
+		})
+		return strings.TrimSpace(out.String()), err
+	}
+
+	var input strings.Builder
+	fmt.Fprintf(&input, "Question:\n%s\n\n", prompt)
+	if results := conv.turnToolResults(); len(results) > 0 {
+		fmt.Fprintf(&input, "Tool results:\n%s\n\n", strings.Join(results, "\n"))
+	}
+	fmt.Fprintf(&input, "Draft answer:\n%s", draft)
+
+	critique, err := complete(critiqueInstruction, input.String())
+	if err != nil {
+		if ctx.Err() == nil {
+			app.logger.Error(fmt.Sprintf("Error reviewing answer: %v", err))
+		}
+		return draft, nil
+	}
+	if critique == "" {
+		app.logger.Debug("Review came back empty", "conversation", conv.id)
+		return draft, nil
+	}
+	ref := &refinement{Draft: draft, Critique: critique}
+	if strings.EqualFold(strings.Trim(critique, " .!"), "ok") {
+		app.logger.Debug("Review found nothing to change", "conversation", conv.id)
+		return draft, ref
+	}
+
+	fmt.Fprintf(&input, "\n\nReview:\n%s", critique)
+	revised, err := complete(reviseInstruction, input.String())
+	if err != nil {
+		if ctx.Err() == nil {
+			app.logger.Error(fmt.Sprintf("Error revising answer: %v", err))
+		}
+		return draft, ref
+	}
+	if revised == "" {
+		app.logger.Debug("Revision came back empty", "conversation", conv.id)
+		return draft, ref
+	}
+	ref.Revised = true
+	app.logger.Debug("Answer revised", "conversation", conv.id)
+	return revised, ref
+}
+
+// returns the draft and review an answer was refined from, see -refine
+func (app *application) handleMessageRefinement(w http.ResponseWriter, r *http.Request) {
+	conv, ok := app.ownConversation(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		app.clientError(w, http.StatusNotFound, "message not found")
+		return
+	}
+	msg, ok := conv.message(id)
+	if !ok {
+		app.clientError(w, http.StatusNotFound, "message not found")
+		return
+	}
+	if msg.Refinement == nil {
+		app.clientError(w, http.StatusNotFound, "the answer wasn't refined")
+		return
+	}
+	app.writeJSON(w, http.StatusOK, map[string]any{
+		"id":         msg.ID,
+		"answer":     msg.Content,
+		"refinement": msg.Refinement,
+	})
+}
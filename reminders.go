@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+const (
+	// reminders further out than this are refused, they live in memory
+	// and wouldn't survive that long anyway
+	maxReminderDelay = 7 * 24 * time.Hour
+	// pending reminders a conversation may have
+	maxRemindersPerConversation = 20
+)
+
+var (
+	setReminderTool = functionTool("set_reminder",
+		"Remind the user of something at a later time, e.g. \"remind me in 20 minutes to call Bob\"",
+		[]string{"message"},
+		map[string]toolProperty{
+			"message":    {Type: api.PropertyType{"string"}, Description: "What to remind the user of"},
+			"in_minutes": {Type: api.PropertyType{"number"}, Description: "Minutes from now until the reminder, use this or at"},
+			"at":         {Type: api.PropertyType{"string"}, Description: "When to remind, as 15:04, 2006-01-02 15:04 or RFC 3339, in the server's timezone unless it has an offset"},
+		})
+	listRemindersTool = functionTool("list_reminders",
+		"List the reminders of this conversation that haven't gone off yet",
+		nil,
+		map[string]toolProperty{})
+)
+
+// reminder is a message delivered to a conversation at a later time
+type reminder struct {
+	ID           int       `json:"id"`
+	Conversation string    `json:"conversation"`
+	Message      string    `json:"message"`
+	Due          time.Time `json:"due"`
+	Created      time.Time `json:"created"`
+}
+
+// reminderScheduler keeps pending reminders in due order and hands them
+// to a delivery function when they're due
+type reminderScheduler struct {
+	mu      sync.Mutex
+	nextID  int
+	pending []reminder
+	// signals run that an earlier reminder may have been added
+	wake chan struct{}
+}
+
+func newReminderScheduler() *reminderScheduler {
+	return &reminderScheduler{wake: make(chan struct{}, 1)}
+}
+
+func (s *reminderScheduler) add(r reminder) (reminder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.forConversationLocked(r.Conversation)) >= maxRemindersPerConversation {
+		return reminder{}, fmt.Errorf("this conversation already has %d reminders", maxRemindersPerConversation)
+	}
+	s.nextID++
+	r.ID = s.nextID
+	i := sort.Search(len(s.pending), func(i int) bool { return s.pending[i].Due.After(r.Due) })
+	s.pending = append(s.pending[:i], append([]reminder{r}, s.pending[i:]...)...)
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return r, nil
+}
+
+// forConversation returns the pending reminders of a conversation, the
+// next one first
+func (s *reminderScheduler) forConversation(id string) []reminder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.forConversationLocked(id)
+}
+
+func (s *reminderScheduler) forConversationLocked(id string) []reminder {
+	out := []reminder{}
+	for _, r := range s.pending {
+		if r.Conversation == id {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// due removes and returns the reminders due at now
+func (s *reminderScheduler) due(now time.Time) []reminder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := sort.Search(len(s.pending), func(i int) bool { return s.pending[i].Due.After(now) })
+	due := append([]reminder(nil), s.pending[:n]...)
+	s.pending = s.pending[n:]
+	return due
+}
+
+// next returns when the next reminder is due
+func (s *reminderScheduler) next() (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		return time.Time{}, false
+	}
+	return s.pending[0].Due, true
+}
+
+// run delivers reminders as they come due until ctx is done
+func (s *reminderScheduler) run(ctx context.Context, deliver func(reminder)) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		for _, r := range s.due(time.Now()) {
+			deliver(r)
+		}
+
+		wait := time.Hour
+		if due, ok := s.next(); ok {
+			wait = time.Until(due)
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-ctx.Done():
+			return
+		// the timer is reset on the next round either way
+		case <-s.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// parseReminderTime works out when a reminder is due from the tool's
+// arguments, relative to now. times without a zone are in now's
+// location, the conversation's timezone
+func parseReminderTime(args api.ToolCallFunctionArguments, now time.Time) (time.Time, error) {
+	// small models send numbers as strings now and then
+	switch m := args["in_minutes"].(type) {
+	case float64:
+		return now.Add(time.Duration(m * float64(time.Minute))), nil
+	case string:
+		if f, err := strconv.ParseFloat(m, 64); err == nil {
+			return now.Add(time.Duration(f * float64(time.Minute))), nil
+		}
+	}
+
+	at, _ := args["at"].(string)
+	if at == "" {
+		return time.Time{}, fmt.Errorf("give in_minutes or at")
+	}
+	if t, err := time.Parse(time.RFC3339, at); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04", at, now.Location()); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("15:04", at, now.Location()); err == nil {
+		// a time of day is the next time the clock shows it
+		due := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+		if !due.After(now) {
+			due = due.AddDate(0, 0, 1)
+		}
+		return due, nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not a time, use 15:04, 2006-01-02 15:04 or RFC 3339", at)
+}
+
+// runReminderTool executes set_reminder and list_reminders
+func (app *application) runReminderTool(ctx context.Context, args api.ToolCallFunctionArguments) string {
+	env := toolEnvFrom(ctx)
+	if env.conv == nil {
+		return `{"error":"reminders need a conversation"}`
+	}
+
+	var result any
+	switch env.tool {
+	case "set_reminder":
+		now, _ := env.conv.now()
+		due, err := parseReminderTime(args, now)
+		switch {
+		case err != nil:
+		case !due.After(now):
+			err = fmt.Errorf("%s is in the past", due.Format(time.RFC3339))
+		case due.Sub(now) > maxReminderDelay:
+			err = fmt.Errorf("reminders can be at most %s ahead", maxReminderDelay)
+		}
+		var r reminder
+		if err == nil {
+			// the schema requires message to be a string
+			r, err = app.reminders.add(reminder{
+				Conversation: env.conv.id,
+				Message:      args["message"].(string),
+				Due:          due,
+				Created:      now,
+			})
+		}
+		if err != nil {
+			result = map[string]string{"error": "invalid_reminder", "message": err.Error()}
+			break
+		}
+		result = reminderResult(r, now)
+	case "list_reminders":
+		now, _ := env.conv.now()
+		reminders := []map[string]any{}
+		for _, r := range app.reminders.forConversation(env.conv.id) {
+			reminders = append(reminders, reminderResult(r, now))
+		}
+		result = map[string]any{"now": now.Format(time.RFC3339), "reminders": reminders}
+	}
+
+	js, _ := json.Marshal(result)
+	return string(js)
+}
+
+func reminderResult(r reminder, now time.Time) map[string]any {
+	return map[string]any{"id": r.ID, "message": r.Message, "due": r.Due.Format(time.RFC3339), "in": r.Due.Sub(now).Round(time.Second).String()}
+}
+
+// deliverReminder adds a due reminder to its conversation, shows it in
+// the conversation's open tabs and posts it to -reminder-webhook
+func (app *application) deliverReminder(r reminder) {
+	app.logger.Info("Reminder due", "id", r.ID, "conversation", r.Conversation)
+	content := "Reminder: " + r.Message
+
+	if conv, ok := app.conversations.get(r.Conversation); ok {
+		go func() {
+			// not in the middle of an answer
+			conv.turn.lock(func(int) {})
+			stored := conv.add(chatMessage{Message: api.Message{Role: "assistant", Content: content}})
+			conv.turn.unlock()
+			app.clients.sendTo(conv.id, Message{
+				Type:    "reminder",
+				Content: content,
+				Time:    time.Now().Format("15:04:05"),
+				ID:      stored.ID,
+				Version: stored.Version,
+			})
+		}()
+	}
+
+	if app.config.reminderWebhook != "" {
+		go app.postReminder(r)
+	}
+}
+
+func (app *application) postReminder(r reminder) {
+	js, _ := json.Marshal(r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, app.config.reminderWebhook, bytes.NewReader(js))
+	if err != nil {
+		app.logger.Error(fmt.Sprintf("Error sending reminder: %v", err))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		app.logger.Error(fmt.Sprintf("Error sending reminder: %v", err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		app.logger.Error(fmt.Sprintf("Error sending reminder: %s returned %s", req.URL.Host, resp.Status))
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// replayChunk is one piece of a replayed message
+type replayChunk struct {
+	ID      int    `json:"id"`
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	Done    bool   `json:"done"`
+}
+
+// streams a conversation back with the pauses it was written with.
+// answers are sent word by word, spread over the time the model took.
+// ?speed=4 plays it four times faster and pauses longer than ?max_pause=
+// (default 5s) are shortened, so a chat left open overnight still replays
+func (app *application) handleReplay(w http.ResponseWriter, r *http.Request) {
+	conv, ok := app.ownConversation(w, r)
+	if !ok {
+		return
+	}
+
+	speed := 1.0
+	if s := r.URL.Query().Get("speed"); s != "" {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v <= 0 {
+			app.clientError(w, http.StatusBadRequest, "speed must be a positive number")
+			return
+		}
+		speed = v
+	}
+	maxPause := 5 * time.Second
+	if s := r.URL.Query().Get("max_pause"); s != "" {
+		v, err := time.ParseDuration(s)
+		if err != nil || v < 0 {
+			app.clientError(w, http.StatusBadRequest, "max_pause must be a duration like 2s")
+			return
+		}
+		maxPause = v
+	}
+
+	msgs, _ := conv.snapshot()
+
+	sse, err := app.newSSEWriter(w, r)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	defer sse.close()
+
+	// wait sleeps for the scaled duration, false if the client went away
+	wait := func(d time.Duration) bool {
+		d = min(time.Duration(float64(d)/speed), maxPause)
+		if d <= 0 {
+			return true
+		}
+		select {
+		case <-time.After(d):
+			return true
+		case <-r.Context().Done():
+			return false
+		}
+	}
+
+	var last time.Time
+	for _, m := range msgs {
+		if m.Role == "system" || m.Role == "tool" || m.Content == "" {
+			continue
+		}
+
+		var gap time.Duration
+		if !last.IsZero() {
+			gap = m.Created.Sub(last)
+		}
+		last = m.Created
+
+		if m.Role != "assistant" {
+			if !wait(gap) {
+				return
+			}
+			if err := sse.send("message", replayChunk{ID: m.ID, Role: m.Role, Content: m.Content, Done: true}); err != nil {
+				return
+			}
+			continue
+		}
+
+		// the answer was written during the gap, replay it as it would
+		// have streamed
+		words := strings.SplitAfter(m.Content, " ")
+		perWord := gap / time.Duration(len(words))
+		for i, word := range words {
+			if !wait(perWord) {
+				return
+			}
+			chunk := replayChunk{ID: m.ID, Role: m.Role, Content: word, Done: i == len(words)-1}
+			if err := sse.send("message", chunk); err != nil {
+				return
+			}
+		}
+	}
+	sse.send("done", map[string]int{"messages": len(msgs)})
+}
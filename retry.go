@@ -0,0 +1,42 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/ollama/ollama/api"
+)
+
+// ignoranceRe matches answers where the model says it can't know
+// something current. it's what a turn the heuristics sent without tools
+// usually gets back when they missed, see -retry-with-tools
+var ignoranceRe = regexp.MustCompile(`(?i)` +
+	`(don['’]t|do not|can['’]t|cannot|am not able to|['’]m not able to|am unable to|['’]m unable to) ` +
+	`(have |get |access |browse |check |look up |provide |retrieve )?(access to )?` +
+	`(the )?(real[- ]?time|current|live|up[- ]to[- ]date|today['’]s|the latest|the internet|the web|recent)` +
+	`|my (knowledge|training)( data)? (cutoff|cut-off|only goes)` +
+	`|as of my (last )?(knowledge|training)` +
+	`|(no|without) (internet|web|real[- ]?time) access` +
+	`|keine (echtzeit|aktuellen)` +
+	`|no tengo acceso a (información|datos) en tiempo real` +
+	`|je n['’]ai pas accès (à|aux) (des )?(informations|données) en temps réel`)
+
+// admitsIgnorance reports whether an answer says the model lacks live
+// information
+func admitsIgnorance(answer string) bool {
+	return ignoranceRe.MatchString(answer)
+}
+
+// liveTools returns the tools that fetch current information: those of
+// the current_info intent, or the built-in ones if there is no such
+// route
+func (app *application) liveTools() api.Tools {
+	if r, ok := app.intentRoutes[intentCurrentInfo]; ok && len(r.tools) > 0 {
+		return r.tools
+	}
+	var tools api.Tools
+	for _, name := range app.tools.registered([]string{"get_weather", "get_time", "web_search"}) {
+		schema, _ := app.tools.schema(name)
+		tools = append(tools, schema)
+	}
+	return tools
+}
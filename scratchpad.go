@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// the scratchpad gives the model somewhere to keep intermediate results
+// across turns, e.g. a plan it's working through or facts it looked up
+var (
+	writeNoteTool = functionTool("write_note",
+		"Save a note to the conversation scratchpad, replacing any note with the same title",
+		[]string{"title", "content"},
+		map[string]toolProperty{
+			"title":   {Type: api.PropertyType{"string"}, Description: "Short title of the note"},
+			"content": {Type: api.PropertyType{"string"}, Description: "The text of the note"},
+		})
+	readNotesTool = functionTool("read_notes",
+		"Read notes from the conversation scratchpad, all of them or the one with the given title",
+		nil,
+		map[string]toolProperty{
+			"title": {Type: api.PropertyType{"string"}, Description: "Title of the note to read, leave out to read all"},
+		})
+	listNotesTool = functionTool("list_notes",
+		"List the titles of the notes in the conversation scratchpad",
+		nil,
+		map[string]toolProperty{})
+)
+
+type scratchNote struct {
+	Title     string    `json:"title"`
+	Content   string    `json:"content"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// writeNote stores a note, replacing an existing one with the same title
+func (c *conversation) writeNote(title, content string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.notes == nil {
+		c.notes = make(map[string]scratchNote)
+	}
+	c.notes[title] = scratchNote{Title: title, Content: content, UpdatedAt: time.Now().UTC()}
+}
+
+// scratchpad returns the notes sorted by title
+func (c *conversation) scratchpad() []scratchNote {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	notes := make([]scratchNote, 0, len(c.notes))
+	for _, n := range c.notes {
+		notes = append(notes, n)
+	}
+	sort.Slice(notes, func(i, j int) bool { return notes[i].Title < notes[j].Title })
+	return notes
+}
+
+// runScratchpadTool executes one of the scratchpad tools
+func runScratchpadTool(ctx context.Context, args api.ToolCallFunctionArguments) string {
+	env := toolEnvFrom(ctx)
+	conv := env.conv
+
+	var result any
+	switch env.tool {
+	case "write_note":
+		conv.writeNote(args["title"].(string), args["content"].(string))
+		result = map[string]string{"status": "saved"}
+	case "read_notes":
+		notes := conv.scratchpad()
+		if title, ok := args["title"].(string); ok {
+			notes = filterNotes(notes, title)
+		}
+		result = notes
+	case "list_notes":
+		titles := []string{}
+		for _, n := range conv.scratchpad() {
+			titles = append(titles, n.Title)
+		}
+		result = titles
+	}
+
+	js, _ := json.Marshal(result)
+	return string(js)
+}
+
+func filterNotes(notes []scratchNote, title string) []scratchNote {
+	out := []scratchNote{}
+	for _, n := range notes {
+		if n.Title == title {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// shows the scratchpad so the UI can display it next to the chat
+func (app *application) handleScratchpad(w http.ResponseWriter, r *http.Request) {
+	conv, ok := app.ownConversation(w, r)
+	if !ok {
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, conv.scratchpad())
+}
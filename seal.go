@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+)
+
+// with -encryption-passphrase the files the server writes with
+// conversation text in them, the -snippets file and state exports, are
+// encrypted with AES-GCM under a key derived from the passphrase.
+// conversations themselves only live in memory. a sealed file is
+//
+//	sealMagic | salt | nonce | ciphertext
+
+const (
+	sealMagic      = "owc-sealed-1\n"
+	sealSaltSize   = 16
+	sealIterations = 600_000
+)
+
+var errNoPassphrase = errors.New("the file is encrypted, -encryption-passphrase is needed to read it")
+
+// sealKey is a key derived from the passphrase with one salt. deriving
+// is slow on purpose, so a store that writes often keeps its key
+type sealKey struct {
+	salt []byte
+	aead cipher.AEAD
+}
+
+// newSealKey derives the key for salt, a new random one if it's nil
+func newSealKey(passphrase string, salt []byte) (*sealKey, error) {
+	if salt == nil {
+		salt = make([]byte, sealSaltSize)
+		rand.Read(salt)
+	}
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, sealIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealKey{salt: salt, aead: aead}, nil
+}
+
+// seal encrypts plain into a sealed file
+func (k *sealKey) seal(plain []byte) []byte {
+	nonce := make([]byte, k.aead.NonceSize())
+	rand.Read(nonce)
+	out := append([]byte(sealMagic), k.salt...)
+	out = append(out, nonce...)
+	return k.aead.Seal(out, nonce, plain, nil)
+}
+
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(sealMagic))
+}
+
+// unseal decrypts a sealed file. the key is returned for sealing the
+// file again
+func unseal(passphrase string, data []byte) ([]byte, *sealKey, error) {
+	if passphrase == "" {
+		return nil, nil, errNoPassphrase
+	}
+	data = data[len(sealMagic):]
+	if len(data) < sealSaltSize {
+		return nil, nil, errors.New("the encrypted file is truncated")
+	}
+	k, err := newSealKey(passphrase, data[:sealSaltSize])
+	if err != nil {
+		return nil, nil, err
+	}
+	data = data[sealSaltSize:]
+	if len(data) < k.aead.NonceSize() {
+		return nil, nil, errors.New("the encrypted file is truncated")
+	}
+	nonce, ciphertext := data[:k.aead.NonceSize()], data[k.aead.NonceSize():]
+	plain, err := k.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, nil, errors.New("the file can't be decrypted, wrong passphrase or damaged")
+	}
+	return plain, k, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+)
+
+// maxSearchResults is how many results web_search returns at most
+const maxSearchResults = 5
+
+var webSearchTool = functionTool("web_search",
+	"Search the web for current events, news and facts that may have changed recently",
+	[]string{"query"},
+	map[string]toolProperty{
+		"query": {Type: api.PropertyType{"string"}, Description: "What to search for"},
+	})
+
+// searchResult is what web_search returns per hit
+type searchResult struct {
+	Title   string `json:"title"`
+	URL     string `json:"url"`
+	Snippet string `json:"snippet,omitempty"`
+}
+
+// searchProvider runs a web search
+type searchProvider interface {
+	search(ctx context.Context, query string) ([]searchResult, error)
+}
+
+// newSearchProvider returns the provider selected by -search-provider,
+// nil when web search is off. a SearxNG URL on its own picks searxng
+func newSearchProvider(name, searxngURL string) (searchProvider, error) {
+	if name == "" && searxngURL != "" {
+		name = "searxng"
+	}
+
+	switch name {
+	case "", "off":
+		return nil, nil
+	case "searxng":
+		if searxngURL == "" {
+			return nil, fmt.Errorf("searxng needs -searxng-url")
+		}
+		return &searxng{baseURL: strings.TrimSuffix(searxngURL, "/")}, nil
+	case "duckduckgo":
+		return &duckDuckGo{}, nil
+	default:
+		return nil, fmt.Errorf("unknown search provider %q, use searxng, duckduckgo or off", name)
+	}
+}
+
+// runSearchTool runs web_search through the tool cache
+func (app *application) runSearchTool(ctx context.Context, args api.ToolCallFunctionArguments) string {
+	// the schema requires query to be a string
+	query := args["query"].(string)
+	return app.toolCache.get("web_search", args, func() string {
+		toolEnvFrom(ctx).report(0, "Searching the web for "+query)
+		results, err := app.search.search(ctx, query)
+		if err != nil {
+			app.logger.Error(fmt.Sprintf("Error searching the web: %v", err))
+			return "Error searching the web, answer from what you know and say that the search failed"
+		}
+		if len(results) > maxSearchResults {
+			results = results[:maxSearchResults]
+		}
+		js, _ := json.Marshal(map[string]any{"query": query, "results": results})
+		return string(js)
+	})
+}
+
+// searxng uses the JSON API of a SearxNG instance. the instance has to
+// have the json format enabled in its settings
+type searxng struct {
+	baseURL string
+}
+
+func (s *searxng) search(ctx context.Context, query string) ([]searchResult, error) {
+	var resp struct {
+		Results []struct {
+			Title   string `json:"title"`
+			URL     string `json:"url"`
+			Content string `json:"content"`
+		} `json:"results"`
+	}
+	u := s.baseURL + "/search?" + url.Values{"q": {query}, "format": {"json"}}.Encode()
+	if err := getJSON(ctx, u, &resp); err != nil {
+		return nil, err
+	}
+
+	var results []searchResult
+	for _, r := range resp.Results {
+		results = append(results, searchResult{Title: r.Title, URL: r.URL, Snippet: r.Content})
+	}
+	return results, nil
+}
+
+// duckDuckGo scrapes the DuckDuckGo HTML endpoint, which needs no key
+type duckDuckGo struct{}
+
+var duckDuckGoURL = "https://html.duckduckgo.com/html/"
+
+var (
+	ddgResultLink = regexp.MustCompile(`(?s)<a[^>]+class="result__a"[^>]+href="([^"]+)"[^>]*>(.*?)</a>`)
+	ddgSnippet    = regexp.MustCompile(`(?s)class="result__snippet"[^>]*>(.*?)</a>`)
+	htmlTag       = regexp.MustCompile(`<[^>]+>`)
+)
+
+func (d *duckDuckGo) search(ctx context.Context, query string) ([]searchResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, duckDuckGoURL+"?"+url.Values{"q": {query}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; ollama-webchat)")
+	resp, err := toolClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	page, err := io.ReadAll(io.LimitReader(resp.Body, 2<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseDuckDuckGo(string(page)), nil
+}
+
+// parseDuckDuckGo pulls the results out of a DuckDuckGo HTML page. the
+// snippet of a result sits between its link and the next result's
+func parseDuckDuckGo(page string) []searchResult {
+	links := ddgResultLink.FindAllStringSubmatchIndex(page, -1)
+
+	var results []searchResult
+	for i, m := range links {
+		end := len(page)
+		if i+1 < len(links) {
+			end = links[i+1][0]
+		}
+
+		target := resolveDuckDuckGoLink(html.UnescapeString(page[m[2]:m[3]]))
+		if target == "" {
+			continue
+		}
+		r := searchResult{Title: htmlText(page[m[4]:m[5]]), URL: target}
+		if s := ddgSnippet.FindStringSubmatch(page[m[1]:end]); s != nil {
+			r.Snippet = htmlText(s[1])
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// resolveDuckDuckGoLink returns where a result link points to. links go
+// through a redirect with the target in uddg, ads go through y.js and are
+// dropped
+func resolveDuckDuckGoLink(href string) string {
+	u, err := url.Parse(href)
+	if err != nil {
+		return ""
+	}
+	if strings.HasSuffix(u.Host, "duckduckgo.com") {
+		if u.Path == "/y.js" {
+			return ""
+		}
+		return u.Query().Get("uddg")
+	}
+	return href
+}
+
+func htmlText(s string) string {
+	return strings.Join(strings.Fields(html.UnescapeString(htmlTag.ReplaceAllString(s, ""))), " ")
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// snippets are saved prompts and canned replies. "/snippet name rest"
+// at the start of a message is replaced by the snippet's text followed
+// by the rest. every owner has their own, workspace snippets are shared
+// by everyone and managed by admins. an owner's snippet hides a
+// workspace one with the same name
+type snippetStore struct {
+	mu   sync.Mutex
+	path string
+	// nil unless -encryption-passphrase, see seal.go
+	key *sealKey
+	// by owner, "" holds the workspace snippets
+	byOwner map[string]map[string]string
+}
+
+var snippetNameRe = regexp.MustCompile(`^[a-z0-9_-]{1,40}$`)
+
+const maxSnippetLen = 4000
+
+// loadSnippets reads the snippets saved at path. a missing file starts
+// an empty store, an empty path keeps snippets in memory only. with a
+// passphrase the file is encrypted, a plaintext one is encrypted the
+// next time it's saved
+func loadSnippets(path, passphrase string) (*snippetStore, error) {
+	s := &snippetStore{path: path, byOwner: make(map[string]map[string]string)}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		data, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if isSealed(data) {
+		if data, s.key, err = unseal(passphrase, data); err != nil {
+			return nil, fmt.Errorf("reading snippets from %s: %w", path, err)
+		}
+	} else if passphrase != "" {
+		if s.key, err = newSealKey(passphrase, nil); err != nil {
+			return nil, err
+		}
+	}
+	if data == nil {
+		return s, nil
+	}
+	if err := json.Unmarshal(data, &s.byOwner); err != nil {
+		return nil, fmt.Errorf("reading snippets from %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// save writes all snippets to the file, the caller must hold s.mu
+func (s *snippetStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.byOwner, "", "  ")
+	if err != nil {
+		return err
+	}
+	if s.key != nil {
+		data = s.key.seal(data)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// set adds or replaces owner's snippet
+func (s *snippetStore) set(owner, name, text string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.byOwner[owner] == nil {
+		s.byOwner[owner] = make(map[string]string)
+	}
+	s.byOwner[owner][name] = text
+	return s.save()
+}
+
+// remove deletes owner's snippet, false if there was none
+func (s *snippetStore) remove(owner, name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byOwner[owner][name]; !ok {
+		return false, nil
+	}
+	delete(s.byOwner[owner], name)
+	if len(s.byOwner[owner]) == 0 {
+		delete(s.byOwner, owner)
+	}
+	return true, s.save()
+}
+
+// lookup returns the snippet owner sees under name
+func (s *snippetStore) lookup(owner, name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if owner != "" {
+		if text, ok := s.byOwner[owner][name]; ok {
+			return text, true
+		}
+	}
+	text, ok := s.byOwner[""][name]
+	return text, ok
+}
+
+type snippetInfo struct {
+	Name      string `json:"name"`
+	Text      string `json:"text"`
+	Workspace bool   `json:"workspace,omitempty"`
+}
+
+// visible lists the snippets owner can use, by name
+func (s *snippetStore) visible(owner string) []snippetInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var infos []snippetInfo
+	if owner != "" {
+		for name, text := range s.byOwner[owner] {
+			infos = append(infos, snippetInfo{Name: name, Text: text})
+		}
+	}
+	for name, text := range s.byOwner[""] {
+		if _, hidden := s.byOwner[owner][name]; owner != "" && hidden {
+			continue
+		}
+		infos = append(infos, snippetInfo{Name: name, Text: text, Workspace: true})
+	}
+	slices.SortFunc(infos, func(a, b snippetInfo) int { return strings.Compare(a.Name, b.Name) })
+	return infos
+}
+
+// expandSnippet replaces a leading "/snippet name" in content. ok is
+// false with a message for the user when the snippet doesn't exist or
+// no name was given, content is returned as is when it doesn't start
+// with /snippet
+func (app *application) expandSnippet(owner, content string) (expanded string, ok bool) {
+	rest, found := strings.CutPrefix(strings.TrimSpace(content), "/snippet")
+	if !found || (rest != "" && !unicode.IsSpace(rune(rest[0]))) {
+		return content, true
+	}
+
+	name := strings.TrimSpace(rest)
+	rest = ""
+	if i := strings.IndexFunc(name, unicode.IsSpace); i >= 0 {
+		name, rest = name[:i], strings.TrimSpace(name[i:])
+	}
+	if name == "" {
+		infos := app.snippets.visible(owner)
+		if len(infos) == 0 {
+			return "There are no snippets yet.", false
+		}
+		names := make([]string, len(infos))
+		for i, info := range infos {
+			names[i] = info.Name
+		}
+		return "Snippets: " + strings.Join(names, ", "), false
+	}
+
+	text, found := app.snippets.lookup(owner, name)
+	if !found {
+		return fmt.Sprintf("There's no snippet named %s.", name), false
+	}
+	if rest == "" {
+		return text, true
+	}
+	return text + " " + rest, true
+}
+
+// snippetInput reads and checks the body of a PUT
+func (app *application) snippetInput(w http.ResponseWriter, r *http.Request) (name, text string, ok bool) {
+	name = r.PathValue("name")
+	if !snippetNameRe.MatchString(name) {
+		app.clientError(w, http.StatusBadRequest, "names are up to 40 lowercase letters, digits, - and _")
+		return "", "", false
+	}
+
+	var input struct {
+		Text string `json:"text"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return "", "", false
+	}
+	input.Text = strings.TrimSpace(input.Text)
+	if input.Text == "" || utf8.RuneCountInString(input.Text) > maxSnippetLen {
+		app.clientError(w, http.StatusBadRequest, fmt.Sprintf("text is required and at most %d characters", maxSnippetLen))
+		return "", "", false
+	}
+	return name, input.Text, true
+}
+
+// snippetOwner returns the owner of the request, snippets of anonymous
+// callers couldn't be found again
+func (app *application) snippetOwner(w http.ResponseWriter, r *http.Request) (string, bool) {
+	owner := app.owner(r)
+	if owner == "" {
+		app.clientError(w, http.StatusForbidden, "sign in, or load the chat page first, to keep snippets")
+		return "", false
+	}
+	return owner, true
+}
+
+// lists the caller's snippets and the workspace ones
+func (app *application) handleListSnippets(w http.ResponseWriter, r *http.Request) {
+	app.writeJSON(w, http.StatusOK, map[string]any{"snippets": app.snippets.visible(app.owner(r))})
+}
+
+// saves one of the caller's snippets
+func (app *application) handlePutSnippet(w http.ResponseWriter, r *http.Request) {
+	owner, ok := app.snippetOwner(w, r)
+	if !ok {
+		return
+	}
+	name, text, ok := app.snippetInput(w, r)
+	if !ok {
+		return
+	}
+	if err := app.snippets.set(owner, name, text); err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.writeJSON(w, http.StatusOK, snippetInfo{Name: name, Text: text})
+}
+
+func (app *application) handleDeleteSnippet(w http.ResponseWriter, r *http.Request) {
+	owner, ok := app.snippetOwner(w, r)
+	if !ok {
+		return
+	}
+	app.deleteSnippet(w, owner, r.PathValue("name"))
+}
+
+// saves a workspace snippet everyone can use
+func (app *application) handleAdminPutSnippet(w http.ResponseWriter, r *http.Request) {
+	name, text, ok := app.snippetInput(w, r)
+	if !ok {
+		return
+	}
+	app.audit(r, "snippet.put", "name", name)
+	if err := app.snippets.set("", name, text); err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.writeJSON(w, http.StatusOK, snippetInfo{Name: name, Text: text, Workspace: true})
+}
+
+func (app *application) handleAdminDeleteSnippet(w http.ResponseWriter, r *http.Request) {
+	app.audit(r, "snippet.delete", "name", r.PathValue("name"))
+	app.deleteSnippet(w, "", r.PathValue("name"))
+}
+
+func (app *application) deleteSnippet(w http.ResponseWriter, owner, name string) {
+	found, err := app.snippets.remove(owner, name)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	if !found {
+		app.clientError(w, http.StatusNotFound, "snippet not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sseWriter writes Server-Sent Events to a response. with a flush
+// interval set, events are coalesced and written together every interval
+// or once maxBytes are buffered, whichever comes first
+type sseWriter struct {
+	mu       sync.Mutex
+	out      io.Writer
+	gz       *gzip.Writer
+	flusher  http.Flusher
+	rc       *http.ResponseController
+	buf      bytes.Buffer
+	interval time.Duration
+	maxBytes int
+	timer    *time.Timer
+	// error from a flush done by the timer, returned by the next send
+	err    error
+	closed bool
+}
+
+// newSSEWriter sets the event-stream headers. It fails if the
+// underlying writer can't flush, since buffered SSE is useless.
+// the response is gzipped when -sse-gzip is set and the client accepts it.
+// callers must close the writer before returning
+func (app *application) newSSEWriter(w http.ResponseWriter, r *http.Request) (*sseWriter, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("streaming not supported by response writer")
+	}
+
+	s := &sseWriter{
+		out:      w,
+		flusher:  flusher,
+		rc:       http.NewResponseController(w),
+		interval: app.config.sseFlushInterval,
+		maxBytes: app.config.sseFlushBytes,
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	if app.config.sseGzip {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			s.gz = gzip.NewWriter(w)
+			s.out = s.gz
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := s.flushLocked(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// send writes a single named event with data encoded as JSON
+func (s *sseWriter) send(event string, data any) error {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return s.write(fmt.Sprintf("event: %s\ndata: %s\n\n", event, js))
+}
+
+// sendData writes an unnamed event, the way OpenAI style streams do.
+// strings are sent as they are, anything else as JSON
+func (s *sseWriter) sendData(data any) error {
+	text, ok := data.(string)
+	if !ok {
+		js, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		text = string(js)
+	}
+	return s.write(fmt.Sprintf("data: %s\n\n", text))
+}
+
+// write queues a complete event and flushes as configured
+func (s *sseWriter) write(frame string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("event stream is closed")
+	}
+	if s.err != nil {
+		return s.err
+	}
+
+	s.buf.WriteString(frame)
+	if s.interval <= 0 || (s.maxBytes > 0 && s.buf.Len() >= s.maxBytes) {
+		return s.flushLocked()
+	}
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.interval, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if !s.closed && s.err == nil {
+				s.err = s.flushLocked()
+			}
+		})
+	}
+	return nil
+}
+
+// flushLocked writes out the buffered events, s.mu must be held
+func (s *sseWriter) flushLocked() error {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	// a client that stopped reading mustn't hold up a turn, see
+	// wsWriteTimeout. writers without deadlines just don't get one
+	s.rc.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := s.out.Write(s.buf.Bytes()); err != nil {
+		return err
+	}
+	s.buf.Reset()
+	if s.gz != nil {
+		if err := s.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// close writes any coalesced events and ends the gzip stream
+func (s *sseWriter) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	err := s.flushLocked()
+	if s.gz != nil {
+		err = errors.Join(err, s.gz.Close())
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// some proxies block websockets. the page and curl users can chat over
+// plain HTTP instead: GET /api/stream opens a server-sent event stream
+// that gets everything a socket would, a data event per message, and
+// POST /api/chat?stream= sends what would go up the socket. both sides
+// speak the legacy Message format
+
+// how often a comment is written to an idle stream so proxies keep it open
+const sseKeepAlive = 25 * time.Second
+
+// sseStreams tracks the open streams by id
+type sseStreams struct {
+	mu   sync.Mutex
+	byID map[string]*chatSession
+}
+
+func (s *sseStreams) add(id string, session *chatSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.byID == nil {
+		s.byID = make(map[string]*chatSession)
+	}
+	s.byID[id] = session
+}
+
+func (s *sseStreams) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.byID, id)
+}
+
+func (s *sseStreams) get(id string) (*chatSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.byID[id]
+	return session, ok
+}
+
+// opens the event stream of a chat client. the first event is a stream
+// message with the stream id to post to, then comes the conversation
+// message as on a socket
+func (app *application) handleChatStream(w http.ResponseWriter, r *http.Request) {
+	sse, err := app.newSSEWriter(w, r)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	defer sse.close()
+
+	current := &socketConversation{owner: app.owner(r)}
+	conv := app.conversations.attach(r.URL.Query().Get("conversation"), current.owner)
+	current.conv.Store(conv)
+	defer func() { app.conversations.detach(current.conv.Load()) }()
+
+	client := &wsClient{sse: sse, protocol: protocolLegacy, conv: conv.id}
+	app.clients.add(client)
+	defer app.clients.remove(client)
+
+	id := randomID(12)
+	session := app.startSession(client, current, clientIP(r))
+	defer session.close()
+	app.streams.add(id, session)
+	defer app.streams.remove(id)
+
+	client.send(Message{
+		Type:    "stream",
+		Content: id,
+		Time:    time.Now().Format("15:04:05"),
+	})
+	client.send(Message{
+		Type:    "conversation",
+		Content: conv.id,
+		Time:    time.Now().Format("15:04:05"),
+		Server:  &app.version,
+	})
+	app.logger.Info("SSE client connected", "conversation", conv.id)
+
+	if r.URL.Query().Get("incognito") == "1" {
+		conv.setIncognito(true)
+	}
+	conv.setClock(nil, requestLocale(r))
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			app.logger.Info("SSE client disconnected", "conversation", current.conv.Load().id)
+			return
+		case <-keepAlive.C:
+			if err := sse.write(": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// takes a message for the stream named by ?stream=, the same JSON a
+// socket would get. what it leads to comes on the stream
+func (app *application) handleChatPost(w http.ResponseWriter, r *http.Request) {
+	session, ok := app.streams.get(r.URL.Query().Get("stream"))
+	if !ok || session.current.owner != app.owner(r) {
+		app.clientError(w, http.StatusNotFound, "stream not found, open /api/stream first")
+		return
+	}
+
+	// images make messages larger than other request bodies
+	var msg Message
+	if err := app.readJSONLimit(w, r, &msg, app.maxMessageBytes()); err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if msg.Type == "" {
+		msg.Type = "user"
+	}
+	if !app.receive(session, msg) {
+		app.clientError(w, http.StatusGone, "the stream was closed")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
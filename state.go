@@ -0,0 +1,673 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// the server keeps its state in memory. an export puts all of it into
+// one archive, gzipped JSON, that another instance can import, e.g. to
+// move to a new machine: the conversations with their notes, artifacts
+// and settings, the snippets, the knowledge graph, pending reminders,
+// email threads and profiles. owners are carried over as they are, so
+// users keep their conversations as long as they sign in the same way.
+// incognito conversations are left out
+//
+//	GET  /admin/state  downloads the archive
+//	POST /admin/state  imports one, plain JSON is accepted too
+//
+// both need the -admin-token. the export and import subcommands do the
+// same against a running server. with -encryption-passphrase exports
+// are encrypted, see seal.go, and an import takes them with the same
+// passphrase
+
+// stateFormat is the version of the archive layout
+const stateFormat = 1
+
+// the largest archive an import reads
+const maxStateArchive = 512 << 20
+
+type serverState struct {
+	Format     int       `json:"format"`
+	ExportedAt time.Time `json:"exported_at"`
+	Build      string    `json:"build"`
+
+	Conversations []conversationState `json:"conversations"`
+	// by owner, "" holds the workspace snippets
+	Snippets map[string]map[string]string `json:"snippets,omitempty"`
+	// nil unless the exporting server had -knowledge-graph
+	Graph        *graphState       `json:"graph,omitempty"`
+	Reminders    []reminder        `json:"reminders,omitempty"`
+	EmailThreads map[string]string `json:"email_threads,omitempty"`
+	// by owner
+	Profiles map[string]profile `json:"profiles,omitempty"`
+}
+
+// conversationState is everything a conversation keeps. what only
+// lives as long as a turn or a socket, the running turn, an operator
+// and refinements, isn't in it
+type conversationState struct {
+	ID           string       `json:"id"`
+	Owner        string       `json:"owner,omitempty"`
+	Created      time.Time    `json:"created"`
+	Title        string       `json:"title,omitempty"`
+	SystemPrompt string       `json:"system_prompt,omitempty"`
+	Model        string       `json:"model,omitempty"`
+	Options      modelOptions `json:"options"`
+	Location     string       `json:"location,omitempty"`
+	Units        string       `json:"units,omitempty"`
+	Timezone     string       `json:"timezone,omitempty"`
+	Locale       string       `json:"locale,omitempty"`
+	// kept even when idle, see conversationStore.keep
+	Pinned   bool `json:"pinned,omitempty"`
+	Archived bool `json:"archived,omitempty"`
+
+	Version       int                `json:"version"`
+	NextID        int                `json:"next_id"`
+	Messages      []chatMessage      `json:"messages"`
+	Notes         []scratchNote      `json:"notes,omitempty"`
+	Artifacts     []artifact         `json:"artifacts,omitempty"`
+	ToolCalls     map[string]int     `json:"tool_calls,omitempty"`
+	InputFilter   *inputFilterConfig `json:"input_filter,omitempty"`
+	TokensPerChar float64            `json:"tokens_per_char,omitempty"`
+	Summary       string             `json:"summary,omitempty"`
+	SummaryUpTo   int                `json:"summary_up_to,omitempty"`
+	GraphUpTo     int                `json:"graph_up_to,omitempty"`
+}
+
+type graphState struct {
+	Entities  []graphEntity   `json:"entities"`
+	Relations []graphRelation `json:"relations"`
+}
+
+// stateImport is what an import brought in
+type stateImport struct {
+	Conversations int `json:"conversations"`
+	// conversations left out because the id is taken here
+	Skipped   []string `json:"skipped,omitempty"`
+	Snippets  int      `json:"snippets"`
+	Entities  int      `json:"entities"`
+	Relations int      `json:"relations"`
+	Reminders int      `json:"reminders"`
+	Threads   int      `json:"email_threads"`
+	Profiles  int      `json:"profiles"`
+}
+
+// exportState collects the state of the server
+func (app *application) exportState() serverState {
+	state := serverState{
+		Format:        stateFormat,
+		ExportedAt:    time.Now().UTC(),
+		Build:         app.version.Build,
+		Conversations: []conversationState{},
+		Snippets:      app.snippets.all(),
+		Reminders:     app.reminders.all(),
+		Profiles:      app.profiles.all(),
+	}
+	for _, conv := range app.conversations.all() {
+		if conv.isIncognito() {
+			continue
+		}
+		s := conv.state()
+		s.Pinned = app.conversations.pinned(conv.id)
+		state.Conversations = append(state.Conversations, s)
+	}
+	slices.SortFunc(state.Conversations, func(a, b conversationState) int {
+		return a.Created.Compare(b.Created)
+	})
+	if app.graph != nil {
+		state.Graph = app.graph.state()
+	}
+	if app.emailThreads != nil {
+		app.emailThreads.mu.Lock()
+		state.EmailThreads = maps.Clone(app.emailThreads.byMessageID)
+		app.emailThreads.mu.Unlock()
+	}
+	return state
+}
+
+// importState adds an exported state to the server's. conversations
+// whose id is taken are skipped along with their reminders and email
+// threads, imported snippets replace those with the same name, the
+// graph is merged. the archive is checked as a whole first, an import
+// that fails leaves the server as it was
+func (app *application) importState(state serverState) (stateImport, error) {
+	var done stateImport
+	if state.Format < 1 || state.Format > stateFormat {
+		return done, fmt.Errorf("unsupported archive format %d, this server reads up to %d", state.Format, stateFormat)
+	}
+
+	convs := make([]*conversation, len(state.Conversations))
+	for i, s := range state.Conversations {
+		conv, err := s.conversation()
+		if err != nil {
+			return done, fmt.Errorf("conversation %q: %v", s.ID, err)
+		}
+		convs[i] = conv
+	}
+
+	// the snippets go first, saving them is the one step that can fail
+	n, err := app.snippets.merge(state.Snippets)
+	if err != nil {
+		return done, fmt.Errorf("saving snippets: %v", err)
+	}
+	done.Snippets = n
+
+	imported := make(map[string]bool)
+	for i, conv := range convs {
+		if !app.conversations.restore(conv, state.Conversations[i].Pinned) {
+			done.Skipped = append(done.Skipped, conv.id)
+			continue
+		}
+		imported[conv.id] = true
+		done.Conversations++
+	}
+
+	if app.graph != nil && state.Graph != nil {
+		done.Entities, done.Relations = app.graph.merge(*state.Graph)
+	}
+
+	for _, r := range state.Reminders {
+		if !imported[r.Conversation] {
+			continue
+		}
+		if _, err := app.reminders.add(r); err == nil {
+			done.Reminders++
+		}
+	}
+
+	if app.emailThreads != nil {
+		for id, conv := range state.EmailThreads {
+			if !imported[conv] {
+				continue
+			}
+			app.emailThreads.add(conv, id)
+			done.Threads++
+		}
+	}
+	done.Profiles = app.profiles.merge(state.Profiles)
+	return done, nil
+}
+
+// state returns a copy of everything the conversation keeps
+func (c *conversation) state() conversationState {
+	c.mu.Lock()
+	s := conversationState{
+		ID:            c.id,
+		Owner:         c.owner,
+		Created:       c.created,
+		Title:         c.title,
+		SystemPrompt:  c.systemPrompt,
+		Model:         c.model,
+		Options:       c.options,
+		Location:      c.location,
+		Units:         c.units,
+		Locale:        c.locale,
+		Archived:      c.archived,
+		Version:       c.version,
+		NextID:        c.nextID,
+		Messages:      make([]chatMessage, len(c.messages)),
+		ToolCalls:     maps.Clone(c.toolCalls),
+		TokensPerChar: c.tokensPerChar,
+		Summary:       c.summary,
+		SummaryUpTo:   c.summaryUpTo,
+		GraphUpTo:     c.graphUpTo,
+	}
+	for i, m := range c.messages {
+		s.Messages[i] = *m
+	}
+	for _, n := range c.notes {
+		s.Notes = append(s.Notes, n)
+	}
+	if c.timezone != nil {
+		s.Timezone = c.timezone.String()
+	}
+	if c.inputFilter != nil {
+		cfg := c.inputFilter.config
+		s.InputFilter = &cfg
+	}
+	c.mu.Unlock()
+
+	c.artifacts.mu.Lock()
+	for _, a := range c.artifacts.byName {
+		s.Artifacts = append(s.Artifacts, *a)
+	}
+	c.artifacts.mu.Unlock()
+	return s
+}
+
+// conversation rebuilds an exported conversation
+func (s conversationState) conversation() (*conversation, error) {
+	if s.ID == "" || len(s.ID) > 64 {
+		return nil, errors.New("invalid id")
+	}
+	if err := s.Options.validate(); err != nil {
+		return nil, err
+	}
+	c := &conversation{
+		id:            s.ID,
+		owner:         s.Owner,
+		created:       s.Created,
+		title:         s.Title,
+		systemPrompt:  s.SystemPrompt,
+		model:         s.Model,
+		options:       s.Options,
+		location:      s.Location,
+		units:         s.Units,
+		locale:        s.Locale,
+		archived:      s.Archived,
+		version:       s.Version,
+		nextID:        s.NextID,
+		toolCalls:     s.ToolCalls,
+		tokensPerChar: s.TokensPerChar,
+		summary:       s.Summary,
+		summaryUpTo:   s.SummaryUpTo,
+		graphUpTo:     s.GraphUpTo,
+		artifacts:     artifactStore{conversation: s.ID},
+	}
+	for _, m := range s.Messages {
+		c.messages = append(c.messages, &m)
+		// ids must stay unique when the conversation goes on
+		c.nextID = max(c.nextID, m.ID)
+	}
+	if s.Timezone != "" {
+		loc, err := time.LoadLocation(s.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		c.timezone = loc
+	}
+	if s.InputFilter != nil {
+		f, err := newInputFilter(*s.InputFilter)
+		if err != nil {
+			return nil, err
+		}
+		c.inputFilter = f
+	}
+	if len(s.Notes) > 0 {
+		c.notes = make(map[string]scratchNote)
+		for _, n := range s.Notes {
+			c.notes[n.Title] = n
+		}
+	}
+	for _, a := range s.Artifacts {
+		if len(a.Versions) == 0 {
+			continue
+		}
+		if c.artifacts.byName == nil {
+			c.artifacts.byName = make(map[string]*artifact)
+		}
+		c.artifacts.byName[a.Name] = &a
+	}
+	return c, nil
+}
+
+// restore stores an imported conversation unless its id is taken. it
+// expires like one whose clients left just now, unless it's pinned
+func (s *conversationStore) restore(conv *conversation, pinned bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.byID[conv.id]; ok {
+		return false
+	}
+	s.byID[conv.id] = &storedConversation{conv: conv, lastSeen: time.Now(), pinned: pinned}
+	return true
+}
+
+// pinned reports whether the conversation is kept even when idle
+func (s *conversationStore) pinned(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.byID[id]
+	return ok && stored.pinned
+}
+
+// all returns a copy of every snippet
+func (s *snippetStore) all() map[string]map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]map[string]string, len(s.byOwner))
+	for owner, snippets := range s.byOwner {
+		out[owner] = maps.Clone(snippets)
+	}
+	return out
+}
+
+// merge adds snippets, replacing those with the same name, and returns
+// how many it added. snippets the API wouldn't take are skipped. when
+// they can't be saved the store is left as it was
+func (s *snippetStore) merge(byOwner map[string]map[string]string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := make(map[string]map[string]string)
+	n := 0
+	for owner, snippets := range byOwner {
+		for name, text := range snippets {
+			text = strings.TrimSpace(text)
+			if !snippetNameRe.MatchString(name) || text == "" || utf8.RuneCountInString(text) > maxSnippetLen {
+				continue
+			}
+			if _, ok := before[owner]; !ok {
+				before[owner] = maps.Clone(s.byOwner[owner])
+			}
+			if s.byOwner[owner] == nil {
+				s.byOwner[owner] = make(map[string]string)
+			}
+			s.byOwner[owner][name] = text
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if err := s.save(); err != nil {
+		for owner, snippets := range before {
+			if snippets == nil {
+				delete(s.byOwner, owner)
+			} else {
+				s.byOwner[owner] = snippets
+			}
+		}
+		return 0, err
+	}
+	return n, nil
+}
+
+// all returns the pending reminders
+func (s *reminderScheduler) all() []reminder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.pending)
+}
+
+// state returns a copy of the graph
+func (g *knowledgeGraph) state() *graphState {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	s := &graphState{Entities: []graphEntity{}, Relations: []graphRelation{}}
+	for _, e := range g.entities {
+		c := *e
+		c.Conversations = slices.Clone(e.Conversations)
+		s.Entities = append(s.Entities, c)
+	}
+	for _, r := range g.relations {
+		c := *r
+		c.Conversations = slices.Clone(r.Conversations)
+		s.Relations = append(s.Relations, c)
+	}
+	return s
+}
+
+// merge adds an exported graph, adding up the mentions of what's in
+// both, and returns how many entities and relations it took in. what
+// already names all its conversations has been imported before and is
+// left alone
+func (g *knowledgeGraph) merge(s graphState) (entities, relations int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, in := range s.Entities {
+		key := graphKey(in.Name)
+		if key == "" {
+			continue
+		}
+		e, ok := g.entities[key]
+		if ok && containsAll(e.Conversations, in.Conversations) {
+			continue
+		}
+		if !ok {
+			if len(g.entities) >= maxGraphEntities {
+				continue
+			}
+			e = &graphEntity{Name: in.Name, Type: in.Type, FirstSeen: in.FirstSeen}
+			g.entities[key] = e
+		}
+		if e.Type == "" || e.Type == "other" {
+			e.Type = in.Type
+		}
+		if in.FirstSeen.Before(e.FirstSeen) {
+			e.FirstSeen = in.FirstSeen
+		}
+		if in.LastSeen.After(e.LastSeen) {
+			e.LastSeen = in.LastSeen
+		}
+		e.Mentions += in.Mentions
+		e.Conversations = mergeIDs(e.Conversations, in.Conversations)
+		entities++
+	}
+
+	for _, in := range s.Relations {
+		from, to := g.entities[graphKey(in.From)], g.entities[graphKey(in.To)]
+		if from == nil || to == nil || in.Relation == "" {
+			continue
+		}
+		key := graphKey(from.Name) + "|" + in.Relation + "|" + graphKey(to.Name)
+		r, ok := g.relations[key]
+		if ok && containsAll(r.Conversations, in.Conversations) {
+			continue
+		}
+		if !ok {
+			r = &graphRelation{From: from.Name, Relation: in.Relation, To: to.Name}
+			g.relations[key] = r
+		}
+		if in.LastSeen.After(r.LastSeen) {
+			r.LastSeen = in.LastSeen
+		}
+		r.Mentions += in.Mentions
+		r.Conversations = mergeIDs(r.Conversations, in.Conversations)
+		relations++
+	}
+	return entities, relations
+}
+
+func containsAll(ids, of []string) bool {
+	for _, id := range of {
+		if !slices.Contains(ids, id) {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeIDs appends the ids of more that aren't in ids yet
+func mergeIDs(ids, more []string) []string {
+	for _, id := range more {
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// readState reads an archive, gzipped or plain JSON, encrypted or not
+func readState(r io.Reader, passphrase string) (serverState, error) {
+	var state serverState
+	var unpacked *io.LimitedReader
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(sealMagic)); isSealed(magic) {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return state, err
+		}
+		if data, _, err = unseal(passphrase, data); err != nil {
+			return state, err
+		}
+		br = bufio.NewReader(bytes.NewReader(data))
+	}
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return state, err
+		}
+		defer zr.Close()
+		// a small archive can unpack to a lot
+		unpacked = &io.LimitedReader{R: zr, N: maxStateArchive + 1}
+		r = unpacked
+	} else {
+		r = br
+	}
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		if unpacked != nil && unpacked.N == 0 {
+			return state, fmt.Errorf("the archive unpacks to more than %d MB", maxStateArchive>>20)
+		}
+		return state, fmt.Errorf("invalid archive: %v", err)
+	}
+	return state, nil
+}
+
+// downloads the state of the server as a gzipped JSON archive,
+// encrypted with -encryption-passphrase
+func (app *application) handleAdminExportState(w http.ResponseWriter, r *http.Request) {
+	state := app.exportState()
+	app.audit(r, "state.export", "conversations", len(state.Conversations), "encrypted", app.config.encryptionPassphrase != "")
+
+	var archive bytes.Buffer
+	zw := gzip.NewWriter(&archive)
+	if err := json.NewEncoder(zw).Encode(state); err != nil {
+		app.serverError(w, err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	name := "ollama-webchat-state-" + state.ExportedAt.Format("20060102-150405") + ".json.gz"
+	data, contentType := archive.Bytes(), "application/gzip"
+	if app.config.encryptionPassphrase != "" {
+		key, err := newSealKey(app.config.encryptionPassphrase, nil)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		data, contentType, name = key.seal(data), "application/octet-stream", name+".sealed"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Write(data)
+}
+
+// imports an archive another instance exported
+func (app *application) handleAdminImportState(w http.ResponseWriter, r *http.Request) {
+	state, err := readState(http.MaxBytesReader(w, r.Body, maxStateArchive), app.config.encryptionPassphrase)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	done, err := app.importState(state)
+	app.audit(r, "state.import", "conversations", done.Conversations, "skipped", len(done.Skipped), "error", err)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	app.writeJSON(w, http.StatusOK, done)
+}
+
+// stateFlags are the flags of the export and import subcommands
+func stateFlags(name string) (*flag.FlagSet, *string, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	server := fs.String("server", "http://localhost:4000", "Address of the running server")
+	token := fs.String("admin-token", os.Getenv("ADMIN_TOKEN"), "The server's -admin-token, defaults to $ADMIN_TOKEN")
+	return fs, server, token
+}
+
+// stateRequest sends a request to the state endpoint of a server
+func stateRequest(method, server, token string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(server, "/")+"/admin/state", body)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// runExportCommand implements the "export" subcommand, it saves the
+// state of a running server to a file
+func runExportCommand(args []string) error {
+	fs, server, token := stateFlags("export")
+	out := fs.String("o", "", "File to write the archive to, stdout if empty")
+	fs.Parse(args)
+
+	resp, err := stateRequest(http.MethodGet, *server, *token, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if *out == "" {
+		_, err = io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// runImportCommand implements the "import" subcommand, it loads an
+// archive into a running server
+func runImportCommand(args []string) error {
+	fs, server, token := stateFlags("import")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: import [flags] archive")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("the archive to import is required")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	resp, err := stateRequest(http.MethodPost, *server, *token, f)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var done stateImport
+	if err := json.NewDecoder(resp.Body).Decode(&done); err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d conversations, %d snippets, %d entities, %d relations, %d reminders, %d email threads, %d profiles\n",
+		done.Conversations, done.Snippets, done.Entities, done.Relations, done.Reminders, done.Threads, done.Profiles)
+	if len(done.Skipped) > 0 {
+		fmt.Printf("Skipped %d conversations that already exist: %s\n", len(done.Skipped), strings.Join(done.Skipped, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+type modelTokens struct {
+	Prompt     int `json:"prompt"`
+	Completion int `json:"completion"`
+}
+
+type latencyPercentiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+}
+
+// statsBucket aggregates the turns that started in [Start, Start+bucket)
+type statsBucket struct {
+	Start     time.Time              `json:"start"`
+	Messages  int                    `json:"messages"`
+	Tokens    map[string]modelTokens `json:"tokens"`
+	LatencyMS latencyPercentiles     `json:"latency_ms"`
+}
+
+// buckets splits the usage records in [from, to) into buckets of size d.
+// empty buckets are included so charts don't skip over quiet hours
+func (l *usageLog) buckets(from, to time.Time, d time.Duration) []statsBucket {
+	from = from.Truncate(d)
+	n := int(to.Sub(from) / d)
+	if to.Sub(from)%d != 0 {
+		n++
+	}
+
+	out := make([]statsBucket, n)
+	latencies := make([][]float64, n)
+	for i := range out {
+		out[i] = statsBucket{Start: from.Add(time.Duration(i) * d), Tokens: map[string]modelTokens{}}
+	}
+
+	for _, r := range l.between(from, to) {
+		i := int(r.Time.Sub(from) / d)
+		b := &out[i]
+		b.Messages++
+		t := b.Tokens[r.Model]
+		t.Prompt += r.PromptTokens
+		t.Completion += r.CompletionTokens
+		b.Tokens[r.Model] = t
+		latencies[i] = append(latencies[i], float64(r.Latency.Microseconds())/1000)
+	}
+
+	for i := range out {
+		sort.Float64s(latencies[i])
+		out[i].LatencyMS = latencyPercentiles{
+			P50: percentile(latencies[i], 50),
+			P90: percentile(latencies[i], 90),
+			P99: percentile(latencies[i], 99),
+		}
+	}
+	return out
+}
+
+// percentile of sorted values by the nearest-rank method, 0 when empty
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
+
+// returns usage in time buckets for charting, e.g. with the Grafana JSON
+// datasource. ?bucket=hour|day (default hour), ?from= and ?to= are
+// RFC 3339 times and default to the last 24 hours or 30 days
+func (app *application) handleStats(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	bucket := q.Get("bucket")
+	var size, span time.Duration
+	switch bucket {
+	case "", "hour":
+		bucket, size, span = "hour", time.Hour, 24*time.Hour
+	case "day":
+		size, span = 24*time.Hour, 30*24*time.Hour
+	default:
+		app.clientError(w, http.StatusBadRequest, "bucket must be hour or day")
+		return
+	}
+
+	to := time.Now()
+	if v := q.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, "to must be an RFC 3339 time")
+			return
+		}
+		to = t
+	}
+	from := to.Add(-span)
+	if v := q.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, "from must be an RFC 3339 time")
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		app.clientError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+	if to.Sub(from)/size > 5000 {
+		app.clientError(w, http.StatusBadRequest, "too many buckets, use a shorter range or a larger bucket")
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]any{
+		"bucket":  bucket,
+		"from":    from,
+		"to":      to,
+		"buckets": app.usage.buckets(from, to, size),
+	})
+}
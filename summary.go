@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+)
+
+// historySummary replaces the oldest messages with a summary written by
+// the model instead of dropping them
+const historySummary = "summary"
+
+const summaryPrompt = `Summarize the conversation below for your own later reference. Keep names, facts, numbers, decisions and open questions. Write plain prose, at most 200 words, and don't address the user.`
+
+// promptMessages is the history sent to the model: system messages, the
+// summary of what came before, then the messages after the summary
+func (c *conversation) promptMessages() []api.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var msgs []api.Message
+	if c.summary == "" {
+		for _, m := range c.messages {
+			msgs = append(msgs, m.Message)
+		}
+		return msgs
+	}
+
+	for _, m := range c.messages {
+		if m.Role == "system" {
+			msgs = append(msgs, m.Message)
+		}
+	}
+	msgs = append(msgs, api.Message{Role: "system", Content: "The conversation so far: " + c.summary})
+	for _, m := range c.messages {
+		if m.Role != "system" && m.ID > c.summaryUpTo {
+			msgs = append(msgs, m.Message)
+		}
+	}
+	return msgs
+}
+
+// summarizable returns the oldest unsummarized messages worth folding
+// into the summary: about half of the earlier turns, ending just before
+// a user message so tool calls stay with their results. the current
+// turn, from the latest user message on, is never included
+func (c *conversation) summarizable() ([]chatMessage, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var pending []chatMessage
+	for _, m := range c.messages {
+		if m.Role != "system" && m.ID > c.summaryUpTo {
+			pending = append(pending, *m)
+		}
+	}
+
+	current := len(pending)
+	for i := len(pending) - 1; i >= 0; i-- {
+		if pending[i].Role == "user" {
+			current = i
+			break
+		}
+	}
+
+	cut := 0
+	for i := 1; i <= current; i++ {
+		if i == current || pending[i].Role == "user" {
+			cut = i
+			if i >= current/2 {
+				break
+			}
+		}
+	}
+	return pending[:cut], c.summary
+}
+
+// setSummary replaces the summary, which now covers up to message id
+func (c *conversation) setSummary(summary string, id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.summary = summary
+	c.summaryUpTo = id
+}
+
+// summarizeHistory folds the oldest turns into the conversation summary
+// once the prompt would go over -history-tokens. the summary is written
+// by the turn's model and counts towards its usage. on failure the full
+// history is sent, the next turn tries again
+func (app *application) summarizeHistory(ctx context.Context, conv *conversation, turn *turnInfo) {
+	if app.config.historyStrategy != historySummary {
+		return
+	}
+	if conv.estimateMessageTokens(conv.promptMessages()) <= app.config.historyTokens {
+		return
+	}
+	old, previous := conv.summarizable()
+	if len(old) == 0 {
+		return
+	}
+
+	var transcript strings.Builder
+	if previous != "" {
+		fmt.Fprintf(&transcript, "Summary of what came before: %s\n\n", previous)
+	}
+	for _, m := range old {
+		switch {
+		case m.Role == "tool":
+			fmt.Fprintf(&transcript, "Tool result (%s): %s\n", m.ToolName, m.Content)
+		case m.Content != "":
+			fmt.Fprintf(&transcript, "%s: %s\n", m.Role, m.Content)
+		}
+	}
+
+	req := &api.ChatRequest{
+		Model: turn.model,
+		Messages: []api.Message{
+			{Role: "system", Content: summaryPrompt},
+			{Role: "user", Content: transcript.String()},
+		},
+		Stream: new(bool),
+	}
+	var summary strings.Builder
+	err := app.backend.Stream(ctx, req, func(resp api.ChatResponse) error {
+		summary.WriteString(resp.Message.Content)
+		turn.promptTokens += resp.PromptEvalCount
+		turn.completionTokens += resp.EvalCount
+		return nil
+	})
+	if err != nil {
+		app.logger.Error(fmt.Sprintf("Error summarizing history: %v", err))
+		return
+	}
+
+	conv.setSummary(strings.TrimSpace(summary.String()), old[len(old)-1].ID)
+	app.logger.Debug("Summarized history", "conversation", conv.id, "messages", len(old))
+}
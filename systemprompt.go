@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// defaultSystemPrompt starts every conversation unless -system-prompt,
+// -system-prompt-file or the conversation says otherwise
+const defaultSystemPrompt = "You are a helpful assistant. When you have access to tools, use them to provide accurate, current information."
+
+// loadSystemPrompt replaces -system-prompt with the contents of
+// -system-prompt-file when one is given
+func (cfg *config) loadSystemPrompt() error {
+	if cfg.systemPromptFile != "" {
+		data, err := os.ReadFile(cfg.systemPromptFile)
+		if err != nil {
+			return fmt.Errorf("reading -system-prompt-file: %w", err)
+		}
+		cfg.systemPrompt = string(data)
+	}
+	cfg.systemPrompt = strings.TrimSpace(cfg.systemPrompt)
+	if cfg.systemPrompt == "" {
+		return fmt.Errorf("the system prompt is empty")
+	}
+	return nil
+}
+
+// systemPrompt is the system message conv starts with
+func (app *application) systemPrompt(conv *conversation) string {
+	conv.mu.Lock()
+	defer conv.mu.Unlock()
+	if conv.systemPrompt != "" {
+		return conv.systemPrompt
+	}
+	return app.config.systemPrompt
+}
+
+// setSystemPrompt replaces conv's system prompt, "" restores the
+// default. a conversation that already started has its system message
+// re-seeded, the rest of the history is kept. false if nothing changed
+func (app *application) setSystemPrompt(conv *conversation, prompt string) bool {
+	conv.mu.Lock()
+	defer conv.mu.Unlock()
+	if conv.systemPrompt == prompt {
+		return false
+	}
+	conv.systemPrompt = prompt
+	if prompt == "" {
+		prompt = app.config.systemPrompt
+	}
+
+	if len(conv.messages) > 0 && conv.messages[0].Role == "system" {
+		conv.messages[0].Content = prompt
+		conv.messages[0].Version++
+		conv.version++
+	} else if len(conv.messages) > 0 {
+		conv.nextID++
+		conv.version++
+		conv.messages = append([]*chatMessage{{
+			ID:      conv.nextID,
+			Version: 1,
+			Created: time.Now(),
+			Message: api.Message{Role: "system", Content: prompt},
+		}}, conv.messages...)
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// markdownTable is a table found in an answer. the header is the first row
+type markdownTable [][]string
+
+var tableSeparator = regexp.MustCompile(`^\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?$`)
+
+// parseMarkdownTables finds the pipe tables in markdown text. a table is
+// a header row, a separator row of dashes and any number of body rows
+func parseMarkdownTables(text string) []markdownTable {
+	lines := strings.Split(text, "\n")
+
+	var tables []markdownTable
+	for i := 0; i+1 < len(lines); i++ {
+		header := strings.TrimSpace(lines[i])
+		separator := strings.TrimSpace(lines[i+1])
+		if !strings.Contains(header, "|") || !strings.Contains(separator, "|") || !tableSeparator.MatchString(separator) {
+			continue
+		}
+
+		table := markdownTable{splitTableRow(header)}
+		j := i + 2
+		for ; j < len(lines); j++ {
+			row := strings.TrimSpace(lines[j])
+			if !strings.Contains(row, "|") {
+				break
+			}
+			table = append(table, splitTableRow(row))
+		}
+		tables = append(tables, table)
+		i = j - 1
+	}
+	return tables
+}
+
+// splitTableRow splits "| a | b |" into cells, allowing escaped pipes
+func splitTableRow(row string) []string {
+	row = strings.TrimPrefix(strings.TrimSuffix(row, "|"), "|")
+
+	var cells []string
+	var cell strings.Builder
+	for i := 0; i < len(row); i++ {
+		switch {
+		case row[i] == '\\' && i+1 < len(row) && row[i+1] == '|':
+			cell.WriteByte('|')
+			i++
+		case row[i] == '|':
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(row[i])
+		}
+	}
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+// tableURLs returns the CSV download links for the tables of a message
+func tableURLs(conv *conversation, msg chatMessage) []string {
+	var urls []string
+	for i := range msg.Tables {
+		urls = append(urls, fmt.Sprintf("/api/conversations/%s/messages/%d/tables/%d", conv.id, msg.ID, i))
+	}
+	return urls
+}
+
+// downloads a table from an answer as CSV
+func (app *application) handleTableCSV(w http.ResponseWriter, r *http.Request) {
+	conv, ok := app.ownConversation(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		app.clientError(w, http.StatusNotFound, "message not found")
+		return
+	}
+	n, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil {
+		app.clientError(w, http.StatusNotFound, "table not found")
+		return
+	}
+
+	msg, ok := conv.message(id)
+	if !ok {
+		app.clientError(w, http.StatusNotFound, "message not found")
+		return
+	}
+	if n < 0 || n >= len(msg.Tables) {
+		app.clientError(w, http.StatusNotFound, "table not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=message-%d-table-%d.csv", id, n+1))
+
+	cw := csv.NewWriter(w)
+	cw.WriteAll(msg.Tables[n])
+	if err := cw.Error(); err != nil {
+		app.logger.Error(fmt.Sprintf("Error writing table: %v", err))
+	}
+}
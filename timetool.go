@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+	// IANA zones for hosts and containers without a zoneinfo database
+	_ "time/tzdata"
+
+	"github.com/ollama/ollama/api"
+)
+
+var timeTool = functionTool("get_time",
+	"Get the current date and time in a timezone",
+	nil,
+	map[string]toolProperty{
+		"timezone": {
+			Type:        api.PropertyType{"string"},
+			Description: "IANA timezone name such as Europe/Paris or America/New_York, UTC if left out",
+		},
+	})
+
+// timeResult is what get_time returns
+type timeResult struct {
+	Timezone  string `json:"timezone"`
+	Time      string `json:"time"`
+	UTC       string `json:"utc"`
+	UTCOffset string `json:"utc_offset"`
+	Weekday   string `json:"weekday"`
+}
+
+// runTimeTool answers get_time. it's never cached, the whole point is
+// the current time
+func runTimeTool(ctx context.Context, args api.ToolCallFunctionArguments) string {
+	name, _ := args["timezone"].(string)
+	if name == "" {
+		name = "UTC"
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		js, _ := json.Marshal(map[string]string{
+			"error":   "unknown_timezone",
+			"message": fmt.Sprintf("%q is not a timezone. Use an IANA name like Europe/Paris for the place the user asked about.", name),
+		})
+		return string(js)
+	}
+
+	now := time.Now()
+	local := now.In(loc)
+	js, _ := json.Marshal(timeResult{
+		Timezone:  loc.String(),
+		Time:      local.Format(time.RFC3339),
+		UTC:       now.UTC().Format(time.RFC3339),
+		UTCOffset: local.Format("-07:00"),
+		Weekday:   local.Weekday().String(),
+	})
+	return string(js)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// toolBudget caps how often the model may call a tool. zero means no cap
+type toolBudget struct {
+	perTurn         int
+	perConversation int
+	perHour         int
+}
+
+// toolBudgets enforces per-tool call budgets. without them a weak model
+// can keep calling the same tool and burn through an external API quota
+type toolBudgets struct {
+	limits map[string]toolBudget
+
+	mu     sync.Mutex
+	hourly map[string][]time.Time
+}
+
+func newToolBudgets(limits map[string]toolBudget) *toolBudgets {
+	return &toolBudgets{
+		limits: limits,
+		hourly: make(map[string][]time.Time),
+	}
+}
+
+// parseToolBudgets reads a list like
+// "get_weather=turn:3,hour:60;web_search=turn:5,conversation:20"
+func parseToolBudgets(s string) (map[string]toolBudget, error) {
+	budgets := make(map[string]toolBudget)
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, limits, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid tool budget %q, expected tool=scope:n,...", part)
+		}
+
+		var b toolBudget
+		for _, limit := range strings.Split(limits, ",") {
+			scope, value, _ := strings.Cut(strings.TrimSpace(limit), ":")
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid tool budget %q: bad count %q", part, value)
+			}
+			switch scope {
+			case "turn":
+				b.perTurn = n
+			case "conversation":
+				b.perConversation = n
+			case "hour":
+				b.perHour = n
+			default:
+				return nil, fmt.Errorf("invalid tool budget %q: unknown scope %q", part, scope)
+			}
+		}
+		budgets[strings.TrimSpace(name)] = b
+	}
+	return budgets, nil
+}
+
+// budgetExceeded is returned to the model as the tool result instead of
+// running the tool, so it can answer with what it has
+type budgetExceeded struct {
+	Error   string `json:"error"`
+	Tool    string `json:"tool"`
+	Scope   string `json:"scope"`
+	Limit   int    `json:"limit"`
+	Message string `json:"message"`
+}
+
+// use counts a call against every budget of the tool. if one is already
+// used up the call isn't counted and the tool result to send instead is
+// returned
+func (b *toolBudgets) use(name string, turn *turnInfo, conv *conversation) (string, bool) {
+	limit, ok := b.limits[name]
+	if !ok {
+		turn.countCall(name)
+		conv.countToolCall(name)
+		return "", true
+	}
+
+	exceeded := func(scope string, n int) (string, bool) {
+		js, _ := json.Marshal(budgetExceeded{
+			Error: "budget_exceeded",
+			Tool:  name,
+			Scope: scope,
+			Limit: n,
+			Message: fmt.Sprintf("%s may only be called %d times per %s. Do not call it again, answer with the information you already have.",
+				name, n, scope),
+		})
+		return string(js), false
+	}
+
+	if limit.perTurn > 0 && turn.toolCalls[name] >= limit.perTurn {
+		return exceeded("turn", limit.perTurn)
+	}
+	if limit.perConversation > 0 && conv.toolCallCount(name) >= limit.perConversation {
+		return exceeded("conversation", limit.perConversation)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if limit.perHour > 0 {
+		cutoff := time.Now().Add(-time.Hour)
+		calls := b.hourly[name]
+		for len(calls) > 0 && calls[0].Before(cutoff) {
+			calls = calls[1:]
+		}
+		b.hourly[name] = calls
+		if len(calls) >= limit.perHour {
+			return exceeded("hour", limit.perHour)
+		}
+		b.hourly[name] = append(calls, time.Now())
+	}
+
+	turn.countCall(name)
+	conv.countToolCall(name)
+
+	return "", true
+}
+
+// countCall records a tool call made this turn
+func (t *turnInfo) countCall(name string) {
+	if t.toolCalls == nil {
+		t.toolCalls = make(map[string]int)
+	}
+	t.toolCalls[name]++
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// toolCache remembers tool results for a per-tool TTL so a burst of
+// identical calls (the same city asked about twice in a minute) only
+// hits the external API once. tools without a TTL are never cached
+type toolCache struct {
+	mu      sync.Mutex
+	ttls    map[string]time.Duration
+	entries map[string]toolCacheEntry
+	stats   map[string]*toolCacheStats
+}
+
+type toolCacheEntry struct {
+	tool    string
+	value   string
+	expires time.Time
+}
+
+type toolCacheStats struct {
+	hits   uint64
+	misses uint64
+}
+
+func newToolCache(ttls map[string]time.Duration) *toolCache {
+	return &toolCache{
+		ttls:    ttls,
+		entries: make(map[string]toolCacheEntry),
+		stats:   make(map[string]*toolCacheStats),
+	}
+}
+
+// parseToolTTLs reads a list like "get_weather=10m,web_search=1h"
+func parseToolTTLs(s string) (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid tool TTL %q, expected tool=duration", part)
+		}
+		ttl, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tool TTL %q: %v", part, err)
+		}
+		ttls[strings.TrimSpace(name)] = ttl
+	}
+	return ttls, nil
+}
+
+// get returns the cached result of a tool call, or runs fn and caches
+// what it returns. error results are not cached so a failing API is
+// retried on the next call
+func (c *toolCache) get(name string, args map[string]any, fn func() string) string {
+	c.mu.Lock()
+	ttl, cacheable := c.ttls[name]
+	stats, ok := c.stats[name]
+	if !ok {
+		stats = &toolCacheStats{}
+		c.stats[name] = stats
+	}
+
+	key := toolKey(name, args)
+	if cacheable {
+		if entry, ok := c.entries[key]; ok && time.Now().Before(entry.expires) {
+			stats.hits++
+			c.mu.Unlock()
+			return entry.value
+		}
+		stats.misses++
+	}
+	c.mu.Unlock()
+
+	value := fn()
+
+	if cacheable && !strings.HasPrefix(value, "Error") {
+		c.mu.Lock()
+		c.entries[key] = toolCacheEntry{tool: name, value: value, expires: time.Now().Add(ttl)}
+		c.mu.Unlock()
+	}
+
+	return value
+}
+
+// bust drops the cached results of one tool, or every tool if name is
+// empty, and returns how many entries were removed
+func (c *toolCache) bust(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for key, entry := range c.entries {
+		if name == "" || entry.tool == name {
+			delete(c.entries, key)
+			n++
+		}
+	}
+	return n
+}
+
+// toolCacheSnapshot is a copy of the counters for one tool
+type toolCacheSnapshot struct {
+	Tool    string
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+// snapshot returns per-tool statistics sorted by tool name. expired
+// entries are pruned here since this runs regularly when scraped
+func (c *toolCache) snapshot() []toolCacheSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	entries := make(map[string]int)
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+			continue
+		}
+		entries[entry.tool]++
+	}
+
+	var out []toolCacheSnapshot
+	for name, stats := range c.stats {
+		out = append(out, toolCacheSnapshot{
+			Tool:    name,
+			Hits:    stats.hits,
+			Misses:  stats.misses,
+			Entries: entries[name],
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Tool < out[j].Tool })
+	return out
+}
+
+// clears cached tool results, either for one tool or all of them
+func (app *application) handleAdminBustToolCache(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Tool string `json:"tool"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.clientError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	n := app.toolCache.bust(input.Tool)
+
+	app.audit(r, "tools.cache.bust", "tool", input.Tool, "removed", n)
+	app.writeJSON(w, http.StatusOK, map[string]int{"removed": n})
+}
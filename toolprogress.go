@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// toolProgress is reported by tools while they run
+type toolProgress struct {
+	Tool    string  `json:"tool"`
+	Percent float64 `json:"percent"`
+	Status  string  `json:"status"`
+}
+
+// progressReporter is handed to tools so long running ones can say how
+// far along they are. percent is 0-100, or negative if unknown
+type progressReporter func(percent float64, status string)
+
+// reporter returns the progress function for one tool call. updates go to
+// the client as they happen and are kept for the tool result summary
+func (t *turnInfo) reporter(tool string) progressReporter {
+	return func(percent float64, status string) {
+		p := toolProgress{Tool: tool, Percent: percent, Status: status}
+		t.progressLog = append(t.progressLog, p)
+		if t.emit != nil {
+			t.emit(Message{
+				Type:     "tool_progress",
+				Content:  p.Status,
+				Time:     time.Now().Format("15:04:05"),
+				Progress: &p,
+			})
+		}
+	}
+}
+
+// emitToolCall tells the client which tool the model called and with
+// what, before it runs
+func (t *turnInfo) emitToolCall(call api.ToolCall) {
+	if t.emit == nil {
+		return
+	}
+	t.emit(Message{
+		Type:    "tool_call",
+		Content: call.Function.Name,
+		Time:    time.Now().Format("15:04:05"),
+		Name:    call.Function.Name,
+		Args:    call.Function.Arguments,
+	})
+}
+
+// emitToolResult sends the result of a tool call as the model gets it
+func (t *turnInfo) emitToolResult(name, result string) {
+	if t.emit == nil {
+		return
+	}
+	t.emit(Message{
+		Type:    "tool_result",
+		Content: name,
+		Time:    time.Now().Format("15:04:05"),
+		Name:    name,
+		Result:  result,
+	})
+	if toolFailed(result) {
+		failed := errorMessage(errToolFailed, "The "+name+" tool failed, the answer may be missing what it would have found.")
+		failed.Name = name
+		t.emit(failed)
+	}
+}
+
+// summarizeProgress appends the status updates of a tool call to its
+// result so the model knows e.g. which sources were skipped
+func summarizeProgress(result string, log []toolProgress) string {
+	var steps []string
+	for _, p := range log {
+		if p.Status != "" {
+			steps = append(steps, p.Status)
+		}
+	}
+	if len(steps) == 0 {
+		return result
+	}
+	return result + "\n\nProgress: " + strings.Join(steps, "; ")
+}
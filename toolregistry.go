@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ollama/ollama/api"
+)
+
+// Tool is a function the model can call. Schema is what's sent to
+// Ollama, its function name has to match Name. Execute gets the
+// arguments after they were checked against the schema and returns the
+// result for the model, errors included
+type Tool interface {
+	Name() string
+	Schema() api.Tool
+	Execute(ctx context.Context, args api.ToolCallFunctionArguments) string
+}
+
+// toolEnv is what a running tool can find out about the turn it runs
+// in, through toolEnvFrom
+type toolEnv struct {
+	conv   *conversation
+	turn   *turnInfo
+	tool   string
+	report progressReporter
+}
+
+type toolEnvKey struct{}
+
+func withToolEnv(ctx context.Context, env *toolEnv) context.Context {
+	return context.WithValue(ctx, toolEnvKey{}, env)
+}
+
+// toolEnvFrom returns the environment of the tool call. outside of a
+// turn, e.g. when prefetching, there is no conversation and progress
+// reports go nowhere
+func toolEnvFrom(ctx context.Context) *toolEnv {
+	if env, ok := ctx.Value(toolEnvKey{}).(*toolEnv); ok {
+		return env
+	}
+	return &toolEnv{turn: &turnInfo{}, report: func(float64, string) {}}
+}
+
+// funcTool is a Tool made from a schema and a function
+type funcTool struct {
+	schema api.Tool
+	fn     func(ctx context.Context, args api.ToolCallFunctionArguments) string
+}
+
+// newTool makes a Tool from a schema and the function that runs it
+func newTool(schema api.Tool, fn func(ctx context.Context, args api.ToolCallFunctionArguments) string) Tool {
+	return &funcTool{schema: schema, fn: fn}
+}
+
+func (t *funcTool) Name() string     { return t.schema.Function.Name }
+func (t *funcTool) Schema() api.Tool { return t.schema }
+func (t *funcTool) Execute(ctx context.Context, args api.ToolCallFunctionArguments) string {
+	return t.fn(ctx, args)
+}
+
+// toolRegistry holds every tool the model may call. most tools are only
+// attached to turns that need them (see heuristics and intent routes),
+// tools registered with always are attached to every turn
+type toolRegistry struct {
+	mu     sync.RWMutex
+	tools  map[string]Tool
+	order  []string
+	always []string
+}
+
+func newToolRegistry() *toolRegistry {
+	return &toolRegistry{tools: make(map[string]Tool)}
+}
+
+// register adds a tool, names have to be unique
+func (r *toolRegistry) register(t Tool, always bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name := t.Name()
+	if name != t.Schema().Function.Name {
+		return fmt.Errorf("tool %q has a schema for %q", name, t.Schema().Function.Name)
+	}
+	if _, ok := r.tools[name]; ok {
+		return fmt.Errorf("tool %q is already registered", name)
+	}
+	r.tools[name] = t
+	r.order = append(r.order, name)
+	if always {
+		r.always = append(r.always, name)
+	}
+	return nil
+}
+
+func (r *toolRegistry) get(name string) (Tool, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.tools[name]
+	return t, ok
+}
+
+// schema returns what to send to Ollama for the named tool
+func (r *toolRegistry) schema(name string) (api.Tool, bool) {
+	t, ok := r.get(name)
+	if !ok {
+		return api.Tool{}, false
+	}
+	return t.Schema(), true
+}
+
+// registered returns the names that are registered tools, in order
+func (r *toolRegistry) registered(names []string) []string {
+	var out []string
+	for _, name := range names {
+		if _, ok := r.get(name); ok {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// all returns the schemas of every registered tool, in order
+func (r *toolRegistry) all() api.Tools {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var tools api.Tools
+	for _, name := range r.order {
+		tools = append(tools, r.tools[name].Schema())
+	}
+	return tools
+}
+
+// alwaysOn returns the schemas of the tools attached to every turn
+func (r *toolRegistry) alwaysOn() api.Tools {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var tools api.Tools
+	for _, name := range r.always {
+		tools = append(tools, r.tools[name].Schema())
+	}
+	return tools
+}
+
+// registerTools registers the built-in tools. add your own here, or
+// anywhere before the server starts
+func (app *application) registerTools() error {
+	builtin := []struct {
+		tool    Tool
+		always  bool
+		enabled bool
+	}{
+		{newTool(weatherTool, app.runWeatherTool), false, true},
+		{newTool(webSearchTool, app.runSearchTool), false, app.search != nil},
+		{newTool(timeTool, runTimeTool), false, true},
+		{newTool(setReminderTool, app.runReminderTool), false, app.config.reminders},
+		{newTool(listRemindersTool, app.runReminderTool), false, app.config.reminders},
+		{newTool(queryKnowledgeTool, app.runKnowledgeTool), true, app.graph != nil},
+		{newTool(writeNoteTool, runScratchpadTool), true, app.config.scratchpad},
+		{newTool(readNotesTool, runScratchpadTool), true, app.config.scratchpad},
+		{newTool(listNotesTool, runScratchpadTool), true, app.config.scratchpad},
+		{newTool(createArtifactTool, runArtifactTool), true, app.config.artifacts},
+		{newTool(applyDiffTool, runApplyDiffTool), true, app.config.artifacts},
+	}
+	for _, b := range builtin {
+		if !b.enabled {
+			continue
+		}
+		if err := app.tools.register(b.tool, b.always); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import "github.com/ollama/ollama/api"
+
+// toolProperty is the same type as the anonymous property struct in
+// api.ToolFunction, so tools can be declared without spelling it out
+type toolProperty = struct {
+	Type        api.PropertyType `json:"type"`
+	Items       any              `json:"items,omitempty"`
+	Description string           `json:"description"`
+	Enum        []any            `json:"enum,omitempty"`
+}
+
+// functionTool declares a tool taking an object of named arguments
+func functionTool(name, description string, required []string, properties map[string]toolProperty) api.Tool {
+	tool := api.Tool{
+		Type: "function",
+		Function: api.ToolFunction{
+			Name:        name,
+			Description: description,
+		},
+	}
+	if required == nil {
+		required = []string{}
+	}
+	tool.Function.Parameters.Type = "object"
+	tool.Function.Parameters.Required = required
+	tool.Function.Parameters.Properties = properties
+	return tool
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/ollama/ollama/api"
+)
+
+// toolValidationError is returned to the model when its arguments don't
+// match the tool's schema, listing every problem so it can fix them in
+// one go
+type toolValidationError struct {
+	Error    string   `json:"error"`
+	Tool     string   `json:"tool"`
+	Problems []string `json:"problems"`
+}
+
+// validateToolArgs checks arguments against the parameters declared for
+// the tool. it returns the tool result to send back, or "" if they're valid
+func validateToolArgs(tool api.Tool, args map[string]any) string {
+	params := tool.Function.Parameters
+	var problems []string
+
+	for _, name := range params.Required {
+		if _, ok := args[name]; !ok {
+			problems = append(problems, fmt.Sprintf("missing required argument %q", name))
+		}
+	}
+
+	for name, value := range args {
+		prop, ok := params.Properties[name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown argument %q", name))
+			continue
+		}
+		if len(prop.Type) > 0 && !slices.ContainsFunc(prop.Type, func(t string) bool { return matchesType(t, value) }) {
+			problems = append(problems, fmt.Sprintf("argument %q must be of type %s", name, prop.Type))
+			continue
+		}
+		if len(prop.Enum) > 0 && !slices.ContainsFunc(prop.Enum, func(e any) bool { return fmt.Sprint(e) == fmt.Sprint(value) }) {
+			problems = append(problems, fmt.Sprintf("argument %q must be one of %v", name, prop.Enum))
+		}
+	}
+
+	if len(problems) == 0 {
+		return ""
+	}
+
+	slices.Sort(problems)
+	js, _ := json.Marshal(toolValidationError{
+		Error:    "invalid_arguments",
+		Tool:     tool.Function.Name,
+		Problems: problems,
+	})
+	return string(js)
+}
+
+// matchesType checks a decoded JSON value against a JSON schema type
+func matchesType(schemaType string, value any) bool {
+	switch schemaType {
+	case "string":
+		s, ok := value.(string)
+		return ok && s != ""
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestValidateToolArgs(t *testing.T) {
+	tool := functionTool("test_tool", "A tool for the tests", []string{"location"}, map[string]toolProperty{
+		"location": {Type: api.PropertyType{"string"}},
+		"days":     {Type: api.PropertyType{"integer"}},
+		"units":    {Type: api.PropertyType{"string"}, Enum: []any{"metric", "imperial"}},
+		"tags":     {Type: api.PropertyType{"array"}},
+		"detail":   {Type: api.PropertyType{"boolean", "null"}},
+	})
+
+	tests := []struct {
+		name     string
+		args     map[string]any
+		problems []string
+	}{
+		{
+			name: "valid",
+			args: map[string]any{"location": "Paris", "days": float64(3), "units": "metric", "tags": []any{"a"}, "detail": true},
+		},
+		{
+			name: "either of two types",
+			args: map[string]any{"location": "Paris", "detail": nil},
+		},
+		{
+			name:     "missing required",
+			args:     map[string]any{"days": float64(3)},
+			problems: []string{`missing required argument "location"`},
+		},
+		{
+			name:     "empty string counts as missing a value",
+			args:     map[string]any{"location": ""},
+			problems: []string{`argument "location" must be of type string`},
+		},
+		{
+			name:     "fraction for an integer",
+			args:     map[string]any{"location": "Paris", "days": 2.5},
+			problems: []string{`argument "days" must be of type integer`},
+		},
+		{
+			name:     "not in the enum",
+			args:     map[string]any{"location": "Paris", "units": "kelvin"},
+			problems: []string{`argument "units" must be one of [metric imperial]`},
+		},
+		{
+			name: "every problem at once, sorted",
+			args: map[string]any{"days": "three", "colour": "red"},
+			problems: []string{
+				`argument "days" must be of type integer`,
+				`missing required argument "location"`,
+				`unknown argument "colour"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := validateToolArgs(tool, tt.args)
+			if tt.problems == nil {
+				if result != "" {
+					t.Fatalf("validateToolArgs = %s, want valid", result)
+				}
+				return
+			}
+			var got toolValidationError
+			if err := json.Unmarshal([]byte(result), &got); err != nil {
+				t.Fatalf("result %q isn't JSON: %v", result, err)
+			}
+			if got.Error != "invalid_arguments" || got.Tool != "test_tool" {
+				t.Errorf("error = %q for %q, want invalid_arguments for test_tool", got.Error, got.Tool)
+			}
+			if !slices.Equal(got.Problems, tt.problems) {
+				t.Errorf("problems = %q, want %q", got.Problems, tt.problems)
+			}
+		})
+	}
+}
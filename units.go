@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+const (
+	unitsMetric   = "metric"
+	unitsImperial = "imperial"
+)
+
+// unitConversion converts a value from one unit to the other system
+type unitConversion struct {
+	to      string
+	system  string
+	convert func(float64) float64
+}
+
+// conversions by the unit a tool reported, the target system is the one
+// the unit doesn't belong to
+var unitConversions = map[string]unitConversion{
+	"Fahrenheit": {to: "Celsius", system: unitsMetric, convert: func(f float64) float64 { return (f - 32) * 5 / 9 }},
+	"Celsius":    {to: "Fahrenheit", system: unitsImperial, convert: func(c float64) float64 { return c*9/5 + 32 }},
+	"mph":        {to: "km/h", system: unitsMetric, convert: func(v float64) float64 { return v * 1.609344 }},
+	"km/h":       {to: "mph", system: unitsImperial, convert: func(v float64) float64 { return v / 1.609344 }},
+	"in":         {to: "mm", system: unitsMetric, convert: func(v float64) float64 { return v * 25.4 }},
+	"mm":         {to: "in", system: unitsImperial, convert: func(v float64) float64 { return v / 25.4 }},
+}
+
+// measurement fields of tool results and the field naming their unit
+var measurementFields = map[string]string{
+	"high":          "unit",
+	"low":           "unit",
+	"temperature":   "unit",
+	"feels_like":    "unit",
+	"wind_speed":    "wind_unit",
+	"precipitation": "precipitation_unit",
+}
+
+// convertUnits rewrites the measurements of a JSON tool result into the
+// preferred unit system. results that aren't JSON objects are returned
+// unchanged
+func convertUnits(result, units string) string {
+	if units == "" {
+		return result
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(result), &fields); err != nil {
+		return result
+	}
+
+	converted := map[string]bool{}
+	for field, unitField := range measurementFields {
+		value, ok := fields[field].(float64)
+		if !ok {
+			continue
+		}
+		unit, _ := fields[unitField].(string)
+		conv, ok := unitConversions[unit]
+		if !ok || conv.system != units {
+			continue
+		}
+		fields[field] = math.Round(conv.convert(value)*10) / 10
+		converted[unitField] = true
+	}
+	if len(converted) == 0 {
+		return result
+	}
+	for unitField := range converted {
+		fields[unitField] = unitConversions[fields[unitField].(string)].to
+	}
+
+	js, err := json.Marshal(fields)
+	if err != nil {
+		return result
+	}
+	return string(js)
+}
+
+// unitInstruction asks the model to answer in the preferred units
+func unitInstruction(units string) api.Message {
+	examples := "°C, km, km/h and mm"
+	if units == unitsImperial {
+		examples = "°F, miles, mph and inches"
+	}
+	return api.Message{
+		Role:    "system",
+		Content: fmt.Sprintf("Use %s units (%s) for any measurements in your answer.", units, examples),
+	}
+}
+
+func (c *conversation) setUnits(units string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.units = units
+}
+
+// unitPreference returns the units chosen in the conversation, or the
+// -units default
+func (app *application) unitPreference(conv *conversation) string {
+	conv.mu.Lock()
+	defer conv.mu.Unlock()
+	if conv.units != "" {
+		return conv.units
+	}
+	return app.config.units
+}
+
+// handleUnitsMessage stores the unit system a client picked
+func (app *application) handleUnitsMessage(client *wsClient, conv *conversation, units string) {
+	if units != unitsMetric && units != unitsImperial {
+		client.send(Message{
+			Type:    "notice",
+			Content: "Units must be metric or imperial.",
+			Time:    time.Now().Format("15:04:05"),
+		})
+		return
+	}
+
+	conv.setUnits(units)
+	client.send(Message{
+		Type:    "notice",
+		Content: fmt.Sprintf("Using %s units.", units),
+		Time:    time.Now().Format("15:04:05"),
+	})
+}
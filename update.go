@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/semver"
+)
+
+// releasesURL is where the latest release of -update-repo is looked up
+var releasesURL = "https://api.github.com/repos/%s/releases/latest"
+
+// updateInfo is the outcome of the last release check, reported on
+// /version
+type updateInfo struct {
+	Latest    string    `json:"latest,omitempty"`
+	URL       string    `json:"url,omitempty"`
+	Available bool      `json:"available"`
+	CheckedAt time.Time `json:"checked_at"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// updateChecker looks for new releases on GitHub. it's off unless
+// -update-check is set, so by default the server never calls out
+type updateChecker struct {
+	repo    string
+	current string
+	logger  *slog.Logger
+
+	mu   sync.Mutex
+	last *updateInfo
+}
+
+func newUpdateChecker(repo, current string, logger *slog.Logger) *updateChecker {
+	return &updateChecker{repo: repo, current: current, logger: logger}
+}
+
+// run checks now and then every interval until ctx is done
+func (u *updateChecker) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		u.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (u *updateChecker) check(ctx context.Context) {
+	var release struct {
+		TagName string `json:"tag_name"`
+		HTMLURL string `json:"html_url"`
+	}
+	info := updateInfo{CheckedAt: time.Now()}
+	if err := getJSON(ctx, fmt.Sprintf(releasesURL, u.repo), &release); err != nil {
+		u.logger.Warn("Update check failed", "repo", u.repo, "error", err)
+		// keep reporting what an earlier check found
+		if last := u.status(); last != nil {
+			info = *last
+		}
+		info.CheckedAt = time.Now()
+		info.Error = err.Error()
+	} else {
+		info.Latest = release.TagName
+		info.URL = release.HTMLURL
+		info.Available = newerVersion(release.TagName, u.current)
+		if info.Available {
+			u.logger.Info("New version available", "current", u.current, "latest", release.TagName, "url", release.HTMLURL)
+		}
+	}
+
+	u.mu.Lock()
+	u.last = &info
+	u.mu.Unlock()
+}
+
+// status returns the last check, nil before the first one finished
+func (u *updateChecker) status() *updateInfo {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.last
+}
+
+// newerVersion reports whether the release tag is newer than the running
+// version. builds without a release version, e.g. (devel), never are
+func newerVersion(tag, current string) bool {
+	if !semver.IsValid(tag) || !semver.IsValid(current) {
+		return false
+	}
+	return semver.Compare(tag, current) > 0
+}
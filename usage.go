@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// usageRecord is kept for every completed turn
+type usageRecord struct {
+	Time             time.Time `json:"time"`
+	Client           string    `json:"client"`
+	Model            string    `json:"model"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	Tools            []string  `json:"tools,omitempty"`
+	// from the turn starting to the answer being ready
+	Latency time.Duration `json:"latency"`
+}
+
+// messageUsage is what one answer took, sent with it so the page can
+// show generation stats
+type messageUsage struct {
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TokensPerSec     float64 `json:"tokens_per_sec,omitempty"`
+	// Ollama's time for the turn's chat calls, in milliseconds
+	TotalDuration int64 `json:"total_duration_ms"`
+}
+
+// usage returns what the turn took, nil if Ollama reported nothing
+func (t *turnInfo) usage() *messageUsage {
+	if t.promptTokens == 0 && t.completionTokens == 0 {
+		return nil
+	}
+	u := &messageUsage{
+		PromptTokens:     t.promptTokens,
+		CompletionTokens: t.completionTokens,
+		TotalDuration:    t.totalDuration.Milliseconds(),
+	}
+	if t.evalDuration > 0 {
+		u.TokensPerSec = math.Round(float64(t.evalTokens)/t.evalDuration.Seconds()*10) / 10
+	}
+	return u
+}
+
+// countResponse adds what Ollama reported for a chat call to the turn
+func (t *turnInfo) countResponse(resp api.ChatResponse) {
+	t.promptTokens += resp.PromptEvalCount
+	t.completionTokens += resp.EvalCount
+	t.evalTokens += resp.EvalCount
+	t.evalDuration += resp.EvalDuration
+	t.totalDuration += resp.TotalDuration
+}
+
+// usageLog holds the usage records of the last few weeks in memory
+type usageLog struct {
+	mu        sync.Mutex
+	records   []usageRecord
+	retention time.Duration
+}
+
+func (l *usageLog) add(rec usageRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.records = append(l.records, rec)
+
+	// records are in time order, drop the ones past retention
+	cutoff := time.Now().Add(-l.retention)
+	i := sort.Search(len(l.records), func(i int) bool { return l.records[i].Time.After(cutoff) })
+	l.records = l.records[i:]
+}
+
+// between returns the records in [from, to)
+func (l *usageLog) between(from, to time.Time) []usageRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var out []usageRecord
+	for _, r := range l.records {
+		if !r.Time.Before(from) && r.Time.Before(to) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+type usageCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+type usageReport struct {
+	Period           string       `json:"period"`
+	From             time.Time    `json:"from"`
+	To               time.Time    `json:"to"`
+	Messages         int          `json:"messages"`
+	PromptTokens     int          `json:"prompt_tokens"`
+	CompletionTokens int          `json:"completion_tokens"`
+	ActiveUsers      int          `json:"active_users"`
+	TopModels        []usageCount `json:"top_models"`
+	TopTools         []usageCount `json:"top_tools"`
+}
+
+// report summarizes the day or week ending at to
+func (l *usageLog) report(period string, to time.Time) usageReport {
+	from := to.AddDate(0, 0, -1)
+	if period == "week" {
+		from = to.AddDate(0, 0, -7)
+	}
+
+	report := usageReport{Period: period, From: from, To: to}
+	users := make(map[string]bool)
+	models := make(map[string]int)
+	tools := make(map[string]int)
+
+	for _, r := range l.between(from, to) {
+		report.Messages++
+		report.PromptTokens += r.PromptTokens
+		report.CompletionTokens += r.CompletionTokens
+		users[r.Client] = true
+		models[r.Model]++
+		for _, t := range r.Tools {
+			tools[t]++
+		}
+	}
+
+	report.ActiveUsers = len(users)
+	report.TopModels = topCounts(models, 5)
+	report.TopTools = topCounts(tools, 5)
+	return report
+}
+
+func topCounts(counts map[string]int, n int) []usageCount {
+	out := []usageCount{}
+	for name, count := range counts {
+		out = append(out, usageCount{Name: name, Count: count})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Name < out[j].Name
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// writeCSV writes the report as name,value rows so it opens cleanly in
+// a spreadsheet
+func (r usageReport) writeCSV(w *csv.Writer) error {
+	rows := [][]string{
+		{"metric", "value"},
+		{"period", r.Period},
+		{"from", r.From.Format(time.RFC3339)},
+		{"to", r.To.Format(time.RFC3339)},
+		{"messages", strconv.Itoa(r.Messages)},
+		{"prompt_tokens", strconv.Itoa(r.PromptTokens)},
+		{"completion_tokens", strconv.Itoa(r.CompletionTokens)},
+		{"active_users", strconv.Itoa(r.ActiveUsers)},
+	}
+	for _, m := range r.TopModels {
+		rows = append(rows, []string{"model:" + m.Name, strconv.Itoa(m.Count)})
+	}
+	for _, t := range r.TopTools {
+		rows = append(rows, []string{"tool:" + t.Name, strconv.Itoa(t.Count)})
+	}
+	if err := w.WriteAll(rows); err != nil {
+		return err
+	}
+	return w.Error()
+}
+
+// startOfDay returns local midnight of the day t falls on
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// returns the usage report for a day or week. ?date= picks the day the
+// report covers (default yesterday), ?format=csv for a spreadsheet
+func (app *application) handleUsageReport(w http.ResponseWriter, r *http.Request) {
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "day"
+	}
+	if period != "day" && period != "week" {
+		app.clientError(w, http.StatusBadRequest, "period must be day or week")
+		return
+	}
+
+	// reports end at midnight after the given day
+	to := startOfDay(time.Now())
+	if date := r.URL.Query().Get("date"); date != "" {
+		day, err := time.ParseInLocation(time.DateOnly, date, time.Local)
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, "date must be YYYY-MM-DD")
+			return
+		}
+		to = day.AddDate(0, 0, 1)
+	}
+
+	report := app.usage.report(period, to)
+
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=usage-%s-%s.csv", period, to.AddDate(0, 0, -1).Format(time.DateOnly)))
+		if err := report.writeCSV(csv.NewWriter(w)); err != nil {
+			app.logger.Error(fmt.Sprintf("Error writing usage report: %v", err))
+		}
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, report)
+}
+
+// runUsageReports posts the daily report (and the weekly one on Mondays)
+// to the report webhook shortly after midnight
+func (app *application) runUsageReports(ctx context.Context) {
+	for {
+		next := startOfDay(time.Now()).AddDate(0, 0, 1).Add(time.Minute)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+
+		to := startOfDay(time.Now())
+		app.sendUsageReport(ctx, app.usage.report("day", to))
+		if to.Weekday() == time.Monday {
+			app.sendUsageReport(ctx, app.usage.report("week", to))
+		}
+	}
+}
+
+func (app *application) sendUsageReport(ctx context.Context, report usageReport) {
+	js, err := json.Marshal(report)
+	if err != nil {
+		app.logger.Error(fmt.Sprintf("Error encoding usage report: %v", err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, app.config.reportWebhook, bytes.NewReader(js))
+	if err != nil {
+		app.logger.Error(fmt.Sprintf("Error sending usage report: %v", err))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		app.logger.Error(fmt.Sprintf("Error sending usage report: %v", err))
+		return
+	}
+	resp.Body.Close()
+
+	app.logger.Info("Usage report sent", "period", report.Period, "status", resp.StatusCode)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// regenerating an answer keeps the earlier ones as variants of the new
+// one. the user can page through them, the variant shown is the one the
+// history continues with, and which one was kept is logged once the
+// conversation moves on
+
+// answerVariant is one of the answers written for a turn
+type answerVariant struct {
+	Content    string        `json:"content"`
+	Created    time.Time     `json:"created"`
+	Language   string        `json:"language,omitempty"`
+	Provenance *provenance   `json:"provenance,omitempty"`
+	Usage      *messageUsage `json:"usage,omitempty"`
+}
+
+func variantOf(m chatMessage) answerVariant {
+	return answerVariant{Content: m.Content, Created: m.Created, Language: m.Language, Provenance: m.Provenance, Usage: m.Usage}
+}
+
+// regeneration is a turn that writes the last answer again
+type regeneration struct {
+	// earlier answers of the turn
+	variants []answerVariant
+	// sampling options for this turn only, over the conversation's
+	options modelOptions
+}
+
+// nudged returns o changed just enough for a different answer: a new
+// seed, so a fixed one doesn't write the same answer again, and a
+// somewhat higher temperature
+func (o modelOptions) nudged() modelOptions {
+	seed := rand.IntN(1 << 31)
+	temperature := 0.8 // Ollama's default
+	if o.Temperature != nil {
+		temperature = *o.Temperature
+	}
+	temperature = min(temperature+0.3, 2)
+	o.Seed, o.Temperature = &seed, &temperature
+	return o
+}
+
+// regenerate writes the last answer of conv again, keeping the earlier
+// ones as variants. false if there's no answer yet
+func (app *application) regenerate(client *wsClient, conv *conversation, ip, language string, options modelOptions) bool {
+	conv.turn.lock(func(int) {})
+	last, variants, ok := conv.dropLastTurn()
+	conv.turn.unlock()
+	if !ok {
+		return false
+	}
+	retry := Message{Type: "user", Content: last.Content, Language: language}
+	for _, img := range last.Images {
+		retry.Images = append(retry.Images, base64.StdEncoding.EncodeToString(img))
+	}
+	app.answerMessage(client, conv, ip, retry, &regeneration{variants: variants, options: options})
+	return true
+}
+
+// handleRegenerateMessage writes the last answer again. content is
+// empty to nudge the sampling options, or a JSON object like
+// {"temperature":1.2} of options to use for this answer only
+func (app *application) handleRegenerateMessage(client *wsClient, conv *conversation, ip string, msg Message) {
+	notice := func(content string) {
+		client.send(Message{
+			Type:    "notice",
+			Content: content,
+			Time:    time.Now().Format("15:04:05"),
+		})
+	}
+
+	var options modelOptions
+	if strings.TrimSpace(msg.Content) == "" {
+		options = app.conversationOptions(conv).nudged()
+	} else {
+		dec := json.NewDecoder(strings.NewReader(msg.Content))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&options); err != nil {
+			notice(fmt.Sprintf("Invalid model options: %v", err))
+			return
+		}
+		if err := app.conversationOptions(conv).merge(options).validate(); err != nil {
+			notice("Invalid model options: " + err.Error())
+			return
+		}
+	}
+	app.logger.Debug("Regenerating", "conversation", conv.id, "options", options.String())
+	if !app.regenerate(client, conv, ip, msg.Language, options) {
+		notice("There's no answer to write again.")
+	}
+}
+
+// dropLastTurn removes the latest user message and everything after it.
+// it returns the user message and the answers written for it so far,
+// which the regenerated answer keeps as variants
+func (c *conversation) dropLastTurn() (chatMessage, []answerVariant, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := len(c.messages) - 1; i >= 0; i-- {
+		if c.messages[i].Role != "user" {
+			continue
+		}
+		user := *c.messages[i]
+		var variants []answerVariant
+		for _, m := range c.messages[i+1:] {
+			if m.Role != "assistant" || m.Content == "" {
+				continue
+			}
+			if len(m.Variants) > 0 {
+				variants = m.Variants
+			} else {
+				variants = []answerVariant{variantOf(*m)}
+			}
+		}
+		c.messages = c.messages[:i]
+		c.version++
+		return user, variants, true
+	}
+	return chatMessage{}, nil, false
+}
+
+// selectVariant shows variant n, counted from 1, of an answer. the
+// history continues with the variant shown
+func (c *conversation) selectVariant(id, n int) (chatMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := c.find(id)
+	if i < 0 || len(c.messages[i].Variants) == 0 {
+		return chatMessage{}, errMessageNotFound
+	}
+	m := c.messages[i]
+	n = min(max(n, 1), len(m.Variants))
+	if n == m.Variant {
+		return *m, nil
+	}
+	v := m.Variants[n-1]
+	m.Content, m.Language, m.Provenance, m.Usage = v.Content, v.Language, v.Provenance, v.Usage
+	m.Tables = parseMarkdownTables(v.Content)
+	m.Variant = n
+	m.Version++
+	c.version++
+	return *m, nil
+}
+
+// keptVariant marks the variant of the latest regenerated answer as
+// kept, once the user moved on from it. false if there's none to mark
+func (c *conversation) keptVariant() (chatMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := len(c.messages) - 1; i >= 0; i-- {
+		m := c.messages[i]
+		if m.Role != "assistant" || m.Content == "" {
+			continue
+		}
+		if len(m.Variants) == 0 || m.Kept > 0 {
+			return chatMessage{}, false
+		}
+		m.Kept = m.Variant
+		return *m, true
+	}
+	return chatMessage{}, false
+}
+
+// recordKeptVariant logs which variant of the last answer the user kept
+func (app *application) recordKeptVariant(conv *conversation, ip string) {
+	m, ok := conv.keptVariant()
+	if !ok {
+		return
+	}
+	app.logger.Debug("Variant kept", "conversation", conv.id, "message", m.ID, "variant", m.Kept, "variants", len(m.Variants))
+	app.event(event{
+		Type:         eventVariantKept,
+		Conversation: conv.id,
+		Client:       ip,
+		Variant:      m.Kept,
+		Variants:     len(m.Variants),
+	})
+}
+
+// handleVariantMessage pages through the variants of the answer msg.ID.
+// content is prev, next or the number of the variant
+func (app *application) handleVariantMessage(client *wsClient, conv *conversation, msg Message) {
+	current, ok := conv.message(msg.ID)
+	if !ok || len(current.Variants) == 0 {
+		client.send(Message{
+			Type:    "notice",
+			Content: "That answer has no other variants.",
+			Time:    time.Now().Format("15:04:05"),
+		})
+		return
+	}
+
+	n := current.Variant
+	switch msg.Content {
+	case "prev":
+		n--
+	case "next":
+		n++
+	default:
+		n, _ = strconv.Atoi(msg.Content)
+	}
+	m, err := conv.selectVariant(msg.ID, n)
+	if err != nil {
+		return
+	}
+
+	app.clients.sendTo(conv.id, Message{
+		Type:       "variant",
+		Content:    m.Content,
+		Time:       m.Created.Format("15:04:05"),
+		ID:         m.ID,
+		Version:    m.Version,
+		Language:   m.Language,
+		Tables:     tableURLs(conv, m),
+		Provenance: m.Provenance,
+		Variant:    m.Variant,
+		Variants:   len(m.Variants),
+		HTML:       app.renderHTML(m.Content),
+		Usage:      m.Usage,
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+)
+
+// version can be set at build time with
+// -ldflags "-X main.version=v1.2.3", otherwise the module version is used
+var version string
+
+// buildVersion describes the running server. clients compare it between
+// connections to notice an upgrade and reload the page
+type buildVersion struct {
+	// the commit, with .dirty for uncommitted changes, or the version
+	// when the commit isn't known. this is what clients compare
+	Build      string `json:"build"`
+	Version    string `json:"version"`
+	Commit     string `json:"commit,omitempty"`
+	CommitTime string `json:"commit_time,omitempty"`
+	Modified   bool   `json:"modified,omitempty"`
+	GoVersion  string `json:"go_version,omitempty"`
+	// websocket protocol versions the server speaks
+	Protocol    int    `json:"protocol"`
+	Subprotocol string `json:"subprotocol"`
+}
+
+// readBuildVersion reads the version and the git commit the binary was
+// built from. the commit is only known for builds inside a checkout
+func readBuildVersion() buildVersion {
+	v := buildVersion{
+		Version:     version,
+		Protocol:    protocolVersion(protocolV2),
+		Subprotocol: protocolV2,
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		if v.Version == "" {
+			v.Version = "unknown"
+		}
+		v.Build = v.Version
+		return v
+	}
+	if v.Version == "" {
+		v.Version = info.Main.Version
+	}
+	v.GoVersion = info.GoVersion
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			v.Commit = s.Value
+		case "vcs.time":
+			v.CommitTime = s.Value
+		case "vcs.modified":
+			v.Modified = s.Value == "true"
+		}
+	}
+
+	v.Build = v.Version
+	if v.Commit != "" {
+		v.Build = v.Commit
+		if v.Modified {
+			v.Build += ".dirty"
+		}
+	}
+	return v
+}
+
+// reports the build of the running server, and with -update-check
+// whether a newer release is out
+func (app *application) handleVersion(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		buildVersion
+		Update *updateInfo `json:"update,omitempty"`
+	}{buildVersion: app.version}
+	if app.updates != nil {
+		data.Update = app.updates.status()
+	}
+	app.writeJSON(w, http.StatusOK, data)
+}
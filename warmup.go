@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// warmUp makes sure the model is loaded before the user sends their first
+// message. Ollama loads a model on a generate request with an empty
+// prompt without producing any tokens, so this costs nothing if the
+// model is already resident. every server is warmed up, chats may go to
+// any of them
+func (app *application) warmUp(model string) {
+	// other backends load models on their own
+	if app.ollama == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range app.ollama.servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			app.warmUpServer(ctx, s, model)
+		}()
+	}
+	wg.Wait()
+}
+
+func (app *application) warmUpServer(ctx context.Context, s *ollamaServer, model string) {
+	client := s.client
+
+	// skip the request when ps already lists the model
+	running, err := client.ListRunning(ctx)
+	if err == nil {
+		for _, m := range running.Models {
+			if m.Name == model || m.Model == model {
+				app.logger.Debug("Warm-up skipped, model already loaded", "model", model, "server", s.url)
+				return
+			}
+		}
+	}
+
+	start := time.Now()
+	req := &api.GenerateRequest{
+		Model:  model,
+		Stream: new(bool),
+	}
+	err = client.Generate(ctx, req, func(api.GenerateResponse) error { return nil })
+	if err != nil {
+		app.logger.Error(fmt.Sprintf("Warm-up on %s failed: %v", s.url, err))
+		return
+	}
+
+	app.logger.Debug("Model warmed up", "model", model, "server", s.url, "took", time.Since(start))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// watch links let someone follow a conversation read-only, e.g. for
+// support or debugging. the token is the conversation id signed like a
+// session cookie and expires after -session-ttl as well. the key is
+// derived from the session key, so a token can't pass as a session
+func (app *application) watchSigner() *sessionSigner {
+	return &sessionSigner{key: []byte(app.sessions.sign("watch")), ttl: app.sessions.ttl}
+}
+
+func (app *application) watchToken(conv string) string {
+	return app.watchSigner().issue(conv)
+}
+
+// canWatch reports whether the request may watch conv: a signed in user
+// may watch any conversation, anyone else needs the conversation's token
+func (app *application) canWatch(r *http.Request, conv string) bool {
+	if app.authEnabled() {
+		if _, ok := app.authenticate(r); ok {
+			return true
+		}
+	}
+	id, ok := app.watchSigner().verify(r.URL.Query().Get("token"))
+	return ok && id == conv
+}
+
+// handleWatchLinkMessage sends the client a link to watch its
+// conversation with
+func (app *application) handleWatchLinkMessage(client *wsClient, conv *conversation) {
+	link := "/?watch=" + url.QueryEscape(conv.id) + "&token=" + url.QueryEscape(app.watchToken(conv.id))
+	app.logger.Info("Watch link created", "conversation", conv.id)
+	client.send(Message{
+		Type:    "watch_link",
+		Content: link,
+		Time:    time.Now().Format("15:04:05"),
+	})
+}
+
+// streams a conversation to a read-only websocket: the history so far,
+// then the messages, tool calls and answers of every turn as they happen
+func (app *application) handleWatch(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("conversation")
+	conv, ok := app.conversations.get(id)
+	if !ok {
+		app.clientError(w, http.StatusNotFound, "conversation not found")
+		return
+	}
+	if !app.canWatch(r, id) {
+		app.clientError(w, http.StatusForbidden, "not allowed to watch this conversation")
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		app.logger.Info("Websocket", "upgrade failed", err)
+		return
+	}
+	defer conn.Close()
+	// watchers only send operator replies
+	conn.SetReadLimit(1 << 20)
+
+	client := newWSClient(conn)
+	client.conv = conv.id
+	client.watching = true
+	app.clients.add(client)
+	defer app.clients.remove(client)
+
+	// signed in admins may take the conversation over, see operator.go
+	var operator string
+	if app.authEnabled() {
+		operator, _ = app.authenticate(r)
+	}
+	client.send(Message{
+		Type:     "watching",
+		Content:  conv.id,
+		Time:     time.Now().Format("15:04:05"),
+		Server:   &app.version,
+		Operator: operator,
+	})
+	author := app.profiles.author(conv.owner)
+	msgs, _ := conv.snapshot()
+	for _, m := range msgs {
+		msg := Message{Content: m.Content, Time: m.Created.Format("15:04:05"), ID: m.ID, Version: m.Version}
+		switch {
+		case m.Content == "":
+			continue
+		case m.Role == "user":
+			msg.Type = "user"
+			msg.Author = author
+		case m.Role == "assistant":
+			msg.Type = "server"
+			msg.Provenance = m.Provenance
+			msg.Operator = m.Operator
+			msg.HTML = app.renderHTML(m.Content)
+		default:
+			continue
+		}
+		client.send(msg)
+	}
+
+	app.logger.Info("Watcher connected", "conversation", conv.id, "client", clientIP(r))
+
+	// only operators may send anything, for everyone else reading only
+	// notices the close
+	for {
+		msg, err := client.read()
+		if err != nil {
+			break
+		}
+		if operator != "" {
+			app.handleOperatorMessage(client, conv, operator, msg)
+		}
+	}
+	app.logger.Info("Watcher disconnected", "conversation", conv.id)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// weatherProvider looks up the current weather for a place name or a
+// "lat,lon" pair and returns it as JSON for the model
+type weatherProvider interface {
+	current(ctx context.Context, location string) (string, error)
+}
+
+// weatherReport is what the real providers return. values are metric,
+// convertUnits turns them into the user's units
+type weatherReport struct {
+	Location          string  `json:"location"`
+	Forecast          string  `json:"forecast"`
+	Temperature       float64 `json:"temperature"`
+	High              float64 `json:"high"`
+	Low               float64 `json:"low"`
+	Unit              string  `json:"unit"`
+	WindSpeed         float64 `json:"wind_speed"`
+	WindUnit          string  `json:"wind_unit"`
+	Precipitation     float64 `json:"precipitation"`
+	PrecipitationUnit string  `json:"precipitation_unit"`
+}
+
+func newWeatherReport(location, forecast string) weatherReport {
+	return weatherReport{
+		Location:          location,
+		Forecast:          forecast,
+		Unit:              "Celsius",
+		WindUnit:          "km/h",
+		PrecipitationUnit: "mm",
+	}
+}
+
+// newWeatherProvider picks the provider from -weather-provider. without
+// one, OpenWeatherMap is used when there's an API key and the mock
+// otherwise. Open-Meteo needs no key but has to be asked for
+func newWeatherProvider(name, apiKey string) (weatherProvider, error) {
+	if apiKey == "" {
+		apiKey = os.Getenv("OPENWEATHERMAP_API_KEY")
+	}
+
+	switch name {
+	case "":
+		if apiKey != "" {
+			return &openWeatherMap{apiKey: apiKey}, nil
+		}
+		return mockWeather{}, nil
+	case "mock":
+		return mockWeather{}, nil
+	case "open-meteo":
+		return &openMeteo{}, nil
+	case "openweathermap":
+		if apiKey == "" {
+			return nil, errors.New("openweathermap needs -weather-api-key or OPENWEATHERMAP_API_KEY")
+		}
+		return &openWeatherMap{apiKey: apiKey}, nil
+	default:
+		return nil, fmt.Errorf("unknown weather provider %q, use mock, open-meteo or openweathermap", name)
+	}
+}
+
+// runWeatherTool runs get_weather through the tool cache
+func (app *application) runWeatherTool(ctx context.Context, args api.ToolCallFunctionArguments) string {
+	// the schema requires location to be a string
+	location := args["location"].(string)
+	return app.toolCache.get("get_weather", args, func() string {
+		toolEnvFrom(ctx).report(0, "Looking up the forecast for "+location)
+		result, err := app.weather.current(ctx, location)
+		if err != nil {
+			app.logger.Error(fmt.Sprintf("Error getting weather: %v", err))
+			return fmt.Sprintf("Error getting the weather for %s: %v", location, err)
+		}
+		return result
+	})
+}
+
+type mockWeather struct{}
+
+func (mockWeather) current(ctx context.Context, location string) (string, error) {
+	return getWeatherTool(location), nil
+}
+
+var coordinatesPattern = regexp.MustCompile(`^\s*(-?\d+(?:\.\d+)?)\s*,\s*(-?\d+(?:\.\d+)?)\s*$`)
+
+// parseCoordinates accepts "lat,lon" as sent by browser geolocation
+func parseCoordinates(location string) (lat, lon float64, ok bool) {
+	m := coordinatesPattern.FindStringSubmatch(location)
+	if m == nil {
+		return 0, 0, false
+	}
+	lat, _ = strconv.ParseFloat(m[1], 64)
+	lon, _ = strconv.ParseFloat(m[2], 64)
+	return lat, lon, lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+// toolClient is used by tools calling external APIs
+var toolClient = &http.Client{Timeout: 10 * time.Second}
+
+// getJSON fetches u and decodes the JSON answer into dst
+func getJSON(ctx context.Context, u string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return errors.New("invalid request URL")
+	}
+	resp, err := toolClient.Do(req)
+	if err != nil {
+		// a url.Error has the whole URL in it, API keys included, and
+		// errors end up in the log, the model and the browser
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return fmt.Errorf("%s: %w", req.URL.Host, urlErr.Err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
+
+func round1(v float64) float64 { return math.Round(v*10) / 10 }
+
+// openMeteo uses the free Open-Meteo geocoding and forecast APIs
+type openMeteo struct{}
+
+var (
+	openMeteoGeocodeURL  = "https://geocoding-api.open-meteo.com/v1/search"
+	openMeteoForecastURL = "https://api.open-meteo.com/v1/forecast"
+)
+
+func (p *openMeteo) current(ctx context.Context, location string) (string, error) {
+	lat, lon, ok := parseCoordinates(location)
+	name := location
+	if !ok {
+		var geo struct {
+			Results []struct {
+				Name      string  `json:"name"`
+				Country   string  `json:"country"`
+				Latitude  float64 `json:"latitude"`
+				Longitude float64 `json:"longitude"`
+			} `json:"results"`
+		}
+		q := url.Values{"name": {location}, "count": {"1"}}
+		if err := getJSON(ctx, openMeteoGeocodeURL+"?"+q.Encode(), &geo); err != nil {
+			return "", err
+		}
+		if len(geo.Results) == 0 {
+			return "", fmt.Errorf("no place called %q found", location)
+		}
+		r := geo.Results[0]
+		lat, lon, name = r.Latitude, r.Longitude, r.Name
+		if r.Country != "" {
+			name += ", " + r.Country
+		}
+	}
+
+	var forecast struct {
+		Current struct {
+			Temperature   float64 `json:"temperature_2m"`
+			WeatherCode   int     `json:"weather_code"`
+			WindSpeed     float64 `json:"wind_speed_10m"`
+			Precipitation float64 `json:"precipitation"`
+		} `json:"current"`
+		Daily struct {
+			Max []float64 `json:"temperature_2m_max"`
+			Min []float64 `json:"temperature_2m_min"`
+		} `json:"daily"`
+	}
+	q := url.Values{
+		"latitude":      {strconv.FormatFloat(lat, 'f', 4, 64)},
+		"longitude":     {strconv.FormatFloat(lon, 'f', 4, 64)},
+		"current":       {"temperature_2m,weather_code,wind_speed_10m,precipitation"},
+		"daily":         {"temperature_2m_max,temperature_2m_min"},
+		"timezone":      {"auto"},
+		"forecast_days": {"1"},
+	}
+	if err := getJSON(ctx, openMeteoForecastURL+"?"+q.Encode(), &forecast); err != nil {
+		return "", err
+	}
+
+	report := newWeatherReport(name, weatherCodeDescription(forecast.Current.WeatherCode))
+	report.Temperature = round1(forecast.Current.Temperature)
+	report.WindSpeed = round1(forecast.Current.WindSpeed)
+	report.Precipitation = round1(forecast.Current.Precipitation)
+	if len(forecast.Daily.Max) > 0 && len(forecast.Daily.Min) > 0 {
+		report.High = round1(forecast.Daily.Max[0])
+		report.Low = round1(forecast.Daily.Min[0])
+	}
+
+	js, err := json.Marshal(report)
+	return string(js), err
+}
+
+// weatherCodeDescription describes a WMO weather interpretation code
+func weatherCodeDescription(code int) string {
+	switch {
+	case code == 0:
+		return "clear sky"
+	case code <= 2:
+		return "partly cloudy"
+	case code == 3:
+		return "overcast"
+	case code == 45 || code == 48:
+		return "fog"
+	case code >= 51 && code <= 57:
+		return "drizzle"
+	case code >= 61 && code <= 67:
+		return "rain"
+	case code >= 71 && code <= 77:
+		return "snow"
+	case code >= 80 && code <= 82:
+		return "rain showers"
+	case code == 85 || code == 86:
+		return "snow showers"
+	case code >= 95:
+		return "thunderstorm"
+	default:
+		return "unknown"
+	}
+}
+
+// openWeatherMap uses the OpenWeatherMap current weather API
+type openWeatherMap struct {
+	apiKey string
+}
+
+var openWeatherMapURL = "https://api.openweathermap.org/data/2.5/weather"
+
+func (p *openWeatherMap) current(ctx context.Context, location string) (string, error) {
+	q := url.Values{"appid": {p.apiKey}, "units": {"metric"}}
+	if lat, lon, ok := parseCoordinates(location); ok {
+		q.Set("lat", strconv.FormatFloat(lat, 'f', 4, 64))
+		q.Set("lon", strconv.FormatFloat(lon, 'f', 4, 64))
+	} else {
+		q.Set("q", location)
+	}
+
+	var current struct {
+		Name string `json:"name"`
+		Main struct {
+			Temp    float64 `json:"temp"`
+			TempMin float64 `json:"temp_min"`
+			TempMax float64 `json:"temp_max"`
+		} `json:"main"`
+		Weather []struct {
+			Description string `json:"description"`
+		} `json:"weather"`
+		Wind struct {
+			Speed float64 `json:"speed"`
+		} `json:"wind"`
+		Rain struct {
+			OneHour float64 `json:"1h"`
+		} `json:"rain"`
+		Sys struct {
+			Country string `json:"country"`
+		} `json:"sys"`
+	}
+	if err := getJSON(ctx, openWeatherMapURL+"?"+q.Encode(), &current); err != nil {
+		return "", err
+	}
+
+	name := current.Name
+	if current.Sys.Country != "" {
+		name += ", " + current.Sys.Country
+	}
+	description := "unknown"
+	if len(current.Weather) > 0 {
+		description = current.Weather[0].Description
+	}
+
+	report := newWeatherReport(name, description)
+	report.Temperature = round1(current.Main.Temp)
+	report.High = round1(current.Main.TempMax)
+	report.Low = round1(current.Main.TempMin)
+	// metric wind speed is in m/s
+	report.WindSpeed = round1(current.Wind.Speed * 3.6)
+	report.Precipitation = round1(current.Rain.OneHour)
+
+	js, err := json.Marshal(report)
+	return string(js), err
+}